@@ -0,0 +1,148 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+)
+
+// newUIATestServer returns a server that requires password auth for all requests and returns the given response
+// once the client provides it.
+func newUIATestServer(t *testing.T, response string, gotBody *map[string]any) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["auth"] == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = fmt.Fprintln(w, `{"flows": [{"stages": ["m.login.password"]}], "session": "abc"}`)
+			return
+		}
+		*gotBody = body
+		_, _ = fmt.Fprintln(w, response)
+	}))
+}
+
+func passwordUIACallback(resp *mautrix.RespUserInteractive) interface{} {
+	return &mautrix.ReqUIAuthLogin{
+		BaseAuthData: mautrix.BaseAuthData{Type: mautrix.AuthTypePassword, Session: resp.Session},
+		User:         "@user:example.com",
+		Password:     "hunter2",
+	}
+}
+
+func TestClient_DeactivateAccount(t *testing.T) {
+	var gotBody map[string]any
+	ts := newUIATestServer(t, `{"id_server_unbind_result": "no-support"}`, &gotBody)
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	_, err = cli.DeactivateAccount(context.Background(), &mautrix.ReqDeactivateAccount{Erase: true}, nil)
+	var uiaErr mautrix.UIARequiredError
+	require.ErrorAs(t, err, &uiaErr)
+	assert.Equal(t, "abc", uiaErr.Response.Session)
+	assert.Equal(t, "token", cli.AccessToken)
+
+	resp, err := cli.DeactivateAccount(context.Background(), &mautrix.ReqDeactivateAccount{Erase: true}, passwordUIACallback)
+	require.NoError(t, err)
+	assert.Equal(t, "no-support", resp.IDServerUnbindResult)
+	assert.Equal(t, true, gotBody["erase"])
+	assert.Equal(t, "abc", gotBody["auth"].(map[string]any)["session"])
+	assert.Empty(t, cli.AccessToken)
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	var gotBody map[string]any
+	ts := newUIATestServer(t, `{}`, &gotBody)
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	err = cli.ChangePassword(context.Background(), &mautrix.ReqChangePassword{NewPassword: "new", LogoutDevices: true}, func(resp *mautrix.RespUserInteractive) interface{} {
+		return nil
+	})
+	assert.ErrorAs(t, err, &mautrix.UIARequiredError{})
+
+	err = cli.ChangePassword(context.Background(), &mautrix.ReqChangePassword{NewPassword: "new", LogoutDevices: true}, passwordUIACallback)
+	require.NoError(t, err)
+	assert.Equal(t, "new", gotBody["new_password"])
+	assert.Equal(t, true, gotBody["logout_devices"])
+	assert.Equal(t, "token", cli.AccessToken)
+}
+
+func TestClient_DeactivateAccount_WrongPassword(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+		if requests == 1 {
+			_, _ = fmt.Fprintln(w, `{"flows": [{"stages": ["m.login.password"]}], "session": "abc"}`)
+		} else {
+			_, _ = fmt.Fprintln(w, `{"errcode": "M_FORBIDDEN", "error": "Invalid password", "flows": [{"stages": ["m.login.password"]}], "session": "abc"}`)
+		}
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	var callbacks int
+	_, err = cli.DeactivateAccount(context.Background(), &mautrix.ReqDeactivateAccount{}, func(resp *mautrix.RespUserInteractive) interface{} {
+		callbacks++
+		return passwordUIACallback(resp)
+	})
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Equal(t, 1, callbacks)
+	assert.Equal(t, 2, requests)
+}
+
+func TestClient_DeactivateAccount_UIAAttemptLimit(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = fmt.Fprintln(w, `{"flows": [{"stages": ["m.login.password"]}], "session": "abc"}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	_, err = cli.DeactivateAccount(context.Background(), &mautrix.ReqDeactivateAccount{}, passwordUIACallback)
+	assert.Error(t, err)
+	assert.Equal(t, 10, requests)
+}
+
+func TestClient_Logout(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = fmt.Fprintln(w, `{}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	_, err = cli.Logout(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, cli.AccessToken)
+	assert.Equal(t, "@user:example.com", cli.UserID.String())
+
+	cli.AccessToken = "token"
+	_, err = cli.LogoutAll(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, cli.AccessToken)
+	assert.Equal(t, []string{"/_matrix/client/v3/logout", "/_matrix/client/v3/logout/all"}, paths)
+}
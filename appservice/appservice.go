@@ -8,6 +8,7 @@ package appservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -46,7 +47,7 @@ func Create() *AppService {
 		StateStore: mautrix.NewMemoryStateStore().(StateStore),
 		Router:     mux.NewRouter(),
 		UserAgent:  mautrix.DefaultUserAgent,
-		txnIDC:     NewTransactionIDCache(128),
+		txnIDC:     NewTransactionIDCache(DefaultTransactionIDCacheSize),
 		Live:       true,
 		Ready:      false,
 		ProcessID:  getDefaultProcessID(),
@@ -56,6 +57,7 @@ func Create() *AppService {
 		OTKCounts:      make(chan *mautrix.OTKCount, OTKChannelSize),
 		DeviceLists:    make(chan *mautrix.DeviceLists, EventChannelSize),
 		QueryHandler:   &QueryHandlerStub{},
+		profileCache:   make(map[id.UserID]cachedProfile),
 	}
 
 	as.Router.HandleFunc("/transactions/{txnID}", as.PutTransaction).Methods(http.MethodPut)
@@ -112,6 +114,11 @@ type AppService struct {
 	Log          zerolog.Logger
 
 	txnIDC *TransactionIDCache
+	// TransactionIDStore is an optional persistent store for the IDs of processed transactions.
+	// The in-memory cache is always checked first, the size of which can be changed with SetTransactionIDCacheSize.
+	TransactionIDStore TransactionIDStore
+	// OnDuplicateTransaction is called when a transaction is ignored because its ID was already processed.
+	OnDuplicateTransaction func(txnID string)
 
 	Events         chan *event.Event
 	ToDeviceEvents chan *event.Event
@@ -123,11 +130,21 @@ type AppService struct {
 	Router     *mux.Router
 	UserAgent  string
 	server     *http.Server
+	serverLock sync.Mutex
 	HTTPClient *http.Client
 	botClient  *mautrix.Client
 	botIntent  *IntentAPI
 
 	DefaultHTTPRetries int
+	// ShutdownTimeout is how long the HTTP server waits for in-flight requests to finish when stopping.
+	// Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+	// If set, IntentAPI.SendMessageEvent and the other message sending methods of intents re-join the room and
+	// retry once if sending fails with M_FORBIDDEN, e.g. because the membership cached in the state store was outdated.
+	RejoinOnForbidden bool
+	// OnCustomIntentLogout is called when a request made by an intent created with NewCustomIntent fails with
+	// M_UNKNOWN_TOKEN, i.e. when the user's access token was invalidated. Bridges can use it to disable double puppeting.
+	OnCustomIntentLogout func(ctx context.Context, intent *IntentAPI, err error)
 
 	Live  bool
 	Ready bool
@@ -137,6 +154,9 @@ type AppService struct {
 	intents     map[id.UserID]*IntentAPI
 	intentsLock sync.RWMutex
 
+	profileCache     map[id.UserID]cachedProfile
+	profileCacheLock sync.Mutex
+
 	ws                    *websocket.Conn
 	wsWriteLock           sync.Mutex
 	StopWebsocket         func(error)
@@ -177,11 +197,40 @@ func (as *AppService) PrepareWebsocket() {
 }
 
 // HostConfig contains info about how to host the appservice.
+//
+// If the hostname starts with a slash, it's treated as a path to a unix socket and the port is ignored.
+// Otherwise, the appservice listens on the given TCP address, using HTTPS if both TLSKey and TLSCert are set.
 type HostConfig struct {
 	Hostname string `yaml:"hostname"`
 	Port     uint16 `yaml:"port"`
 	TLSKey   string `yaml:"tls_key,omitempty"`
 	TLSCert  string `yaml:"tls_cert,omitempty"`
+	// SocketMode is the file mode to set on the unix socket after creating it.
+	// If zero, the mode is determined by the process umask.
+	SocketMode os.FileMode `yaml:"socket_mode,omitempty"`
+}
+
+var (
+	ErrHostTLSWithUnixSocket = errors.New("TLS can't be used when listening on a unix socket")
+	ErrHostIncompleteTLS     = errors.New("both tls_cert and tls_key must be set to enable TLS")
+	ErrHostSocketModeWithTCP = errors.New("socket_mode can only be used when listening on a unix socket")
+)
+
+// Validate checks that the host config doesn't mix options of different listen modes.
+func (hc *HostConfig) Validate() error {
+	hasTLS := len(hc.TLSCert) > 0 || len(hc.TLSKey) > 0
+	if hc.IsUnixSocket() {
+		if hasTLS {
+			return ErrHostTLSWithUnixSocket
+		}
+	} else {
+		if hasTLS && (len(hc.TLSCert) == 0 || len(hc.TLSKey) == 0) {
+			return ErrHostIncompleteTLS
+		} else if hc.SocketMode != 0 {
+			return ErrHostSocketModeWithTCP
+		}
+	}
+	return nil
 }
 
 // Address gets the whole address of the Appservice.
@@ -219,6 +268,12 @@ func (as *AppService) BotMXID() id.UserID {
 	return id.NewUserID(as.Registration.SenderLocalpart, as.HomeserverDomain)
 }
 
+// IsOwnedUser checks if the given user ID belongs to the appservice, i.e. it's the bot user
+// or it matches one of the exclusive user namespaces in the registration.
+func (as *AppService) IsOwnedUser(userID id.UserID) bool {
+	return userID == as.BotMXID() || as.Registration.Namespaces.UserIDs.MatchesExclusive(string(userID))
+}
+
 func (as *AppService) makeIntent(userID id.UserID) *IntentAPI {
 	as.intentsLock.Lock()
 	defer as.intentsLock.Unlock()
@@ -247,10 +302,15 @@ func (as *AppService) makeIntent(userID id.UserID) *IntentAPI {
 		return nil
 	}
 	intent = as.NewIntentAPI(localpart)
+	intent.lastUsed.Store(time.Now().UnixMilli())
 	as.intents[userID] = intent
 	return intent
 }
 
+// Intent returns the IntentAPI for the given user ID, creating it if it doesn't exist yet.
+//
+// Intents are cached and share the appservice's HTTP client, so calling this repeatedly is cheap.
+// Intents that haven't been fetched in a while can be dropped from the cache with EvictIdleIntents.
 func (as *AppService) Intent(userID id.UserID) *IntentAPI {
 	as.intentsLock.RLock()
 	intent, ok := as.intents[userID]
@@ -258,9 +318,55 @@ func (as *AppService) Intent(userID id.UserID) *IntentAPI {
 	if !ok {
 		return as.makeIntent(userID)
 	}
+	intent.lastUsed.Store(time.Now().UnixMilli())
 	return intent
 }
 
+// EvictIdleIntents removes intents (and their clients) that haven't been fetched with Intent
+// within the given duration from the cache. The bot intent is never evicted.
+//
+// Evicted intents remain usable by anyone still holding a reference, but a future call to Intent
+// will create a new instance. Returns the number of evicted intents.
+func (as *AppService) EvictIdleIntents(maxIdle time.Duration) int {
+	cutoff := time.Now().Add(-maxIdle).UnixMilli()
+	botMXID := as.BotMXID()
+	as.intentsLock.Lock()
+	defer as.intentsLock.Unlock()
+	as.clientsLock.Lock()
+	defer as.clientsLock.Unlock()
+	evicted := 0
+	for userID, intent := range as.intents {
+		if userID == botMXID || intent.lastUsed.Load() >= cutoff {
+			continue
+		}
+		delete(as.intents, userID)
+		if as.clients[userID] == intent.Client {
+			delete(as.clients, userID)
+		}
+		as.profileCacheLock.Lock()
+		delete(as.profileCache, userID)
+		as.profileCacheLock.Unlock()
+		evicted++
+	}
+	return evicted
+}
+
+// EvictIdleIntentsLoop calls EvictIdleIntents periodically until the context is canceled.
+func (as *AppService) EvictIdleIntentsLoop(ctx context.Context, maxIdle, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if evicted := as.EvictIdleIntents(maxIdle); evicted > 0 {
+				as.Log.Debug().Int("evicted_count", evicted).Msg("Evicted idle intents")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (as *AppService) BotIntent() *IntentAPI {
 	if as.botIntent == nil {
 		as.botIntent = as.makeIntent(as.BotMXID())
@@ -307,6 +413,8 @@ func (as *AppService) NewMautrixClient(userID id.UserID) *mautrix.Client {
 		Log:                 as.Log.With().Str("as_user_id", userID.String()).Logger(),
 		Client:              as.HTTPClient,
 		DefaultHTTPRetries:  as.DefaultHTTPRetries,
+		// Namespaced users aren't rate limited if the registration says so, so a 429 should be returned immediately.
+		IgnoreRateLimit: !as.Registration.IsRateLimited(),
 	}
 	client.Logger = maulogadapt.ZeroAsMau(&client.Log)
 	return client
@@ -316,6 +424,8 @@ func (as *AppService) NewExternalMautrixClient(userID id.UserID, token string, h
 	client := as.NewMautrixClient(userID)
 	client.AccessToken = token
 	client.SetAppServiceUserID = false
+	// Real users' access tokens are always rate limited normally
+	client.IgnoreRateLimit = false
 	if homeserverURL != "" {
 		client.Client = &http.Client{Timeout: 180 * time.Second}
 		var err error
@@ -8,8 +8,11 @@ import (
 	"net/http/httptest"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
 )
 
 func TestClient_UnixSocket(t *testing.T) {
@@ -40,3 +43,61 @@ func TestClient_UnixSocket(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "@joe:example.org", string(resp.UserID))
 }
+
+func TestHostConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&HostConfig{Hostname: "0.0.0.0", Port: 29317}).Validate())
+	assert.NoError(t, (&HostConfig{Hostname: "0.0.0.0", Port: 29317, TLSCert: "cert.pem", TLSKey: "key.pem"}).Validate())
+	assert.NoError(t, (&HostConfig{Hostname: "/run/bridge.sock", SocketMode: 0660}).Validate())
+	assert.ErrorIs(t, (&HostConfig{Hostname: "0.0.0.0", Port: 29317, TLSCert: "cert.pem"}).Validate(), ErrHostIncompleteTLS)
+	assert.ErrorIs(t, (&HostConfig{Hostname: "/run/bridge.sock", TLSCert: "cert.pem", TLSKey: "key.pem"}).Validate(), ErrHostTLSWithUnixSocket)
+	assert.ErrorIs(t, (&HostConfig{Hostname: "0.0.0.0", Port: 29317, SocketMode: 0660}).Validate(), ErrHostSocketModeWithTCP)
+}
+
+func TestAppService_EvictIdleIntents(t *testing.T) {
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot"}
+	bot := as.BotIntent()
+	ghost := as.Intent("@ghost:example.com")
+	assert.Same(t, ghost, as.Intent("@ghost:example.com"))
+	assert.Same(t, ghost.Client, as.Client("@ghost:example.com"))
+	assert.Same(t, as.HTTPClient, ghost.Client.Client)
+
+	assert.Equal(t, 0, as.EvictIdleIntents(time.Hour))
+	ghost.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixMilli())
+	bot.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixMilli())
+	assert.Equal(t, 1, as.EvictIdleIntents(time.Hour))
+	assert.NotSame(t, ghost, as.Intent("@ghost:example.com"))
+	assert.Same(t, bot, as.Intent(as.BotMXID()))
+}
+
+func TestIntentAPI_WithDevice(t *testing.T) {
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot"}
+	ghost := as.Intent("@ghost:example.com")
+	_, err := ghost.WithDevice("DEVICE")
+	assert.ErrorIs(t, err, ErrDeviceMasqueradingNotEnabled)
+
+	as.Registration.MSC3202 = true
+	deviceIntent, err := ghost.WithDevice("DEVICE")
+	assert.NoError(t, err)
+	assert.Equal(t, ghost.UserID, deviceIntent.UserID)
+	assert.Equal(t, id.DeviceID("DEVICE"), deviceIntent.DeviceID)
+	assert.True(t, deviceIntent.SetAppServiceDeviceID)
+	assert.Empty(t, ghost.DeviceID, "original intent shouldn't be modified")
+}
+
+func TestAppService_NewMautrixClient_RateLimited(t *testing.T) {
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot"}
+	assert.False(t, as.NewMautrixClient("@ghost:example.com").IgnoreRateLimit)
+
+	rateLimited := false
+	as.Registration.RateLimited = &rateLimited
+	assert.True(t, as.NewMautrixClient("@ghost:example.com").IgnoreRateLimit)
+	external, err := as.NewExternalMautrixClient("@user:example.com", "token", "")
+	assert.NoError(t, err)
+	assert.False(t, external.IgnoreRateLimit)
+}
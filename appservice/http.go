@@ -8,11 +8,15 @@ package appservice
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -25,81 +29,180 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// DefaultShutdownTimeout is the default value for AppService.ShutdownTimeout.
+const DefaultShutdownTimeout = 5 * time.Second
+
 // Start starts the HTTP server that listens for calls from the Matrix homeserver.
-func (as *AppService) Start() {
-	as.server = &http.Server{
-		Handler: as.Router,
+//
+// The listener address is taken from the Host config: hostnames starting with a slash are treated as unix sockets.
+// This will block until the context is canceled or Stop is called, after which in-flight requests are given
+// ShutdownTimeout to finish. Errors binding the listener or an invalid Host config are returned immediately.
+func (as *AppService) Start(ctx context.Context) error {
+	if err := as.Host.Validate(); err != nil {
+		return fmt.Errorf("invalid host config: %w", err)
 	}
-	var err error
 	if as.Host.IsUnixSocket() {
-		err = as.listenUnix()
-	} else {
-		as.server.Addr = as.Host.Address()
-		err = as.listenTCP()
+		return as.ListenUnix(ctx, as.Host.Hostname)
 	}
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		as.Log.Error().Err(err).Msg("Error in HTTP listener")
+	return as.ListenAndServe(ctx, as.Host.Address())
+}
+
+// ListenAndServe starts the HTTP server on the given TCP address. See Start for more info.
+//
+// If the TLSCert and TLSKey fields are set in the Host config, the server will use HTTPS.
+func (as *AppService) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if len(as.Host.TLSCert) == 0 || len(as.Host.TLSKey) == 0 {
+		as.Log.Info().Str("address", addr).Msg("Starting HTTP listener")
+		return as.serve(ctx, listener, "", "")
 	} else {
-		as.Log.Debug().Msg("HTTP listener stopped")
+		as.Log.Info().Str("address", addr).Msg("Starting HTTP listener with TLS")
+		return as.serve(ctx, listener, as.Host.TLSCert, as.Host.TLSKey)
 	}
 }
 
-func (as *AppService) listenUnix() error {
-	socket := as.Host.Hostname
+// ListenUnix starts the HTTP server on the given unix socket path. See Start for more info.
+//
+// Any existing file at the path is removed before listening, and the socket is removed after the server stops.
+// If SocketMode is set in the Host config, the socket is created with that file mode.
+func (as *AppService) ListenUnix(ctx context.Context, socket string) error {
 	_ = syscall.Unlink(socket)
+	var listener net.Listener
+	var err error
+	if as.Host.SocketMode != 0 {
+		listener, err = listenUnixWithMode(socket, as.Host.SocketMode)
+	} else {
+		listener, err = net.Listen("unix", socket)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on unix socket %s: %w", socket, err)
+	}
 	defer func() {
 		_ = syscall.Unlink(socket)
 	}()
-	listener, err := net.Listen("unix", socket)
+	as.Log.Info().Str("socket", socket).Msg("Starting unix socket HTTP listener")
+	return as.serve(ctx, listener, "", "")
+}
+
+// listenUnixWithMode listens on a unix socket that is never accessible with permissions other than the given mode.
+//
+// The socket is first created in a private directory next to the target path, then its mode is changed
+// and it's moved to the target path. This avoids changing the umask, which would affect the whole process.
+func listenUnixWithMode(socket string, mode os.FileMode) (net.Listener, error) {
+	tempDir, err := os.MkdirTemp(filepath.Dir(socket), ".socket-")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create temporary directory for socket: %w", err)
 	}
-	as.Log.Info().Str("socket", socket).Msg("Starting unix socket HTTP listener")
-	return as.server.Serve(listener)
+	defer os.RemoveAll(tempDir)
+	tempSocket := filepath.Join(tempDir, "socket")
+	listener, err := net.Listen("unix", tempSocket)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is moved, so the listener shouldn't try to remove the temporary path when closing.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tempSocket, mode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to change unix socket mode: %w", err)
+	} else if err = os.Rename(tempSocket, socket); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to move unix socket into place: %w", err)
+	}
+	return listener, nil
 }
 
-func (as *AppService) listenTCP() error {
-	if len(as.Host.TLSCert) == 0 || len(as.Host.TLSKey) == 0 {
-		as.Log.Info().Str("address", as.server.Addr).Msg("Starting HTTP listener")
-		return as.server.ListenAndServe()
+func (as *AppService) shutdownTimeout() time.Duration {
+	if as.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return as.ShutdownTimeout
+}
+
+func (as *AppService) serve(ctx context.Context, listener net.Listener, tlsCert, tlsKey string) error {
+	server := &http.Server{
+		Handler: as.Router,
+	}
+	as.serverLock.Lock()
+	as.server = server
+	as.serverLock.Unlock()
+	serveStopped := make(chan struct{})
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		select {
+		case <-ctx.Done():
+			as.Log.Debug().Msg("Context canceled, shutting down HTTP listener")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), as.shutdownTimeout())
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				as.Log.Warn().Err(err).Msg("Failed to gracefully shut down HTTP listener")
+			}
+		case <-serveStopped:
+		}
+	}()
+	var err error
+	if tlsCert != "" && tlsKey != "" {
+		err = server.ServeTLS(listener, tlsCert, tlsKey)
 	} else {
-		as.Log.Info().Str("address", as.server.Addr).Msg("Starting HTTP listener with TLS")
-		return as.server.ListenAndServeTLS(as.Host.TLSCert, as.Host.TLSKey)
+		err = server.Serve(listener)
 	}
+	close(serveStopped)
+	<-shutdownDone
+	as.serverLock.Lock()
+	if as.server == server {
+		as.server = nil
+	}
+	as.serverLock.Unlock()
+	if errors.Is(err, http.ErrServerClosed) {
+		as.Log.Debug().Msg("HTTP listener stopped")
+		return nil
+	}
+	return err
 }
 
+// Stop shuts down the HTTP server, waiting up to ShutdownTimeout for in-flight requests to finish.
 func (as *AppService) Stop() {
-	if as.server == nil {
+	as.serverLock.Lock()
+	server := as.server
+	as.server = nil
+	as.serverLock.Unlock()
+	if server == nil {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), as.shutdownTimeout())
 	defer cancel()
-	_ = as.server.Shutdown(ctx)
-	as.server = nil
+	_ = server.Shutdown(ctx)
 }
 
 // CheckServerToken checks if the given request originated from the Matrix homeserver.
+//
+// The token may be provided either in the Authorization header or the access_token query parameter.
+// If the token is missing or doesn't match the hs_token in the registration, an error is written
+// to the response and false is returned.
 func (as *AppService) CheckServerToken(w http.ResponseWriter, r *http.Request) (isValid bool) {
+	var token string
 	authHeader := r.Header.Get("Authorization")
-	if len(authHeader) > 0 && strings.HasPrefix(authHeader, "Bearer ") {
-		isValid = authHeader[len("Bearer "):] == as.Registration.ServerToken
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token = authHeader[len("Bearer "):]
 	} else {
-		queryToken := r.URL.Query().Get("access_token")
-		if len(queryToken) > 0 {
-			isValid = queryToken == as.Registration.ServerToken
-		} else {
-			Error{
-				ErrorCode:  ErrUnknownToken,
-				HTTPStatus: http.StatusForbidden,
-				Message:    "Missing access token",
-			}.Write(w)
-			return
-		}
+		token = r.URL.Query().Get("access_token")
+	}
+	if len(token) == 0 {
+		Error{
+			ErrorCode:  ErrUnauthorized,
+			HTTPStatus: http.StatusUnauthorized,
+			Message:    "Missing access token",
+		}.Write(w)
+		return false
 	}
+	isValid = subtle.ConstantTimeCompare([]byte(token), []byte(as.Registration.ServerToken)) == 1
 	if !isValid {
 		Error{
-			ErrorCode:  ErrUnknownToken,
+			ErrorCode:  ErrForbidden,
 			HTTPStatus: http.StatusForbidden,
 			Message:    "Incorrect access token",
 		}.Write(w)
@@ -136,10 +239,11 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 	log := as.Log.With().Str("transaction_id", txnID).Logger()
 	ctx := context.Background()
 	ctx = log.WithContext(ctx)
-	if as.txnIDC.IsProcessed(txnID) {
+	if as.isTransactionProcessed(ctx, txnID) {
 		// Duplicate transaction ID: no-op
 		WriteBlankOK(w)
 		log.Debug().Msg("Ignoring duplicate transaction")
+		as.notifyDuplicateTransaction(txnID)
 		return
 	}
 
@@ -161,7 +265,7 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction) {
 	log := zerolog.Ctx(ctx)
 	log.Debug().Object("content", txn).Msg("Starting handling of transaction")
-	if as.Registration.EphemeralEvents {
+	if as.Registration.ReceivesEphemeralEvents() {
 		if txn.EphemeralEvents != nil {
 			as.handleEvents(ctx, txn.EphemeralEvents, event.EphemeralEventType)
 		} else if txn.MSC2409EphemeralEvents != nil {
@@ -184,7 +288,9 @@ func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Tra
 	} else if txn.MSC3202DeviceOTKCount != nil {
 		as.handleOTKCounts(ctx, txn.MSC3202DeviceOTKCount)
 	}
-	as.txnIDC.MarkProcessed(id)
+	if id != "" {
+		as.markTransactionProcessed(ctx, id)
+	}
 	log.Debug().Msg("Finished dispatching events from transaction")
 }
 
@@ -0,0 +1,243 @@
+package appservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestAppService() *AppService {
+	as := Create()
+	as.Registration = &Registration{ServerToken: "correct"}
+	return as
+}
+
+func doTestTransaction(as *AppService, modify func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(`{"events": []}`))
+	modify(req)
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAppService_PutTransaction_WrongToken(t *testing.T) {
+	as := newTestAppService()
+	w := doTestTransaction(as, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer wrong")
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var respErr Error
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &respErr))
+	assert.Equal(t, ErrForbidden, respErr.ErrorCode)
+
+	w = doTestTransaction(as, func(req *http.Request) {
+		req.URL.RawQuery = "access_token=wrong"
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAppService_PutTransaction_MissingToken(t *testing.T) {
+	w := doTestTransaction(newTestAppService(), func(req *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAppService_PutTransaction_CorrectToken(t *testing.T) {
+	as := newTestAppService()
+	w := doTestTransaction(as, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer correct")
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doTestTransaction(as, func(req *http.Request) {
+		req.URL.RawQuery = "access_token=correct"
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAppService_Start_ContextCancel(t *testing.T) {
+	as := newTestAppService()
+	socket := filepath.Join(t.TempDir(), "as.sock")
+	as.Host.Hostname = socket
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- as.Start(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after context was canceled")
+	}
+	_, err := os.Stat(socket)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "socket should be removed after stopping")
+}
+
+func TestAppService_Stop(t *testing.T) {
+	as := newTestAppService()
+	socket := filepath.Join(t.TempDir(), "as.sock")
+	as.Host.Hostname = socket
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- as.Start(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	as.Stop()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop was called")
+	}
+	// Stopping again is a no-op
+	as.Stop()
+}
+
+func TestAppService_ListenAndServe_BindError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	err = newTestAppService().ListenAndServe(context.Background(), listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestAppService_ListenUnix_SocketMode(t *testing.T) {
+	as := newTestAppService()
+	socket := filepath.Join(t.TempDir(), "as.sock")
+	as.Host.Hostname = socket
+	as.Host.SocketMode = 0600
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = as.Start(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// The socket must already have the correct mode when it appears at the path
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	_ = conn.Close()
+	entries, err := os.ReadDir(filepath.Dir(socket))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary socket directory should be removed")
+}
+
+// synapseEphemeralTransaction is a transaction with MSC2409 ephemeral events as sent by Synapse.
+const synapseEphemeralTransaction = `{
+	"events": [],
+	"de.sorunome.msc2409.ephemeral": [
+		{"type": "m.typing", "room_id": "!room:example.com", "content": {"user_ids": ["@alice:example.com"]}},
+		{"type": "m.receipt", "room_id": "!room:example.com", "content": {
+			"$event:example.com": {"m.read": {"@alice:example.com": {"ts": 1696000000000, "thread_id": "main"}}}
+		}},
+		{"type": "m.presence", "sender": "@alice:example.com", "content": {
+			"presence": "online", "last_active_ago": 1234, "currently_active": true, "user_id": "@alice:example.com"
+		}}
+	]
+}`
+
+func TestAppService_PutTransaction_EphemeralEvents(t *testing.T) {
+	as := newTestAppService()
+	as.Registration.SoruEphemeralEvents = true
+	ep := NewEventProcessor(as)
+	ep.ExecMode = Sync
+	received := make(chan *event.Event, 3)
+	handler := func(evt *event.Event) {
+		received <- evt
+	}
+	ep.On(event.EphemeralEventTyping, handler)
+	ep.On(event.EphemeralEventReceipt, handler)
+	ep.On(event.EphemeralEventPresence, handler)
+	ep.Start()
+	defer ep.Stop()
+
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(synapseEphemeralTransaction))
+	req.Header.Set("Authorization", "Bearer correct")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var evts []*event.Event
+	for i := 0; i < 3; i++ {
+		select {
+		case evt := <-received:
+			evts = append(evts, evt)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for ephemeral events")
+		}
+	}
+	assert.Equal(t, event.EphemeralEventTyping, evts[0].Type)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, evts[0].Content.AsTyping().UserIDs)
+	assert.Equal(t, event.EphemeralEventReceipt, evts[1].Type)
+	assert.Equal(t, id.RoomID("!room:example.com"), evts[1].RoomID)
+	receipt := (*evts[1].Content.AsReceipt())["$event:example.com"][event.ReceiptTypeRead]["@alice:example.com"]
+	assert.Equal(t, time.UnixMilli(1696000000000), receipt.Timestamp)
+	assert.Equal(t, event.ReadReceiptThreadMain, receipt.ThreadID)
+	assert.Equal(t, event.EphemeralEventPresence, evts[2].Type)
+	assert.Equal(t, event.PresenceOnline, evts[2].Content.AsPresence().Presence)
+	assert.True(t, evts[2].Content.AsPresence().CurrentlyActive)
+}
+
+func TestAppService_PutTransaction_EphemeralEventsNotEnabled(t *testing.T) {
+	as := newTestAppService()
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(synapseEphemeralTransaction))
+	req.Header.Set("Authorization", "Bearer correct")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, as.Events, 0)
+}
+
+func TestAppService_PutTransaction_UpdatesStateStore(t *testing.T) {
+	as := newTestAppService()
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(`{"events": [
+		{"type": "m.room.member", "state_key": "@alice:example.com", "sender": "@alice:example.com", "room_id": "!room:example.com", "event_id": "$member", "content": {"membership": "join", "displayname": "Alice"}},
+		{"type": "m.room.power_levels", "state_key": "", "sender": "@alice:example.com", "room_id": "!room:example.com", "event_id": "$pl", "content": {"users": {"@alice:example.com": 100}, "kick": 50}}
+	]}`))
+	req.Header.Set("Authorization", "Bearer correct")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	roomID := id.RoomID("!room:example.com")
+	assert.Equal(t, "Alice", as.StateStore.GetMemberDisplayName(roomID, "@alice:example.com"))
+	members, err := as.StateStore.GetRoomJoinedOrInvitedMembers(roomID)
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@alice:example.com"}, members)
+	assert.Equal(t, 100, as.StateStore.GetPowerLevel(roomID, "@alice:example.com"))
+	assert.Equal(t, 50, as.StateStore.GetPowerLevels(roomID).Kick())
+	assert.True(t, as.StateStore.HasPowerLevel(roomID, "@alice:example.com", event.StateTombstone))
+	assert.False(t, as.StateStore.HasPowerLevel(roomID, "@bob:example.com", event.StateTombstone))
+}
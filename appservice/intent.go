@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -26,6 +27,8 @@ type IntentAPI struct {
 	UserID    id.UserID
 
 	registerLock sync.Mutex
+	// lastUsed is the unix millisecond timestamp of when the intent was last fetched with AppService.Intent.
+	lastUsed atomic.Int64
 
 	IsCustomPuppet bool
 }
@@ -47,6 +50,67 @@ func (as *AppService) NewIntentAPI(localpart string) *IntentAPI {
 	}
 }
 
+// NewCustomIntent creates an IntentAPI that uses a real user's access token instead of the appservice token,
+// e.g. for double puppeting. The user ID isn't sent as a query parameter, the user is never registered automatically,
+// and requests are rate limited normally.
+//
+// Custom intents aren't cached by the appservice. When the access token stops working, the cached profile of the user
+// is dropped and OnCustomIntentLogout is called.
+func (as *AppService) NewCustomIntent(userID id.UserID, accessToken string) (*IntentAPI, error) {
+	localpart, _, err := userID.Parse()
+	if err != nil {
+		return nil, err
+	}
+	client, err := as.NewExternalMautrixClient(userID, accessToken, "")
+	if err != nil {
+		return nil, err
+	}
+	intent := &IntentAPI{
+		Client:    client,
+		bot:       as.BotClient(),
+		as:        as,
+		Localpart: localpart,
+		UserID:    userID,
+
+		IsCustomPuppet: true,
+	}
+	client.OnLogout = func(ctx context.Context, err error) {
+		as.profileCacheLock.Lock()
+		delete(as.profileCache, userID)
+		as.profileCacheLock.Unlock()
+		if as.OnCustomIntentLogout != nil {
+			as.OnCustomIntentLogout(ctx, intent, err)
+		}
+	}
+	return intent, nil
+}
+
+// ErrDeviceMasqueradingNotEnabled is returned by IntentAPI.WithDevice if MSC3202 isn't enabled in the registration.
+var ErrDeviceMasqueradingNotEnabled = errors.New("device masquerading requires org.matrix.msc3202 to be enabled in the registration")
+
+// WithDevice returns a copy of the intent that masquerades as the given device of the user using MSC3202.
+// The returned intent has its own client and is not cached, so it should be stored by the caller if it's used repeatedly.
+//
+// Custom puppets can't masquerade as other devices, as they're already logged in as a specific device.
+func (intent *IntentAPI) WithDevice(deviceID id.DeviceID) (*IntentAPI, error) {
+	if intent.as.Registration == nil || !intent.as.Registration.MSC3202 {
+		return nil, ErrDeviceMasqueradingNotEnabled
+	} else if intent.IsCustomPuppet {
+		return nil, fmt.Errorf("can't masquerade as a device of custom puppet %s", intent.UserID)
+	}
+	client := intent.as.NewMautrixClient(intent.UserID)
+	client.DeviceID = deviceID
+	client.SetAppServiceDeviceID = true
+	client.Log = client.Log.With().Str("as_device_id", deviceID.String()).Logger()
+	return &IntentAPI{
+		Client:    client,
+		bot:       intent.bot,
+		as:        intent.as,
+		Localpart: intent.Localpart,
+		UserID:    intent.UserID,
+	}, nil
+}
+
 func (intent *IntentAPI) Register(ctx context.Context) error {
 	_, _, err := intent.Client.Register(ctx, &mautrix.ReqRegister{
 		Username:     intent.Localpart,
@@ -104,7 +168,8 @@ func (intent *IntentAPI) EnsureJoined(ctx context.Context, roomID id.RoomID, ext
 			UserID: intent.UserID,
 		})
 		if inviteErr != nil {
-			return fmt.Errorf("failed to invite in ensure joined: %w", inviteErr)
+			// Return the join error too, as it's usually the more relevant one (e.g. if the join rules don't allow invites either)
+			return fmt.Errorf("failed to ensure joined: %w (inviting also failed: %w)", err, inviteErr)
 		}
 		resp, err = intent.JoinRoomByID(ctx, roomID)
 		if err != nil {
@@ -152,12 +217,39 @@ func (intent *IntentAPI) AddDoublePuppetValue(into interface{}) interface{} {
 	}
 }
 
+// sendWithRejoin calls the given send function, and if AppService.RejoinOnForbidden is set and the send fails with
+// M_FORBIDDEN, ensures that the user is joined to the room (ignoring the cache) and calls the function again.
+func (intent *IntentAPI) sendWithRejoin(ctx context.Context, roomID id.RoomID, send func() (*mautrix.RespSendEvent, error)) (*mautrix.RespSendEvent, error) {
+	resp, err := send()
+	if err == nil || !intent.as.RejoinOnForbidden || !errors.Is(err, mautrix.MForbidden) {
+		return resp, err
+	}
+	intent.Log.Debug().Err(err).
+		Str("room_id", roomID.String()).
+		Msg("Got M_FORBIDDEN while sending event, re-joining room and retrying")
+	if joinErr := intent.EnsureJoined(ctx, roomID, EnsureJoinedParams{IgnoreCache: true}); joinErr != nil {
+		return nil, fmt.Errorf("%w (re-joining failed: %w)", err, joinErr)
+	}
+	return send()
+}
+
 func (intent *IntentAPI) SendMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
 	if err := intent.EnsureJoined(ctx, roomID); err != nil {
 		return nil, err
 	}
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
-	return intent.Client.SendMessageEvent(ctx, roomID, eventType, contentJSON)
+	return intent.sendWithRejoin(ctx, roomID, func() (*mautrix.RespSendEvent, error) {
+		return intent.Client.SendMessageEvent(ctx, roomID, eventType, contentJSON)
+	})
+}
+
+// massageTimestamp drops the custom timestamp for double puppets that aren't logged in with an as_token,
+// as only appservice users are allowed to set origin_server_ts.
+func (intent *IntentAPI) massageTimestamp(ts int64) int64 {
+	if intent.IsCustomPuppet && !intent.SetAppServiceUserID {
+		return 0
+	}
+	return ts
 }
 
 func (intent *IntentAPI) SendMassagedMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, ts int64) (*mautrix.RespSendEvent, error) {
@@ -165,7 +257,9 @@ func (intent *IntentAPI) SendMassagedMessageEvent(ctx context.Context, roomID id
 		return nil, err
 	}
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
-	return intent.Client.SendMessageEvent(ctx, roomID, eventType, contentJSON, mautrix.ReqSendEvent{Timestamp: ts})
+	return intent.sendWithRejoin(ctx, roomID, func() (*mautrix.RespSendEvent, error) {
+		return intent.Client.SendMessageEvent(ctx, roomID, eventType, contentJSON, mautrix.ReqSendEvent{Timestamp: intent.massageTimestamp(ts)})
+	})
 }
 
 func (intent *IntentAPI) SendStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (*mautrix.RespSendEvent, error) {
@@ -183,6 +277,9 @@ func (intent *IntentAPI) SendMassagedStateEvent(ctx context.Context, roomID id.R
 		return nil, err
 	}
 	contentJSON = intent.AddDoublePuppetValue(contentJSON)
+	if ts = intent.massageTimestamp(ts); ts == 0 {
+		return intent.Client.SendStateEvent(ctx, roomID, eventType, stateKey, contentJSON)
+	}
 	return intent.Client.SendMassagedStateEvent(ctx, roomID, eventType, stateKey, contentJSON, ts)
 }
 
@@ -334,14 +431,18 @@ func (intent *IntentAPI) SendText(ctx context.Context, roomID id.RoomID, text st
 	if err := intent.EnsureJoined(ctx, roomID); err != nil {
 		return nil, err
 	}
-	return intent.Client.SendText(ctx, roomID, text)
+	return intent.sendWithRejoin(ctx, roomID, func() (*mautrix.RespSendEvent, error) {
+		return intent.Client.SendText(ctx, roomID, text)
+	})
 }
 
 func (intent *IntentAPI) SendNotice(ctx context.Context, roomID id.RoomID, text string) (*mautrix.RespSendEvent, error) {
 	if err := intent.EnsureJoined(ctx, roomID); err != nil {
 		return nil, err
 	}
-	return intent.Client.SendNotice(ctx, roomID, text)
+	return intent.sendWithRejoin(ctx, roomID, func() (*mautrix.RespSendEvent, error) {
+		return intent.Client.SendNotice(ctx, roomID, text)
+	})
 }
 
 func (intent *IntentAPI) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, extra ...mautrix.ReqRedact) (*mautrix.RespSendEvent, error) {
@@ -402,6 +503,42 @@ func (intent *IntentAPI) SetAvatarURL(ctx context.Context, avatarURL id.ContentU
 	return intent.Client.SetAvatarURL(ctx, avatarURL)
 }
 
+type cachedProfile struct {
+	DisplayName string
+	AvatarURL   id.ContentURI
+}
+
+// SetProfileOnce sets the display name and avatar of the user, unless they're already set to the given values.
+//
+// The last profile set using this method is cached in memory per user, so repeated calls with the same values
+// don't make any requests. If the cache doesn't match, SetDisplayName and SetAvatarURL are used, which check
+// the current values on the server before changing them.
+func (intent *IntentAPI) SetProfileOnce(ctx context.Context, displayName string, avatarURL id.ContentURI) error {
+	intent.as.profileCacheLock.Lock()
+	cached, ok := intent.as.profileCache[intent.UserID]
+	intent.as.profileCacheLock.Unlock()
+	if ok && cached.DisplayName == displayName && cached.AvatarURL == avatarURL {
+		return nil
+	}
+	if !ok || cached.DisplayName != displayName {
+		if err := intent.SetDisplayName(ctx, displayName); err != nil {
+			return err
+		}
+	}
+	if !ok || cached.AvatarURL != avatarURL {
+		if err := intent.SetAvatarURL(ctx, avatarURL); err != nil {
+			return err
+		}
+	}
+	intent.as.profileCacheLock.Lock()
+	if intent.as.profileCache == nil {
+		intent.as.profileCache = make(map[id.UserID]cachedProfile)
+	}
+	intent.as.profileCache[intent.UserID] = cachedProfile{DisplayName: displayName, AvatarURL: avatarURL}
+	intent.as.profileCacheLock.Unlock()
+	return nil
+}
+
 func (intent *IntentAPI) Whoami(ctx context.Context) (*mautrix.RespWhoami, error) {
 	if err := intent.EnsureRegistered(ctx); err != nil {
 		return nil, err
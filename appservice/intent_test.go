@@ -0,0 +1,172 @@
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIntentAPI_SetProfileOnce(t *testing.T) {
+	var gets, puts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		_, _ = fmt.Fprintln(w, `{}`)
+	}))
+	defer ts.Close()
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot"}
+	require.NoError(t, as.SetHomeserverURL(ts.URL))
+	// The cache map is only created by Create, so appservices constructed otherwise don't have it
+	as.profileCache = nil
+	ghost := as.Intent("@ghost:example.com")
+	as.StateStore.MarkRegistered(ghost.UserID)
+	avatar := id.MustParseContentURI("mxc://example.com/avatar")
+
+	require.NoError(t, ghost.SetProfileOnce(context.Background(), "Ghost", avatar))
+	assert.Equal(t, int32(2), gets.Load())
+	assert.Equal(t, int32(2), puts.Load())
+
+	require.NoError(t, ghost.SetProfileOnce(context.Background(), "Ghost", avatar))
+	assert.Equal(t, int32(2), gets.Load(), "cached profile shouldn't be fetched again")
+	assert.Equal(t, int32(2), puts.Load())
+
+	require.NoError(t, ghost.SetProfileOnce(context.Background(), "New name", avatar))
+	assert.Equal(t, int32(3), gets.Load(), "only the changed display name should be checked")
+	assert.Equal(t, int32(3), puts.Load())
+}
+
+// newMembershipTestAppService returns an appservice whose homeserver rejects the first forbiddenSends message sends
+// and all joins and invites if rejectJoins is set. The returned counters are the number of join, invite and send requests.
+func newMembershipTestAppService(t *testing.T, forbiddenSends int32, rejectJoins bool) (as *AppService, joins, invites, sends *atomic.Int32) {
+	joins, invites, sends = &atomic.Int32{}, &atomic.Int32{}, &atomic.Int32{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/join"):
+			joins.Add(1)
+			if rejectJoins {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You are not invited to this room."}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"room_id": "!room:example.com"}`))
+		case strings.HasSuffix(r.URL.Path, "/invite"):
+			invites.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Join rule forbids invites"}`))
+		case strings.Contains(r.URL.Path, "/send/"):
+			if sends.Add(1) <= forbiddenSends {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "User not in room"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	as = Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot"}
+	require.NoError(t, as.SetHomeserverURL(ts.URL))
+	return
+}
+
+func TestIntentAPI_SendMessageEvent_RejoinOnForbidden(t *testing.T) {
+	as, joins, _, sends := newMembershipTestAppService(t, 1, false)
+	ghost := as.Intent("@ghost:example.com")
+	as.StateStore.MarkRegistered(ghost.UserID)
+	// The cached membership is outdated, e.g. because the ghost was kicked while the bridge was offline
+	as.StateStore.SetMembership("!room:example.com", ghost.UserID, event.MembershipJoin)
+
+	_, err := ghost.SendText(context.Background(), "!room:example.com", "hello")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+	assert.Equal(t, int32(0), joins.Load())
+
+	as.RejoinOnForbidden = true
+	sends.Store(0)
+	resp, err := ghost.SendText(context.Background(), "!room:example.com", "hello")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$event"), resp.EventID)
+	assert.Equal(t, int32(1), joins.Load())
+	assert.Equal(t, int32(2), sends.Load())
+}
+
+func TestIntentAPI_EnsureJoined_InviteRejected(t *testing.T) {
+	as, joins, invites, _ := newMembershipTestAppService(t, 0, true)
+	ghost := as.Intent("@ghost:example.com")
+	as.StateStore.MarkRegistered(ghost.UserID)
+
+	err := ghost.EnsureJoined(context.Background(), "!room:example.com")
+	require.ErrorIs(t, err, mautrix.MForbidden)
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	// The original join error is the one that's surfaced first
+	assert.Equal(t, "You are not invited to this room.", httpErr.RespError.Err)
+	assert.Contains(t, err.Error(), "Join rule forbids invites")
+	assert.Equal(t, int32(1), joins.Load())
+	assert.Equal(t, int32(1), invites.Load())
+	assert.False(t, as.StateStore.IsInRoom("!room:example.com", ghost.UserID))
+}
+
+func TestAppService_NewCustomIntent(t *testing.T) {
+	var tokenValid atomic.Bool
+	tokenValid.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("user_id"))
+		assert.Equal(t, "Bearer user_token", r.Header.Get("Authorization"))
+		assert.False(t, strings.HasSuffix(r.URL.Path, "/register"), "custom intents must not be registered")
+		if !tokenValid.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"user_id": "@user:example.com"}`))
+	}))
+	defer ts.Close()
+	as := Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &Registration{SenderLocalpart: "bot", AppToken: "as_token"}
+	require.NoError(t, as.SetHomeserverURL(ts.URL))
+	var loggedOut []*IntentAPI
+	as.OnCustomIntentLogout = func(ctx context.Context, intent *IntentAPI, err error) {
+		assert.ErrorIs(t, err, mautrix.MUnknownToken)
+		loggedOut = append(loggedOut, intent)
+	}
+
+	intent, err := as.NewCustomIntent("@user:example.com", "user_token")
+	require.NoError(t, err)
+	assert.True(t, intent.IsCustomPuppet)
+	assert.Equal(t, "user", intent.Localpart)
+	require.NoError(t, intent.EnsureRegistered(context.Background()))
+	resp, err := intent.Whoami(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+	assert.Empty(t, loggedOut)
+
+	as.profileCache[intent.UserID] = cachedProfile{DisplayName: "User"}
+	tokenValid.Store(false)
+	_, err = intent.Whoami(context.Background())
+	require.ErrorIs(t, err, mautrix.MUnknownToken)
+	assert.Equal(t, []*IntentAPI{intent}, loggedOut)
+	assert.NotContains(t, as.profileCache, intent.UserID)
+
+	_, err = as.NewCustomIntent("invalid", "user_token")
+	assert.Error(t, err)
+}
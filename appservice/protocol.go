@@ -141,6 +141,8 @@ type ErrorCode string
 // Native ErrorCodes
 const (
 	ErrUnknownToken ErrorCode = "M_UNKNOWN_TOKEN"
+	ErrUnauthorized ErrorCode = "M_UNAUTHORIZED"
+	ErrForbidden    ErrorCode = "M_FORBIDDEN"
 	ErrBadJSON      ErrorCode = "M_BAD_JSON"
 	ErrNotJSON      ErrorCode = "M_NOT_JSON"
 	ErrUnknown      ErrorCode = "M_UNKNOWN"
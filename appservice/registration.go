@@ -7,12 +7,19 @@
 package appservice
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
 	"go.mau.fi/util/random"
+
+	"maunium.net/go/mautrix/id"
 )
 
 // Registration contains the data in a Matrix appservice registration.
@@ -29,8 +36,13 @@ type Registration struct {
 
 	SoruEphemeralEvents bool `yaml:"de.sorunome.msc2409.push_ephemeral,omitempty" json:"de.sorunome.msc2409.push_ephemeral,omitempty"`
 	EphemeralEvents     bool `yaml:"push_ephemeral,omitempty" json:"push_ephemeral,omitempty"`
+	// MSC3202 enables device masquerading and pushing device lists and one-time key counts in transactions.
+	MSC3202 bool `yaml:"org.matrix.msc3202,omitempty" json:"org.matrix.msc3202,omitempty"`
 }
 
+// ErrRegistrationMissingField is returned by Registration.Validate if a required field is empty.
+var ErrRegistrationMissingField = errors.New("required field missing from registration")
+
 // CreateRegistration creates a Registration with random appservice and homeserver tokens.
 func CreateRegistration() *Registration {
 	return &Registration{
@@ -39,7 +51,31 @@ func CreateRegistration() *Registration {
 	}
 }
 
-// LoadRegistration loads a YAML file and turns it into a Registration.
+// GenerateRegistration creates a Registration with the given basic fields and random tokens.
+// The namespaces are left empty and should be filled by the caller.
+func GenerateRegistration(appserviceID, url, senderLocalpart string) *Registration {
+	reg := CreateRegistration()
+	reg.ID = appserviceID
+	reg.URL = url
+	reg.SenderLocalpart = senderLocalpart
+	return reg
+}
+
+// SetEphemeralEvents sets both the stable and unstable MSC2409 flags for receiving ephemeral events
+// (typing notifications, receipts and presence) in transactions.
+func (reg *Registration) SetEphemeralEvents(enabled bool) {
+	reg.EphemeralEvents = enabled
+	reg.SoruEphemeralEvents = enabled
+}
+
+// ReceivesEphemeralEvents returns true if either the stable or unstable MSC2409 flag is set.
+func (reg *Registration) ReceivesEphemeralEvents() bool {
+	return reg.EphemeralEvents || reg.SoruEphemeralEvents
+}
+
+// LoadRegistration loads a YAML or JSON file, turns it into a Registration and validates it.
+//
+// Files with the .json extension are parsed as JSON, everything else is parsed as YAML.
 func LoadRegistration(path string) (*Registration, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -47,13 +83,57 @@ func LoadRegistration(path string) (*Registration, error) {
 	}
 
 	reg := &Registration{}
-	err = yaml.Unmarshal(data, reg)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, reg)
+	} else {
+		err = yaml.Unmarshal(data, reg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registration: %w", err)
+	}
+	err = reg.Validate()
 	if err != nil {
 		return nil, err
 	}
 	return reg, nil
 }
 
+// Validate checks that all the fields required by the spec are present in the registration
+// and that all namespace regexes are valid when anchored to match the entire string.
+func (reg *Registration) Validate() error {
+	switch {
+	case reg.ID == "":
+		return fmt.Errorf("%w: id", ErrRegistrationMissingField)
+	case reg.AppToken == "":
+		return fmt.Errorf("%w: as_token", ErrRegistrationMissingField)
+	case reg.ServerToken == "":
+		return fmt.Errorf("%w: hs_token", ErrRegistrationMissingField)
+	case reg.SenderLocalpart == "":
+		return fmt.Errorf("%w: sender_localpart", ErrRegistrationMissingField)
+	}
+	for _, nsl := range []NamespaceList{reg.Namespaces.UserIDs, reg.Namespaces.RoomAliases, reg.Namespaces.RoomIDs} {
+		for _, ns := range nsl {
+			if _, err := compileNamespaceRegex(ns.Regex); err != nil {
+				return fmt.Errorf("invalid namespace regex %q: %w", ns.Regex, err)
+			}
+		}
+	}
+	return nil
+}
+
+// IsRateLimited returns whether the homeserver should apply rate limits to users in the appservice's namespaces.
+// As per the spec, rate limiting is enabled if the field is not set.
+//
+// mautrix-go doesn't throttle requests on the client side, the only rate limit handling is retrying
+// on M_LIMIT_EXCEEDED responses. When rate_limited is false, the homeserver won't send such responses
+// for requests made as namespaced users, so clients made with AppService.NewMautrixClient have
+// IgnoreRateLimit set and return unexpected 429s immediately instead of retrying.
+// Note that the exemption only applies to users in the namespaces and the sender_localpart user,
+// requests made with real users' access tokens (e.g. double puppeting) are still rate limited normally.
+func (reg *Registration) IsRateLimited() bool {
+	return reg.RateLimited == nil || *reg.RateLimited
+}
+
 // Save saves this Registration into a file at the given path.
 func (reg *Registration) Save(path string) error {
 	data, err := yaml.Marshal(reg)
@@ -83,6 +163,64 @@ type Namespaces struct {
 type Namespace struct {
 	Regex     string `yaml:"regex" json:"regex"`
 	Exclusive bool   `yaml:"exclusive" json:"exclusive"`
+
+	compiled     *regexp.Regexp
+	compiledFrom string
+}
+
+type serializableNamespace Namespace
+
+func (ns *Namespace) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, (*serializableNamespace)(ns))
+	if err != nil {
+		return err
+	}
+	return ns.compile()
+}
+
+func (ns *Namespace) UnmarshalYAML(node *yaml.Node) error {
+	err := node.Decode((*serializableNamespace)(ns))
+	if err != nil {
+		return err
+	}
+	return ns.compile()
+}
+
+// compileNamespaceRegex compiles the given namespace regex so that it must match the entire string,
+// like homeservers do when checking namespaces.
+//
+// The regex is also compiled on its own first, so that unbalanced groups like "a)|(b" can't escape the anchors.
+func compileNamespaceRegex(regex string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(regex); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + regex + ")$")
+}
+
+func (ns *Namespace) compile() (err error) {
+	ns.compiled, err = compileNamespaceRegex(ns.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid namespace regex %q: %w", ns.Regex, err)
+	}
+	ns.compiledFrom = ns.Regex
+	return nil
+}
+
+// Matches checks if the given string matches the regex of this namespace.
+// The regex must match the entire string, not just a substring.
+//
+// The regex is compiled once when the namespace is parsed or registered.
+// Namespaces constructed manually are compiled on every call.
+func (ns *Namespace) Matches(str string) bool {
+	compiled := ns.compiled
+	if compiled == nil || ns.compiledFrom != ns.Regex {
+		var err error
+		compiled, err = compileNamespaceRegex(ns.Regex)
+		if err != nil {
+			return false
+		}
+	}
+	return compiled.MatchString(str)
 }
 
 type NamespaceList []Namespace
@@ -92,9 +230,48 @@ func (nsl *NamespaceList) Register(regex *regexp.Regexp, exclusive bool) {
 		Regex:     regex.String(),
 		Exclusive: exclusive,
 	}
+	// The regex is already known to be valid, so this can't fail
+	_ = ns.compile()
 	if nsl == nil {
 		*nsl = []Namespace{ns}
 	} else {
 		*nsl = append(*nsl, ns)
 	}
 }
+
+// Matches checks if the given string matches any namespace in the list.
+func (nsl NamespaceList) Matches(str string) bool {
+	for i := range nsl {
+		if nsl[i].Matches(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesExclusive checks if the given string matches any exclusive namespace in the list.
+//
+// Exclusive namespaces are reserved for the appservice: other users can't register or create anything in them.
+func (nsl NamespaceList) MatchesExclusive(str string) bool {
+	for i := range nsl {
+		if nsl[i].Exclusive && nsl[i].Matches(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesUserID checks if the given user ID is in the user namespaces of the registration.
+func (ns *Namespaces) MatchesUserID(userID id.UserID) bool {
+	return ns.UserIDs.Matches(string(userID))
+}
+
+// MatchesRoomAlias checks if the given room alias is in the alias namespaces of the registration.
+func (ns *Namespaces) MatchesRoomAlias(alias id.RoomAlias) bool {
+	return ns.RoomAliases.Matches(string(alias))
+}
+
+// MatchesRoomID checks if the given room ID is in the room namespaces of the registration.
+func (ns *Namespaces) MatchesRoomID(roomID id.RoomID) bool {
+	return ns.RoomIDs.Matches(string(roomID))
+}
@@ -0,0 +1,114 @@
+package appservice
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const sampleNamespacesYAML = `
+users:
+- regex: '@bridge_.+:example\.com'
+  exclusive: true
+- regex: '@shared_.+:example\.com'
+  exclusive: false
+aliases:
+- regex: '#bridge_.+:example\.com'
+  exclusive: true
+`
+
+func TestNamespaces_Matches(t *testing.T) {
+	var ns Namespaces
+	require.NoError(t, yaml.Unmarshal([]byte(sampleNamespacesYAML), &ns))
+	assert.NotNil(t, ns.UserIDs[0].compiled)
+
+	assert.True(t, ns.MatchesUserID("@bridge_123:example.com"))
+	assert.True(t, ns.MatchesUserID("@shared_123:example.com"))
+	assert.False(t, ns.MatchesUserID("@user:example.com"))
+	assert.True(t, ns.UserIDs.MatchesExclusive("@bridge_123:example.com"))
+	assert.False(t, ns.UserIDs.MatchesExclusive("@shared_123:example.com"))
+	assert.True(t, ns.MatchesRoomAlias("#bridge_abc:example.com"))
+	assert.False(t, ns.MatchesRoomID("!room:example.com"))
+}
+
+func TestNamespace_MatchesWholeString(t *testing.T) {
+	var ns Namespace
+	require.NoError(t, json.Unmarshal([]byte(`{"regex": "@bridge_.*", "exclusive": true}`), &ns))
+	assert.True(t, ns.Matches("@bridge_x:server"))
+	assert.False(t, ns.Matches("@evil_bridge_x:server"))
+
+	var nsl NamespaceList
+	nsl.Register(regexp.MustCompile(`@bridge_.*:server`), true)
+	assert.True(t, nsl.MatchesExclusive("@bridge_x:server"))
+	assert.False(t, nsl.MatchesExclusive("@evil_bridge_x:server"))
+	assert.False(t, nsl.MatchesExclusive("@bridge_x:server.evil"))
+
+	manual := Namespace{Regex: "a|b"}
+	assert.True(t, manual.Matches("a"))
+	assert.False(t, manual.Matches("ab"))
+}
+
+func TestNamespace_UnmarshalInvalidRegex(t *testing.T) {
+	var ns Namespace
+	assert.Error(t, json.Unmarshal([]byte(`{"regex": "(", "exclusive": true}`), &ns))
+	assert.Error(t, json.Unmarshal([]byte(`{"regex": "a)|(b", "exclusive": true}`), &ns))
+	assert.False(t, (&Namespace{Regex: "a)|(b"}).Matches("xb"))
+}
+
+func TestLoadRegistration(t *testing.T) {
+	reg := GenerateRegistration("test", "http://localhost:29318", "bot")
+	reg.Namespaces.UserIDs = NamespaceList{{Regex: "@test_.+:example.com", Exclusive: true}}
+	yamlPath := filepath.Join(t.TempDir(), "registration.yaml")
+	require.NoError(t, reg.Save(yamlPath))
+	loaded, err := LoadRegistration(yamlPath)
+	require.NoError(t, err)
+	assert.Equal(t, reg.AppToken, loaded.AppToken)
+	assert.Equal(t, reg.ServerToken, loaded.ServerToken)
+	assert.True(t, loaded.Namespaces.MatchesUserID("@test_123:example.com"))
+	assert.False(t, loaded.Namespaces.MatchesUserID("@evil_test_123:example.com"))
+	assert.False(t, loaded.Namespaces.MatchesUserID("@test_123:example.com.evil"))
+
+	jsonPath := filepath.Join(t.TempDir(), "registration.json")
+	data, err := json.Marshal(reg)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(jsonPath, data, 0600))
+	loaded, err = LoadRegistration(jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, "bot", loaded.SenderLocalpart)
+	assert.False(t, loaded.Namespaces.MatchesUserID("@evil_test_123:example.com"))
+}
+
+func TestRegistration_Validate(t *testing.T) {
+	reg := GenerateRegistration("test", "", "bot")
+	assert.NoError(t, reg.Validate())
+	reg.Namespaces.UserIDs = NamespaceList{{Regex: "a)|(b"}}
+	assert.Error(t, reg.Validate())
+	reg.Namespaces.UserIDs = nil
+	reg.ServerToken = ""
+	assert.ErrorIs(t, reg.Validate(), ErrRegistrationMissingField)
+}
+
+func TestRegistration_IsRateLimited(t *testing.T) {
+	reg := &Registration{}
+	assert.True(t, reg.IsRateLimited())
+	rateLimited := false
+	reg.RateLimited = &rateLimited
+	assert.False(t, reg.IsRateLimited())
+}
+
+func TestRegistration_SetEphemeralEvents(t *testing.T) {
+	reg := GenerateRegistration("bridge", "http://localhost:29318", "bridgebot")
+	assert.False(t, reg.ReceivesEphemeralEvents())
+	reg.SetEphemeralEvents(true)
+	assert.True(t, reg.ReceivesEphemeralEvents())
+	data, err := yaml.Marshal(reg)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "de.sorunome.msc2409.push_ephemeral: true")
+	assert.Contains(t, string(data), "push_ephemeral: true")
+}
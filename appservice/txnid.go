@@ -6,8 +6,18 @@
 
 package appservice
 
-import "sync"
+import (
+	"context"
+	"sync"
 
+	"github.com/rs/zerolog"
+)
+
+// DefaultTransactionIDCacheSize is the number of transaction IDs that AppService instances remember by default.
+const DefaultTransactionIDCacheSize = 128
+
+// TransactionIDCache remembers a limited number of recently processed transaction IDs.
+// When the cache is full, the oldest transaction ID is forgotten.
 type TransactionIDCache struct {
 	array    []string
 	arrayPtr int
@@ -16,9 +26,12 @@ type TransactionIDCache struct {
 }
 
 func NewTransactionIDCache(size int) *TransactionIDCache {
+	if size < 1 {
+		size = 1
+	}
 	return &TransactionIDCache{
 		array: make([]string, size),
-		hash:  make(map[string]struct{}),
+		hash:  make(map[string]struct{}, size),
 	}
 }
 
@@ -31,13 +44,59 @@ func (txnIDC *TransactionIDCache) IsProcessed(txnID string) bool {
 
 func (txnIDC *TransactionIDCache) MarkProcessed(txnID string) {
 	txnIDC.lock.Lock()
+	defer txnIDC.lock.Unlock()
+	if _, exists := txnIDC.hash[txnID]; exists {
+		return
+	}
+	if oldest := txnIDC.array[txnIDC.arrayPtr]; oldest != "" {
+		delete(txnIDC.hash, oldest)
+	}
 	txnIDC.hash[txnID] = struct{}{}
-	if txnIDC.array[txnIDC.arrayPtr] != "" {
-		for i := 0; i < len(txnIDC.array)/8; i++ {
-			delete(txnIDC.hash, txnIDC.array[txnIDC.arrayPtr+i])
-			txnIDC.array[txnIDC.arrayPtr+i] = ""
+	txnIDC.array[txnIDC.arrayPtr] = txnID
+	txnIDC.arrayPtr = (txnIDC.arrayPtr + 1) % len(txnIDC.array)
+}
+
+// TransactionIDStore persists the IDs of processed transactions, so that transactions retried by the homeserver
+// aren't processed again after the appservice is restarted.
+type TransactionIDStore interface {
+	IsTransactionProcessed(ctx context.Context, txnID string) (bool, error)
+	MarkTransactionProcessed(ctx context.Context, txnID string) error
+}
+
+// SetTransactionIDCacheSize replaces the in-memory transaction ID cache with an empty one of the given size.
+// This should be called before the appservice starts receiving transactions.
+func (as *AppService) SetTransactionIDCacheSize(size int) {
+	as.txnIDC = NewTransactionIDCache(size)
+}
+
+func (as *AppService) isTransactionProcessed(ctx context.Context, txnID string) bool {
+	if as.txnIDC.IsProcessed(txnID) {
+		return true
+	} else if as.TransactionIDStore == nil {
+		return false
+	}
+	processed, err := as.TransactionIDStore.IsTransactionProcessed(ctx, txnID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to check if transaction was already processed")
+		return false
+	} else if processed {
+		as.txnIDC.MarkProcessed(txnID)
+	}
+	return processed
+}
+
+func (as *AppService) markTransactionProcessed(ctx context.Context, txnID string) {
+	as.txnIDC.MarkProcessed(txnID)
+	if as.TransactionIDStore != nil {
+		err := as.TransactionIDStore.MarkTransactionProcessed(ctx, txnID)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to mark transaction as processed in store")
 		}
 	}
-	txnIDC.array[txnIDC.arrayPtr] = txnID
-	txnIDC.lock.Unlock()
+}
+
+func (as *AppService) notifyDuplicateTransaction(txnID string) {
+	if as.OnDuplicateTransaction != nil {
+		as.OnDuplicateTransaction(txnID)
+	}
 }
@@ -0,0 +1,96 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionIDCache_Eviction(t *testing.T) {
+	cache := NewTransactionIDCache(3)
+	for _, txnID := range []string{"txn1", "txn2", "txn3"} {
+		cache.MarkProcessed(txnID)
+	}
+	// Marking an already known ID doesn't push out anything
+	cache.MarkProcessed("txn1")
+	assert.True(t, cache.IsProcessed("txn1"))
+	assert.True(t, cache.IsProcessed("txn2"))
+	assert.True(t, cache.IsProcessed("txn3"))
+
+	cache.MarkProcessed("txn4")
+	assert.False(t, cache.IsProcessed("txn1"))
+	assert.True(t, cache.IsProcessed("txn2"))
+	assert.True(t, cache.IsProcessed("txn4"))
+	cache.MarkProcessed("txn5")
+	cache.MarkProcessed("txn6")
+	assert.False(t, cache.IsProcessed("txn3"))
+	assert.True(t, cache.IsProcessed("txn4"))
+	assert.True(t, cache.IsProcessed("txn6"))
+}
+
+type memoryTransactionIDStore struct {
+	lock      sync.Mutex
+	processed map[string]struct{}
+}
+
+func (store *memoryTransactionIDStore) IsTransactionProcessed(_ context.Context, txnID string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	_, ok := store.processed[txnID]
+	return ok, nil
+}
+
+func (store *memoryTransactionIDStore) MarkTransactionProcessed(_ context.Context, txnID string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.processed[txnID] = struct{}{}
+	return nil
+}
+
+func putTestTransaction(as *AppService, txnID string) int {
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(`{"events": [
+		{"type": "m.room.message", "room_id": "!room:example.com", "event_id": "$event", "sender": "@user:example.com", "content": {"msgtype": "m.text", "body": "hi"}}
+	]}`))
+	req.Header.Set("Authorization", "Bearer correct")
+	w := httptest.NewRecorder()
+	as.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAppService_PutTransaction_Duplicate(t *testing.T) {
+	store := &memoryTransactionIDStore{processed: make(map[string]struct{})}
+	var duplicates []string
+	newAS := func() *AppService {
+		as := newTestAppService()
+		as.TransactionIDStore = store
+		as.OnDuplicateTransaction = func(txnID string) {
+			duplicates = append(duplicates, txnID)
+		}
+		return as
+	}
+
+	as := newAS()
+	require.Equal(t, http.StatusOK, putTestTransaction(as, "txn1"))
+	require.Equal(t, http.StatusOK, putTestTransaction(as, "txn1"))
+	assert.Len(t, as.Events, 1)
+	assert.Equal(t, []string{"txn1"}, duplicates)
+
+	// The persistent store catches retries after a restart
+	restarted := newAS()
+	require.Equal(t, http.StatusOK, putTestTransaction(restarted, "txn1"))
+	require.Equal(t, http.StatusOK, putTestTransaction(restarted, "txn2"))
+	assert.Len(t, restarted.Events, 1)
+	assert.Equal(t, []string{"txn1", "txn1"}, duplicates)
+}
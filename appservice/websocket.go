@@ -268,12 +268,13 @@ func (as *AppService) SetWebsocketCommandHandler(cmd string, handler WebsocketHa
 type WebsocketTransactionHandler func(ctx context.Context, msg WebsocketMessage) (bool, any)
 
 func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg WebsocketMessage) (bool, any) {
-	if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
+	if msg.TxnID == "" || !as.isTransactionProcessed(ctx, msg.TxnID) {
 		as.handleTransaction(ctx, msg.TxnID, &msg.Transaction)
 	} else {
 		zerolog.Ctx(ctx).Debug().
 			Object("content", &msg.Transaction).
 			Msg("Ignoring duplicate transaction")
+		as.notifyDuplicateTransaction(msg.TxnID)
 	}
 	return true, &WebsocketTransactionResponse{TxnID: msg.TxnID}
 }
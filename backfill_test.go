@@ -0,0 +1,26 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestEnsureIncreasingTimestamps(t *testing.T) {
+	events := []*event.Event{{Timestamp: 1000}, {Timestamp: 1000}, {Timestamp: 1000}, {Timestamp: 999}, {Timestamp: 2000}}
+	mautrix.EnsureIncreasingTimestamps(events)
+	var timestamps []int64
+	for _, evt := range events {
+		timestamps = append(timestamps, evt.Timestamp)
+	}
+	assert.Equal(t, []int64{1000, 1001, 1002, 1003, 2000}, timestamps)
+}
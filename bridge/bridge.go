@@ -627,7 +627,13 @@ func (br *Bridge) start() {
 		go br.startWebsocket(&wg)
 	} else if br.AS.Host.IsConfigured() {
 		br.ZLog.Debug().Msg("Starting application service HTTP server")
-		go br.AS.Start()
+		go func() {
+			err := br.AS.Start(context.Background())
+			if err != nil {
+				br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Msg("Error in appservice HTTP listener")
+				os.Exit(24)
+			}
+		}()
 	} else {
 		br.ZLog.WithLevel(zerolog.FatalLevel).Msg("Neither appservice HTTP listener nor websocket is enabled")
 		os.Exit(23)
@@ -127,8 +127,7 @@ func (asc *AppserviceConfig) copyToRegistration(registration *appservice.Registr
 	registration.URL = asc.Address
 	falseVal := false
 	registration.RateLimited = &falseVal
-	registration.EphemeralEvents = asc.EphemeralEvents
-	registration.SoruEphemeralEvents = asc.EphemeralEvents
+	registration.SetEphemeralEvents(asc.EphemeralEvents)
 }
 
 type BotUserConfig struct {
@@ -13,7 +13,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -70,18 +72,71 @@ type Client struct {
 	StreamSyncMinAge time.Duration
 
 	// Number of times that mautrix will retry any HTTP request
-	// if the request fails entirely or returns a HTTP gateway error (502-504)
+	// if the request fails entirely or returns a HTTP gateway error (502-504).
+	// Non-idempotent (POST) requests are only retried after rate limit errors.
 	DefaultHTTPRetries int
 	// Set to true to disable automatically sleeping on 429 errors.
+	// Individual requests can also opt out by setting IgnoreRateLimitContextKey in the context.
 	IgnoreRateLimit bool
-
-	txnID int32
+	// The maximum total time that mautrix will sleep between retries of a single request.
+	// If the homeserver asks to wait longer than what's left, the error is returned instead. 0 means no limit.
+	MaxRetryWait time.Duration
+
+	// If set, MarkRead and SetReadMarkers calls for the same room within this duration of each other
+	// are coalesced into a single request using the latest values. The calls return immediately and
+	// errors are only logged. Pending updates can be sent immediately using FlushReadMarkers.
+	ReadMarkerDebounce time.Duration
+	readMarkers        readMarkerDebouncer
+
+	// If set, SendMessageEvent, SendStateEvent, SendMassagedStateEvent and RedactEvent calls to the same room
+	// are sent one at a time in the order they were called, waiting for the response of each request before
+	// sending the next one. Sends to different rooms still happen concurrently.
+	SequentialRoomSends bool
+	roomSendQueue       roomSendQueue
+
+	// If set, encrypted events returned by Messages and Context are decrypted using Crypto.
+	// Events that can't be decrypted are left encrypted and have Mautrix.DecryptionError set.
+	DecryptHistory bool
+
+	// Set to true to return an error if a JSON response contains fields that the response struct doesn't have.
+	// This is meant for catching spec drift in tests and should not be enabled in production.
+	// Fields of nested structs are checked too, except for types that have custom unmarshalers.
+	StrictResponseDecoding bool
+	// If set, StrictResponseDecoding only applies to responses of these types, e.g. reflect.TypeOf(RespWhoami{}).
+	StrictResponseTypes []reflect.Type
+
+	// OnSoftLogout is called when a request fails with M_UNKNOWN_TOKEN and soft_logout set to true.
+	// The function should re-authenticate and update AccessToken, e.g. by logging in again with the
+	// same device ID, which keeps the device's crypto state valid. If it returns nil, the failed request
+	// is retried with the new access token. Requests made inside the function won't trigger it again.
+	OnSoftLogout   func(ctx context.Context) error
+	softLogoutLock sync.Mutex
+	// OnLogout is called when a request fails with M_UNKNOWN_TOKEN, i.e. when the access token is no longer valid.
+	// Soft logouts only trigger it if OnSoftLogout isn't set or fails to re-authenticate.
+	OnLogout func(ctx context.Context, err error)
+
+	txnID      int32
+	sentTxnIDs sentTransactionCache
+
+	rateLimitedUntil time.Time
+	rateLimitLock    sync.Mutex
 
 	// Should the ?user_id= query parameter be set in requests?
 	// See https://spec.matrix.org/v1.6/application-service-api/#identity-assertion
 	SetAppServiceUserID bool
+	// Should the ?org.matrix.msc3202.device_id= query parameter be set in requests?
+	// This only has an effect if SetAppServiceUserID is also true and DeviceID is set.
+	// See https://github.com/matrix-org/matrix-spec-proposals/pull/3202
+	SetAppServiceDeviceID bool
+
+	syncingID      uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+	syncCancel     context.CancelFunc
+	syncCancelLock sync.Mutex
 
-	syncingID uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+	closeCtx         context.Context
+	closeCancel      context.CancelFunc
+	closeLock        sync.Mutex
+	inFlightRequests int64
 }
 
 type ClientWellKnown struct {
@@ -169,17 +224,29 @@ func (cli *Client) Sync() error {
 	return cli.SyncWithContext(context.Background())
 }
 
+// SyncWithContext is like Sync, but it also stops syncing when the given context is cancelled. Cancelling the
+// context aborts the in-flight /sync request instead of waiting for the long poll to time out. In that case,
+// the context error is returned, which can be checked with errors.Is(err, context.Canceled) to distinguish it
+// from network errors. If the sync is stopped with StopSync or by starting another sync, nil is returned.
 func (cli *Client) SyncWithContext(ctx context.Context) error {
+	if cli.getCloseContext().Err() != nil {
+		return ErrClientClosed
+	}
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
-	syncingID := cli.incrementSyncingID()
+	ctx, cancel := context.WithCancel(ctx)
+	syncingID := cli.startSync(cancel)
+	defer cli.finishSync(syncingID, cancel)
 	nextBatch := cli.Store.LoadNextBatch(ctx, cli.UserID)
 	filterID := cli.Store.LoadFilterID(ctx, cli.UserID)
 	if filterID == "" {
 		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
 		resFilter, err := cli.CreateFilter(ctx, filterJSON)
 		if err != nil {
+			if cli.getSyncingID() != syncingID {
+				return nil
+			}
 			return err
 		}
 		filterID = resFilter.FilterID
@@ -201,7 +268,9 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			StreamResponse: streamResp,
 		})
 		if err != nil {
-			if ctx.Err() != nil {
+			if cli.getSyncingID() != syncingID {
+				return nil
+			} else if ctx.Err() != nil {
 				return ctx.Err()
 			}
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
@@ -210,6 +279,9 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 			}
 			select {
 			case <-ctx.Done():
+				if cli.getSyncingID() != syncingID {
+					return nil
+				}
 				return ctx.Err()
 			case <-time.After(duration):
 				continue
@@ -228,6 +300,7 @@ func (cli *Client) SyncWithContext(ctx context.Context) error {
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
 		cli.Store.SaveNextBatch(ctx, cli.UserID, resSync.NextBatch)
+		cli.markOwnEchoes(resSync)
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
@@ -244,10 +317,96 @@ func (cli *Client) getSyncingID() uint32 {
 	return atomic.LoadUint32(&cli.syncingID)
 }
 
-// StopSync stops the ongoing sync started by Sync.
+// startSync stops any previous sync and stores the cancel function of the new sync, so that StopSync can abort it.
+func (cli *Client) startSync(cancel context.CancelFunc) uint32 {
+	cli.syncCancelLock.Lock()
+	defer cli.syncCancelLock.Unlock()
+	syncingID := cli.incrementSyncingID()
+	if cli.syncCancel != nil {
+		cli.syncCancel()
+	}
+	cli.syncCancel = cancel
+	return syncingID
+}
+
+func (cli *Client) finishSync(syncingID uint32, cancel context.CancelFunc) {
+	cancel()
+	cli.syncCancelLock.Lock()
+	if cli.getSyncingID() == syncingID {
+		cli.syncCancel = nil
+	}
+	cli.syncCancelLock.Unlock()
+}
+
+// StopSync stops the ongoing sync started by Sync. Any in-flight /sync request is aborted immediately.
 func (cli *Client) StopSync() {
+	cli.syncCancelLock.Lock()
+	defer cli.syncCancelLock.Unlock()
 	// Advance the syncing state so that any running Syncs will terminate.
 	cli.incrementSyncingID()
+	if cli.syncCancel != nil {
+		cli.syncCancel()
+		cli.syncCancel = nil
+	}
+}
+
+// ErrClientClosed is returned by all requests made after Client.Close has been called.
+var ErrClientClosed = errors.New("client has been closed")
+
+func (cli *Client) getCloseContext() context.Context {
+	cli.closeLock.Lock()
+	defer cli.closeLock.Unlock()
+	if cli.closeCtx == nil {
+		cli.closeCtx, cli.closeCancel = context.WithCancel(context.Background())
+	}
+	return cli.closeCtx
+}
+
+// trackRequest returns a context that is cancelled when either the given context is cancelled or the client is closed.
+// The returned function must be called when the request is done.
+func (cli *Client) trackRequest(ctx context.Context) (context.Context, func(), error) {
+	closeCtx := cli.getCloseContext()
+	if closeCtx.Err() != nil {
+		return nil, nil, ErrClientClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	atomic.AddInt64(&cli.inFlightRequests, 1)
+	go func() {
+		select {
+		case <-closeCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			atomic.AddInt64(&cli.inFlightRequests, -1)
+		})
+	}, nil
+}
+
+// InFlightRequests returns the number of HTTP requests that are currently in progress.
+// Media downloads are counted until the response body is closed.
+func (cli *Client) InFlightRequests() int {
+	return int(atomic.LoadInt64(&cli.inFlightRequests))
+}
+
+// Close cancels all in-flight requests and stops the sync loop. Like with StopSync, a running
+// SyncWithContext call will return nil.
+//
+// Read marker updates held back by ReadMarkerDebounce are sent before closing.
+//
+// The client is unusable after this: all further requests will fail with ErrClientClosed.
+func (cli *Client) Close() {
+	if err := cli.FlushReadMarkers(cli.getCloseContext()); err != nil {
+		cli.Log.Err(err).Msg("Failed to flush read markers while closing client")
+	}
+	cli.closeLock.Lock()
+	cli.closeCancel()
+	cli.closeLock.Unlock()
+	cli.StopSync()
 }
 
 type contextKey int
@@ -255,6 +414,11 @@ type contextKey int
 const (
 	LogBodyContextKey contextKey = iota
 	LogRequestIDContextKey
+	// IgnoreRateLimitContextKey can be set to true in the context of a request to return 429 errors
+	// immediately instead of sleeping and retrying, even if Client.IgnoreRateLimit is false.
+	IgnoreRateLimitContextKey
+
+	softLogoutContextKey
 )
 
 func (cli *Client) RequestStart(req *http.Request) {
@@ -352,6 +516,9 @@ func (params *FullRequest) compileRequest(ctx context.Context) (*http.Request, e
 		params.RequestLength = int64(len(params.RequestBytes))
 	} else if params.RequestLength > 0 && params.RequestBody != nil {
 		logBody = fmt.Sprintf("<%d bytes>", params.RequestLength)
+	} else if params.RequestBody != nil {
+		// Unknown length, the body will be streamed using chunked transfer encoding
+		logBody = "<streamed body>"
 	} else if params.Method != http.MethodGet && params.Method != http.MethodHead {
 		params.RequestJSON = struct{}{}
 		logBody = params.RequestJSON
@@ -399,18 +566,57 @@ func (cli *Client) MakeFullRequest(ctx context.Context, params FullRequest) ([]b
 	if params.Logger == nil {
 		params.Logger = &cli.Log
 	}
+	ctx, done, err := cli.trackRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	req, err := params.compileRequest(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if params.Handler == nil {
-		params.Handler = handleNormalResponse
+		if cli.isStrictResponse(params.ResponseJSON) {
+			params.Handler = handleStrictResponse
+		} else {
+			params.Handler = handleNormalResponse
+		}
 	}
 	req.Header.Set("User-Agent", cli.UserAgent)
-	if len(cli.AccessToken) > 0 {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	accessToken := cli.AccessToken
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	body, err := cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, 0, params.ResponseJSON, params.Handler)
+	// Streamed request bodies can't be sent again, so those requests aren't retried after a soft logout
+	if cli.OnSoftLogout != nil && len(accessToken) > 0 && params.RequestBody == nil && isSoftLogout(err) && ctx.Value(softLogoutContextKey) == nil {
+		ctx = context.WithValue(ctx, softLogoutContextKey, true)
+		if softLogoutErr := cli.handleSoftLogout(ctx, accessToken); softLogoutErr == nil {
+			return cli.MakeFullRequest(ctx, params)
+		} else {
+			cli.cliOrContextLog(ctx).Err(softLogoutErr).Msg("Failed to recover from soft logout")
+		}
+	}
+	if cli.OnLogout != nil && errors.Is(err, MUnknownToken) {
+		cli.OnLogout(ctx, err)
 	}
-	return cli.executeCompiledRequest(req, params.MaxAttempts-1, 4*time.Second, params.ResponseJSON, params.Handler)
+	return body, err
+}
+
+func isSoftLogout(err error) bool {
+	var httpErr HTTPError
+	return errors.As(err, &httpErr) && httpErr.RespError != nil && httpErr.RespError.IsSoftLogout()
+}
+
+func (cli *Client) handleSoftLogout(ctx context.Context, usedAccessToken string) error {
+	cli.softLogoutLock.Lock()
+	defer cli.softLogoutLock.Unlock()
+	if cli.AccessToken != usedAccessToken {
+		// Another request already re-authenticated
+		return nil
+	}
+	cli.cliOrContextLog(ctx).Info().Msg("Got soft logout, trying to re-authenticate")
+	return cli.OnSoftLogout(ctx)
 }
 
 func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
@@ -421,8 +627,61 @@ func (cli *Client) cliOrContextLog(ctx context.Context) *zerolog.Logger {
 	return log
 }
 
-func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+func (cli *Client) shouldRetryRateLimit(req *http.Request) bool {
+	ignore, _ := req.Context().Value(IgnoreRateLimitContextKey).(bool)
+	return !cli.IgnoreRateLimit && !ignore
+}
+
+// parseRateLimitBackoff returns how long to wait before retrying a request that was rate limited.
+// The Retry-After header is preferred, then the retry_after_ms field in the response body.
+func parseRateLimitBackoff(res *http.Response, err error, fallback time.Duration) time.Duration {
+	if header := res.Header.Get("Retry-After"); header != "" {
+		return retryafter.Parse(header, fallback)
+	}
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.RespError != nil {
+		if retryAfterMS, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && retryAfterMS >= 0 {
+			return time.Duration(retryAfterMS) * time.Millisecond
+		}
+	}
+	return fallback
+}
+
+// LastRateLimit returns how much is left of the wait time from the most recent rate limit information
+// sent by the homeserver. The information is read from Retry-After headers and retry_after_ms fields of
+// 429 responses, as well as RateLimit-Reset headers of responses with RateLimit-Remaining: 0.
+//
+// If no rate limit is currently in effect, ok is false.
+func (cli *Client) LastRateLimit() (retryAfter time.Duration, ok bool) {
+	cli.rateLimitLock.Lock()
+	retryAfter = time.Until(cli.rateLimitedUntil)
+	cli.rateLimitLock.Unlock()
+	if retryAfter <= 0 {
+		return 0, false
+	}
+	return retryAfter, true
+}
+
+func (cli *Client) updateRateLimit(res *http.Response, err error) {
+	var wait time.Duration
+	if res.StatusCode == http.StatusTooManyRequests {
+		wait = parseRateLimitBackoff(res, err, 0)
+	} else if res.Header.Get("RateLimit-Remaining") == "0" {
+		wait = retryafter.Parse(res.Header.Get("RateLimit-Reset"), 0)
+	}
+	if wait <= 0 {
+		return
+	}
+	cli.rateLimitLock.Lock()
+	cli.rateLimitedUntil = time.Now().Add(wait)
+	cli.rateLimitLock.Unlock()
+}
+
+func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff, waited time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
 	log := zerolog.Ctx(req.Context())
+	if cli.exceedsMaxRetryWait(log, cause, backoff, waited) {
+		return nil, cause
+	}
 	if req.Body != nil {
 		if req.GetBody == nil {
 			log.Warn().Msg("Failed to get new body to retry request: GetBody is nil")
@@ -438,8 +697,24 @@ func (cli *Client) doRetry(req *http.Request, cause error, retries int, backoff
 	log.Warn().Err(cause).
 		Int("retry_in_seconds", int(backoff.Seconds())).
 		Msg("Request failed, retrying")
-	time.Sleep(backoff)
-	return cli.executeCompiledRequest(req, retries-1, backoff*2, responseJSON, handler)
+	select {
+	case <-time.After(backoff):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return cli.executeCompiledRequest(req, retries-1, backoff*2, waited+backoff, responseJSON, handler)
+}
+
+// exceedsMaxRetryWait returns true and logs a warning if waiting for the given backoff would make the total time
+// spent waiting between retries of a request exceed MaxRetryWait.
+func (cli *Client) exceedsMaxRetryWait(log *zerolog.Logger, cause error, backoff, waited time.Duration) bool {
+	if cli.MaxRetryWait <= 0 || waited+backoff <= cli.MaxRetryWait {
+		return false
+	}
+	log.Warn().Err(cause).
+		Int("retry_in_seconds", int(backoff.Seconds())).
+		Msg("Request failed, not retrying as the wait would exceed the maximum")
+	return true
 }
 
 func readRequestBody(req *http.Request, res *http.Response) ([]byte, error) {
@@ -521,7 +796,57 @@ func ParseErrorResponse(req *http.Request, res *http.Response) ([]byte, error) {
 	}
 }
 
-func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
+// isIdempotent returns whether sending the request multiple times has the same effect as sending it once,
+// which means it's safe to retry after network errors or gateway errors, where the server may have already
+// processed the request. Matrix PUT endpoints are either idempotent or include a transaction ID.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cli *Client) isStrictResponse(responseJSON interface{}) bool {
+	if !cli.StrictResponseDecoding || responseJSON == nil {
+		return false
+	} else if len(cli.StrictResponseTypes) == 0 {
+		return true
+	}
+	respType := reflect.TypeOf(responseJSON)
+	for respType.Kind() == reflect.Pointer {
+		respType = respType.Elem()
+	}
+	for _, strictType := range cli.StrictResponseTypes {
+		if strictType == respType {
+			return true
+		}
+	}
+	return false
+}
+
+func handleStrictResponse(req *http.Request, res *http.Response, responseJSON interface{}) ([]byte, error) {
+	contents, err := readRequestBody(req, res)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(responseJSON); err != nil {
+		return nil, HTTPError{
+			Request:  req,
+			Response: res,
+
+			Message:      "failed to strictly unmarshal response body",
+			ResponseBody: string(contents),
+			WrappedError: err,
+		}
+	}
+	return contents, nil
+}
+
+func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backoff, waited time.Duration, responseJSON interface{}, handler ClientResponseHandler) ([]byte, error) {
 	cli.RequestStart(req)
 	startTime := time.Now()
 	res, err := cli.Client.Do(req)
@@ -530,8 +855,9 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		defer res.Body.Close()
 	}
 	if err != nil {
-		if retries > 0 {
-			return cli.doRetry(req, err, retries, backoff, responseJSON, handler)
+		// Don't retry if the request failed because the context was cancelled
+		if retries > 0 && req.Context().Err() == nil && isIdempotent(req) {
+			return cli.doRetry(req, err, retries, backoff, waited, responseJSON, handler)
 		}
 		err = HTTPError{
 			Request:  req,
@@ -544,9 +870,21 @@ func (cli *Client) executeCompiledRequest(req *http.Request, retries int, backof
 		return nil, err
 	}
 
-	if retries > 0 && retryafter.Should(res.StatusCode, !cli.IgnoreRateLimit) {
+	if res.StatusCode == http.StatusTooManyRequests {
+		// Rate limited requests weren't processed by the server, so they're safe to retry regardless of the method.
+		body, err := ParseErrorResponse(req, res)
+		cli.updateRateLimit(res, err)
+		if retries > 0 && cli.shouldRetryRateLimit(req) {
+			backoff = parseRateLimitBackoff(res, err, backoff)
+			return cli.doRetry(req, err, retries, backoff, waited, responseJSON, handler)
+		}
+		cli.LogRequestDone(req, res, err, nil, len(body), duration)
+		return body, err
+	}
+	cli.updateRateLimit(res, nil)
+	if retries > 0 && isIdempotent(req) && retryafter.Should(res.StatusCode, false) {
 		backoff = retryafter.Parse(res.Header.Get("Retry-After"), backoff)
-		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, responseJSON, handler)
+		return cli.doRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, waited, responseJSON, handler)
 	}
 
 	var body []byte
@@ -793,18 +1131,29 @@ func (cli *Client) Login(ctx context.Context, req *ReqLogin) (resp *RespLogin, e
 }
 
 // Logout the current user. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logout
-// This does not clear the credentials from the client instance. See ClearCredentials() instead.
+//
+// The access token is removed from the client instance if the request succeeds, but the user and device IDs are kept.
+// See ClearCredentials() to clear everything.
 func (cli *Client) Logout(ctx context.Context) (resp *RespLogout, err error) {
 	urlPath := cli.BuildClientURL("v3", "logout")
 	_, err = cli.MakeRequest(ctx, "POST", urlPath, nil, &resp)
+	if err == nil {
+		cli.AccessToken = ""
+	}
 	return
 }
 
 // LogoutAll logs out all the devices of the current user. See https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3logoutall
-// This does not clear the credentials from the client instance. See ClearCredentials() instead.
+//
+// Like Logout, the access token is removed from the client instance if the request succeeds.
+// Logging out invalidates the device, so clients using encryption should also clear their crypto store afterwards,
+// as the keys of the old device can't be used anymore.
 func (cli *Client) LogoutAll(ctx context.Context) (resp *RespLogout, err error) {
 	urlPath := cli.BuildClientURL("v3", "logout", "all")
 	_, err = cli.MakeRequest(ctx, "POST", urlPath, nil, &resp)
+	if err == nil {
+		cli.AccessToken = ""
+	}
 	return
 }
 
@@ -860,6 +1209,72 @@ func (cli *Client) GetProfile(ctx context.Context, mxid id.UserID) (resp *RespUs
 	return
 }
 
+// GetProfilesError is returned by GetProfiles if fetching the profiles of some users failed.
+// It maps each failed user ID to the error returned by GetProfile.
+type GetProfilesError map[id.UserID]error
+
+func (gpe GetProfilesError) Error() string {
+	for userID, err := range gpe {
+		if len(gpe) == 1 {
+			return fmt.Sprintf("failed to get profile of %s: %v", userID, err)
+		}
+		return fmt.Sprintf("failed to get %d profiles (e.g. %s: %v)", len(gpe), userID, err)
+	}
+	return "failed to get profiles"
+}
+
+func (gpe GetProfilesError) Unwrap() []error {
+	errs := make([]error, 0, len(gpe))
+	for _, err := range gpe {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// GetProfiles gets the profiles of many users by making up to the given number of concurrent GetProfile requests.
+// The spec doesn't have a batch profile endpoint, so this is only a helper for fetching profiles faster.
+//
+// The returned map contains the profiles that were fetched successfully. If any requests failed, the error is a
+// GetProfilesError containing the error for each failed user, and the successful profiles are still returned.
+func (cli *Client) GetProfiles(ctx context.Context, userIDs []id.UserID, concurrency int) (map[id.UserID]*RespUserProfile, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	profiles := make(map[id.UserID]*RespUserProfile, len(userIDs))
+	errs := make(GetProfilesError)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	seen := make(map[id.UserID]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, alreadySeen := seen[userID]; alreadySeen {
+			continue
+		}
+		seen[userID] = struct{}{}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(userID id.UserID) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			profile, err := cli.GetProfile(ctx, userID)
+			lock.Lock()
+			if err != nil {
+				errs[userID] = err
+			} else {
+				profiles[userID] = profile
+			}
+			lock.Unlock()
+		}(userID)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return profiles, errs
+	}
+	return profiles, nil
+}
+
 // GetDisplayName returns the display name of the user with the specified MXID. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3profileuseriddisplayname
 func (cli *Client) GetDisplayName(ctx context.Context, mxid id.UserID) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildClientURL("v3", "profile", mxid, "displayname")
@@ -948,6 +1363,19 @@ func (cli *Client) GetRoomAccountData(ctx context.Context, roomID id.RoomID, nam
 	return
 }
 
+// GetFullyReadMarker gets the event ID of the user's m.fully_read marker in the given room.
+// If the user doesn't have a marker in the room, an empty event ID is returned.
+func (cli *Client) GetFullyReadMarker(ctx context.Context, roomID id.RoomID) (id.EventID, error) {
+	var content event.FullyReadEventContent
+	err := cli.GetRoomAccountData(ctx, roomID, event.AccountDataFullyRead.Type, &content)
+	if errors.Is(err, MNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return content.EventID, nil
+}
+
 // SetRoomAccountData sets the user's account data of this type in a specific room. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3useruseridroomsroomidaccount_datatype
 func (cli *Client) SetRoomAccountData(ctx context.Context, roomID id.RoomID, name string, data interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "user", cli.UserID, "rooms", roomID, "account_data", name)
@@ -959,7 +1387,14 @@ func (cli *Client) SetRoomAccountData(ctx context.Context, roomID id.RoomID, nam
 	return nil
 }
 
+// ErrTimestampRequiresAppService is returned when trying to send an event with a custom timestamp
+// using a client that isn't authenticated as an appservice user.
+var ErrTimestampRequiresAppService = errors.New("custom timestamps can only be used by appservices")
+
 type ReqSendEvent struct {
+	// Timestamp is a custom origin_server_ts for the event in unix milliseconds, passed as the ts query parameter.
+	// It's only supported for appservice clients (SetAppServiceUserID = true) and is meant for bridging
+	// messages with their original timestamp.
 	Timestamp     int64
 	TransactionID string
 
@@ -985,12 +1420,23 @@ func (cli *Client) SendMessageEvent(ctx context.Context, roomID id.RoomID, event
 
 	queryParams := map[string]string{}
 	if req.Timestamp > 0 {
+		if !cli.SetAppServiceUserID {
+			err = ErrTimestampRequiresAppService
+			return
+		}
 		queryParams["ts"] = strconv.FormatInt(req.Timestamp, 10)
 	}
 	if req.MeowEventID != "" {
 		queryParams["fi.mau.event_id"] = req.MeowEventID.String()
 	}
 
+	var sendDone func()
+	sendDone, err = cli.waitRoomSendTurn(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer sendDone()
+
 	if !req.DontEncrypt && cli.Crypto != nil && eventType != event.EventReaction && eventType != event.EventEncrypted && cli.StateStore.IsEncrypted(roomID) {
 		contentJSON, err = cli.Crypto.Encrypt(roomID, eventType, contentJSON)
 		if err != nil {
@@ -1002,6 +1448,8 @@ func (cli *Client) SendMessageEvent(ctx context.Context, roomID id.RoomID, event
 
 	urlData := ClientURLPath{"v3", "rooms", roomID, "send", eventType.String(), txnID}
 	urlPath := cli.BuildURLWithQuery(urlData, queryParams)
+	// Remember the transaction ID before sending, as the echo may come down /sync before the request returns.
+	cli.sentTxnIDs.add(txnID)
 	_, err = cli.MakeRequest(ctx, "PUT", urlPath, contentJSON, &resp)
 	return
 }
@@ -1010,6 +1458,12 @@ func (cli *Client) SendMessageEvent(ctx context.Context, roomID id.RoomID, event
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "state", eventType.String(), stateKey)
+	var sendDone func()
+	sendDone, err = cli.waitRoomSendTurn(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer sendDone()
 	_, err = cli.MakeRequest(ctx, "PUT", urlPath, contentJSON, &resp)
 	if err == nil && cli.StateStore != nil {
 		cli.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON)
@@ -1019,10 +1473,22 @@ func (cli *Client) SendStateEvent(ctx context.Context, roomID id.RoomID, eventTy
 
 // SendMassagedStateEvent sends a state event into a room with a custom timestamp. See https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3roomsroomidstateeventtypestatekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
+//
+// Custom timestamps are only supported for appservice clients, ErrTimestampRequiresAppService is returned for other clients.
 func (cli *Client) SendMassagedStateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, contentJSON interface{}, ts int64) (resp *RespSendEvent, err error) {
+	if !cli.SetAppServiceUserID {
+		err = ErrTimestampRequiresAppService
+		return
+	}
 	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "state", eventType.String(), stateKey}, map[string]string{
 		"ts": strconv.FormatInt(ts, 10),
 	})
+	var sendDone func()
+	sendDone, err = cli.waitRoomSendTurn(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer sendDone()
 	_, err = cli.MakeRequest(ctx, "PUT", urlPath, contentJSON, &resp)
 	if err == nil && cli.StateStore != nil {
 		cli.updateStoreWithOutgoingEvent(roomID, eventType, stateKey, contentJSON)
@@ -1048,7 +1514,14 @@ func (cli *Client) SendNotice(ctx context.Context, roomID id.RoomID, text string
 	})
 }
 
+// SendReaction sends an m.reaction event annotating the given event with the given key.
+//
+// The reaction key is normalized with event.NormalizeReactionKey, and an error is returned if it's invalid.
 func (cli *Client) SendReaction(ctx context.Context, roomID id.RoomID, eventID id.EventID, reaction string) (*RespSendEvent, error) {
+	reaction, err := event.NormalizeReactionKey(reaction)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reaction key: %w", err)
+	}
 	return cli.SendMessageEvent(ctx, roomID, event.EventReaction, &event.ReactionEventContent{
 		RelatesTo: event.RelatesTo{
 			EventID: eventID,
@@ -1077,6 +1550,13 @@ func (cli *Client) RedactEvent(ctx context.Context, roomID id.RoomID, eventID id
 		txnID = cli.TxnID()
 	}
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "redact", eventID, txnID)
+	var sendDone func()
+	sendDone, err = cli.waitRoomSendTurn(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer sendDone()
+	cli.sentTxnIDs.add(txnID)
 	_, err = cli.MakeRequest(ctx, "PUT", urlPath, req.Extra, &resp)
 	return
 }
@@ -1243,6 +1723,9 @@ func (cli *Client) updateStoreWithOutgoingEvent(roomID id.RoomID, eventType even
 // StateEvent gets a single state event in a room. It will attempt to JSON unmarshal into the given "outContent" struct with
 // the HTTP response body, or return an error.
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidstateeventtypestatekey
+//
+// If the room doesn't have a state event with the given type and state key, the returned error will match MNotFound
+// (use errors.Is to check).
 func (cli *Client) StateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) (err error) {
 	u := cli.BuildClientURL("v3", "rooms", roomID, "state", eventType.String(), stateKey)
 	_, err = cli.MakeRequest(ctx, "GET", u, nil, outContent)
@@ -1320,6 +1803,12 @@ func (cli *Client) GetMediaConfig(ctx context.Context) (resp *RespMediaConfig, e
 
 // UploadLink uploads an HTTP URL and then returns an MXC URI.
 func (cli *Client) UploadLink(ctx context.Context, link string) (*RespMediaUpload, error) {
+	// The download is in progress until the upload has read the whole body
+	ctx, done, err := cli.trackRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
 	if err != nil {
 		return nil, err
@@ -1339,16 +1828,47 @@ func (cli *Client) GetDownloadURL(mxcURL id.ContentURI) string {
 	return cli.BuildURLWithQuery(MediaURLPath{"v3", "download", mxcURL.Homeserver, mxcURL.FileID}, map[string]string{"allow_redirect": "true"})
 }
 
+// Download streams the media with the given content URI from the content repository.
+// The caller is responsible for closing the returned reader.
+//
+// Non-2xx responses are returned as HTTPErrors before any data is read. If the connection
+// fails while reading the body, the read error is also wrapped in an HTTPError.
 func (cli *Client) Download(ctx context.Context, mxcURL id.ContentURI) (io.ReadCloser, error) {
 	resp, err := cli.download(ctx, mxcURL)
 	if err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
+	return &mediaBodyReader{res: resp}, nil
 }
 
-func (cli *Client) doMediaRetry(req *http.Request, cause error, retries int, backoff time.Duration) (*http.Response, error) {
+// mediaBodyReader wraps read errors of a media response body in HTTPErrors.
+type mediaBodyReader struct {
+	res *http.Response
+}
+
+func (mbr *mediaBodyReader) Read(p []byte) (n int, err error) {
+	n, err = mbr.res.Body.Read(p)
+	if err != nil && err != io.EOF {
+		err = HTTPError{
+			Request:  mbr.res.Request,
+			Response: mbr.res,
+
+			Message:      "failed to read response body",
+			WrappedError: err,
+		}
+	}
+	return
+}
+
+func (mbr *mediaBodyReader) Close() error {
+	return mbr.res.Body.Close()
+}
+
+func (cli *Client) doMediaRetry(req *http.Request, cause error, retries int, backoff, waited time.Duration) (*http.Response, error) {
 	log := zerolog.Ctx(req.Context())
+	if cli.exceedsMaxRetryWait(log, cause, backoff, waited) {
+		return nil, cause
+	}
 	if req.Body != nil {
 		if req.GetBody == nil {
 			log.Warn().Msg("Failed to get new body to retry request: GetBody is nil")
@@ -1364,18 +1884,22 @@ func (cli *Client) doMediaRetry(req *http.Request, cause error, retries int, bac
 	log.Warn().Err(cause).
 		Int("retry_in_seconds", int(backoff.Seconds())).
 		Msg("Request failed, retrying")
-	time.Sleep(backoff)
-	return cli.doMediaRequest(req, retries-1, backoff*2)
+	select {
+	case <-time.After(backoff):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return cli.doMediaRequest(req, retries-1, backoff*2, waited+backoff)
 }
 
-func (cli *Client) doMediaRequest(req *http.Request, retries int, backoff time.Duration) (*http.Response, error) {
+func (cli *Client) doMediaRequest(req *http.Request, retries int, backoff, waited time.Duration) (*http.Response, error) {
 	cli.RequestStart(req)
 	startTime := time.Now()
 	res, err := cli.Client.Do(req)
 	duration := time.Now().Sub(startTime)
 	if err != nil {
-		if retries > 0 {
-			return cli.doMediaRetry(req, err, retries, backoff)
+		if retries > 0 && req.Context().Err() == nil {
+			return cli.doMediaRetry(req, err, retries, backoff, waited)
 		}
 		err = HTTPError{
 			Request:  req,
@@ -1388,9 +1912,10 @@ func (cli *Client) doMediaRequest(req *http.Request, retries int, backoff time.D
 		return nil, err
 	}
 
-	if retries > 0 && retryafter.Should(res.StatusCode, !cli.IgnoreRateLimit) {
+	cli.updateRateLimit(res, nil)
+	if retries > 0 && retryafter.Should(res.StatusCode, cli.shouldRetryRateLimit(req)) {
 		backoff = retryafter.Parse(res.Header.Get("Retry-After"), backoff)
-		return cli.doMediaRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff)
+		return cli.doMediaRetry(req, fmt.Errorf("HTTP %d", res.StatusCode), retries, backoff, waited)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
@@ -1408,12 +1933,35 @@ func (cli *Client) download(ctx context.Context, mxcURL id.ContentURI) (*http.Re
 	if ctxLog.GetLevel() == zerolog.Disabled || ctxLog == zerolog.DefaultContextLogger {
 		ctx = cli.Log.WithContext(ctx)
 	}
+	ctx, done, err := cli.trackRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cli.GetDownloadURL(mxcURL), nil)
 	if err != nil {
+		done()
 		return nil, err
 	}
 	req.Header.Set("User-Agent", cli.UserAgent+" (media downloader)")
-	return cli.doMediaRequest(req, cli.DefaultHTTPRetries, 4*time.Second)
+	resp, err := cli.doMediaRequest(req, cli.DefaultHTTPRetries, 4*time.Second, 0)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	// The request is only done after the body has been read
+	resp.Body = &doneCallbackBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+type doneCallbackBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (body *doneCallbackBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.done()
+	return err
 }
 
 func (cli *Client) DownloadBytes(ctx context.Context, mxcURL id.ContentURI) ([]byte, error) {
@@ -1422,7 +1970,7 @@ func (cli *Client) DownloadBytes(ctx context.Context, mxcURL id.ContentURI) ([]b
 		return nil, err
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	return readRequestBody(resp.Request, resp)
 }
 
 // CreateMXC creates a blank Matrix content URI to allow uploading the content asynchronously later.
@@ -1484,8 +2032,12 @@ func (cli *Client) Upload(ctx context.Context, content io.Reader, contentType st
 }
 
 type ReqUploadMedia struct {
-	ContentBytes  []byte
-	Content       io.Reader
+	ContentBytes []byte
+	// Content is streamed to the server as-is instead of being read into memory.
+	// Requests with a reader can't be retried, as the data can't be rewound.
+	Content io.Reader
+	// ContentLength is the length of Content. If it's not set, the body is sent using chunked transfer encoding,
+	// which some servers and proxies don't support.
 	ContentLength int64
 	ContentType   string
 	FileName      string
@@ -1501,6 +2053,11 @@ type ReqUploadMedia struct {
 
 func (cli *Client) tryUploadMediaToURL(ctx context.Context, url, contentType string, content io.Reader) (*http.Response, error) {
 	cli.Log.Debug().Str("url", url).Msg("Uploading media to external URL")
+	ctx, done, err := cli.trackRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, content)
 	if err != nil {
 		return nil, err
@@ -1508,7 +2065,12 @@ func (cli *Client) tryUploadMediaToURL(ctx context.Context, url, contentType str
 	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("User-Agent", cli.UserAgent+" (external media uploader)")
 
-	return http.DefaultClient.Do(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		// Only the status code is used
+		_ = resp.Body.Close()
+	}
+	return resp, err
 }
 
 func (cli *Client) uploadMediaToURL(ctx context.Context, data ReqUploadMedia) (*RespMediaUpload, error) {
@@ -1633,6 +2195,11 @@ func (cli *Client) JoinedMembers(ctx context.Context, roomID id.RoomID) (resp *R
 	return
 }
 
+// Members returns the member state events of a room. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidmembers
+//
+// The optional request parameter can be used to fetch the members at a specific point in history (At), or to only
+// return members with (Membership) or without (NotMembership) a specific membership, e.g. to list only banned users.
+// The state store is only updated with the returned events if no parameters are set.
 func (cli *Client) Members(ctx context.Context, roomID id.RoomID, req ...ReqMembers) (resp *RespMembers, err error) {
 	var extra ReqMembers
 	if len(req) > 0 {
@@ -1650,14 +2217,16 @@ func (cli *Client) Members(ctx context.Context, roomID id.RoomID, req ...ReqMemb
 	}
 	u := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "members"}, query)
 	_, err = cli.MakeRequest(ctx, "GET", u, nil, &resp)
-	if err == nil && cli.StateStore != nil {
-		var clearMemberships []event.Membership
-		if extra.Membership != "" {
-			clearMemberships = append(clearMemberships, extra.Membership)
-		}
-		if extra.NotMembership == "" {
-			cli.StateStore.ClearCachedMembers(roomID, clearMemberships...)
-		}
+	if err != nil {
+		return
+	}
+	for _, evt := range resp.Chunk {
+		evt.Type.Class = event.StateEventType
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	// Historical or filtered member lists aren't the full current state, so they must not replace the cached members
+	if cli.StateStore != nil && extra == (ReqMembers{}) {
+		cli.StateStore.ClearCachedMembers(roomID)
 		for _, evt := range resp.Chunk {
 			UpdateStateStore(cli.StateStore, evt)
 		}
@@ -1665,6 +2234,62 @@ func (cli *Client) Members(ctx context.Context, roomID id.RoomID, req ...ReqMemb
 	return
 }
 
+// IsDirectRoom checks whether the given room is a direct chat and returns the other user in the room if it is.
+//
+// The room is first looked up from the m.direct account data. If it's not listed there, the room is considered
+// a direct chat if it has exactly two joined or invited members including the own user, and one of their membership events
+// (or the previous content of one) has is_direct set, like the invite sent when creating a DM.
+func (cli *Client) IsDirectRoom(ctx context.Context, roomID id.RoomID) (bool, id.UserID, error) {
+	var directChats event.DirectChatsEventContent
+	err := cli.GetAccountData(ctx, event.AccountDataDirectChats.Type, &directChats)
+	if err != nil && !errors.Is(err, MNotFound) {
+		return false, "", fmt.Errorf("failed to get m.direct account data: %w", err)
+	}
+	for userID, rooms := range directChats {
+		for _, directRoomID := range rooms {
+			if directRoomID == roomID {
+				return true, userID, nil
+			}
+		}
+	}
+
+	members, err := cli.Members(ctx, roomID)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get room members: %w", err)
+	}
+	var otherUser id.UserID
+	memberCount := 0
+	isDirect := false
+	ownUserIsMember := false
+	for _, evt := range members.Chunk {
+		if evt.Content.Parsed == nil {
+			_ = evt.Content.ParseRaw(event.StateMember)
+		}
+		content := evt.Content.AsMember()
+		if !content.Membership.IsInviteOrJoin() {
+			continue
+		}
+		memberCount++
+		if evt.GetStateKey() == cli.UserID.String() {
+			ownUserIsMember = true
+		} else {
+			otherUser = id.UserID(evt.GetStateKey())
+		}
+		if content.IsDirect {
+			isDirect = true
+		} else if prevContent := evt.Unsigned.PrevContent; prevContent != nil {
+			if prevContent.Parsed == nil {
+				_ = prevContent.ParseRaw(event.StateMember)
+			}
+			isDirect = isDirect || prevContent.AsMember().IsDirect
+		}
+	}
+	if memberCount == 2 && ownUserIsMember && otherUser != "" && isDirect {
+		return true, otherUser, nil
+	}
+	return false, "", nil
+}
+
 // JoinedRooms returns a list of rooms which the client is joined to. See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3joined_rooms
 //
 // In general, usage of this API is discouraged in favour of /sync, as calling this API can race with incoming membership changes.
@@ -1687,6 +2312,79 @@ func (cli *Client) Hierarchy(ctx context.Context, roomID id.RoomID, req *ReqHier
 	return
 }
 
+// GetRelations returns a page of events that relate to the given event.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+func (cli *Client) GetRelations(ctx context.Context, roomID id.RoomID, eventID id.EventID, req *ReqGetRelations) (resp *RespGetRelations, err error) {
+	urlPath := cli.BuildURLWithQuery(append(ClientURLPath{"v1", "rooms", roomID, "relations", eventID}, req.PathSuffix()...), req.Query())
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetThread fetches the given thread root and all of its replies in chronological order.
+//
+// Edits of messages in the thread are resolved using the replacement event bundled by the server
+// (or any m.replace events returned alongside the replies): the content of an edited event is
+// replaced with the m.new_content of its latest edit, and the edit events themselves are omitted.
+func (cli *Client) GetThread(ctx context.Context, roomID id.RoomID, threadRoot id.EventID) ([]*event.Event, error) {
+	root, err := cli.GetEvent(ctx, roomID, threadRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread root: %w", err)
+	}
+	thread := []*event.Event{root}
+	req := &ReqGetRelations{RelationType: event.RelThread, Dir: DirectionForward}
+	for {
+		resp, err := cli.GetRelations(ctx, roomID, threadRoot, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get thread replies: %w", err)
+		}
+		thread = append(thread, resp.Chunk...)
+		if resp.NextBatch == "" || resp.NextBatch == req.From {
+			break
+		}
+		req.From = resp.NextBatch
+	}
+	return resolveThreadEdits(thread), nil
+}
+
+func resolveThreadEdits(evts []*event.Event) []*event.Event {
+	byID := make(map[id.EventID]*event.Event, len(evts))
+	latestEdit := make(map[id.EventID]*event.Event)
+	output := evts[:0]
+	for _, evt := range evts {
+		if evt.Unsigned.Relations != nil && evt.Unsigned.Relations.Replacement != nil {
+			latestEdit[evt.ID] = evt.Unsigned.Relations.Replacement
+		}
+		_ = evt.Content.ParseRaw(evt.Type)
+		if content, ok := evt.Content.Parsed.(*event.MessageEventContent); ok {
+			if replaces := content.RelatesTo.GetReplaceID(); replaces != "" {
+				if prev, ok := latestEdit[replaces]; !ok || prev.Timestamp <= evt.Timestamp {
+					latestEdit[replaces] = evt
+				}
+				continue
+			}
+		}
+		byID[evt.ID] = evt
+		output = append(output, evt)
+	}
+	for targetID, edit := range latestEdit {
+		target, ok := byID[targetID]
+		if !ok || edit.Sender != target.Sender {
+			continue
+		}
+		_ = edit.Content.ParseRaw(edit.Type)
+		editContent, ok := edit.Content.Parsed.(*event.MessageEventContent)
+		if !ok || editContent.NewContent == nil {
+			continue
+		}
+		newContent := *editContent.NewContent
+		if origContent, ok := target.Content.Parsed.(*event.MessageEventContent); ok {
+			newContent.RelatesTo = origContent.RelatesTo
+		}
+		target.Content = event.Content{Parsed: &newContent}
+	}
+	return output
+}
+
 // Messages returns a list of message and state events for a room. It uses
 // pagination query parameters to paginate history in the room.
 // See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidmessages
@@ -1711,6 +2409,9 @@ func (cli *Client) Messages(ctx context.Context, roomID id.RoomID, from, to stri
 
 	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "messages"}, query)
 	_, err = cli.MakeRequest(ctx, "GET", urlPath, nil, &resp)
+	if err == nil && resp != nil {
+		cli.decryptHistory(roomID, resp.Chunk)
+	}
 	return
 }
 
@@ -1746,16 +2447,79 @@ func (cli *Client) Context(ctx context.Context, roomID id.RoomID, eventID id.Eve
 
 	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "rooms", roomID, "context", eventID}, query)
 	_, err = cli.MakeRequest(ctx, "GET", urlPath, nil, &resp)
+	if err == nil && resp != nil {
+		resp.Event = cli.decryptHistoryEvent(roomID, resp.Event)
+		cli.decryptHistory(roomID, resp.EventsBefore)
+		cli.decryptHistory(roomID, resp.EventsAfter)
+	}
 	return
 }
 
+// decryptHistory replaces encrypted events in the given list with their decrypted versions if DecryptHistory is enabled.
+func (cli *Client) decryptHistory(roomID id.RoomID, events []*event.Event) {
+	for i, evt := range events {
+		events[i] = cli.decryptHistoryEvent(roomID, evt)
+	}
+}
+
+// decryptHistoryEvent returns the decrypted version of the given event if it's encrypted and DecryptHistory is enabled.
+// If decryption fails, the encrypted event is returned with the error stored in Mautrix.DecryptionError.
+func (cli *Client) decryptHistoryEvent(roomID id.RoomID, evt *event.Event) *event.Event {
+	if !cli.DecryptHistory || cli.Crypto == nil || evt == nil || evt.Type != event.EventEncrypted {
+		return evt
+	}
+	if evt.RoomID == "" {
+		evt.RoomID = roomID
+	}
+	evt.Type.Class = event.MessageEventType
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		evt.Mautrix.DecryptionError = err
+		return evt
+	}
+	decrypted, err := cli.Crypto.Decrypt(evt)
+	if err != nil {
+		cli.Log.Debug().Err(err).
+			Str("room_id", roomID.String()).
+			Str("event_id", evt.ID.String()).
+			Msg("Failed to decrypt event from history")
+		evt.Mautrix.DecryptionError = err
+		return evt
+	}
+	return decrypted
+}
+
+// GetEvent fetches a single event by its ID.
+//
+// The content is parsed if the event type is known, and any aggregations bundled by the server
+// (like the latest edit) are available in Unsigned.Relations.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3roomsroomideventeventid
 func (cli *Client) GetEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (resp *event.Event, err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "event", eventID)
 	_, err = cli.MakeRequest(ctx, "GET", urlPath, nil, &resp)
+	if err == nil && resp != nil {
+		if resp.RoomID == "" {
+			resp.RoomID = roomID
+		}
+		if resp.StateKey != nil {
+			resp.Type.Class = event.StateEventType
+		} else {
+			resp.Type.Class = event.MessageEventType
+		}
+		_ = resp.Content.ParseRaw(resp.Type)
+	}
 	return
 }
 
+// MarkRead sends a read receipt for the given event.
+// If ReadMarkerDebounce is set, the request may be delayed and only the latest event ID for the room is sent.
 func (cli *Client) MarkRead(ctx context.Context, roomID id.RoomID, eventID id.EventID) (err error) {
+	if cli.ReadMarkerDebounce > 0 {
+		cli.debounceReadMarker(readMarkerKey{roomID: roomID, receipt: true}, func(ctx context.Context) error {
+			return cli.SendReceipt(ctx, roomID, eventID, event.ReceiptTypeRead, nil)
+		})
+		return nil
+	}
 	return cli.SendReceipt(ctx, roomID, eventID, event.ReceiptTypeRead, nil)
 }
 
@@ -1776,7 +2540,20 @@ func (cli *Client) SendReceipt(ctx context.Context, roomID id.RoomID, eventID id
 	return
 }
 
+// SetReadMarkers updates the read receipt and fully read marker of the user in the given room.
+// If ReadMarkerDebounce is set, the request may be delayed and only the latest content for the room is sent.
+// See https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3roomsroomidread_markers
 func (cli *Client) SetReadMarkers(ctx context.Context, roomID id.RoomID, content interface{}) (err error) {
+	if cli.ReadMarkerDebounce > 0 {
+		cli.debounceReadMarker(readMarkerKey{roomID: roomID}, func(ctx context.Context) error {
+			return cli.setReadMarkers(ctx, roomID, content)
+		})
+		return nil
+	}
+	return cli.setReadMarkers(ctx, roomID, content)
+}
+
+func (cli *Client) setReadMarkers(ctx context.Context, roomID id.RoomID, content interface{}) (err error) {
 	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "read_markers")
 	_, err = cli.MakeRequest(ctx, "POST", urlPath, content, nil)
 	return
@@ -1917,6 +2694,83 @@ func (cli *Client) DeleteDevices(ctx context.Context, req *ReqDeleteDevices) err
 
 type UIACallback = func(*RespUserInteractive) interface{}
 
+// UIARequiredError is returned by methods that support user-interactive authentication if the server requires
+// (additional) authentication, but the callback wasn't provided or returned nil.
+type UIARequiredError struct {
+	Response *RespUserInteractive
+}
+
+func (e UIARequiredError) Error() string {
+	if e.Response != nil && e.Response.Error != "" {
+		return fmt.Sprintf("user-interactive authentication required: %s", e.Response.Error)
+	}
+	return "user-interactive authentication required"
+}
+
+// maxUIAAttempts is the maximum number of times makeUIARequest sends a request, which limits how many stages
+// of user-interactive authentication can be completed.
+const maxUIAAttempts = 10
+
+// makeUIARequest makes a request to an endpoint that supports user-interactive authentication.
+// If the server responds with a UIA response, the callback is called and the request is retried
+// with the returned auth data stored in authField.
+//
+// If the server rejects the provided auth data with an error code, e.g. because the password was wrong,
+// the error is returned instead of calling the callback again.
+func (cli *Client) makeUIARequest(ctx context.Context, method, url string, reqJSON any, authField *any, respJSON any, uiaCallback UIACallback) error {
+	for attempt := 1; ; attempt++ {
+		content, err := cli.MakeFullRequest(ctx, FullRequest{
+			Method:           method,
+			URL:              url,
+			RequestJSON:      reqJSON,
+			ResponseJSON:     respJSON,
+			SensitiveContent: *authField != nil,
+		})
+		var httpErr HTTPError
+		if !errors.As(err, &httpErr) || !httpErr.IsStatus(http.StatusUnauthorized) {
+			return err
+		}
+		var uiAuthResp RespUserInteractive
+		if json.Unmarshal(content, &uiAuthResp) != nil || len(uiAuthResp.Flows) == 0 {
+			return err
+		} else if *authField != nil && uiAuthResp.ErrCode != "" {
+			return err
+		} else if attempt >= maxUIAAttempts {
+			return fmt.Errorf("user-interactive authentication not completed after %d attempts: %w", attempt, err)
+		}
+		var auth any
+		if uiaCallback != nil {
+			auth = uiaCallback(&uiAuthResp)
+		}
+		if auth == nil {
+			return UIARequiredError{Response: &uiAuthResp}
+		}
+		*authField = auth
+	}
+}
+
+// ChangePassword changes the password of the current user. See https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3accountpassword
+//
+// The endpoint requires user-interactive authentication, see DeactivateAccount for how the callback is used.
+// If LogoutDevices is true, all other devices of the user are logged out. The access token of this client
+// remains valid, so logging in again isn't necessary.
+func (cli *Client) ChangePassword(ctx context.Context, req *ReqChangePassword, uiaCallback UIACallback) error {
+	return cli.makeUIARequest(ctx, http.MethodPost, cli.BuildClientURL("v3", "account", "password"), req, &req.Auth, nil, uiaCallback)
+}
+
+// DeactivateAccount deactivates the current user's account. See https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3accountdeactivate
+//
+// The endpoint requires user-interactive authentication, so a callback must be provided that produces the auth data
+// for the given UIA parameters. If the callback is nil or returns nil, a UIARequiredError is returned.
+// The credentials of the client are cleared if the deactivation succeeds.
+func (cli *Client) DeactivateAccount(ctx context.Context, req *ReqDeactivateAccount, uiaCallback UIACallback) (resp *RespDeactivateAccount, err error) {
+	err = cli.makeUIARequest(ctx, http.MethodPost, cli.BuildClientURL("v3", "account", "deactivate"), req, &req.Auth, &resp, uiaCallback)
+	if err == nil {
+		cli.ClearCredentials()
+	}
+	return
+}
+
 // UploadCrossSigningKeys uploads the given cross-signing keys to the server.
 // Because the endpoint requires user-interactive authentication a callback must be provided that,
 // given the UI auth parameters, produces the required result (or nil to end the flow).
@@ -1948,6 +2802,106 @@ func (cli *Client) UploadSignatures(ctx context.Context, req *ReqUploadSignature
 	return
 }
 
+// CreateKeyBackupVersion creates a new server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3room_keysversion
+func (cli *Client) CreateKeyBackupVersion(ctx context.Context, req *ReqRoomKeysVersionCreate) (resp *RespRoomKeysVersionCreate, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
+// GetKeyBackupLatestVersion gets information about the latest server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3room_keysversion
+func (cli *Client) GetKeyBackupLatestVersion(ctx context.Context) (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version")
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupVersion gets information about the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3room_keysversionversion
+func (cli *Client) GetKeyBackupVersion(ctx context.Context, version string) (resp *RespRoomKeysVersion, err error) {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version", version)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// UpdateKeyBackupVersion updates the auth data of the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#put_matrixclientv3room_keysversionversion
+func (cli *Client) UpdateKeyBackupVersion(ctx context.Context, version string, req *ReqRoomKeysVersionUpdate) error {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version", version)
+	_, err := cli.MakeRequest(ctx, http.MethodPut, urlPath, req, nil)
+	return err
+}
+
+// DeleteKeyBackupVersion deletes the given server-side key backup version and all keys stored in it.
+// See https://spec.matrix.org/v1.8/client-server-api/#delete_matrixclientv3room_keysversionversion
+func (cli *Client) DeleteKeyBackupVersion(ctx context.Context, version string) error {
+	urlPath := cli.BuildClientURL("v3", "room_keys", "version", version)
+	_, err := cli.MakeRequest(ctx, http.MethodDelete, urlPath, nil, nil)
+	return err
+}
+
+// GetKeyBackup gets all keys stored in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3room_keyskeys
+func (cli *Client) GetKeyBackup(ctx context.Context, version string) (resp *RespRoomKeys, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// PutKeysInBackup stores keys in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#put_matrixclientv3room_keyskeys
+func (cli *Client) PutKeysInBackup(ctx context.Context, version string, req *ReqRoomKeysUpdate) (resp *RespRoomKeysUpdate, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, req, &resp)
+	return
+}
+
+// DeleteKeyBackup deletes all keys stored in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#delete_matrixclientv3room_keyskeys
+func (cli *Client) DeleteKeyBackup(ctx context.Context, version string) (resp *RespRoomKeysUpdate, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys"}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodDelete, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupForRoom gets the keys of the given room stored in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3room_keyskeysroomid
+func (cli *Client) GetKeyBackupForRoom(ctx context.Context, version string, roomID id.RoomID) (resp *RespRoomKeysRoom, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys", roomID}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// GetKeyBackupForRoomAndSession gets a single key stored in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv3room_keyskeysroomidsessionid
+func (cli *Client) GetKeyBackupForRoomAndSession(ctx context.Context, version string, roomID id.RoomID, sessionID id.SessionID) (resp *RespRoomKeysSession, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys", roomID, sessionID}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// PutKeysInBackupForRoomAndSession stores a single key in the given server-side key backup version.
+// See https://spec.matrix.org/v1.8/client-server-api/#put_matrixclientv3room_keyskeysroomidsessionid
+func (cli *Client) PutKeysInBackupForRoomAndSession(ctx context.Context, version string, roomID id.RoomID, sessionID id.SessionID, req *ReqRoomKeysSessionUpdate) (resp *RespRoomKeysUpdate, err error) {
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v3", "room_keys", "keys", roomID, sessionID}, map[string]string{
+		"version": version,
+	})
+	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, req, &resp)
+	return
+}
+
 // GetPushRules returns the push notification rules for the global scope.
 func (cli *Client) GetPushRules(ctx context.Context) (*pushrules.PushRuleset, error) {
 	return cli.GetScopedPushRules(ctx, "global")
@@ -1990,10 +2944,26 @@ func (cli *Client) PutPushRule(ctx context.Context, scope string, kind pushrules
 	return err
 }
 
+// EnsureIncreasingTimestamps modifies the timestamps of the given events in-place so that they're strictly increasing,
+// which ensures that events with identical timestamps are sorted in the same order as they are in the slice.
+// Events whose timestamp isn't greater than the previous event's are moved to 1 millisecond after the previous event.
+func EnsureIncreasingTimestamps(events []*event.Event) {
+	var prevTS int64
+	for i, evt := range events {
+		if i > 0 && evt.Timestamp <= prevTS {
+			evt.Timestamp = prevTS + 1
+		}
+		prevTS = evt.Timestamp
+	}
+}
+
 // BatchSend sends a batch of historical events into a room. This is only available for appservices.
 //
 // Deprecated: MSC2716 has been abandoned, so this is now Beeper-specific. BeeperBatchSend should be used instead.
 func (cli *Client) BatchSend(ctx context.Context, roomID id.RoomID, req *ReqBatchSend) (resp *RespBatchSend, err error) {
+	if req.EnsureIncreasingTimestamps {
+		EnsureIncreasingTimestamps(req.Events)
+	}
 	path := ClientURLPath{"unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"}
 	query := map[string]string{
 		"prev_event_id": req.PrevEventID.String(),
@@ -2024,6 +2994,9 @@ func (cli *Client) AppservicePing(ctx context.Context, id, txnID string) (resp *
 }
 
 func (cli *Client) BeeperBatchSend(ctx context.Context, roomID id.RoomID, req *ReqBeeperBatchSend) (resp *RespBeeperBatchSend, err error) {
+	if req.EnsureIncreasingTimestamps {
+		EnsureIncreasingTimestamps(req.Events)
+	}
 	u := cli.BuildClientURL("unstable", "com.beeper.backfill", "rooms", roomID, "batch_send")
 	_, err = cli.MakeRequest(ctx, http.MethodPost, u, req, &resp)
 	return
@@ -0,0 +1,933 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// newHangingTestServer returns a server that never responds to /sync and media requests until the request is cancelled.
+func newHangingTestServer(t *testing.T) *mautrix.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/user/@user:example.com/filter" {
+			_, _ = w.Write([]byte(`{"filter_id": "1"}`))
+			return
+		}
+		// The request context is only cancelled on disconnect after the body has been read
+		_, _ = io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 3
+	return cli
+}
+
+func runSync(cli *mautrix.Client, ctx context.Context) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- cli.SyncWithContext(ctx)
+	}()
+	return result
+}
+
+func waitForResult(t *testing.T, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for request to return")
+		return nil
+	}
+}
+
+func TestClient_SyncWithContext_Cancel(t *testing.T) {
+	cli := newHangingTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := runSync(cli, ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	err := waitForResult(t, result)
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+}
+
+func TestClient_StopSync(t *testing.T) {
+	cli := newHangingTestServer(t)
+	result := runSync(cli, context.Background())
+	time.Sleep(50 * time.Millisecond)
+	cli.StopSync()
+	assert.NoError(t, waitForResult(t, result))
+}
+
+func TestClient_Download_Cancel(t *testing.T) {
+	cli := newHangingTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := cli.DownloadBytes(ctx, id.ContentURI{Homeserver: "example.com", FileID: "file"})
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	err := waitForResult(t, result)
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+}
+
+// newRateLimitTestServer returns a client for a server that responds to the first rateLimitedRequests requests
+// with M_LIMIT_EXCEEDED and the given body, and with an empty object afterwards.
+func newRateLimitTestServer(t *testing.T, rateLimitedRequests int32, body string) (*mautrix.Client, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= rateLimitedRequests {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 2
+	return cli, &requests
+}
+
+func TestClient_RateLimitRetry(t *testing.T) {
+	cli, requests := newRateLimitTestServer(t, 2, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`)
+	_, err := cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(requests))
+}
+
+func TestClient_RateLimitRetry_Exhausted(t *testing.T) {
+	cli, requests := newRateLimitTestServer(t, 10, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`)
+	var logs bytes.Buffer
+	cli.Log = zerolog.New(&logs)
+	_, err := cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+	assert.EqualValues(t, 3, atomic.LoadInt32(requests))
+	// The final failed request must be logged as an error rather than a successful request
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Contains(t, lines[len(lines)-1], `"level":"error"`)
+	assert.Contains(t, lines[len(lines)-1], `"status_code":429`)
+}
+
+func TestClient_MaxRetryWait_Download(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 2
+	// The default backoff is longer than the max wait, so the download shouldn't be retried
+	cli.MaxRetryWait = 1 * time.Second
+	start := time.Now()
+	_, err = cli.DownloadBytes(context.Background(), id.MustParseContentURI("mxc://example.com/media"))
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	assert.Less(t, time.Since(start), 1*time.Second)
+}
+
+func TestClient_RateLimitRetry_MissingRetryAfter(t *testing.T) {
+	cli, requests := newRateLimitTestServer(t, 1, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`)
+	// The default backoff is longer than the max wait, so the request shouldn't be retried
+	cli.MaxRetryWait = 1 * time.Second
+	start := time.Now()
+	_, err := cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+	assert.EqualValues(t, 1, atomic.LoadInt32(requests))
+	assert.Less(t, time.Since(start), 1*time.Second)
+}
+
+func TestClient_GetProfiles(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			prevMax := atomic.LoadInt32(&maxInFlight)
+			if current <= prevMax || atomic.CompareAndSwapInt32(&maxInFlight, prevMax, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if strings.Contains(r.URL.Path, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Profile not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"displayname": "meow"}`))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	userIDs := []id.UserID{"@a:example.com", "@b:example.com", "@c:example.com", "@missing:example.com", "@d:example.com", "@a:example.com"}
+	profiles, err := cli.GetProfiles(context.Background(), userIDs, 2)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+	var profilesErr mautrix.GetProfilesError
+	require.ErrorAs(t, err, &profilesErr)
+	assert.Len(t, profilesErr, 1)
+	assert.Contains(t, profilesErr, id.UserID("@missing:example.com"))
+	assert.Len(t, profiles, 4)
+	assert.Equal(t, "meow", profiles["@c:example.com"].DisplayName)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2))
+
+	profiles, err = cli.GetProfiles(context.Background(), userIDs[:3], 0)
+	assert.NoError(t, err)
+	assert.Len(t, profiles, 3)
+}
+
+func TestClient_StrictResponseDecoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"user_id": "@user:example.com", "unknown_field": true}`))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	resp, err := cli.Whoami(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@user:example.com"), resp.UserID)
+
+	cli.StrictResponseDecoding = true
+	_, err = cli.Whoami(context.Background())
+	assert.ErrorContains(t, err, "unknown_field")
+
+	cli.StrictResponseTypes = []reflect.Type{reflect.TypeOf(mautrix.RespCreateFilter{})}
+	_, err = cli.Whoami(context.Background())
+	assert.NoError(t, err)
+	cli.StrictResponseTypes = []reflect.Type{reflect.TypeOf(mautrix.RespWhoami{})}
+	_, err = cli.Whoami(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClient_GatewayErrorRetry_OnlyIdempotent(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 2
+
+	_, err = cli.CreateFilter(context.Background(), &mautrix.Filter{})
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.SwapInt32(&requests, 0), "POST requests must not be retried")
+
+	_, err = cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.Error(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+}
+
+func TestClient_RateLimitRetry_POST(t *testing.T) {
+	cli, requests := newRateLimitTestServer(t, 1, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`)
+	// Rate limited requests weren't processed, so they're retried even if they aren't idempotent
+	_, err := cli.CreateFilter(context.Background(), &mautrix.Filter{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(requests))
+}
+
+func TestClient_RateLimitRetry_RetryAfterHeader(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 60000}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.DefaultHTTPRetries = 2
+	cli.MaxRetryWait = 1 * time.Second
+	_, err = cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+}
+
+func TestClient_RateLimitRetry_IgnoredPerRequest(t *testing.T) {
+	cli, requests := newRateLimitTestServer(t, 1, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 10}`)
+	ctx := context.WithValue(context.Background(), mautrix.IgnoreRateLimitContextKey, true)
+	_, err := cli.SendStateEvent(ctx, "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+	assert.EqualValues(t, 1, atomic.LoadInt32(requests))
+}
+
+func TestClient_LastRateLimit(t *testing.T) {
+	cli, _ := newRateLimitTestServer(t, 1, `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 60000}`)
+	_, ok := cli.LastRateLimit()
+	assert.False(t, ok)
+	cli.IgnoreRateLimit = true
+	_, err := cli.SendStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{Topic: "meow"})
+	assert.ErrorIs(t, err, mautrix.MLimitExceeded)
+	retryAfter, ok := cli.LastRateLimit()
+	assert.True(t, ok)
+	assert.Greater(t, retryAfter, 59*time.Second)
+	assert.LessOrEqual(t, retryAfter, time.Minute)
+}
+
+func TestClient_LastRateLimit_Headers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Reset", "30")
+		_, _ = w.Write([]byte(`{"user_id": "@user:example.com"}`))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	_, err = cli.Whoami(context.Background())
+	require.NoError(t, err)
+	retryAfter, ok := cli.LastRateLimit()
+	assert.True(t, ok)
+	assert.Greater(t, retryAfter, 29*time.Second)
+}
+
+func TestClient_UploadMedia_Stream(t *testing.T) {
+	var received string
+	var contentLength int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = string(data)
+		contentLength = r.ContentLength
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/file"}`))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	// Wrap the reader so that the HTTP client can't detect the length automatically
+	resp, err := cli.UploadMedia(context.Background(), mautrix.ReqUploadMedia{
+		Content:     io.MultiReader(strings.NewReader("meow")),
+		ContentType: "text/plain",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/file", resp.ContentURI.String())
+	assert.Equal(t, "meow", received)
+	assert.EqualValues(t, -1, contentLength)
+
+	_, err = cli.UploadMedia(context.Background(), mautrix.ReqUploadMedia{
+		Content:       io.MultiReader(strings.NewReader("meow")),
+		ContentLength: 4,
+		ContentType:   "text/plain",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "meow", received)
+	assert.EqualValues(t, 4, contentLength)
+}
+
+func TestClient_Download_Stream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/media/v3/download/example.com/file":
+			_, _ = w.Write([]byte("meow"))
+		case "/_matrix/media/v3/download/example.com/truncated":
+			// Claim a longer body than what's actually sent
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte("meow"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Media not found"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	reader, err := cli.Download(context.Background(), id.MustParseContentURI("mxc://example.com/file"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "meow", string(data))
+	assert.NoError(t, reader.Close())
+
+	_, err = cli.Download(context.Background(), id.MustParseContentURI("mxc://example.com/missing"))
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+
+	reader, err = cli.Download(context.Background(), id.MustParseContentURI("mxc://example.com/truncated"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	var httpErr mautrix.HTTPError
+	assert.ErrorAs(t, err, &httpErr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.NoError(t, reader.Close())
+}
+
+func TestClient_OnSoftLogout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Token expired", "soft_logout": true}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"user_id": "@user:example.com", "device_id": "DEVICE"}`))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "old")
+	require.NoError(t, err)
+
+	_, err = cli.Whoami(context.Background())
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	var httpErr mautrix.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.True(t, httpErr.RespError.IsSoftLogout())
+
+	var calls int
+	cli.OnSoftLogout = func(ctx context.Context) error {
+		calls++
+		// Requests inside the callback must not trigger it recursively
+		_, err := cli.Whoami(ctx)
+		assert.ErrorIs(t, err, mautrix.MUnknownToken)
+		cli.AccessToken = "new"
+		return nil
+	}
+	resp, err := cli.Whoami(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID("DEVICE"), resp.DeviceID)
+	assert.Equal(t, 1, calls)
+}
+
+func TestClient_OnSoftLogout_HardLogout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Token revoked"}`))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.OnSoftLogout = func(ctx context.Context) error {
+		t.Error("OnSoftLogout called for a hard logout")
+		return nil
+	}
+	var logouts int
+	cli.OnLogout = func(ctx context.Context, err error) {
+		logouts++
+		assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	}
+	_, err = cli.Whoami(context.Background())
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+	assert.Equal(t, 1, logouts)
+}
+
+func TestClient_Close(t *testing.T) {
+	cli := newHangingTestServer(t)
+	syncResult := runSync(cli, context.Background())
+	reqResult := make(chan error, 1)
+	go func() {
+		_, err := cli.Download(context.Background(), id.MustParseContentURI("mxc://example.com/hanging"))
+		reqResult <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return cli.InFlightRequests() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cli.Close()
+	assert.NoError(t, waitForResult(t, syncResult))
+	err := waitForResult(t, reqResult)
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+	assert.Equal(t, 0, cli.InFlightRequests())
+
+	_, err = cli.Whoami(context.Background())
+	assert.ErrorIs(t, err, mautrix.ErrClientClosed)
+	assert.ErrorIs(t, cli.SyncWithContext(context.Background()), mautrix.ErrClientClosed)
+}
+
+func TestClient_Close_ExternalUploads(t *testing.T) {
+	cli := newHangingTestServer(t)
+	linkResult := make(chan error, 1)
+	go func() {
+		_, err := cli.UploadLink(context.Background(), cli.HomeserverURL.String()+"/hanging-link")
+		linkResult <- err
+	}()
+	uploadResult := make(chan error, 1)
+	go func() {
+		_, err := cli.UploadMedia(context.Background(), mautrix.ReqUploadMedia{
+			ContentBytes:      []byte("media"),
+			ContentType:       "text/plain",
+			MXC:               id.MustParseContentURI("mxc://example.com/media"),
+			UnstableUploadURL: cli.HomeserverURL.String() + "/hanging-upload",
+		})
+		uploadResult <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return cli.InFlightRequests() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cli.Close()
+	assert.Error(t, waitForResult(t, linkResult))
+	assert.Error(t, waitForResult(t, uploadResult))
+	assert.Equal(t, 0, cli.InFlightRequests())
+}
+
+func TestClient_InFlightRequests_Download(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("media"))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	body, err := cli.Download(context.Background(), id.MustParseContentURI("mxc://example.com/media"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, cli.InFlightRequests())
+	require.NoError(t, body.Close())
+	assert.Equal(t, 0, cli.InFlightRequests())
+}
+
+// newDirectRoomTestServer returns a client for a server with the given m.direct account data (or none if empty)
+// and the given member list for every room.
+func newDirectRoomTestServer(t *testing.T, directChats, members string) *mautrix.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/account_data/m.direct"):
+			if directChats == "" {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`))
+				return
+			}
+			_, _ = w.Write([]byte(directChats))
+		case strings.HasSuffix(r.URL.Path, "/members"):
+			_, _ = w.Write([]byte(`{"chunk": [` + members + `]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return cli
+}
+
+func testMemberEvent(userID, membership string, isDirect bool, prevContent string) string {
+	content := `{"membership": "` + membership + `"`
+	if isDirect {
+		content += `, "is_direct": true`
+	}
+	evt := `{"type": "m.room.member", "state_key": "` + userID + `", "sender": "` + userID + `", "event_id": "$` + userID + `", ` +
+		`"content": ` + content + `}`
+	if prevContent != "" {
+		evt += `, "unsigned": {"prev_content": ` + prevContent + `}`
+	}
+	return evt + `}`
+}
+
+func TestClient_IsDirectRoom(t *testing.T) {
+	tests := []struct {
+		name        string
+		directChats string
+		members     []string
+		isDirect    bool
+		otherUser   id.UserID
+	}{{
+		name:        "AccountData",
+		directChats: `{"@other:example.com": ["!other:example.com", "!room:example.com"]}`,
+		isDirect:    true,
+		otherUser:   "@other:example.com",
+	}, {
+		name: "InviteIsDirect",
+		members: []string{
+			testMemberEvent("@user:example.com", "join", false, ""),
+			testMemberEvent("@other:example.com", "invite", true, ""),
+		},
+		isDirect:  true,
+		otherUser: "@other:example.com",
+	}, {
+		name:        "PrevContentIsDirect",
+		directChats: `{"@other:example.com": ["!other:example.com"]}`,
+		members: []string{
+			testMemberEvent("@user:example.com", "join", false, ""),
+			testMemberEvent("@other:example.com", "join", false, `{"membership": "invite", "is_direct": true}`),
+		},
+		isDirect:  true,
+		otherUser: "@other:example.com",
+	}, {
+		name: "NotDirect",
+		members: []string{
+			testMemberEvent("@user:example.com", "join", false, ""),
+			testMemberEvent("@other:example.com", "join", false, ""),
+		},
+	}, {
+		name: "OwnUserNotMember",
+		members: []string{
+			testMemberEvent("@other:example.com", "join", false, ""),
+			testMemberEvent("@third:example.com", "invite", true, ""),
+		},
+	}, {
+		name: "TooManyMembers",
+		members: []string{
+			testMemberEvent("@user:example.com", "join", false, ""),
+			testMemberEvent("@other:example.com", "join", true, ""),
+			testMemberEvent("@third:example.com", "join", false, ""),
+		},
+	}, {
+		name: "OtherUserLeft",
+		members: []string{
+			testMemberEvent("@user:example.com", "join", true, ""),
+			testMemberEvent("@other:example.com", "leave", false, ""),
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli := newDirectRoomTestServer(t, test.directChats, strings.Join(test.members, ","))
+			isDirect, otherUser, err := cli.IsDirectRoom(context.Background(), "!room:example.com")
+			require.NoError(t, err)
+			assert.Equal(t, test.isDirect, isDirect)
+			assert.Equal(t, test.otherUser, otherUser)
+		})
+	}
+}
+
+func TestClient_GetThread(t *testing.T) {
+	msg := func(eventID, sender, body string, ts int, extra string) string {
+		return `{"type": "m.room.message", "event_id": "` + eventID + `", "sender": "` + sender + `", "origin_server_ts": ` +
+			strconv.Itoa(ts) + `, "content": {"msgtype": "m.text", "body": "` + body + `"` + extra + `}}`
+	}
+	inThread := `, "m.relates_to": {"rel_type": "m.thread", "event_id": "$root"}`
+	edit := func(target, body string) string {
+		return `, "m.new_content": {"msgtype": "m.text", "body": "` + body + `"}, "m.relates_to": {"rel_type": "m.replace", "event_id": "` + target + `"}`
+	}
+	root := `{"type": "m.room.message", "event_id": "$root", "sender": "@alice:example.com", "origin_server_ts": 1, ` +
+		`"content": {"msgtype": "m.text", "body": "root"}, "unsigned": {"m.relations": {"m.replace": ` +
+		msg("$rootedit", "@alice:example.com", "* root edited", 2, edit("$root", "root edited")) + `}}}`
+	pages := map[string]string{
+		"": `{"chunk": [` + msg("$reply1", "@bob:example.com", "first", 3, inThread) + `, ` +
+			msg("$reply2", "@alice:example.com", "second", 4, inThread) + `], "next_batch": "page2"}`,
+		"page2": `{"chunk": [` + msg("$reply2edit", "@alice:example.com", "* second edited", 5, edit("$reply2", "second edited")) + `, ` +
+			msg("$spoof", "@mallory:example.com", "* spoofed", 6, edit("$reply1", "spoofed")) + `, ` +
+			msg("$reply3", "@bob:example.com", "third", 7, inThread) + `]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.com/event/$root":
+			_, _ = w.Write([]byte(root))
+		case "/_matrix/client/v1/rooms/!room:example.com/relations/$root/m.thread":
+			assert.Equal(t, "f", r.URL.Query().Get("dir"))
+			_, _ = w.Write([]byte(pages[r.URL.Query().Get("from")]))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+		}
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	thread, err := cli.GetThread(context.Background(), "!room:example.com", "$root")
+	require.NoError(t, err)
+	var ids []id.EventID
+	var bodies []string
+	for _, evt := range thread {
+		ids = append(ids, evt.ID)
+		bodies = append(bodies, evt.Content.AsMessage().Body)
+	}
+	assert.Equal(t, []id.EventID{"$root", "$reply1", "$reply2", "$reply3"}, ids)
+	// Edits by someone other than the original sender are ignored.
+	assert.Equal(t, []string{"root edited", "first", "second edited", "third"}, bodies)
+	assert.Equal(t, id.EventID("$root"), thread[2].Content.AsMessage().RelatesTo.GetThreadParent())
+}
+
+func TestClient_GetFullyReadMarker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/user/@user:example.com/rooms/!room:example.com/account_data/m.fully_read":
+			_, _ = w.Write([]byte(`{"event_id": "$read"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`))
+		}
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	eventID, err := cli.GetFullyReadMarker(context.Background(), "!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$read"), eventID)
+	eventID, err = cli.GetFullyReadMarker(context.Background(), "!other:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, eventID)
+}
+
+func newReadMarkerTestServer(t *testing.T) (*mautrix.Client, *[]string, *sync.Mutex) {
+	var requests []string
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, r.URL.Path+" "+string(body))
+		lock.Unlock()
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	return cli, &requests, &lock
+}
+
+func TestClient_ReadMarkerDebounce(t *testing.T) {
+	cli, requests, lock := newReadMarkerTestServer(t)
+	cli.ReadMarkerDebounce = 50 * time.Millisecond
+	for _, eventID := range []id.EventID{"$1", "$2", "$3"} {
+		require.NoError(t, cli.MarkRead(context.Background(), "!room:example.com", eventID))
+	}
+	require.NoError(t, cli.MarkRead(context.Background(), "!other:example.com", "$4"))
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(*requests) == 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.ElementsMatch(t, []string{
+		"/_matrix/client/v3/rooms/!room:example.com/receipt/m.read/$3 {}",
+		"/_matrix/client/v3/rooms/!other:example.com/receipt/m.read/$4 {}",
+	}, *requests)
+}
+
+func TestClient_ReadMarkerDebounce_FlushOnClose(t *testing.T) {
+	cli, requests, lock := newReadMarkerTestServer(t)
+	cli.ReadMarkerDebounce = time.Hour
+	require.NoError(t, cli.SetReadMarkers(context.Background(), "!room:example.com", &mautrix.ReqSetReadMarkers{Read: "$1"}))
+	require.NoError(t, cli.SetReadMarkers(context.Background(), "!room:example.com", &mautrix.ReqSetReadMarkers{Read: "$2", FullyRead: "$2"}))
+	lock.Lock()
+	assert.Empty(t, *requests)
+	lock.Unlock()
+	cli.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{
+		`/_matrix/client/v3/rooms/!room:example.com/read_markers {"m.read":"$2","m.fully_read":"$2"}`,
+	}, *requests)
+}
+
+func TestClient_GetEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/event/$event", r.URL.Path)
+		_, _ = w.Write([]byte(`{"type": "m.room.message", "event_id": "$event", "sender": "@alice:example.com", "origin_server_ts": 1,
+			"content": {"msgtype": "m.text", "body": "hello"},
+			"unsigned": {"m.relations": {"m.replace": {"type": "m.room.message", "event_id": "$edit", "sender": "@alice:example.com",
+				"content": {"msgtype": "m.text", "body": "* hi", "m.new_content": {"msgtype": "m.text", "body": "hi"},
+					"m.relates_to": {"rel_type": "m.replace", "event_id": "$event"}}}}}}`))
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+
+	evt, err := cli.GetEvent(context.Background(), "!room:example.com", "$event")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:example.com"), evt.RoomID)
+	assert.Equal(t, event.MessageEventType, evt.Type.Class)
+	msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	require.True(t, ok)
+	assert.Equal(t, "hello", msg.Body)
+	require.NotNil(t, evt.Unsigned.Relations.GetReplacementContent())
+	assert.Equal(t, "hi", evt.Unsigned.Relations.GetReplacementContent().Body)
+}
+
+// newSequentialSendTestServer returns a client whose message sends to !slow:example.com block until release is closed.
+// The bodies of the sends are recorded in the order they arrive.
+func newSequentialSendTestServer(t *testing.T) (cli *mautrix.Client, bodies *[]string, lock *sync.Mutex, release chan struct{}) {
+	bodies = &[]string{}
+	lock = &sync.Mutex{}
+	release = make(chan struct{})
+	var inFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!slow:example.com/") {
+			assert.Equal(t, int32(1), inFlight.Add(1), "multiple concurrent sends to the same room")
+			defer inFlight.Add(-1)
+			<-release
+		}
+		lock.Lock()
+		*bodies = append(*bodies, string(body))
+		lock.Unlock()
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.SequentialRoomSends = true
+	return
+}
+
+func TestClient_SequentialRoomSends(t *testing.T) {
+	cli, bodies, lock, release := newSequentialSendTestServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := cli.SendMessageEvent(context.Background(), "!slow:example.com", event.EventMessage, map[string]int{"i": i})
+			assert.NoError(t, err)
+		}(i)
+		// Give the goroutine time to join the queue so that the send order is deterministic
+		time.Sleep(20 * time.Millisecond)
+	}
+	// Sends to other rooms aren't blocked by the queue of the slow room
+	_, err := cli.SendMessageEvent(context.Background(), "!fast:example.com", event.EventMessage, map[string]int{"i": 100})
+	require.NoError(t, err)
+	close(release)
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{`{"i":100}`, `{"i":0}`, `{"i":1}`, `{"i":2}`, `{"i":3}`}, *bodies)
+}
+
+func TestClient_SequentialRoomSends_Cancel(t *testing.T) {
+	cli, bodies, lock, release := newSequentialSendTestServer(t)
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		_, err := cli.SendMessageEvent(context.Background(), "!slow:example.com", event.EventMessage, map[string]int{"i": 0})
+		assert.NoError(t, err)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := cli.SendMessageEvent(ctx, "!slow:example.com", event.EventMessage, map[string]int{"i": 1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	<-firstDone
+	_, err = cli.SendMessageEvent(context.Background(), "!slow:example.com", event.EventMessage, map[string]int{"i": 2})
+	require.NoError(t, err)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{`{"i":0}`, `{"i":2}`}, *bodies)
+}
+
+// fakeHistoryCrypto is a CryptoHelper that can only decrypt events using the session ID "known".
+type fakeHistoryCrypto struct{}
+
+func (fakeHistoryCrypto) Encrypt(id.RoomID, event.Type, any) (*event.EncryptedEventContent, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (fakeHistoryCrypto) Decrypt(evt *event.Event) (*event.Event, error) {
+	content := evt.Content.AsEncrypted()
+	if content.SessionID != "known" {
+		return nil, errors.New("no session found")
+	}
+	return &event.Event{
+		ID:      evt.ID,
+		RoomID:  evt.RoomID,
+		Sender:  evt.Sender,
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "decrypted"}},
+		Mautrix: event.MautrixInfo{WasEncrypted: true},
+	}, nil
+}
+
+func (fakeHistoryCrypto) WaitForSession(id.RoomID, id.SenderKey, id.SessionID, time.Duration) bool {
+	return false
+}
+
+func (fakeHistoryCrypto) RequestSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, id.UserID, id.DeviceID) {
+}
+
+func (fakeHistoryCrypto) Init() error {
+	return nil
+}
+
+func testEncryptedEvent(eventID, sessionID string) string {
+	return fmt.Sprintf(`{"type": "m.room.encrypted", "event_id": %q, "sender": "@user:example.com", "origin_server_ts": 1, "content": {
+		"algorithm": "m.megolm.v1.aes-sha2", "sender_key": "key", "session_id": %q, "ciphertext": "ciphertext"
+	}}`, eventID, sessionID)
+}
+
+func TestClient_DecryptHistory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			_, _ = fmt.Fprintf(w, `{"start": "s1", "end": "s2", "chunk": [%s, %s, %s]}`,
+				testEncryptedEvent("$known", "known"),
+				testEncryptedEvent("$unknown", "unknown"),
+				`{"type": "m.room.message", "event_id": "$plain", "sender": "@user:example.com", "origin_server_ts": 1, "content": {"msgtype": "m.text", "body": "plain"}}`,
+			)
+		case strings.Contains(r.URL.Path, "/context/"):
+			_, _ = fmt.Fprintf(w, `{"start": "s1", "end": "s2", "event": %s, "events_before": [%s], "events_after": [%s]}`,
+				testEncryptedEvent("$known", "known"),
+				testEncryptedEvent("$unknown", "unknown"),
+				testEncryptedEvent("$known2", "known"),
+			)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Crypto = fakeHistoryCrypto{}
+
+	resp, err := cli.Messages(context.Background(), "!room:example.com", "", "", mautrix.DirectionBackward, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 3)
+	// Decryption is opt-in
+	assert.Equal(t, event.EventEncrypted.Type, resp.Chunk[0].Type.Type)
+	assert.Nil(t, resp.Chunk[0].Mautrix.DecryptionError)
+
+	cli.DecryptHistory = true
+	resp, err = cli.Messages(context.Background(), "!room:example.com", "", "", mautrix.DirectionBackward, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 3)
+	assert.Equal(t, event.EventMessage, resp.Chunk[0].Type)
+	assert.Equal(t, id.RoomID("!room:example.com"), resp.Chunk[0].RoomID)
+	assert.True(t, resp.Chunk[0].Mautrix.WasEncrypted)
+	assert.Equal(t, "decrypted", resp.Chunk[0].Content.AsMessage().Body)
+	assert.Equal(t, event.EventEncrypted.Type, resp.Chunk[1].Type.Type)
+	assert.EqualError(t, resp.Chunk[1].Mautrix.DecryptionError, "no session found")
+	assert.Equal(t, id.EventID("$plain"), resp.Chunk[2].ID)
+	assert.Nil(t, resp.Chunk[2].Mautrix.DecryptionError)
+
+	ctxResp, err := cli.Context(context.Background(), "!room:example.com", "$known", nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "decrypted", ctxResp.Event.Content.AsMessage().Body)
+	require.Len(t, ctxResp.EventsBefore, 1)
+	assert.Error(t, ctxResp.EventsBefore[0].Mautrix.DecryptionError)
+	require.Len(t, ctxResp.EventsAfter, 1)
+	assert.Equal(t, id.EventID("$known2"), ctxResp.EventsAfter[0].ID)
+	assert.Equal(t, event.EventMessage, ctxResp.EventsAfter[0].Type)
+}
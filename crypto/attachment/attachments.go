@@ -7,6 +7,7 @@
 package attachment
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha256"
@@ -80,26 +81,29 @@ func NewEncryptedFile() *EncryptedFile {
 }
 
 func (ef *EncryptedFile) decodeKeys(includeHash bool) error {
-	if ef.decoded != nil {
-		return nil
-	} else if len(ef.Key.Key) != keyBase64Length {
-		return InvalidKey
-	} else if len(ef.InitVector) != ivBase64Length {
-		return InvalidInitVector
-	} else if includeHash && len(ef.Hashes.SHA256) != hashBase64Length {
-		return InvalidHash
-	}
-	ef.decoded = &decodedKeys{}
-	_, err := base64.RawURLEncoding.Decode(ef.decoded.key[:], []byte(ef.Key.Key))
-	if err != nil {
-		return InvalidKey
-	}
-	_, err = base64.RawStdEncoding.Decode(ef.decoded.iv[:], []byte(ef.InitVector))
-	if err != nil {
-		return InvalidInitVector
+	if ef.decoded == nil {
+		if len(ef.Key.Key) != keyBase64Length {
+			return InvalidKey
+		} else if len(ef.InitVector) != ivBase64Length {
+			return InvalidInitVector
+		}
+		decoded := &decodedKeys{}
+		_, err := base64.RawURLEncoding.Decode(decoded.key[:], []byte(ef.Key.Key))
+		if err != nil {
+			return InvalidKey
+		}
+		_, err = base64.RawStdEncoding.Decode(decoded.iv[:], []byte(ef.InitVector))
+		if err != nil {
+			return InvalidInitVector
+		}
+		ef.decoded = decoded
 	}
 	if includeHash {
-		_, err = base64.RawStdEncoding.Decode(ef.decoded.sha256[:], []byte(ef.Hashes.SHA256))
+		// The hash is always decoded again, as it changes when the same struct is used for encrypting
+		if len(ef.Hashes.SHA256) != hashBase64Length {
+			return InvalidHash
+		}
+		_, err := base64.RawStdEncoding.Decode(ef.decoded.sha256[:], []byte(ef.Hashes.SHA256))
 		if err != nil {
 			return InvalidHash
 		}
@@ -139,14 +143,21 @@ type encryptingReader struct {
 func (r *encryptingReader) Read(dst []byte) (n int, err error) {
 	if r.closed {
 		return 0, ReaderClosed
-	} else if r.isDecrypting && r.file.decoded == nil {
+	} else if r.stream == nil {
 		if err = r.file.PrepareForDecryption(); err != nil {
 			return
 		}
+		r.stream = r.file.newStream()
 	}
 	n, err = r.source.Read(dst)
-	r.stream.XORKeyStream(dst[:n], dst[:n])
-	r.hash.Write(dst[:n])
+	if r.isDecrypting {
+		// The hash is calculated from the ciphertext, so it must be updated before decrypting
+		r.hash.Write(dst[:n])
+		r.stream.XORKeyStream(dst[:n], dst[:n])
+	} else {
+		r.stream.XORKeyStream(dst[:n], dst[:n])
+		r.hash.Write(dst[:n])
+	}
 	return
 }
 
@@ -156,9 +167,9 @@ func (r *encryptingReader) Close() (err error) {
 		err = closer.Close()
 	}
 	if r.isDecrypting {
-		var downloadedChecksum [utils.SHAHashLength]byte
-		r.hash.Sum(downloadedChecksum[:])
-		if downloadedChecksum != r.file.decoded.sha256 {
+		if prepareErr := r.file.PrepareForDecryption(); prepareErr != nil {
+			return prepareErr
+		} else if !bytes.Equal(r.hash.Sum(nil), r.file.decoded.sha256[:]) {
 			return HashMismatch
 		}
 	} else {
@@ -175,9 +186,8 @@ func (r *encryptingReader) Close() (err error) {
 // is filled.
 func (ef *EncryptedFile) EncryptStream(reader io.Reader) io.ReadCloser {
 	ef.decodeKeys(false)
-	block, _ := aes.NewCipher(ef.decoded.key[:])
 	return &encryptingReader{
-		stream: cipher.NewCTR(block, ef.decoded.iv[:]),
+		stream: ef.newStream(),
 		hash:   sha256.New(),
 		source: reader,
 		file:   ef,
@@ -229,11 +239,16 @@ func (ef *EncryptedFile) DecryptInPlace(data []byte) error {
 // The Close call will validate the hash and return an error if it doesn't match.
 // In this case, the written data should be considered compromised and should not be used further.
 func (ef *EncryptedFile) DecryptStream(reader io.Reader) io.ReadCloser {
-	block, _ := aes.NewCipher(ef.decoded.key[:])
 	return &encryptingReader{
-		stream: cipher.NewCTR(block, ef.decoded.iv[:]),
 		hash:   sha256.New(),
 		source: reader,
 		file:   ef,
+
+		isDecrypting: true,
 	}
 }
+
+func (ef *EncryptedFile) newStream() cipher.Stream {
+	block, _ := aes.NewCipher(ef.decoded.key[:])
+	return cipher.NewCTR(block, ef.decoded.iv[:])
+}
@@ -1,11 +1,15 @@
 package attachment
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const helloWorldCiphertext = ":6\xc7O1yR\x06\xe8\xcf]"
@@ -83,3 +87,83 @@ func TestTooShortHash(t *testing.T) {
 	err := file.DecryptInPlace([]byte(helloWorldCiphertext))
 	assert.ErrorIs(t, err, InvalidHash)
 }
+
+var testFileSizes = []int{0, 1, 15, 16, 17, 1000, 1 << 20}
+
+func randomFile(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+// reencode makes a copy of the file that doesn't have the decoded keys cached, like a file received in an event.
+func reencode(t *testing.T, file *EncryptedFile) *EncryptedFile {
+	data, err := json.Marshal(file)
+	require.NoError(t, err)
+	var parsed EncryptedFile
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	return &parsed
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range testFileSizes {
+		plaintext := randomFile(t, size)
+		file := NewEncryptedFile()
+		data := bytes.Clone(plaintext)
+		file.EncryptInPlace(data)
+		if size > 0 {
+			assert.NotEqual(t, plaintext, data)
+		}
+		assert.NoError(t, file.DecryptInPlace(bytes.Clone(data)), "failed to decrypt %d bytes with same struct", size)
+
+		assert.NoError(t, reencode(t, file).DecryptInPlace(data), "failed to decrypt %d bytes", size)
+		assert.Equal(t, plaintext, data)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range testFileSizes {
+		plaintext := randomFile(t, size)
+		file := NewEncryptedFile()
+		encryptStream := file.EncryptStream(bytes.NewReader(plaintext))
+		ciphertext, err := io.ReadAll(encryptStream)
+		require.NoError(t, err)
+		require.NoError(t, encryptStream.Close())
+
+		compareFile := NewEncryptedFile()
+		compareFile.Key, compareFile.InitVector, compareFile.decoded = file.Key, file.InitVector, nil
+		expectedCiphertext := bytes.Clone(plaintext)
+		compareFile.EncryptInPlace(expectedCiphertext)
+		assert.Equal(t, expectedCiphertext, ciphertext)
+		assert.Equal(t, compareFile.Hashes.SHA256, file.Hashes.SHA256)
+
+		decryptStream := reencode(t, file).DecryptStream(bytes.NewReader(ciphertext))
+		decrypted, err := io.ReadAll(decryptStream)
+		require.NoError(t, err)
+		assert.NoError(t, decryptStream.Close(), "hash mismatch when decrypting %d bytes", size)
+		assert.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestTamperedCiphertext(t *testing.T) {
+	file := NewEncryptedFile()
+	ciphertext := randomFile(t, 1000)
+	file.EncryptInPlace(ciphertext)
+	ciphertext[500] ^= 0xff
+
+	err := reencode(t, file).DecryptInPlace(bytes.Clone(ciphertext))
+	assert.ErrorIs(t, err, HashMismatch)
+
+	decryptStream := reencode(t, file).DecryptStream(bytes.NewReader(ciphertext))
+	_, err = io.ReadAll(decryptStream)
+	require.NoError(t, err)
+	assert.ErrorIs(t, decryptStream.Close(), HashMismatch)
+}
+
+func TestDecryptStreamUnsupportedVersion(t *testing.T) {
+	file := parseHelloWorld()
+	file.Version = "foo"
+	_, err := io.ReadAll(file.DecryptStream(bytes.NewReader([]byte(helloWorldCiphertext))))
+	assert.ErrorIs(t, err, UnsupportedVersion)
+}
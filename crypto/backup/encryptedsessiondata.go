@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrMACMismatch       = errors.New("session data MAC mismatch")
+	ErrInvalidCiphertext = errors.New("invalid session data ciphertext")
+)
+
+// EncryptedSessionData is the encrypted session_data of a key in a m.megolm_backup.v1.curve25519-aes-sha2 backup.
+type EncryptedSessionData struct {
+	Ciphertext string        `json:"ciphertext"`
+	Ephemeral  id.Curve25519 `json:"ephemeral"`
+	MAC        string        `json:"mac"`
+}
+
+func deriveKeys(sharedSecret []byte) (aesKey, macKey, iv []byte) {
+	// The spec says the salt is 32 zero bytes, which is equivalent to an empty salt in HKDF.
+	keys := make([]byte, 80)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, nil), keys)
+	if err != nil {
+		panic(err)
+	}
+	return keys[:32], keys[32:64], keys[64:]
+}
+
+func calculateMAC(macKey, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, macKey)
+	h.Write(ciphertext)
+	return h.Sum(nil)[:8]
+}
+
+// EncryptSessionData encrypts the given data for the backup with the given public key.
+//
+// The MAC is calculated over an empty input instead of the ciphertext for compatibility with libolm,
+// which is what all other clients use.
+func EncryptSessionData(pubKey *ecdh.PublicKey, data any) (*EncryptedSessionData, error) {
+	plaintext, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session data: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	sharedSecret, err := ephemeral.ECDH(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	aesKey, macKey, iv := deriveKeys(sharedSecret)
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(aesKey)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return &EncryptedSessionData{
+		Ciphertext: base64.RawStdEncoding.EncodeToString(ciphertext),
+		Ephemeral:  id.Curve25519(base64.RawStdEncoding.EncodeToString(ephemeral.PublicKey().Bytes())),
+		MAC:        base64.RawStdEncoding.EncodeToString(calculateMAC(macKey, nil)),
+	}, nil
+}
+
+// Decrypt decrypts the session data with the given backup key and unmarshals the JSON into the given value.
+//
+// Both MACs calculated over the ciphertext and MACs calculated over an empty input (like libolm does) are accepted.
+func (esd *EncryptedSessionData) Decrypt(key *MegolmBackupKey, into any) error {
+	ciphertext, err := base64.RawStdEncoding.DecodeString(esd.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	mac, err := base64.RawStdEncoding.DecodeString(esd.MAC)
+	if err != nil {
+		return fmt.Errorf("failed to decode MAC: %w", err)
+	}
+	ephemeral, err := ParsePublicKey(esd.Ephemeral)
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	sharedSecret, err := key.ECDH(ephemeral)
+	if err != nil {
+		return fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	aesKey, macKey, iv := deriveKeys(sharedSecret)
+	if !hmac.Equal(mac, calculateMAC(macKey, ciphertext)) && !hmac.Equal(mac, calculateMAC(macKey, nil)) {
+		return ErrMACMismatch
+	} else if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return ErrInvalidCiphertext
+	}
+
+	block, _ := aes.NewCipher(aesKey)
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return fmt.Errorf("%w: bad padding", ErrInvalidCiphertext)
+	}
+	err = json.Unmarshal(plaintext[:len(plaintext)-padding], into)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal session data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package backup implements the m.megolm_backup.v1.curve25519-aes-sha2 algorithm for server-side key backups.
+// See https://spec.matrix.org/v1.8/client-server-api/#backup-algorithm-mmegolm_backupv1curve25519-aes-sha2
+package backup
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/utils"
+	"maunium.net/go/mautrix/id"
+)
+
+// AlgorithmMegolmBackupV1 is the identifier of the only specced key backup algorithm.
+const AlgorithmMegolmBackupV1 = "m.megolm_backup.v1.curve25519-aes-sha2"
+
+var (
+	ErrInvalidRecoveryKey = errors.New("invalid recovery key")
+	ErrInvalidKeyLength   = errors.New("backup key must be 32 bytes")
+)
+
+// MegolmAuthData is the auth_data of a m.megolm_backup.v1.curve25519-aes-sha2 backup version.
+type MegolmAuthData struct {
+	PublicKey  id.Curve25519                     `json:"public_key"`
+	Signatures map[id.UserID]map[id.KeyID]string `json:"signatures,omitempty"`
+}
+
+// MegolmBackupKey is the private curve25519 key used to decrypt sessions in a key backup.
+type MegolmBackupKey struct {
+	*ecdh.PrivateKey
+}
+
+// NewMegolmBackupKey generates a new random backup key.
+func NewMegolmBackupKey() (*MegolmBackupKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &MegolmBackupKey{key}, nil
+}
+
+// MegolmBackupKeyFromBytes creates a backup key from the raw private key bytes,
+// like the base64-decoded m.megolm_backup.v1 secret from SSSS.
+func MegolmBackupKeyFromBytes(data []byte) (*MegolmBackupKey, error) {
+	if len(data) != 32 {
+		return nil, ErrInvalidKeyLength
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &MegolmBackupKey{key}, nil
+}
+
+// MegolmBackupKeyFromRecoveryKey creates a backup key from a base58-encoded recovery key.
+func MegolmBackupKeyFromRecoveryKey(recoveryKey string) (*MegolmBackupKey, error) {
+	data := utils.DecodeBase58RecoveryKey(recoveryKey)
+	if data == nil {
+		return nil, ErrInvalidRecoveryKey
+	}
+	return MegolmBackupKeyFromBytes(data)
+}
+
+// RecoveryKey returns the base58-encoded recovery key for this backup key.
+func (key *MegolmBackupKey) RecoveryKey() string {
+	return utils.EncodeBase58RecoveryKey(key.Bytes())
+}
+
+// PublicKeyString returns the unpadded base64 public key, as used in the backup auth data.
+func (key *MegolmBackupKey) PublicKeyString() id.Curve25519 {
+	return id.Curve25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
+
+// AuthData returns the unsigned auth data for a backup version using this key.
+func (key *MegolmBackupKey) AuthData() *MegolmAuthData {
+	return &MegolmAuthData{PublicKey: key.PublicKeyString()}
+}
+
+// ParsePublicKey parses an unpadded base64 curve25519 public key from backup auth data.
+func ParsePublicKey(pubKey id.Curve25519) (*ecdh.PublicKey, error) {
+	data, err := base64.RawStdEncoding.DecodeString(string(pubKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package backup_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/goolm/pk"
+	"maunium.net/go/mautrix/id"
+)
+
+var alicePrivate = []byte{
+	0x77, 0x07, 0x6D, 0x0A, 0x73, 0x18, 0xA5, 0x7D,
+	0x3C, 0x16, 0xC1, 0x72, 0x51, 0xB2, 0x66, 0x45,
+	0xDF, 0x4C, 0x2F, 0x87, 0xEB, 0xC0, 0x99, 0x2A,
+	0xB1, 0x77, 0xFB, 0xA5, 0x1D, 0xB9, 0x2C, 0x2A,
+}
+
+const alicePublic = id.Curve25519("hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo")
+
+type testSessionData struct {
+	SessionKey string `json:"session_key"`
+}
+
+func TestMegolmBackupKey_RecoveryKey(t *testing.T) {
+	key, err := backup.MegolmBackupKeyFromBytes(alicePrivate)
+	require.NoError(t, err)
+	assert.Equal(t, alicePublic, key.PublicKeyString())
+
+	parsed, err := backup.MegolmBackupKeyFromRecoveryKey(key.RecoveryKey())
+	require.NoError(t, err)
+	assert.Equal(t, alicePrivate, parsed.Bytes())
+
+	_, err = backup.MegolmBackupKeyFromRecoveryKey("EsT8 not a recovery key")
+	assert.ErrorIs(t, err, backup.ErrInvalidRecoveryKey)
+}
+
+func TestEncryptedSessionData_RoundTrip(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	encrypted, err := backup.EncryptSessionData(key.PublicKey(), &testSessionData{SessionKey: "meow"})
+	require.NoError(t, err)
+
+	var decrypted testSessionData
+	require.NoError(t, encrypted.Decrypt(key, &decrypted))
+	assert.Equal(t, "meow", decrypted.SessionKey)
+
+	otherKey, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	assert.ErrorIs(t, encrypted.Decrypt(otherKey, &decrypted), backup.ErrMACMismatch)
+}
+
+// TestEncryptedSessionData_DecryptPk checks compatibility with data encrypted using Olm's PkEncryption.
+func TestEncryptedSessionData_DecryptPk(t *testing.T) {
+	key, err := backup.MegolmBackupKeyFromBytes(alicePrivate)
+	require.NoError(t, err)
+	encryption, err := pk.NewEncryption(alicePublic)
+	require.NoError(t, err)
+	ephemeral, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	ciphertext, mac, err := encryption.Encrypt([]byte(`{"session_key":"meow"}`), ephemeral.Bytes())
+	require.NoError(t, err)
+	// PkEncryption returns the full HMAC, but only the first 8 bytes are used in key backups
+	fullMAC, err := base64.RawStdEncoding.DecodeString(string(mac))
+	require.NoError(t, err)
+
+	encrypted := &backup.EncryptedSessionData{
+		Ciphertext: base64.RawStdEncoding.EncodeToString(ciphertext),
+		Ephemeral:  ephemeral.PublicKeyString(),
+		MAC:        base64.RawStdEncoding.EncodeToString(fullMAC[:8]),
+	}
+	var decrypted testSessionData
+	require.NoError(t, encrypted.Decrypt(key, &decrypted))
+	assert.Equal(t, "meow", decrypted.SessionKey)
+}
@@ -92,6 +92,54 @@ func (mach *OlmMachine) SignUser(ctx context.Context, userID id.UserID, masterKe
 	return nil
 }
 
+// TrustUser marks all currently known devices of the given user as verified. If the user's devices aren't cached,
+// they're fetched from the server first. If the user-signing key is cached, the user's master key is also signed
+// with it, which makes any future devices cross-signed by the user trusted too.
+//
+// Blacklisted devices are left as-is.
+func (mach *OlmMachine) TrustUser(ctx context.Context, userID id.UserID) error {
+	devices, err := mach.CryptoStore.GetDevices(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get devices of %s: %w", userID, err)
+	} else if devices == nil {
+		devices = mach.fetchKeys(ctx, []id.UserID{userID}, "", true)[userID]
+	}
+	if len(devices) > 0 {
+		for _, device := range devices {
+			if device.Trust != id.TrustStateBlacklisted {
+				device.Trust = id.TrustStateVerified
+			}
+		}
+		if err = mach.CryptoStore.PutDevices(userID, devices); err != nil {
+			return fmt.Errorf("failed to store device trust: %w", err)
+		}
+		mach.Log.Debug().
+			Str("user_id", userID.String()).
+			Int("device_count", len(devices)).
+			Msg("Marked all devices of user as verified")
+	} else {
+		mach.Log.Debug().
+			Str("user_id", userID.String()).
+			Msg("User has no known devices to mark as verified")
+	}
+
+	if userID == mach.Client.UserID {
+		return nil
+	} else if mach.CrossSigningKeys == nil || mach.CrossSigningKeys.UserSigningKey == nil {
+		mach.Log.Debug().
+			Str("user_id", userID.String()).
+			Msg("User-signing key not cached, not cross-signing trusted user")
+		return nil
+	}
+	theirKeys, err := mach.GetCrossSigningPublicKeys(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get cross-signing keys of %s: %w", userID, err)
+	} else if theirKeys == nil || theirKeys.MasterKey == "" {
+		return ErrCrossSigningMasterKeyNotFound
+	}
+	return mach.SignUser(ctx, userID, theirKeys.MasterKey)
+}
+
 // SignOwnMasterKey uses the current account for signing the current user's master key and uploads the signature.
 func (mach *OlmMachine) SignOwnMasterKey(ctx context.Context) error {
 	if mach.CrossSigningKeys == nil {
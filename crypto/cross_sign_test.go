@@ -17,6 +17,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -154,4 +155,220 @@ func TestTrustOtherDevice(t *testing.T) {
 	if !m.IsDeviceTrusted(theirDevice) {
 		t.Error("Other device not trusted while it should be")
 	}
+	if trust := m.ResolveTrust(theirDevice); trust != id.TrustStateCrossSignedVerified {
+		t.Errorf("Expected device of trusted user to be cross-signed verified, got %s", trust)
+	}
+}
+
+func TestTrustOtherDeviceTOFU(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	theirDevice := &id.Device{
+		UserID:     otherUser,
+		DeviceID:   "theirDevice",
+		SigningKey: id.Ed25519("theirDeviceKey"),
+	}
+	theirMasterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, theirMasterKey.PublicKey)
+	theirSSK, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageSelfSigning, theirSSK.PublicKey)
+	m.CryptoStore.PutSignature(otherUser, theirSSK.PublicKey,
+		otherUser, theirMasterKey.PublicKey, "sig1")
+	m.CryptoStore.PutSignature(otherUser, theirDevice.SigningKey,
+		otherUser, theirSSK.PublicKey, "sig2")
+
+	if trust := m.ResolveTrust(theirDevice); trust != id.TrustStateCrossSignedTOFU {
+		t.Errorf("Expected device of unverified user to be cross-signed TOFU, got %s", trust)
+	}
+
+	newMasterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, newMasterKey.PublicKey)
+	m.CryptoStore.PutSignature(otherUser, theirSSK.PublicKey,
+		otherUser, newMasterKey.PublicKey, "sig3")
+	if trust := m.ResolveTrust(theirDevice); trust != id.TrustStateCrossSignedUntrusted {
+		t.Errorf("Expected device of unverified user with changed master key to be cross-signed untrusted, got %s", trust)
+	}
+}
+
+func TestResolveEventTrust(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	theirDevice := &id.Device{
+		UserID:      otherUser,
+		DeviceID:    "theirDevice",
+		IdentityKey: id.Curve25519("theirIdentityKey"),
+		SigningKey:  id.Ed25519("theirDeviceKey"),
+	}
+	m.CryptoStore.PutDevice(otherUser, theirDevice)
+	evt := &event.Event{
+		Sender: otherUser,
+		Mautrix: event.MautrixInfo{
+			WasEncrypted: true,
+			TrustState:   id.TrustStateUnset,
+			TrustSource:  theirDevice,
+		},
+	}
+	if trust, err := m.ResolveEventTrust(context.TODO(), evt); err != nil {
+		t.Errorf("Error resolving event trust: %v", err)
+	} else if trust != id.TrustStateUnset {
+		t.Errorf("Expected event from device without cross-signing to be unverified, got %s", trust)
+	}
+
+	theirMasterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, theirMasterKey.PublicKey)
+	theirSSK, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageSelfSigning, theirSSK.PublicKey)
+	m.CryptoStore.PutSignature(otherUser, theirDevice.SigningKey,
+		otherUser, theirSSK.PublicKey, "sig1")
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateUnset {
+		t.Errorf("Expected event to be unverified before self-signing key has been signed with master key, got %s", trust)
+	}
+
+	m.CryptoStore.PutSignature(otherUser, theirSSK.PublicKey,
+		otherUser, theirMasterKey.PublicKey, "sig2")
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateCrossSignedTOFU {
+		t.Errorf("Expected event from device of unverified user to be cross-signed TOFU, got %s", trust)
+	}
+
+	m.CryptoStore.PutSignature(m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.MasterKey.PublicKey, "sig3")
+	m.CryptoStore.PutSignature(otherUser, theirMasterKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey, "sig4")
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateCrossSignedVerified {
+		t.Errorf("Expected event from device of verified user to be cross-signed verified, got %s", trust)
+	}
+
+	forwarded := &event.Event{
+		Sender: otherUser,
+		Mautrix: event.MautrixInfo{
+			WasEncrypted:  true,
+			TrustState:    id.TrustStateCrossSignedVerified,
+			TrustSource:   theirDevice,
+			ForwardedKeys: true,
+		},
+	}
+	if trust, _ := m.ResolveEventTrust(context.TODO(), forwarded); trust != id.TrustStateForwarded {
+		t.Errorf("Expected event decrypted with forwarded keys to be capped at forwarded, got %s", trust)
+	}
+
+	changedKeys := *theirDevice
+	changedKeys.SigningKey = "theirNewDeviceKey"
+	mismatch := &event.Event{
+		Sender: otherUser,
+		Mautrix: event.MautrixInfo{
+			WasEncrypted: true,
+			TrustState:   id.TrustStateCrossSignedVerified,
+			TrustSource:  &changedKeys,
+		},
+	}
+	if trust, _ := m.ResolveEventTrust(context.TODO(), mismatch); trust != id.TrustStateUnset {
+		t.Errorf("Expected event from device with mismatching keys in store to be unverified, got %s", trust)
+	}
+
+	// The device trust is read from the store, not from the copy in the event
+	blacklisted := *theirDevice
+	blacklisted.Trust = id.TrustStateBlacklisted
+	m.CryptoStore.PutDevice(otherUser, &blacklisted)
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateBlacklisted {
+		t.Errorf("Expected event from blacklisted device to be blacklisted, got %s", trust)
+	}
+
+	evt.Mautrix = event.MautrixInfo{WasEncrypted: true, TrustState: id.TrustStateForwarded, ForwardedKeys: true}
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateUnset {
+		t.Errorf("Expected event without known sender device to be unverified, got %s", trust)
+	}
+	evt.Mautrix = event.MautrixInfo{WasEncrypted: true, TrustState: id.TrustStateVerified}
+	if trust, _ := m.ResolveEventTrust(context.TODO(), evt); trust != id.TrustStateVerified {
+		t.Errorf("Expected event encrypted with own session to be verified, got %s", trust)
+	}
+	if trust, _ := m.ResolveEventTrust(context.TODO(), &event.Event{}); trust != id.TrustStateUnset {
+		t.Errorf("Expected unencrypted event to be unverified, got %s", trust)
+	}
+}
+
+func TestIsOwnDeviceVerified(t *testing.T) {
+	m := getOlmMachine(t)
+	m.account = NewOlmAccount()
+	if verified, err := m.IsOwnDeviceVerified(context.TODO()); err != nil {
+		t.Errorf("Error checking own device verification: %v", err)
+	} else if verified {
+		t.Error("Own device verified while it shouldn't be")
+	}
+
+	m.CryptoStore.PutSignature(m.Client.UserID, m.account.SigningKey(),
+		m.Client.UserID, m.CrossSigningKeys.SelfSigningKey.PublicKey, "sig1")
+	if verified, _ := m.IsOwnDeviceVerified(context.TODO()); verified {
+		t.Error("Own device verified before self-signing key has been signed with master key")
+	}
+
+	m.CryptoStore.PutSignature(m.Client.UserID, m.CrossSigningKeys.SelfSigningKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.MasterKey.PublicKey, "sig2")
+	if verified, err := m.IsOwnDeviceVerified(context.TODO()); err != nil {
+		t.Errorf("Error checking own device verification: %v", err)
+	} else if !verified {
+		t.Error("Own device not verified while it should be")
+	}
+	if verified, _ := m.IsUserVerified(context.TODO(), m.Client.UserID); !verified {
+		t.Error("Own user not verified while own device is")
+	}
+}
+
+func TestIsUserVerified(t *testing.T) {
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@user")
+	if verified, err := m.IsUserVerified(context.TODO(), otherUser); err != nil {
+		t.Errorf("Error checking user verification: %v", err)
+	} else if verified {
+		t.Error("Other user verified while they shouldn't be")
+	}
+
+	theirMasterKey, _ := olm.NewPkSigning()
+	m.CryptoStore.PutCrossSigningKey(otherUser, id.XSUsageMaster, theirMasterKey.PublicKey)
+	m.CryptoStore.PutSignature(otherUser, theirMasterKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey, "sig1")
+	if verified, _ := m.IsUserVerified(context.TODO(), otherUser); verified {
+		t.Error("Other user verified before our user-signing key has been signed with our master key")
+	}
+
+	m.CryptoStore.PutSignature(m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey,
+		m.Client.UserID, m.CrossSigningKeys.MasterKey.PublicKey, "sig2")
+	if verified, err := m.IsUserVerified(context.TODO(), otherUser); err != nil {
+		t.Errorf("Error checking user verification: %v", err)
+	} else if !verified {
+		t.Error("Other user not verified while they should be")
+	}
+}
+
+func TestTrustUser(t *testing.T) {
+	m := newMachine(t, "@mautrix")
+	otherUser := id.UserID("@user")
+	m.CryptoStore.PutDevices(otherUser, map[id.DeviceID]*id.Device{
+		"dev1": {UserID: otherUser, DeviceID: "dev1"},
+		"dev2": {UserID: otherUser, DeviceID: "dev2", Trust: id.TrustStateBlacklisted},
+	})
+	if err := m.TrustUser(context.TODO(), otherUser); err != nil {
+		t.Fatalf("Error trusting user: %v", err)
+	}
+	devices, _ := m.CryptoStore.GetDevices(otherUser)
+	if devices["dev1"].Trust != id.TrustStateVerified {
+		t.Error("Device not verified after trusting user")
+	}
+	if devices["dev2"].Trust != id.TrustStateBlacklisted {
+		t.Error("Blacklisted device changed after trusting user")
+	}
+}
+
+func TestTrustUser_DevicesNotCached(t *testing.T) {
+	m := newMachine(t, "@mautrix")
+	otherUser := id.UserID("@user")
+	// Fetching the devices fails, so the user must not be marked as tracked with no devices
+	if err := m.TrustUser(context.TODO(), otherUser); err != nil {
+		t.Fatalf("Error trusting user: %v", err)
+	}
+	tracked, err := m.CryptoStore.FilterTrackedUsers([]id.UserID{otherUser})
+	if err != nil {
+		t.Fatalf("Error filtering tracked users: %v", err)
+	} else if len(tracked) != 0 {
+		t.Error("User without fetched devices was marked as tracked")
+	}
 }
@@ -9,7 +9,9 @@ package crypto
 
 import (
 	"context"
+	"fmt"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -18,6 +20,39 @@ func (mach *OlmMachine) ResolveTrust(device *id.Device) id.TrustState {
 	return state
 }
 
+// ResolveEventTrust resolves the current trust state of the device that sent the given decrypted event.
+//
+// The device is looked up from the store again, so changes to cross-signing keys or signatures since the event
+// was decrypted are taken into account. TrustStateUnset is returned if the event wasn't encrypted, if the sending
+// device isn't known or if its keys in the store don't match the ones the event was decrypted with.
+// Events decrypted with forwarded keys are never trusted more than TrustStateForwarded, and events sent
+// with our own megolm sessions are always TrustStateVerified.
+func (mach *OlmMachine) ResolveEventTrust(ctx context.Context, evt *event.Event) (id.TrustState, error) {
+	if !evt.Mautrix.WasEncrypted {
+		return id.TrustStateUnset, nil
+	}
+	device := evt.Mautrix.TrustSource
+	if device == nil {
+		if evt.Mautrix.TrustState == id.TrustStateVerified && !evt.Mautrix.ForwardedKeys {
+			return id.TrustStateVerified, nil
+		}
+		return id.TrustStateUnset, nil
+	}
+	storedDevice, err := mach.CryptoStore.GetDevice(device.UserID, device.DeviceID)
+	if err != nil {
+		return id.TrustStateUnset, fmt.Errorf("failed to get sender device from store: %w", err)
+	} else if storedDevice == nil || storedDevice.IdentityKey != device.IdentityKey || storedDevice.SigningKey != device.SigningKey {
+		return id.TrustStateUnset, nil
+	}
+	state, err := mach.ResolveTrustContext(ctx, storedDevice)
+	if err != nil {
+		return id.TrustStateUnset, err
+	} else if evt.Mautrix.ForwardedKeys && state > id.TrustStateForwarded {
+		return id.TrustStateForwarded, nil
+	}
+	return state, nil
+}
+
 // ResolveTrustContext resolves the trust state of the device from cross-signing.
 func (mach *OlmMachine) ResolveTrustContext(ctx context.Context, device *id.Device) (id.TrustState, error) {
 	if device.Trust == id.TrustStateVerified || device.Trust == id.TrustStateBlacklisted {
@@ -66,8 +101,10 @@ func (mach *OlmMachine) ResolveTrustContext(ctx context.Context, device *id.Devi
 		return id.TrustStateUnset, err
 	}
 	if deviceSigExists {
-		if trusted, err := mach.IsUserTrusted(ctx, device.UserID); !trusted {
-			return id.TrustStateCrossSignedVerified, err
+		if trusted, err := mach.IsUserTrusted(ctx, device.UserID); err != nil {
+			return id.TrustStateUnset, err
+		} else if trusted {
+			return id.TrustStateCrossSignedVerified, nil
 		} else if theirMSK.Key == theirMSK.First {
 			return id.TrustStateCrossSignedTOFU, nil
 		}
@@ -127,3 +164,77 @@ func (mach *OlmMachine) IsUserTrusted(ctx context.Context, userID id.UserID) (bo
 	}
 	return sigExists, nil
 }
+
+// IsOwnDeviceVerified returns whether the current device has been cross-signed, i.e. whether the device key has been
+// signed by the user's self-signing key, which in turn has been signed by the user's master key.
+//
+// This only consults the cross-signing keys and signatures in the crypto store, it doesn't fetch anything from the server.
+func (mach *OlmMachine) IsOwnDeviceVerified(ctx context.Context) (bool, error) {
+	ownKeys, err := mach.CryptoStore.GetCrossSigningKeys(mach.Client.UserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get own cross-signing keys: %w", err)
+	}
+	masterKey, ok := ownKeys[id.XSUsageMaster]
+	if !ok {
+		return false, nil
+	}
+	selfSigningKey, ok := ownKeys[id.XSUsageSelfSigning]
+	if !ok {
+		return false, nil
+	}
+	sskSigned, err := mach.CryptoStore.IsKeySignedBy(mach.Client.UserID, selfSigningKey.Key, mach.Client.UserID, masterKey.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check self-signing key signature: %w", err)
+	} else if !sskSigned {
+		mach.machOrContextLog(ctx).Debug().Msg("Own self-signing key is not signed by master key")
+		return false, nil
+	}
+	deviceSigned, err := mach.CryptoStore.IsKeySignedBy(mach.Client.UserID, mach.account.SigningKey(), mach.Client.UserID, selfSigningKey.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check device signature: %w", err)
+	}
+	return deviceSigned, nil
+}
+
+// IsUserVerified returns whether the given user has been verified, i.e. whether their master key has been signed by
+// our user-signing key, which in turn has been signed by our master key. For our own user ID, this is equivalent to
+// IsOwnDeviceVerified.
+//
+// Unlike IsUserTrusted, this only consults the cross-signing keys and signatures in the crypto store.
+func (mach *OlmMachine) IsUserVerified(ctx context.Context, userID id.UserID) (bool, error) {
+	if userID == mach.Client.UserID {
+		return mach.IsOwnDeviceVerified(ctx)
+	}
+	ownKeys, err := mach.CryptoStore.GetCrossSigningKeys(mach.Client.UserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get own cross-signing keys: %w", err)
+	}
+	ownMasterKey, ok := ownKeys[id.XSUsageMaster]
+	if !ok {
+		return false, nil
+	}
+	userSigningKey, ok := ownKeys[id.XSUsageUserSigning]
+	if !ok {
+		return false, nil
+	}
+	uskSigned, err := mach.CryptoStore.IsKeySignedBy(mach.Client.UserID, userSigningKey.Key, mach.Client.UserID, ownMasterKey.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check user-signing key signature: %w", err)
+	} else if !uskSigned {
+		mach.machOrContextLog(ctx).Debug().Msg("Own user-signing key is not signed by master key")
+		return false, nil
+	}
+	theirKeys, err := mach.CryptoStore.GetCrossSigningKeys(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get cross-signing keys of %s: %w", userID, err)
+	}
+	theirMasterKey, ok := theirKeys[id.XSUsageMaster]
+	if !ok {
+		return false, nil
+	}
+	mskSigned, err := mach.CryptoStore.IsKeySignedBy(userID, theirMasterKey.Key, mach.Client.UserID, userSigningKey.Key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check master key signature of %s: %w", userID, err)
+	}
+	return mskSigned, nil
+}
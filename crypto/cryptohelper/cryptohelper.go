@@ -18,6 +18,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/sqlstatestore"
@@ -133,7 +134,7 @@ func (helper *CryptoHelper) Init() error {
 		} else if _, isMemory := helper.client.Store.(*mautrix.MemorySyncStore); isMemory {
 			helper.client.Store = managedCryptoStore
 		}
-		err := managedCryptoStore.DB.Upgrade()
+		err := sql_store_upgrade.Upgrade(managedCryptoStore.DB)
 		if err != nil {
 			return fmt.Errorf("failed to upgrade crypto state store: %w", err)
 		}
@@ -362,13 +363,19 @@ func (helper *CryptoHelper) Encrypt(roomID id.RoomID, evtType event.Type, conten
 			Str("room_id", roomID.String()).
 			Msg("Got session error while encrypting event, sharing group session and trying again")
 		var users []id.UserID
+		var unverifiedErr *crypto.UnverifiedDevicesError
 		users, err = helper.client.StateStore.GetRoomJoinedOrInvitedMembers(roomID)
 		if err != nil {
 			err = fmt.Errorf("failed to get room member list: %w", err)
-		} else if err = helper.mach.ShareGroupSession(ctx, roomID, users); err != nil {
+		} else if err = helper.mach.ShareGroupSession(ctx, roomID, users); err != nil && !errors.As(err, &unverifiedErr) {
 			err = fmt.Errorf("failed to share group session: %w", err)
 		} else if encrypted, err = helper.mach.EncryptMegolmEvent(ctx, roomID, evtType, content); err != nil {
 			err = fmt.Errorf("failed to encrypt event after re-sharing group session: %w", err)
+		} else if unverifiedErr != nil {
+			// The session was still shared with all verified devices, so the event can be sent
+			helper.log.Debug().Err(unverifiedErr).
+				Str("room_id", roomID.String()).
+				Msg("Group session was withheld from unverified devices")
 		}
 	}
 	return
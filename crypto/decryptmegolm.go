@@ -30,6 +30,78 @@ var (
 	RatchetError                  = errors.New("failed to ratchet session after use")
 )
 
+// DuplicateMessageIndexError is returned when a megolm message index has already been used by a different event,
+// which means the index was reused for different content (possibly a replay attack).
+//
+// Exact duplicates (same event ID and timestamp, e.g. from a retried /sync) are not considered errors.
+type DuplicateMessageIndexError struct {
+	MessageIndex uint
+	// The event ID and timestamp stored for the index when it was first seen.
+	// These are empty if the crypto store didn't provide them.
+	OriginalEventID   id.EventID
+	OriginalTimestamp int64
+}
+
+func (e *DuplicateMessageIndexError) Error() string {
+	if e.OriginalEventID == "" {
+		return fmt.Sprintf("%s %d", DuplicateMessageIndex, e.MessageIndex)
+	}
+	return fmt.Sprintf("%s %d (originally used by %s at %d)", DuplicateMessageIndex, e.MessageIndex, e.OriginalEventID, e.OriginalTimestamp)
+}
+
+func (e *DuplicateMessageIndexError) Unwrap() error {
+	return DuplicateMessageIndex
+}
+
+// validateMessageIndex wraps CryptoStore.ValidateMessageIndex to always return a *DuplicateMessageIndexError
+// if the index was reused, even if the store only returned false.
+func (mach *OlmMachine) validateMessageIndex(ctx context.Context, senderKey id.SenderKey, sessionID id.SessionID, evt *event.Event, index uint) error {
+	ok, err := mach.CryptoStore.ValidateMessageIndex(ctx, senderKey, sessionID, evt.ID, index, evt.Timestamp)
+	var dupErr *DuplicateMessageIndexError
+	if errors.As(err, &dupErr) {
+		return dupErr
+	} else if err != nil {
+		return fmt.Errorf("failed to check if message index is duplicate: %w", err)
+	} else if !ok {
+		return &DuplicateMessageIndexError{MessageIndex: index}
+	}
+	return nil
+}
+
+// NoSessionFoundError is returned when the megolm session used to encrypt an event isn't in the crypto store.
+// It matches NoSessionFound with errors.Is. The session may arrive later, e.g. via a key share or backup.
+type NoSessionFoundError struct {
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+}
+
+func (e *NoSessionFoundError) Error() string {
+	return fmt.Sprintf("%s (ID %s)", NoSessionFound, e.SessionID)
+}
+
+func (e *NoSessionFoundError) Unwrap() error {
+	return NoSessionFound
+}
+
+// DecryptionError is returned by DecryptMegolmEvent for all decryption failures. It contains the original
+// encrypted event, so that callers can e.g. queue it to be decrypted again when the session arrives.
+//
+// The underlying error can be checked with errors.Is and errors.As, e.g. against NoSessionFound,
+// olm.UnknownMessageIndex, DuplicateMessageIndex, WrongRoom or ErrGroupSessionWithheld.
+type DecryptionError struct {
+	Event *event.Event
+	Err   error
+}
+
+func (e *DecryptionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
 type megolmEvent struct {
 	RoomID  id.RoomID     `json:"room_id"`
 	Type    event.Type    `json:"type"`
@@ -37,7 +109,21 @@ type megolmEvent struct {
 }
 
 // DecryptMegolmEvent decrypts an m.room.encrypted event where the algorithm is m.megolm.v1.aes-sha2
+//
+// Errors are always returned as a *DecryptionError containing the encrypted event. If the session isn't known,
+// the wrapped error is a *NoSessionFoundError.
+//
+// Decrypting the exact same event again (e.g. when a /sync is retried) is allowed. If the message index was already
+// used by a different event, the wrapped error will be a *DuplicateMessageIndexError containing the original event.
 func (mach *OlmMachine) DecryptMegolmEvent(ctx context.Context, evt *event.Event) (*event.Event, error) {
+	decrypted, err := mach.decryptMegolmEvent(ctx, evt)
+	if err != nil {
+		return nil, &DecryptionError{Event: evt, Err: err}
+	}
+	return decrypted, nil
+}
+
+func (mach *OlmMachine) decryptMegolmEvent(ctx context.Context, evt *event.Event) (*event.Event, error) {
 	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
 	if !ok {
 		return nil, IncorrectEncryptedContentType
@@ -60,6 +146,9 @@ func (mach *OlmMachine) DecryptMegolmEvent(ctx context.Context, evt *event.Event
 		encryptionRoomID = id.RoomID(origRoomID)
 	}
 	sess, plaintext, messageIndex, err := mach.actuallyDecryptMegolmEvent(ctx, evt, encryptionRoomID, content)
+	if (errors.Is(err, NoSessionFound) || errors.Is(err, olm.UnknownMessageIndex)) && mach.restoreSessionFromBackup(ctx, encryptionRoomID, content.SessionID) {
+		sess, plaintext, messageIndex, err = mach.actuallyDecryptMegolmEvent(ctx, evt, encryptionRoomID, content)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -69,15 +158,19 @@ func (mach *OlmMachine) DecryptMegolmEvent(ctx context.Context, evt *event.Event
 	var forwardedKeys bool
 	var device *id.Device
 	ownSigningKey, ownIdentityKey := mach.account.Keys()
-	if sess.SigningKey == ownSigningKey && sess.SenderKey == ownIdentityKey && len(sess.ForwardingChains) == 0 {
+	if sess.SigningKey == ownSigningKey && sess.SenderKey == ownIdentityKey && len(sess.ForwardingChains) == 0 && !sess.IsForwarded {
 		trustLevel = id.TrustStateVerified
+	} else if sess.IsForwarded && len(sess.ForwardingChains) == 0 {
+		// Imported keys don't have a forwarding chain, so there's no device to resolve the trust level from
+		forwardedKeys = true
+		trustLevel = id.TrustStateForwarded
 	} else {
 		device, err = mach.GetOrFetchDeviceByKey(ctx, evt.Sender, sess.SenderKey)
 		if err != nil {
 			// We don't want to throw these errors as the message can still be decrypted.
 			log.Debug().Err(err).Msg("Failed to get device to verify session")
 			trustLevel = id.TrustStateUnknownDevice
-		} else if len(sess.ForwardingChains) == 0 || (len(sess.ForwardingChains) == 1 && sess.ForwardingChains[0] == sess.SenderKey.String()) {
+		} else if (len(sess.ForwardingChains) == 0 && !sess.IsForwarded) || (len(sess.ForwardingChains) == 1 && sess.ForwardingChains[0] == sess.SenderKey.String()) {
 			if device == nil {
 				log.Debug().
 					Str("session_sender_key", sess.SenderKey.String()).
@@ -149,6 +242,7 @@ func (mach *OlmMachine) DecryptMegolmEvent(ctx context.Context, evt *event.Event
 			ForwardedKeys: forwardedKeys,
 			WasEncrypted:  true,
 			ReceivedAt:    evt.Mautrix.ReceivedAt,
+			IsOwnEcho:     evt.Mautrix.IsOwnEcho,
 		},
 	}, nil
 }
@@ -173,12 +267,13 @@ func (mach *OlmMachine) checkUndecryptableMessageIndexDuplication(ctx context.Co
 	}
 	firstKnown := sess.Internal.FirstKnownIndex()
 	log = log.With().Uint("message_index", messageIndex).Uint32("first_known_index", firstKnown).Logger()
-	if ok, err := mach.CryptoStore.ValidateMessageIndex(ctx, sess.SenderKey, content.SessionID, evt.ID, messageIndex, evt.Timestamp); err != nil {
+	var dupErr *DuplicateMessageIndexError
+	if err := mach.validateMessageIndex(ctx, sess.SenderKey, content.SessionID, evt, messageIndex); errors.As(err, &dupErr) {
+		log.Debug().Err(err).Msg("Failed to decrypt message due to unknown index and found duplicate")
+		return messageIndex, fmt.Errorf("%w (also failed to decrypt because earliest known index is %d)", dupErr, firstKnown)
+	} else if err != nil {
 		log.Debug().Err(err).Msg("Failed to check if message index is duplicate")
 		return messageIndex, fmt.Errorf("%w (failed to check if index is duplicate; received: %d, earliest known: %d)", olm.UnknownMessageIndex, messageIndex, firstKnown)
-	} else if !ok {
-		log.Debug().Msg("Failed to decrypt message due to unknown index and found duplicate")
-		return messageIndex, fmt.Errorf("%w %d (also failed to decrypt because earliest known index is %d)", DuplicateMessageIndex, messageIndex, firstKnown)
 	}
 	log.Debug().Msg("Failed to decrypt message due to unknown index, but index is not duplicate")
 	return messageIndex, fmt.Errorf("%w (not duplicate index; received: %d, earliest known: %d)", olm.UnknownMessageIndex, messageIndex, firstKnown)
@@ -192,7 +287,7 @@ func (mach *OlmMachine) actuallyDecryptMegolmEvent(ctx context.Context, evt *eve
 	if err != nil {
 		return nil, nil, 0, fmt.Errorf("failed to get group session: %w", err)
 	} else if sess == nil {
-		return nil, nil, 0, fmt.Errorf("%w (ID %s)", NoSessionFound, content.SessionID)
+		return nil, nil, 0, &NoSessionFoundError{RoomID: encryptionRoomID, SenderKey: content.SenderKey, SessionID: content.SessionID}
 	} else if content.SenderKey != "" && content.SenderKey != sess.SenderKey {
 		return sess, nil, 0, SenderKeyMismatch
 	}
@@ -203,10 +298,8 @@ func (mach *OlmMachine) actuallyDecryptMegolmEvent(ctx context.Context, evt *eve
 			return sess, nil, messageIndex, fmt.Errorf("failed to decrypt megolm event: %w", err)
 		}
 		return sess, nil, 0, fmt.Errorf("failed to decrypt megolm event: %w", err)
-	} else if ok, err := mach.CryptoStore.ValidateMessageIndex(ctx, sess.SenderKey, content.SessionID, evt.ID, messageIndex, evt.Timestamp); err != nil {
-		return sess, nil, messageIndex, fmt.Errorf("failed to check if message index is duplicate: %w", err)
-	} else if !ok {
-		return sess, nil, messageIndex, fmt.Errorf("%w %d", DuplicateMessageIndex, messageIndex)
+	} else if err = mach.validateMessageIndex(ctx, sess.SenderKey, content.SessionID, evt, messageIndex); err != nil {
+		return sess, nil, messageIndex, err
 	}
 
 	expectedMessageIndex := sess.RatchetSafety.NextIndex
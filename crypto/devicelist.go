@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/rs/zerolog"
 
@@ -88,11 +89,6 @@ func (mach *OlmMachine) storeDeviceSelfSignatures(ctx context.Context, userID id
 
 func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceToken string, includeUntracked bool) (data map[id.UserID]map[id.DeviceID]*id.Device) {
 	// TODO this function should probably return errors
-	req := &mautrix.ReqQueryKeys{
-		DeviceKeys: mautrix.DeviceKeysRequest{},
-		Timeout:    10 * 1000,
-		Token:      sinceToken,
-	}
 	log := mach.machOrContextLog(ctx)
 	if !includeUntracked {
 		var err error
@@ -104,6 +100,68 @@ func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceT
 	if len(users) == 0 {
 		return
 	}
+	batchSize := mach.KeyQueryBatchSize
+	if batchSize < 1 || batchSize > len(users) {
+		batchSize = len(users)
+	}
+	data = make(map[id.UserID]map[id.DeviceID]*id.Device)
+	for start := 0; start < len(users); start += batchSize {
+		end := start + batchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		mach.fetchKeysBatch(ctx, users[start:end], sinceToken, data)
+	}
+	return data
+}
+
+type deviceValidation struct {
+	userID     id.UserID
+	deviceID   id.DeviceID
+	deviceKeys mautrix.DeviceKeys
+	existing   *id.Device
+
+	device *id.Device
+	err    error
+}
+
+// validateDevices validates all the given devices using up to KeyQueryWorkers goroutines.
+func (mach *OlmMachine) validateDevices(validations []*deviceValidation) {
+	workers := mach.KeyQueryWorkers
+	if workers > len(validations) {
+		workers = len(validations)
+	}
+	if workers <= 1 {
+		for _, val := range validations {
+			val.device, val.err = mach.validateDevice(val.userID, val.deviceID, val.deviceKeys, val.existing)
+		}
+		return
+	}
+	queue := make(chan *deviceValidation)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for val := range queue {
+				val.device, val.err = mach.validateDevice(val.userID, val.deviceID, val.deviceKeys, val.existing)
+			}
+		}()
+	}
+	for _, val := range validations {
+		queue <- val
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (mach *OlmMachine) fetchKeysBatch(ctx context.Context, users []id.UserID, sinceToken string, data map[id.UserID]map[id.DeviceID]*id.Device) {
+	req := &mautrix.ReqQueryKeys{
+		DeviceKeys: mautrix.DeviceKeysRequest{},
+		Timeout:    10 * 1000,
+		Token:      sinceToken,
+	}
+	log := mach.machOrContextLog(ctx)
 	for _, userID := range users {
 		req.DeviceKeys[userID] = mautrix.DeviceIDList{}
 	}
@@ -117,37 +175,49 @@ func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceT
 		log.Warn().Interface("query_error", err).Str("server", server).Msg("Query keys failure for server")
 	}
 	log.Trace().Int("user_count", len(resp.DeviceKeys)).Msg("Query key result received")
-	data = make(map[id.UserID]map[id.DeviceID]*id.Device)
-	for userID, devices := range resp.DeviceKeys {
-		log := log.With().Str("user_id", userID.String()).Logger()
-		delete(req.DeviceKeys, userID)
 
-		newDevices := make(map[id.DeviceID]*id.Device)
+	allExistingDevices := make(map[id.UserID]map[id.DeviceID]*id.Device, len(resp.DeviceKeys))
+	validations := make(map[id.UserID][]*deviceValidation, len(resp.DeviceKeys))
+	var allValidations []*deviceValidation
+	for userID, devices := range resp.DeviceKeys {
 		existingDevices, err := mach.CryptoStore.GetDevices(userID)
 		if err != nil {
-			log.Warn().Err(err).Msg("Failed to get existing devices for user")
+			log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to get existing devices for user")
 			existingDevices = make(map[id.DeviceID]*id.Device)
 		}
+		allExistingDevices[userID] = existingDevices
+		for deviceID, deviceKeys := range devices {
+			val := &deviceValidation{userID: userID, deviceID: deviceID, deviceKeys: deviceKeys, existing: existingDevices[deviceID]}
+			validations[userID] = append(validations[userID], val)
+			allValidations = append(allValidations, val)
+		}
+	}
+	log.Trace().Int("device_count", len(allValidations)).Msg("Validating devices")
+	mach.validateDevices(allValidations)
+
+	for userID, devices := range resp.DeviceKeys {
+		log := log.With().Str("user_id", userID.String()).Logger()
+		delete(req.DeviceKeys, userID)
+
+		newDevices := make(map[id.DeviceID]*id.Device)
+		existingDevices := allExistingDevices[userID]
 
 		log.Debug().
 			Int("new_device_count", len(devices)).
 			Int("old_device_count", len(existingDevices)).
 			Msg("Updating devices in store")
 		changed := false
-		for deviceID, deviceKeys := range devices {
-			log := log.With().Str("device_id", deviceID.String()).Logger()
-			existing, ok := existingDevices[deviceID]
-			if !ok {
+		for _, val := range validations[userID] {
+			log := log.With().Str("device_id", val.deviceID.String()).Logger()
+			if val.existing == nil {
 				// New device
 				changed = true
 			}
-			log.Trace().Msg("Validating device")
-			newDevice, err := mach.validateDevice(userID, deviceID, deviceKeys, existing)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to validate device")
-			} else if newDevice != nil {
-				newDevices[deviceID] = newDevice
-				mach.storeDeviceSelfSignatures(ctx, userID, deviceID, resp)
+			if val.err != nil {
+				log.Error().Err(val.err).Msg("Failed to validate device")
+			} else if val.device != nil {
+				newDevices[val.deviceID] = val.device
+				mach.storeDeviceSelfSignatures(ctx, userID, val.deviceID, resp)
 			}
 		}
 		log.Trace().Int("new_device_count", len(newDevices)).Msg("Storing new device list")
@@ -189,8 +259,33 @@ func (mach *OlmMachine) fetchKeys(ctx context.Context, users []id.UserID, sinceT
 	mach.storeCrossSigningKeys(ctx, resp.MasterKeys, resp.DeviceKeys)
 	mach.storeCrossSigningKeys(ctx, resp.SelfSigningKeys, resp.DeviceKeys)
 	mach.storeCrossSigningKeys(ctx, resp.UserSigningKeys, resp.DeviceKeys)
+}
 
-	return data
+// refreshOutdatedDevices fetches the device lists of the given users that have been flagged as outdated.
+// If fetching fails, the users keep the outdated flag and their previously stored devices are used.
+func (mach *OlmMachine) refreshOutdatedDevices(ctx context.Context, users []id.UserID) {
+	log := mach.machOrContextLog(ctx)
+	outdated, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get users with outdated device lists")
+		return
+	} else if len(outdated) == 0 {
+		return
+	}
+	isOutdated := make(map[id.UserID]struct{}, len(outdated))
+	for _, userID := range outdated {
+		isOutdated[userID] = struct{}{}
+	}
+	var refresh []id.UserID
+	for _, userID := range users {
+		if _, ok := isOutdated[userID]; ok {
+			refresh = append(refresh, userID)
+		}
+	}
+	if len(refresh) > 0 {
+		log.Debug().Strs("users", strishArray(refresh)).Msg("Refreshing outdated device lists")
+		mach.fetchKeys(ctx, refresh, "", true)
+	}
 }
 
 // OnDevicesChanged finds all shared rooms with the given user and invalidates outbound sessions in those rooms.
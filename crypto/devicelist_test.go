@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type testKeyQueryServer struct {
+	fail atomic.Bool
+
+	lock    sync.Mutex
+	queries [][]id.UserID
+	devices map[id.UserID]*mautrix.DeviceKeys
+}
+
+// newMachineWithKeyQueryServer creates a machine whose client sends requests to a test server that returns
+// one signed device for every user in /keys/query requests and records the queried users.
+func newMachineWithKeyQueryServer(t *testing.T, userID id.UserID) (*OlmMachine, *testKeyQueryServer) {
+	srv := &testKeyQueryServer{devices: make(map[id.UserID]*mautrix.DeviceKeys)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/keys/query" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req mautrix.ReqQueryKeys
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := mautrix.RespQueryKeys{DeviceKeys: make(map[id.UserID]map[id.DeviceID]mautrix.DeviceKeys)}
+		srv.lock.Lock()
+		var queried []id.UserID
+		for queriedUser := range req.DeviceKeys {
+			queried = append(queried, queriedUser)
+			deviceKeys, ok := srv.devices[queriedUser]
+			if !ok {
+				deviceKeys = NewOlmAccount().getInitialKeys(queriedUser, "DEVICE")
+				srv.devices[queriedUser] = deviceKeys
+			}
+			resp.DeviceKeys[queriedUser] = map[id.DeviceID]mautrix.DeviceKeys{deviceKeys.DeviceID: *deviceKeys}
+		}
+		srv.queries = append(srv.queries, queried)
+		srv.lock.Unlock()
+		if srv.fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "test failure"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&resp)
+	}))
+	t.Cleanup(server.Close)
+	mach := newMachine(t, userID)
+	mach.Client.HomeserverURL, _ = url.Parse(server.URL)
+	return mach, srv
+}
+
+func (srv *testKeyQueryServer) popQueries() [][]id.UserID {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	queries := srv.queries
+	srv.queries = nil
+	for _, query := range queries {
+		sort.Slice(query, func(i, j int) bool {
+			return query[i] < query[j]
+		})
+	}
+	return queries
+}
+
+func TestFetchKeysBatched(t *testing.T) {
+	mach, srv := newMachineWithKeyQueryServer(t, "@user1:example.com")
+	mach.KeyQueryBatchSize = 2
+	mach.KeyQueryWorkers = 3
+	users := []id.UserID{"@a:example.com", "@b:example.com", "@c:example.com", "@d:example.com", "@e:example.com"}
+
+	data := mach.fetchKeys(context.TODO(), users, "", true)
+	assert.Len(t, srv.popQueries(), 3)
+	require.Len(t, data, len(users))
+	for _, userID := range users {
+		require.Contains(t, data[userID], id.DeviceID("DEVICE"))
+		assert.Equal(t, srv.devices[userID].Keys.GetEd25519("DEVICE"), data[userID]["DEVICE"].SigningKey)
+		devices, err := mach.CryptoStore.GetDevices(userID)
+		require.NoError(t, err)
+		assert.Len(t, devices, 1)
+	}
+
+	mach.KeyQueryBatchSize = 0
+	mach.fetchKeys(context.TODO(), users, "", true)
+	assert.Len(t, srv.popQueries(), 1)
+}
+
+func TestHandleDeviceListsOutdated(t *testing.T) {
+	mach, srv := newMachineWithKeyQueryServer(t, "@user1:example.com")
+	mach.fetchKeys(context.TODO(), []id.UserID{"@changed:example.com", "@left:example.com", "@unchanged:example.com"}, "", true)
+	srv.popQueries()
+
+	srv.fail.Store(true)
+	mach.HandleDeviceLists(&mautrix.DeviceLists{
+		Changed: []id.UserID{"@changed:example.com", "@untracked:example.com"},
+		Left:    []id.UserID{"@left:example.com"},
+	}, "")
+	// Only tracked users are queried, and users who left are only flagged as outdated
+	assert.Equal(t, [][]id.UserID{{"@changed:example.com"}}, srv.popQueries())
+	outdated, err := mach.CryptoStore.GetOutdatedTrackedUsers()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []id.UserID{"@changed:example.com", "@left:example.com"}, outdated)
+
+	srv.fail.Store(false)
+	mach.refreshOutdatedDevices(context.TODO(), []id.UserID{"@changed:example.com", "@unchanged:example.com"})
+	assert.Equal(t, [][]id.UserID{{"@changed:example.com"}}, srv.popQueries())
+	outdated, err = mach.CryptoStore.GetOutdatedTrackedUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@left:example.com"}, outdated)
+}
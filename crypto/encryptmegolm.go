@@ -22,16 +22,54 @@ import (
 )
 
 var (
+	// Deprecated: ShareGroupSession no longer returns this error, it shares the existing session with new devices instead.
 	AlreadyShared  = errors.New("group session already shared")
 	NoGroupSession = errors.New("no group session created")
+
+	ErrUnsupportedAlgorithm = errors.New("unsupported room encryption algorithm")
+	ErrUnverifiedDevices    = errors.New("group session was not shared with unverified devices")
 )
 
-func getRelatesTo(content interface{}) *event.RelatesTo {
+// UnverifiedDevicesError is returned by ShareGroupSession when ShareToUnverifiedDevices is false and the session
+// was withheld from some devices because they're not verified. The session is still shared with all other devices,
+// so the caller can decide whether to proceed with sending.
+type UnverifiedDevicesError struct {
+	Devices map[id.UserID][]id.DeviceID
+}
+
+func (err *UnverifiedDevicesError) Error() string {
+	count := 0
+	for _, devices := range err.Devices {
+		count += len(devices)
+	}
+	return fmt.Sprintf("%s (%d devices of %d users)", ErrUnverifiedDevices.Error(), count, len(err.Devices))
+}
+
+func (err *UnverifiedDevicesError) Is(other error) bool {
+	return other == ErrUnverifiedDevices
+}
+
+// checkRoomAlgorithm returns ErrUnsupportedAlgorithm if the room's m.room.encryption event declares an algorithm
+// other than m.megolm.v1.aes-sha2. Rooms whose encryption event isn't known or doesn't specify an algorithm
+// are assumed to use megolm.
+func (mach *OlmMachine) checkRoomAlgorithm(roomID id.RoomID) error {
+	encryptionEvent := mach.StateStore.GetEncryptionEvent(roomID)
+	if encryptionEvent != nil && encryptionEvent.Algorithm != "" && encryptionEvent.Algorithm != id.AlgorithmMegolmV1 {
+		return fmt.Errorf("%w %q in %s", ErrUnsupportedAlgorithm, encryptionEvent.Algorithm, roomID)
+	}
+	return nil
+}
+
+func unwrapContent(content interface{}) interface{} {
 	contentStruct, ok := content.(*event.Content)
 	if ok {
-		content = contentStruct.Parsed
+		return contentStruct.Parsed
 	}
-	relatable, ok := content.(event.Relatable)
+	return content
+}
+
+func getRelatesTo(content interface{}) *event.RelatesTo {
+	relatable, ok := unwrapContent(content).(event.Relatable)
 	if ok {
 		return relatable.OptionalGetRelatesTo()
 	}
@@ -39,17 +77,22 @@ func getRelatesTo(content interface{}) *event.RelatesTo {
 }
 
 func getMentions(content interface{}) *event.Mentions {
-	contentStruct, ok := content.(*event.Content)
-	if ok {
-		content = contentStruct.Parsed
-	}
-	message, ok := content.(*event.MessageEventContent)
+	message, ok := unwrapContent(content).(*event.MessageEventContent)
 	if ok {
 		return message.Mentions
 	}
 	return nil
 }
 
+// plaintextMetadata contains the fields that are copied from the plaintext to the unencrypted content
+// for content types that aren't event.Relatable, e.g. maps or structs of custom event types.
+type plaintextMetadata struct {
+	Content struct {
+		RelatesTo *event.RelatesTo `json:"m.relates_to,omitempty"`
+		Mentions  *event.Mentions  `json:"m.mentions,omitempty"`
+	} `json:"content"`
+}
+
 type rawMegolmEvent struct {
 	RoomID  id.RoomID   `json:"room_id"`
 	Type    event.Type  `json:"type"`
@@ -79,9 +122,18 @@ func parseMessageIndex(ciphertext []byte) (uint, error) {
 
 // EncryptMegolmEvent encrypts data with the m.megolm.v1.aes-sha2 algorithm.
 //
+// Any event type can be encrypted, and the content can be anything that can be marshaled into a JSON object,
+// e.g. a content struct, a map or an event.Content. The m.relates_to field (and m.mentions if PlaintextMentions
+// is enabled) is copied to the unencrypted content so that the server can aggregate relations.
+//
 // If you use the event.Content struct, make sure you pass a pointer to the struct,
 // as JSON serialization will not work correctly otherwise.
+//
+// If the room's encryption event declares a different algorithm, ErrUnsupportedAlgorithm is returned.
 func (mach *OlmMachine) EncryptMegolmEvent(ctx context.Context, roomID id.RoomID, evtType event.Type, content interface{}) (*event.EncryptedEventContent, error) {
+	if err := mach.checkRoomAlgorithm(roomID); err != nil {
+		return nil, err
+	}
 	mach.megolmEncryptLock.Lock()
 	defer mach.megolmEncryptLock.Unlock()
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
@@ -89,6 +141,11 @@ func (mach *OlmMachine) EncryptMegolmEvent(ctx context.Context, roomID id.RoomID
 		return nil, fmt.Errorf("failed to get outbound group session: %w", err)
 	} else if session == nil {
 		return nil, NoGroupSession
+	} else if session.Expired() {
+		session, err = mach.rotateOutboundGroupSession(ctx, session)
+		if err != nil {
+			return nil, err
+		}
 	}
 	plaintext, err := json.Marshal(&rawMegolmEvent{
 		RoomID:  roomID,
@@ -133,9 +190,87 @@ func (mach *OlmMachine) EncryptMegolmEvent(ctx context.Context, roomID id.RoomID
 	if mach.PlaintextMentions {
 		encrypted.Mentions = getMentions(content)
 	}
+	if _, isRelatable := unwrapContent(content).(event.Relatable); !isRelatable {
+		var meta plaintextMetadata
+		if err = json.Unmarshal(plaintext, &meta); err != nil {
+			log.Warn().Err(err).Msg("Failed to find relation in plaintext of encrypted event")
+		} else {
+			encrypted.RelatesTo = meta.Content.RelatesTo
+			if mach.PlaintextMentions {
+				encrypted.Mentions = meta.Content.Mentions
+			}
+		}
+	}
 	return encrypted, nil
 }
 
+// roomMemberStateStore is implemented by state stores that can list room members, like mautrix.StateStore.
+type roomMemberStateStore interface {
+	GetRoomJoinedOrInvitedMembers(roomID id.RoomID) ([]id.UserID, error)
+}
+
+// rotateOutboundGroupSession removes an expired outbound group session and shares a new one with the room members.
+// If the state store can't list room members, SessionExpired is returned so that the caller can share the new session.
+//
+// The inbound copy of the old session is kept, so events encrypted with it remain decryptable.
+// The caller must hold megolmEncryptLock.
+func (mach *OlmMachine) rotateOutboundGroupSession(ctx context.Context, session *OutboundGroupSession) (*OutboundGroupSession, error) {
+	log := mach.machOrContextLog(ctx).With().
+		Str("room_id", session.RoomID.String()).
+		Str("session_id", session.ID().String()).
+		Logger()
+	log.Debug().
+		Int("message_count", session.MessageCount).
+		Int("max_messages", session.MaxMessages).
+		Dur("max_age", session.MaxAge).
+		Time("creation_time", session.CreationTime).
+		Msg("Outbound group session expired, rotating")
+	err := mach.CryptoStore.RemoveOutboundGroupSession(session.RoomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove expired outbound group session: %w", err)
+	}
+	memberStore, ok := mach.StateStore.(roomMemberStateStore)
+	if !ok {
+		return nil, SessionExpired
+	}
+	users, err := memberStore.GetRoomJoinedOrInvitedMembers(session.RoomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room members to share new group session: %w", err)
+	}
+	var unverifiedErr *UnverifiedDevicesError
+	err = mach.shareGroupSession(ctx, session.RoomID, users)
+	if errors.As(err, &unverifiedErr) {
+		// The new session was still shared with all verified devices
+		log.Debug().Err(err).Msg("New group session was withheld from unverified devices")
+	} else if err != nil {
+		return nil, err
+	}
+	newSession, err := mach.CryptoStore.GetOutboundGroupSession(session.RoomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get new outbound group session: %w", err)
+	} else if newSession == nil {
+		return nil, NoGroupSession
+	}
+	return newSession, nil
+}
+
+// InvalidateOutboundSession removes the outbound group session of the given room, so that a new session is created
+// and shared the next time a message is sent. This should be called when a member leaves the room, which is done
+// automatically by HandleMemberEvent.
+//
+// This waits for any in-progress EncryptMegolmEvent or ShareGroupSession call to finish, so that the session isn't
+// removed while it's being used or shared.
+func (mach *OlmMachine) InvalidateOutboundSession(ctx context.Context, roomID id.RoomID) error {
+	mach.megolmEncryptLock.Lock()
+	defer mach.megolmEncryptLock.Unlock()
+	err := mach.CryptoStore.RemoveOutboundGroupSession(roomID)
+	if err != nil {
+		return fmt.Errorf("failed to remove outbound group session: %w", err)
+	}
+	mach.machOrContextLog(ctx).Debug().Str("room_id", roomID.String()).Msg("Invalidated outbound group session")
+	return nil
+}
+
 func (mach *OlmMachine) newOutboundGroupSession(ctx context.Context, roomID id.RoomID) *OutboundGroupSession {
 	session := NewOutboundGroupSession(roomID, mach.StateStore.GetEncryptionEvent(roomID))
 	if !mach.DontStoreOutboundKeys {
@@ -160,16 +295,27 @@ func strishArray[T ~string](arr []T) []string {
 
 // ShareGroupSession shares a group session for a specific room with all the devices of the given user list.
 //
+// This can be called before EncryptMegolmEvent to warm up the session, e.g. when a burst of messages is expected.
+// If the room already has a shared session that hasn't expired, the session is only shared with devices that
+// don't have it yet, so calling this again with the same user list is a no-op.
+//
 // For devices with TrustStateBlacklisted, a m.room_key.withheld event with code=m.blacklisted is sent.
-// If AllowUnverifiedDevices is false, a similar event with code=m.unverified is sent to devices with TrustStateUnset
+// For devices whose trust state is below SendKeysMinTrust, a similar event with code=m.unverified is sent.
+// If ShareToUnverifiedDevices is false, unverified devices get the same event, and they're reported to the caller
+// by returning an *UnverifiedDevicesError after the session is shared with the other devices.
 func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID, users []id.UserID) error {
+	if err := mach.checkRoomAlgorithm(roomID); err != nil {
+		return err
+	}
 	mach.megolmEncryptLock.Lock()
 	defer mach.megolmEncryptLock.Unlock()
+	return mach.shareGroupSession(ctx, roomID, users)
+}
+
+func (mach *OlmMachine) shareGroupSession(ctx context.Context, roomID id.RoomID, users []id.UserID) error {
 	session, err := mach.CryptoStore.GetOutboundGroupSession(roomID)
 	if err != nil {
 		return fmt.Errorf("failed to get previous outbound group session: %w", err)
-	} else if session != nil && session.Shared && !session.Expired() {
-		return AlreadyShared
 	}
 	log := mach.machOrContextLog(ctx).With().
 		Str("room_id", roomID.String()).
@@ -178,18 +324,23 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 	ctx = log.WithContext(ctx)
 	if session == nil || session.Expired() {
 		session = mach.newOutboundGroupSession(ctx, roomID)
+	} else if session.Shared {
+		log.Debug().Msg("Group session already shared, sharing with new devices only")
 	}
 	log = log.With().Str("session_id", session.ID().String()).Logger()
 	ctx = log.WithContext(ctx)
 	log.Debug().Strs("users", strishArray(users)).Msg("Sharing group session for room")
 
 	withheldCount := 0
+	unverifiedDevices := make(map[id.UserID][]id.DeviceID)
 	toDeviceWithheld := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
 	olmSessions := make(map[id.UserID]map[id.DeviceID]deviceSessionWrapper)
 	missingSessions := make(map[id.UserID]map[id.DeviceID]*id.Device)
 	missingUserSessions := make(map[id.DeviceID]*id.Device)
 	var fetchKeys []id.UserID
 
+	mach.refreshOutdatedDevices(ctx, users)
+
 	for _, userID := range users {
 		log := log.With().Str("target_user_id", userID.String()).Logger()
 		devices, err := mach.CryptoStore.GetDevices(userID)
@@ -204,7 +355,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 			log.Trace().Msg("Trying to find olm session to encrypt megolm session for user")
 			toDeviceWithheld.Messages[userID] = make(map[id.DeviceID]*event.Content)
 			olmSessions[userID] = make(map[id.DeviceID]deviceSessionWrapper)
-			mach.findOlmSessionsForUser(ctx, session, userID, devices, olmSessions[userID], toDeviceWithheld.Messages[userID], missingUserSessions)
+			mach.findOlmSessionsForUser(ctx, session, userID, devices, olmSessions[userID], toDeviceWithheld.Messages[userID], missingUserSessions, unverifiedDevices)
 			log.Debug().
 				Int("olm_session_count", len(olmSessions[userID])).
 				Int("withheld_count", len(toDeviceWithheld.Messages[userID])).
@@ -258,7 +409,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 
 		log := log.With().Str("target_user_id", userID.String()).Logger()
 		log.Trace().Msg("Trying to find olm session to encrypt megolm session for user (post-fetch retry)")
-		mach.findOlmSessionsForUser(ctx, session, userID, devices, output, withheld, nil)
+		mach.findOlmSessionsForUser(ctx, session, userID, devices, output, withheld, nil, unverifiedDevices)
 		log.Debug().
 			Int("olm_session_count", len(output)).
 			Int("withheld_count", len(withheld)).
@@ -292,7 +443,13 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 
 	log.Debug().Msg("Group session successfully shared")
 	session.Shared = true
-	return mach.CryptoStore.AddOutboundGroupSession(session)
+	err = mach.CryptoStore.AddOutboundGroupSession(session)
+	if err != nil {
+		return err
+	} else if len(unverifiedDevices) > 0 {
+		return &UnverifiedDevicesError{Devices: unverifiedDevices}
+	}
+	return nil
 }
 
 func (mach *OlmMachine) encryptAndSendGroupSession(ctx context.Context, session *OutboundGroupSession, olmSessions map[id.UserID]map[id.DeviceID]deviceSessionWrapper) error {
@@ -323,6 +480,10 @@ func (mach *OlmMachine) encryptAndSendGroupSession(ctx context.Context, session
 		}
 	}
 
+	if deviceCount == 0 {
+		log.Debug().Msg("No devices to share group session with")
+		return nil
+	}
 	log.Debug().
 		Int("device_count", deviceCount).
 		Int("user_count", len(toDevice.Messages)).
@@ -331,7 +492,10 @@ func (mach *OlmMachine) encryptAndSendGroupSession(ctx context.Context, session
 	return err
 }
 
-func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*id.Device, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*id.Device) {
+func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*id.Device, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*id.Device, unverifiedOutput map[id.UserID][]id.DeviceID) {
+	if session.Users == nil {
+		session.Users = make(map[UserDevice]OGSState)
+	}
 	for deviceID, device := range devices {
 		log := zerolog.Ctx(ctx).With().
 			Str("target_user_id", userID.String()).
@@ -367,6 +531,20 @@ func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *Out
 				Reason:    "This device does not encrypt messages for unverified devices",
 			}}
 			session.Users[userKey] = OGSIgnored
+		} else if !mach.ShareToUnverifiedDevices && trustState < id.TrustStateCrossSignedVerified {
+			log.Debug().
+				Str("device_trust", trustState.String()).
+				Msg("Not encrypting group session for device: device is not verified")
+			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+				RoomID:    session.RoomID,
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: session.ID(),
+				SenderKey: mach.account.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnverified,
+				Reason:    "This device only encrypts messages for verified devices",
+			}}
+			session.Users[userKey] = OGSIgnored
+			unverifiedOutput[userID] = append(unverifiedOutput[userID], deviceID)
 		} else if deviceSession, err := mach.CryptoStore.GetLatestSession(device.IdentityKey); err != nil {
 			log.Error().Err(err).Msg("Failed to get olm session to encrypt group session")
 		} else if deviceSession == nil {
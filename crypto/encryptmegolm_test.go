@@ -0,0 +1,353 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestShareGroupSessionIdempotent(t *testing.T) {
+	for storeName, store := range getCryptoStores(t) {
+		t.Run(storeName, func(t *testing.T) {
+			mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+			mach.CryptoStore = store
+			require.NoError(t, mach.CryptoStore.PutDevices("@user1:example.com", map[id.DeviceID]*id.Device{
+				mach.Client.DeviceID: mach.OwnIdentity(),
+			}))
+			require.NoError(t, mach.CryptoStore.PutDevices("@user2:example.com", map[id.DeviceID]*id.Device{
+				"dev": {UserID: "@user2:example.com", DeviceID: "dev", Trust: id.TrustStateBlacklisted},
+			}))
+			users := []id.UserID{"@user1:example.com", "@user2:example.com"}
+
+			require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", users))
+			// The blacklisted device gets withheld notices with both event types
+			receiveToDevice(t, sent)
+			receiveToDevice(t, sent)
+			session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+			require.NoError(t, err)
+			require.NotNil(t, session)
+			assert.True(t, session.Shared)
+			assert.Equal(t, OGSIgnored, session.Users[UserDevice{UserID: "@user2:example.com", DeviceID: "dev"}])
+
+			require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", users))
+			sessionAfter, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+			require.NoError(t, err)
+			assert.Equal(t, session.ID(), sessionAfter.ID())
+			assert.Empty(t, sent)
+		})
+	}
+}
+
+type unknownAlgorithmStateStore struct {
+	mockStateStore
+}
+
+func (unknownAlgorithmStateStore) GetEncryptionEvent(id.RoomID) *event.EncryptionEventContent {
+	return &event.EncryptionEventContent{Algorithm: "com.example.unknown"}
+}
+
+func TestEncryptUnsupportedAlgorithm(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	mach.StateStore = unknownAlgorithmStateStore{}
+
+	err := mach.ShareGroupSession(context.TODO(), "!room:example.com", []id.UserID{"@user1:example.com"})
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+	_, err = mach.EncryptMegolmEvent(context.TODO(), "!room:example.com", event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hello",
+	})
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+	session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestShareGroupSessionOnlyToVerifiedDevices(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	mach.ShareToUnverifiedDevices = false
+	require.NoError(t, mach.CryptoStore.PutDevices("@user2:example.com", map[id.DeviceID]*id.Device{
+		"dev": {UserID: "@user2:example.com", DeviceID: "dev", IdentityKey: "identitykey", SigningKey: "signingkey"},
+	}))
+
+	err := mach.ShareGroupSession(context.TODO(), "!room:example.com", []id.UserID{"@user2:example.com"})
+	require.ErrorIs(t, err, ErrUnverifiedDevices)
+	var unverifiedErr *UnverifiedDevicesError
+	require.ErrorAs(t, err, &unverifiedErr)
+	assert.Equal(t, map[id.UserID][]id.DeviceID{"@user2:example.com": {"dev"}}, unverifiedErr.Devices)
+
+	for _, expectedType := range []event.Type{event.ToDeviceOrgMatrixRoomKeyWithheld, event.ToDeviceRoomKeyWithheld} {
+		withheld := receiveToDevice(t, sent)
+		assert.Equal(t, expectedType.Type, withheld.eventType)
+		var content event.RoomKeyWithheldEventContent
+		require.NoError(t, json.Unmarshal(withheld.messages["@user2:example.com"]["dev"], &content))
+		assert.Equal(t, event.RoomKeyWithheldUnverified, content.Code)
+	}
+
+	session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	assert.True(t, session.Shared)
+}
+
+func TestShareGroupSessionSkipsBlacklistedDevice(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	machineIn := newMachine(t, "@user2:example.com")
+	var otk mautrix.OneTimeKey
+	for _, otk = range machineIn.account.getOneTimeKeys("@user2:example.com", "dev", 0, 1) {
+		break
+	}
+	olmSession, err := mach.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk.Key)
+	require.NoError(t, err)
+	require.NoError(t, mach.CryptoStore.AddSession(machineIn.account.IdentityKey(), wrapSession(olmSession)))
+	require.NoError(t, mach.CryptoStore.PutDevices("@user2:example.com", map[id.DeviceID]*id.Device{
+		"dev": {UserID: "@user2:example.com", DeviceID: "dev", IdentityKey: machineIn.account.IdentityKey(), SigningKey: machineIn.account.SigningKey()},
+	}))
+	users := []id.UserID{"@user2:example.com"}
+
+	// mockStateStore says room1 is the only room shared with other users
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "room1", users))
+	assert.Equal(t, event.ToDeviceEncrypted.Type, receiveToDevice(t, sent).eventType)
+
+	require.NoError(t, mach.SetDeviceTrust(context.TODO(), "@user2:example.com", "dev", id.TrustStateBlacklisted))
+	stored, err := mach.CryptoStore.GetDevice("@user2:example.com", "dev")
+	require.NoError(t, err)
+	assert.Equal(t, id.TrustStateBlacklisted, stored.Trust)
+	session, err := mach.CryptoStore.GetOutboundGroupSession("room1")
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "room1", users))
+	for _, expectedType := range []event.Type{event.ToDeviceOrgMatrixRoomKeyWithheld, event.ToDeviceRoomKeyWithheld} {
+		withheld := receiveToDevice(t, sent)
+		assert.Equal(t, expectedType.Type, withheld.eventType)
+		var content event.RoomKeyWithheldEventContent
+		require.NoError(t, json.Unmarshal(withheld.messages["@user2:example.com"]["dev"], &content))
+		assert.Equal(t, event.RoomKeyWithheldBlacklisted, content.Code)
+	}
+	assert.Empty(t, sent)
+
+	err = mach.SetDeviceTrust(context.TODO(), "@user2:example.com", "unknown", id.TrustStateVerified)
+	assert.ErrorIs(t, err, ErrUnknownDevice)
+}
+
+type memberListStateStore struct {
+	mockStateStore
+	members []id.UserID
+}
+
+func (store memberListStateStore) GetRoomJoinedOrInvitedMembers(id.RoomID) ([]id.UserID, error) {
+	return store.members, nil
+}
+
+func encryptTestMessage(t *testing.T, mach *OlmMachine) *event.Event {
+	encrypted, err := mach.EncryptMegolmEvent(context.TODO(), "!room:example.com", event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hello",
+	})
+	require.NoError(t, err)
+	return &event.Event{
+		Content: event.Content{Parsed: encrypted},
+		Type:    event.EventEncrypted,
+		ID:      "$event1",
+		RoomID:  "!room:example.com",
+		Sender:  mach.Client.UserID,
+	}
+}
+
+func TestEncryptMegolmEvent_RotatesAfterMaxMessages(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	// mockStateStore sets rotation_period_msgs to 3
+	mach.StateStore = memberListStateStore{members: []id.UserID{"@user1:example.com"}}
+	require.NoError(t, mach.CryptoStore.PutDevices("@user1:example.com", map[id.DeviceID]*id.Device{
+		mach.Client.DeviceID: mach.OwnIdentity(),
+	}))
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", []id.UserID{"@user1:example.com"}))
+
+	firstEvt := encryptTestMessage(t, mach)
+	firstSessionID := firstEvt.Content.AsEncrypted().SessionID
+	for i := 0; i < 2; i++ {
+		evt := encryptTestMessage(t, mach)
+		assert.Equal(t, firstSessionID, evt.Content.AsEncrypted().SessionID)
+	}
+	evt := encryptTestMessage(t, mach)
+	assert.NotEqual(t, firstSessionID, evt.Content.AsEncrypted().SessionID)
+	session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, evt.Content.AsEncrypted().SessionID, session.ID())
+	assert.Equal(t, 1, session.MessageCount)
+
+	// Messages encrypted with the old session must remain decryptable
+	decrypted, err := mach.DecryptMegolmEvent(context.TODO(), firstEvt)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", decrypted.Content.AsMessage().Body)
+}
+
+type customTestContent struct {
+	Answer    string           `json:"answer"`
+	RelatesTo *event.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func TestEncryptMegolmEvent_CustomEventTypes(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	mach.PlaintextMentions = true
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", nil))
+
+	pollResponse := event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	for name, content := range map[string]interface{}{
+		"map": map[string]interface{}{
+			"answer":       "yes",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.reference", "event_id": "$poll"},
+			"m.mentions":   map[string]interface{}{"user_ids": []string{"@user2:example.com"}},
+		},
+		"struct": &customTestContent{Answer: "yes", RelatesTo: (&event.RelatesTo{}).SetReplace("$poll")},
+		"raw content": &event.Content{Raw: map[string]interface{}{
+			"answer":       "yes",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.reference", "event_id": "$poll"},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			encrypted, err := mach.EncryptMegolmEvent(context.TODO(), "!room:example.com", pollResponse, content)
+			require.NoError(t, err)
+			require.NotNil(t, encrypted.RelatesTo)
+			assert.Equal(t, id.EventID("$poll"), encrypted.RelatesTo.EventID)
+			if name == "map" {
+				require.NotNil(t, encrypted.Mentions)
+				assert.Equal(t, []id.UserID{"@user2:example.com"}, encrypted.Mentions.UserIDs)
+			} else {
+				assert.Nil(t, encrypted.Mentions)
+			}
+
+			decrypted, err := mach.DecryptMegolmEvent(context.TODO(), &event.Event{
+				Content: event.Content{Parsed: encrypted},
+				Type:    event.EventEncrypted,
+				ID:      id.EventID("$" + name),
+				RoomID:  "!room:example.com",
+				Sender:  mach.Client.UserID,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, pollResponse.Type, decrypted.Type.Type)
+			assert.Equal(t, "yes", decrypted.Content.Raw["answer"])
+		})
+	}
+}
+
+func TestDecryptMegolmEvent_DuplicateMessageIndex(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", nil))
+	evt := encryptTestMessage(t, mach)
+	evt.Timestamp = 1000
+
+	_, err := mach.DecryptMegolmEvent(context.TODO(), evt)
+	require.NoError(t, err)
+	// Exact duplicates (e.g. from a retried sync) are harmless
+	decrypted, err := mach.DecryptMegolmEvent(context.TODO(), evt)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", decrypted.Content.AsMessage().Body)
+
+	replayed := *evt
+	replayed.ID = "$event2"
+	replayed.Timestamp = 2000
+	_, err = mach.DecryptMegolmEvent(context.TODO(), &replayed)
+	assert.ErrorIs(t, err, DuplicateMessageIndex)
+	var dupErr *DuplicateMessageIndexError
+	require.ErrorAs(t, err, &dupErr)
+	assert.Equal(t, id.EventID("$event1"), dupErr.OriginalEventID)
+	assert.Equal(t, int64(1000), dupErr.OriginalTimestamp)
+}
+
+func TestDecryptMegolmEvent_Errors(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", nil))
+	evt := encryptTestMessage(t, mach)
+	content := evt.Content.AsEncrypted()
+
+	unknownSession := *evt
+	unknownSession.Content = event.Content{Parsed: &event.EncryptedEventContent{
+		Algorithm:        id.AlgorithmMegolmV1,
+		SenderKey:        content.SenderKey,
+		SessionID:        "unknown",
+		MegolmCiphertext: content.MegolmCiphertext,
+	}}
+	_, err := mach.DecryptMegolmEvent(context.TODO(), &unknownSession)
+	assert.ErrorIs(t, err, NoSessionFound)
+	var decryptErr *DecryptionError
+	require.ErrorAs(t, err, &decryptErr)
+	assert.Same(t, &unknownSession, decryptErr.Event)
+	var noSessionErr *NoSessionFoundError
+	require.ErrorAs(t, err, &noSessionErr)
+	assert.Equal(t, NoSessionFoundError{RoomID: "!room:example.com", SenderKey: content.SenderKey, SessionID: "unknown"}, *noSessionErr)
+
+	// Copy the session to another room, so that it's found but the payload is for the wrong room
+	sess, err := mach.CryptoStore.GetGroupSession("!room:example.com", content.SenderKey, content.SessionID)
+	require.NoError(t, err)
+	require.NoError(t, mach.CryptoStore.PutGroupSession("!other:example.com", content.SenderKey, content.SessionID, sess))
+	wrongRoom := *evt
+	wrongRoom.RoomID = "!other:example.com"
+	_, err = mach.DecryptMegolmEvent(context.TODO(), &wrongRoom)
+	assert.ErrorIs(t, err, WrongRoom)
+	require.ErrorAs(t, err, &decryptErr)
+	assert.Same(t, &wrongRoom, decryptErr.Event)
+}
+
+func TestEncryptMegolmEvent_ExpiredWithoutMemberList(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", nil))
+	session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	session.CreationTime = time.Now().Add(-8 * 24 * time.Hour)
+	require.NoError(t, mach.CryptoStore.UpdateOutboundGroupSession(session))
+
+	_, err = mach.EncryptMegolmEvent(context.TODO(), "!room:example.com", event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hello",
+	})
+	assert.ErrorIs(t, err, SessionExpired)
+	session, err = mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func TestInvalidateOutboundSession(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "!room:example.com", nil))
+	require.NoError(t, mach.InvalidateOutboundSession(context.TODO(), "!room:example.com"))
+	session, err := mach.CryptoStore.GetOutboundGroupSession("!room:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	_, err = mach.EncryptMegolmEvent(context.TODO(), "!room:example.com", event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "hello",
+	})
+	assert.ErrorIs(t, err, NoGroupSession)
+}
+
+func TestEncryptMegolmEvent_RotatesWithUnverifiedDevices(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	mach.ShareToUnverifiedDevices = false
+	mach.StateStore = memberListStateStore{members: []id.UserID{"@user1:example.com", "@user2:example.com"}}
+	require.NoError(t, mach.CryptoStore.PutDevices("@user2:example.com", map[id.DeviceID]*id.Device{
+		"dev": {UserID: "@user2:example.com", DeviceID: "dev", IdentityKey: "identitykey", SigningKey: "signingkey"},
+	}))
+	err := mach.ShareGroupSession(context.TODO(), "!room:example.com", []id.UserID{"@user1:example.com", "@user2:example.com"})
+	require.ErrorIs(t, err, ErrUnverifiedDevices)
+
+	firstEvt := encryptTestMessage(t, mach)
+	encryptTestMessage(t, mach)
+	encryptTestMessage(t, mach)
+	// The session is rotated even though the new session is withheld from the unverified device
+	evt := encryptTestMessage(t, mach)
+	assert.NotEqual(t, firstEvt.Content.AsEncrypted().SessionID, evt.Content.AsEncrypted().SessionID)
+}
@@ -102,6 +102,7 @@ func (mach *OlmMachine) createOutboundSessions(ctx context.Context, input map[id
 				Str("peer_user_id", userID.String()).
 				Str("peer_device_id", deviceID.String()).
 				Str("peer_otk_id", keyID.String()).
+				Bool("fallback_key", oneTimeKey.Fallback).
 				Logger()
 			keyAlg, _ := keyID.Parse()
 			if keyAlg != id.KeyAlgorithmSignedCurve25519 {
@@ -117,9 +118,12 @@ func (mach *OlmMachine) createOutboundSessions(ctx context.Context, input map[id
 				log.Error().Err(err).Msg("Failed to create outbound session with claimed one-time key")
 			} else {
 				wrapped := wrapSession(sess)
+				wrapped.UsedFallbackKey = oneTimeKey.Fallback
 				err = mach.CryptoStore.AddSession(identity.IdentityKey, wrapped)
 				if err != nil {
 					log.Error().Err(err).Msg("Failed to store created outbound session")
+				} else if oneTimeKey.Fallback {
+					log.Debug().Msg("Created new Olm session using a fallback key, the key may have been used for other sessions too")
 				} else {
 					log.Debug().Msg("Created new Olm session")
 				}
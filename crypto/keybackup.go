@@ -0,0 +1,261 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrUnsupportedKeyBackupAlgorithm = errors.New("unsupported key backup algorithm")
+	ErrKeyBackupKeyMismatch          = errors.New("key backup public key doesn't match the given key")
+)
+
+// backupSessionData is the decrypted session_data of a key in a m.megolm_backup.v1.curve25519-aes-sha2 backup.
+type backupSessionData struct {
+	Algorithm         id.Algorithm      `json:"algorithm"`
+	ForwardingChains  []string          `json:"forwarding_curve25519_key_chain"`
+	SenderKey         id.SenderKey      `json:"sender_key"`
+	SenderClaimedKeys SenderClaimedKeys `json:"sender_claimed_keys"`
+	SessionKey        string            `json:"session_key"`
+}
+
+// keyBackupMissTTL is how long a session that couldn't be restored from the key backup is remembered,
+// so that every undecryptable event in a busy room doesn't cause another request to the server.
+const keyBackupMissTTL = 5 * time.Minute
+
+type keyBackupState struct {
+	version string
+	key     *backup.MegolmBackupKey
+	pubKey  *ecdh.PublicKey
+
+	misses     map[id.SessionID]time.Time
+	missesLock sync.Mutex
+}
+
+// recentlyMissed returns true if the given session couldn't be restored from the backup within keyBackupMissTTL.
+func (state *keyBackupState) recentlyMissed(sessionID id.SessionID) bool {
+	state.missesLock.Lock()
+	defer state.missesLock.Unlock()
+	missedAt, ok := state.misses[sessionID]
+	if ok && time.Since(missedAt) > keyBackupMissTTL {
+		delete(state.misses, sessionID)
+		return false
+	}
+	return ok
+}
+
+func (state *keyBackupState) markMissed(sessionID id.SessionID) {
+	state.missesLock.Lock()
+	defer state.missesLock.Unlock()
+	for otherSessionID, missedAt := range state.misses {
+		if time.Since(missedAt) > keyBackupMissTTL {
+			delete(state.misses, otherSessionID)
+		}
+	}
+	state.misses[sessionID] = time.Now()
+}
+
+func (mach *OlmMachine) getKeyBackup() *keyBackupState {
+	mach.keyBackupLock.RLock()
+	defer mach.keyBackupLock.RUnlock()
+	return mach.keyBackup
+}
+
+// EnableKeyBackup fetches the latest server-side key backup version and checks that its public key matches
+// the given backup key. After that, newly received Megolm sessions are automatically uploaded to the backup,
+// and sessions that are missing when decrypting are looked up from the backup.
+//
+// The backup key can be parsed from a recovery key with backup.MegolmBackupKeyFromRecoveryKey,
+// or from the m.megolm_backup.v1 secret with backup.MegolmBackupKeyFromBytes.
+func (mach *OlmMachine) EnableKeyBackup(ctx context.Context, key *backup.MegolmBackupKey) (string, error) {
+	versionInfo, err := mach.Client.GetKeyBackupLatestVersion(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get latest key backup version: %w", err)
+	} else if versionInfo.Algorithm != backup.AlgorithmMegolmBackupV1 {
+		return "", fmt.Errorf("%w %s", ErrUnsupportedKeyBackupAlgorithm, versionInfo.Algorithm)
+	}
+	var authData backup.MegolmAuthData
+	err = json.Unmarshal(versionInfo.AuthData, &authData)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse key backup auth data: %w", err)
+	} else if authData.PublicKey != key.PublicKeyString() {
+		return "", ErrKeyBackupKeyMismatch
+	}
+	mach.keyBackupLock.Lock()
+	mach.keyBackup = &keyBackupState{
+		version: versionInfo.Version,
+		key:     key,
+		pubKey:  key.PublicKey(),
+		misses:  make(map[id.SessionID]time.Time),
+	}
+	mach.keyBackupLock.Unlock()
+	mach.machOrContextLog(ctx).Debug().Str("key_backup_version", versionInfo.Version).Msg("Enabled key backup")
+	return versionInfo.Version, nil
+}
+
+// DisableKeyBackup stops automatically uploading sessions to and restoring sessions from the key backup.
+func (mach *OlmMachine) DisableKeyBackup() {
+	mach.keyBackupLock.Lock()
+	mach.keyBackup = nil
+	mach.keyBackupLock.Unlock()
+}
+
+// RestoreKeysFromBackup enables the key backup with the given recovery key (see EnableKeyBackup)
+// and imports all sessions stored in it. The number of imported sessions is returned.
+//
+// Sessions that are already in the store with an equal or lower first known index are skipped.
+// Like sessions imported from files, restored sessions are treated as forwarded keys.
+func (mach *OlmMachine) RestoreKeysFromBackup(ctx context.Context, recoveryKey string) (int, error) {
+	key, err := backup.MegolmBackupKeyFromRecoveryKey(recoveryKey)
+	if err != nil {
+		return 0, err
+	}
+	version, err := mach.EnableKeyBackup(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := mach.Client.GetKeyBackup(ctx, version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get keys from backup: %w", err)
+	}
+	count := 0
+	for roomID, room := range keys.Rooms {
+		for sessionID, session := range room.Sessions {
+			log := mach.machOrContextLog(ctx).With().
+				Str("room_id", roomID.String()).
+				Str("session_id", sessionID.String()).
+				Logger()
+			imported, err := mach.importBackedUpSession(key, roomID, sessionID, &session)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to import Megolm session from backup")
+			} else if imported {
+				log.Debug().Msg("Imported Megolm session from backup")
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (mach *OlmMachine) importBackedUpSession(key *backup.MegolmBackupKey, roomID id.RoomID, sessionID id.SessionID, session *mautrix.RespRoomKeysSession) (bool, error) {
+	var encryptedData backup.EncryptedSessionData
+	err := json.Unmarshal(session.SessionData, &encryptedData)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse session data: %w", err)
+	}
+	var data backupSessionData
+	err = encryptedData.Decrypt(key, &data)
+	if err != nil {
+		return false, fmt.Errorf("failed to decrypt session data: %w", err)
+	}
+	return mach.importExportedRoomKey(ExportedSession{
+		Algorithm:         data.Algorithm,
+		ForwardingChains:  data.ForwardingChains,
+		RoomID:            roomID,
+		SenderKey:         data.SenderKey,
+		SenderClaimedKeys: data.SenderClaimedKeys,
+		SessionID:         sessionID,
+		SessionKey:        data.SessionKey,
+	})
+}
+
+// restoreSessionFromBackup tries to fetch a single session from the key backup, if one is enabled.
+//
+// Sessions that couldn't be restored are not looked up again for a few minutes.
+func (mach *OlmMachine) restoreSessionFromBackup(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) bool {
+	state := mach.getKeyBackup()
+	if state == nil {
+		return false
+	}
+	log := zerolog.Ctx(ctx)
+	if state.recentlyMissed(sessionID) {
+		log.Debug().Msg("Not looking up session from key backup as it was recently missing")
+		return false
+	}
+	session, err := mach.Client.GetKeyBackupForRoomAndSession(ctx, state.version, roomID, sessionID)
+	if errors.Is(err, mautrix.MNotFound) {
+		log.Debug().Msg("Session not found in key backup")
+		state.markMissed(sessionID)
+		return false
+	} else if err != nil {
+		log.Warn().Err(err).Msg("Failed to get session from key backup")
+		state.markMissed(sessionID)
+		return false
+	}
+	imported, err := mach.importBackedUpSession(state.key, roomID, sessionID, session)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to import Megolm session from key backup")
+	} else if imported {
+		log.Debug().Msg("Imported Megolm session from key backup")
+	}
+	if !imported {
+		state.markMissed(sessionID)
+	}
+	return imported
+}
+
+// backupGroupSession uploads the given session to the key backup in the background, if one is enabled.
+func (mach *OlmMachine) backupGroupSession(igs *InboundGroupSession) {
+	state := mach.getKeyBackup()
+	if state == nil {
+		return
+	}
+	log := mach.Log.With().
+		Str("room_id", igs.RoomID.String()).
+		Str("session_id", igs.ID().String()).
+		Str("key_backup_version", state.version).
+		Logger()
+	firstKnownIndex := igs.Internal.FirstKnownIndex()
+	sessionKey, err := igs.Internal.Export(firstKnownIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to export session for key backup")
+		return
+	}
+	encryptedData, err := backup.EncryptSessionData(state.pubKey, &backupSessionData{
+		Algorithm:         id.AlgorithmMegolmV1,
+		ForwardingChains:  igs.ForwardingChains,
+		SenderKey:         igs.SenderKey,
+		SenderClaimedKeys: SenderClaimedKeys{Ed25519: igs.SigningKey},
+		SessionKey:        string(sessionKey),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encrypt session for key backup")
+		return
+	}
+	sessionData, err := json.Marshal(encryptedData)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal encrypted session for key backup")
+		return
+	}
+	go func() {
+		_, err := mach.Client.PutKeysInBackupForRoomAndSession(context.TODO(), state.version, igs.RoomID, igs.ID(), &mautrix.ReqRoomKeysSessionUpdate{
+			FirstMessageIndex: int(firstKnownIndex),
+			ForwardedCount:    len(igs.ForwardingChains),
+			// Whether the sender device is verified isn't tracked per session
+			IsVerified:  false,
+			SessionData: sessionData,
+		})
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to upload session to key backup")
+		} else {
+			log.Debug().Msg("Uploaded session to key backup")
+		}
+	}()
+}
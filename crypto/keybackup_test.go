@@ -0,0 +1,214 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type testKeyBackupServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	sessions map[id.RoomID]map[id.SessionID]mautrix.RespRoomKeysSession
+	lookups  int
+}
+
+func (srv *testKeyBackupServer) count() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	count := 0
+	for _, room := range srv.sessions {
+		count += len(room)
+	}
+	return count
+}
+
+// newKeyBackupServer returns a server that stores a single key backup version using the given key.
+func newKeyBackupServer(t *testing.T, key *backup.MegolmBackupKey) *testKeyBackupServer {
+	srv := &testKeyBackupServer{sessions: make(map[id.RoomID]map[id.SessionID]mautrix.RespRoomKeysSession)}
+	authData, err := json.Marshal(key.AuthData())
+	require.NoError(t, err)
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		var resp any
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3/room_keys/")
+		parts := strings.Split(path, "/")
+		for i, part := range parts {
+			parts[i], _ = url.PathUnescape(part)
+		}
+		switch {
+		case path == "version" && r.Method == http.MethodGet:
+			resp = &mautrix.RespRoomKeysVersion{
+				Algorithm: backup.AlgorithmMegolmBackupV1,
+				AuthData:  authData,
+				Version:   "1",
+			}
+		case path == "keys" && r.Method == http.MethodGet:
+			rooms := make(map[id.RoomID]mautrix.RespRoomKeysRoom)
+			for roomID, sessions := range srv.sessions {
+				rooms[roomID] = mautrix.RespRoomKeysRoom{Sessions: sessions}
+			}
+			resp = &mautrix.RespRoomKeys{Rooms: rooms}
+		case len(parts) == 3 && parts[0] == "keys" && r.Method == http.MethodPut:
+			var session mautrix.RespRoomKeysSession
+			if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&session)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			roomID, sessionID := id.RoomID(parts[1]), id.SessionID(parts[2])
+			if srv.sessions[roomID] == nil {
+				srv.sessions[roomID] = make(map[id.SessionID]mautrix.RespRoomKeysSession)
+			}
+			srv.sessions[roomID][sessionID] = session
+			resp = &mautrix.RespRoomKeysUpdate{Count: 1, ETag: "1"}
+		case len(parts) == 3 && parts[0] == "keys" && r.Method == http.MethodGet:
+			srv.lookups++
+			session, ok := srv.sessions[id.RoomID(parts[1])][id.SessionID(parts[2])]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				resp = &mautrix.RespError{ErrCode: "M_NOT_FOUND", Err: "Session not found"}
+			} else {
+				resp = &session
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			resp = &mautrix.RespError{ErrCode: "M_UNRECOGNIZED", Err: "Unrecognized request"}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newMachineWithKeyBackup(t *testing.T, userID id.UserID, srv *testKeyBackupServer) *OlmMachine {
+	mach := newMachine(t, userID)
+	mach.Client.HomeserverURL, _ = url.Parse(srv.URL)
+	return mach
+}
+
+// uploadTestSession creates an outbound session in a new machine, receives it in a machine with
+// key backup enabled so that it gets uploaded and returns an event encrypted with the session.
+func uploadTestSession(t *testing.T, key *backup.MegolmBackupKey, srv *testKeyBackupServer) *event.Event {
+	machineOut := newMachine(t, "@user1:example.com")
+	outSess := machineOut.newOutboundGroupSession(context.TODO(), "!room:example.com")
+	outSess.Shared = true
+	require.NoError(t, machineOut.CryptoStore.AddOutboundGroupSession(outSess))
+	sessionKey := outSess.Internal.Key()
+	encrypted, err := machineOut.EncryptMegolmEvent(context.TODO(), "!room:example.com", event.EventMessage, map[string]string{"hello": "world"})
+	require.NoError(t, err)
+
+	machineIn := newMachineWithKeyBackup(t, "@user2:example.com", srv)
+	_, err = machineIn.EnableKeyBackup(context.TODO(), key)
+	require.NoError(t, err)
+	senderKey, signingKey := machineOut.account.IdentityKey(), machineOut.account.SigningKey()
+	machineIn.createGroupSession(context.TODO(), senderKey, signingKey, "!room:example.com", outSess.ID(), sessionKey, 0, 0, false)
+	assert.Eventually(t, func() bool {
+		return srv.count() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return &event.Event{
+		Content: event.Content{Parsed: encrypted},
+		Type:    event.EventEncrypted,
+		ID:      "$event1",
+		RoomID:  "!room:example.com",
+		Sender:  "@user1:example.com",
+	}
+}
+
+func TestRestoreKeysFromBackup(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	srv := newKeyBackupServer(t, key)
+	evt := uploadTestSession(t, key, srv)
+
+	mach := newMachineWithKeyBackup(t, "@user2:example.com", srv)
+	count, err := mach.RestoreKeysFromBackup(context.TODO(), key.RecoveryKey())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	mach.DisableKeyBackup()
+
+	decrypted, err := mach.DecryptMegolmEvent(context.TODO(), evt)
+	require.NoError(t, err)
+	assert.Equal(t, "world", decrypted.Content.Raw["hello"])
+	assert.Equal(t, id.TrustStateForwarded, decrypted.Mautrix.TrustState)
+}
+
+func TestDecryptMegolmEvent_RestoresFromBackup(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	srv := newKeyBackupServer(t, key)
+	evt := uploadTestSession(t, key, srv)
+
+	mach := newMachineWithKeyBackup(t, "@user2:example.com", srv)
+	_, err = mach.DecryptMegolmEvent(context.TODO(), evt)
+	assert.ErrorIs(t, err, NoSessionFound)
+
+	_, err = mach.EnableKeyBackup(context.TODO(), key)
+	require.NoError(t, err)
+	decrypted, err := mach.DecryptMegolmEvent(context.TODO(), evt)
+	require.NoError(t, err)
+	assert.Equal(t, "world", decrypted.Content.Raw["hello"])
+}
+
+func TestDecryptMegolmEvent_BackupMissCached(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	srv := newKeyBackupServer(t, key)
+	evt := uploadTestSession(t, key, srv)
+	srv.lock.Lock()
+	srv.sessions = make(map[id.RoomID]map[id.SessionID]mautrix.RespRoomKeysSession)
+	srv.lock.Unlock()
+
+	mach := newMachineWithKeyBackup(t, "@user2:example.com", srv)
+	_, err = mach.EnableKeyBackup(context.TODO(), key)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = mach.DecryptMegolmEvent(context.TODO(), evt)
+		assert.ErrorIs(t, err, NoSessionFound)
+	}
+	srv.lock.Lock()
+	assert.Equal(t, 1, srv.lookups)
+	srv.lock.Unlock()
+
+	// Re-enabling the backup forgets previous misses
+	_, err = mach.EnableKeyBackup(context.TODO(), key)
+	require.NoError(t, err)
+	_, err = mach.DecryptMegolmEvent(context.TODO(), evt)
+	assert.ErrorIs(t, err, NoSessionFound)
+	srv.lock.Lock()
+	assert.Equal(t, 2, srv.lookups)
+	srv.lock.Unlock()
+}
+
+func TestEnableKeyBackup_KeyMismatch(t *testing.T) {
+	key, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	otherKey, err := backup.NewMegolmBackupKey()
+	require.NoError(t, err)
+	mach := newMachineWithKeyBackup(t, "@user1:example.com", newKeyBackupServer(t, key))
+	_, err = mach.EnableKeyBackup(context.TODO(), otherKey)
+	assert.ErrorIs(t, err, ErrKeyBackupKeyMismatch)
+	_, err = mach.RestoreKeysFromBackup(context.TODO(), "not a recovery key")
+	assert.ErrorIs(t, err, backup.ErrInvalidRecoveryKey)
+}
@@ -71,8 +71,8 @@ func makeExportIV() []byte {
 	if err != nil {
 		panic(olm.NotEnoughGoRandom)
 	}
-	// Set bit 63 to zero
-	iv[7] &= 0b11111110
+	// Set bit 63 to zero, i.e. the highest bit of the counter half, so that the counter can't overflow
+	iv[8] &= 0x7F
 	return iv
 }
 
@@ -101,7 +101,7 @@ func exportSessions(sessions []*InboundGroupSession) ([]ExportedSession, error)
 			ForwardingChains:  session.ForwardingChains,
 			RoomID:            session.RoomID,
 			SenderKey:         session.SenderKey,
-			SenderClaimedKeys: SenderClaimedKeys{},
+			SenderClaimedKeys: SenderClaimedKeys{Ed25519: session.SigningKey},
 			SessionID:         session.ID(),
 			SessionKey:        string(key),
 		}
@@ -141,8 +141,8 @@ func formatKeyExportData(data []byte) []byte {
 		buf.WriteRune('\n')
 	}
 	buf.WriteString(exportSuffix)
-	if buf.Len() != buf.Cap() || buf.Len() != outputLength {
-		panic(fmt.Errorf("unexpected length %d / %d / %d", buf.Len(), buf.Cap(), outputLength))
+	if buf.Len() != outputLength {
+		panic(fmt.Errorf("unexpected length %d / %d", buf.Len(), outputLength))
 	}
 	return buf.Bytes()
 }
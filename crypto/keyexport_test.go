@@ -0,0 +1,135 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func getExportTestSession(t *testing.T) (*OlmMachine, *InboundGroupSession) {
+	mach := newMachine(t, "@user1:example.com")
+	outSess := mach.newOutboundGroupSession(context.TODO(), "!room:example.com")
+	sess, err := mach.CryptoStore.GetGroupSession("!room:example.com", mach.OwnIdentity().IdentityKey, outSess.ID())
+	require.NoError(t, err)
+	require.NotNil(t, sess)
+	return mach, sess
+}
+
+func TestExportImportKeys(t *testing.T) {
+	_, sess := getExportTestSession(t)
+	export, err := ExportKeys("meow", []*InboundGroupSession{sess})
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(export, []byte(exportPrefix)))
+	assert.True(t, bytes.HasSuffix(export, []byte(exportSuffix)))
+
+	mach := newMachine(t, "@user2:example.com")
+	imported, total, err := mach.ImportKeys("meow", export)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, 1, total)
+	importedSess, err := mach.CryptoStore.GetGroupSession(sess.RoomID, sess.SenderKey, sess.ID())
+	require.NoError(t, err)
+	require.NotNil(t, importedSess)
+	assert.Equal(t, sess.SigningKey, importedSess.SigningKey)
+	assert.True(t, importedSess.IsForwarded)
+
+	_, _, err = mach.ImportKeys("wrong passphrase", export)
+	assert.ErrorIs(t, err, ErrMismatchingExportHash)
+}
+
+func TestImportKeys_KeepsLowerFirstKnownIndex(t *testing.T) {
+	_, sess := getExportTestSession(t)
+	fullExport, err := ExportKeys("meow", []*InboundGroupSession{sess})
+	require.NoError(t, err)
+	require.NoError(t, sess.RatchetTo(5))
+	ratchetedExport, err := ExportKeys("meow", []*InboundGroupSession{sess})
+	require.NoError(t, err)
+
+	mach := newMachine(t, "@user2:example.com")
+	imported, _, err := mach.ImportKeys("meow", fullExport)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	// The ratcheted session must not replace the one that can decrypt more messages
+	imported, total, err := mach.ImportKeys("meow", ratchetedExport)
+	require.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	assert.Equal(t, 1, total)
+	storedSess, err := mach.CryptoStore.GetGroupSession(sess.RoomID, sess.SenderKey, sess.ID())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), storedSess.Internal.FirstKnownIndex())
+}
+
+// TestImportKeys_ElementLayout checks that exports wrapped like Element does it (96 characters per line)
+// are accepted, even with Windows line endings and no trailing newline.
+func TestImportKeys_ElementLayout(t *testing.T) {
+	_, sess := getExportTestSession(t)
+	export, err := ExportKeys("meow", []*InboundGroupSession{sess})
+	require.NoError(t, err)
+	exportData, err := decodeKeyExport(export)
+	require.NoError(t, err)
+
+	b64 := base64.StdEncoding.EncodeToString(exportData)
+	lines := []string{strings.TrimSpace(exportPrefix)}
+	for len(b64) > 96 {
+		lines = append(lines, b64[:96])
+		b64 = b64[96:]
+	}
+	lines = append(lines, b64, strings.TrimSpace(exportSuffix))
+	elementExport := []byte(strings.Join(lines, "\r\n"))
+
+	mach := newMachine(t, "@user2:example.com")
+	imported, _, err := mach.ImportKeys("meow", elementExport)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+}
+
+func TestImportKeys_Invalid(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	tests := []struct {
+		name     string
+		data     string
+		expected error
+	}{
+		{"NoPrefix", "meow", ErrMissingExportPrefix},
+		{"NoSuffix", exportPrefix + "AQ==\n", ErrMissingExportSuffix},
+		{"TooShort", exportPrefix + "AQ==\n" + exportSuffix, ErrExportTooShort},
+		{"WrongVersion", exportPrefix + base64.StdEncoding.EncodeToString(make([]byte, 100)) + "\n" + exportSuffix, ErrUnsupportedExportVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := mach.ImportKeys("meow", []byte(test.data))
+			assert.ErrorIs(t, err, test.expected)
+		})
+	}
+}
+
+func TestMakeExportIV(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		iv := makeExportIV()
+		require.Len(t, iv, 16)
+		assert.Zero(t, iv[8]&0x80)
+	}
+}
+
+func TestExportSessions(t *testing.T) {
+	_, sess := getExportTestSession(t)
+	exported, err := exportSessions([]*InboundGroupSession{sess})
+	require.NoError(t, err)
+	require.Len(t, exported, 1)
+	assert.Equal(t, id.AlgorithmMegolmV1, exported[0].Algorithm)
+	assert.Equal(t, sess.SigningKey, exported[0].SenderClaimedKeys.Ed25519)
+	assert.Equal(t, sess.SenderKey, exported[0].SenderKey)
+}
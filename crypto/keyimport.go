@@ -30,11 +30,14 @@ var (
 	ErrMismatchingExportHash        = errors.New("mismatching hash; incorrect passphrase?")
 	ErrInvalidExportedAlgorithm     = errors.New("session has unknown algorithm")
 	ErrMismatchingExportedSessionID = errors.New("imported session has different ID than expected")
+	ErrExportTooShort               = errors.New("invalid Matrix key export: data too short")
 )
 
-var exportPrefixBytes, exportSuffixBytes = []byte(exportPrefix), []byte(exportSuffix)
+var exportPrefixBytes, exportSuffixBytes = bytes.TrimSpace([]byte(exportPrefix)), bytes.TrimSpace([]byte(exportSuffix))
 
 func decodeKeyExport(data []byte) ([]byte, error) {
+	// Exports may have Windows line endings or no trailing newline, so ignore surrounding whitespace
+	data = bytes.TrimSpace(data)
 	// If the valid prefix and suffix aren't there, it's probably not a Matrix key export
 	if !bytes.HasPrefix(data, exportPrefixBytes) {
 		return nil, ErrMissingExportPrefix
@@ -42,10 +45,10 @@ func decodeKeyExport(data []byte) ([]byte, error) {
 		return nil, ErrMissingExportSuffix
 	}
 	// Remove the prefix and suffix, we don't care about them anymore
-	data = data[len(exportPrefix) : len(data)-len(exportSuffix)]
+	data = data[len(exportPrefixBytes) : len(data)-len(exportSuffixBytes)]
 
-	// Allocate space for the decoded data. Ignore newlines when counting the length
-	exportData := make([]byte, base64.StdEncoding.DecodedLen(len(data)-bytes.Count(data, []byte{'\n'})))
+	// Allocate space for the decoded data. The base64 decoder ignores newlines, so this may be slightly too much.
+	exportData := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
 	n, err := base64.StdEncoding.Decode(exportData, data)
 	if err != nil {
 		return nil, err
@@ -55,7 +58,9 @@ func decodeKeyExport(data []byte) ([]byte, error) {
 }
 
 func decryptKeyExport(passphrase string, exportData []byte) ([]ExportedSession, error) {
-	if exportData[0] != exportVersion1 {
+	if len(exportData) < exportHeaderLength+exportHashLength {
+		return nil, ErrExportTooShort
+	} else if exportData[0] != exportVersion1 {
 		return nil, ErrUnsupportedExportVersion
 	}
 
@@ -107,8 +112,9 @@ func (mach *OlmMachine) importExportedRoomKey(session ExportedSession) (bool, er
 		SigningKey: session.SenderClaimedKeys.Ed25519,
 		SenderKey:  session.SenderKey,
 		RoomID:     session.RoomID,
-		// TODO should we add something here to mark the signing key as unverified like key requests do?
+		// Imported keys can't be verified to come from the sender, so they're treated like forwarded keys.
 		ForwardingChains: session.ForwardingChains,
+		IsForwarded:      true,
 
 		ReceivedAt: time.Now().UTC(),
 	}
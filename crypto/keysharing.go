@@ -10,6 +10,7 @@ package crypto
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -55,10 +56,12 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 
 	resChan := make(chan bool, 1)
 	go func() {
+		var received bool
 		select {
 		case <-keyResponseReceived:
 			// key request successful
 			mach.Log.Debug().Msgf("Key for session %v was received, cancelling other key requests", sessionID)
+			received = true
 			resChan <- true
 		case <-ctx.Done():
 			// if the context is done, key request was unsuccessful
@@ -66,26 +69,17 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 			resChan <- false
 		}
 
-		// send a message to all devices cancelling this key request
 		mach.roomKeyRequestFilled.Delete(sessionID)
-
-		cancelEvtContent := &event.Content{
-			Parsed: event.RoomKeyRequestEventContent{
-				Action:             event.KeyRequestActionCancel,
-				RequestID:          requestID,
-				RequestingDeviceID: mach.Client.DeviceID,
-			},
+		// If the key was received, markSessionReceived already cancelled the request
+		if !received {
+			err := mach.sendKeyRequestCancellation(context.Background(), &OutgoingKeyRequest{
+				RequestID: requestID,
+				Targets:   map[id.UserID][]id.DeviceID{toUser: {toDevice}},
+			})
+			if err != nil {
+				mach.Log.Warn().Err(err).Str("request_id", requestID).Msg("Failed to cancel key request")
+			}
 		}
-
-		toDeviceCancel := &mautrix.ReqSendToDevice{
-			Messages: map[id.UserID]map[id.DeviceID]*event.Content{
-				toUser: {
-					toDevice: cancelEvtContent,
-				},
-			},
-		}
-
-		mach.Client.SendToDevice(ctx, event.ToDeviceRoomKeyRequest, toDeviceCancel)
 	}()
 	return resChan, nil
 }
@@ -94,6 +88,9 @@ func (mach *OlmMachine) RequestRoomKey(ctx context.Context, toUser id.UserID, to
 //
 // The request ID parameter is optional. If it's empty, a random ID will be generated.
 //
+// The request is stored in the crypto store, and a cancellation is sent to the same devices when the key is received
+// or when the request is older than KeyRequestTimeout.
+//
 // This function does not wait for the keys to arrive. You can use WaitForSession to wait for the session to
 // arrive (in any way, not just as a reply to this request). There's also RequestRoomKey which waits for a response
 // to the specific key request, but currently it only supports a single target device and is therefore deprecated.
@@ -126,8 +123,122 @@ func (mach *OlmMachine) SendRoomKeyRequest(ctx context.Context, roomID id.RoomID
 			toDeviceReq.Messages[user][device] = requestEvent
 		}
 	}
-	_, err := mach.Client.SendToDevice(ctx, event.ToDeviceRoomKeyRequest, toDeviceReq)
-	return err
+	// Store the request before sending it, so that a key arriving right after the request is sent will cancel it.
+	err := mach.CryptoStore.PutOutgoingKeyRequest(&OutgoingKeyRequest{
+		RequestID: requestID,
+		RoomID:    roomID,
+		SenderKey: senderKey,
+		SessionID: sessionID,
+		Targets:   users,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store key request: %w", err)
+	}
+	_, err = mach.Client.SendToDevice(ctx, event.ToDeviceRoomKeyRequest, toDeviceReq)
+	if err != nil {
+		if deleteErr := mach.CryptoStore.DeleteOutgoingKeyRequest(requestID); deleteErr != nil {
+			mach.Log.Warn().Err(deleteErr).Str("request_id", requestID).Msg("Failed to delete unsent key request from store")
+		}
+		return err
+	}
+	return nil
+}
+
+const keyRequestExpiryCheckInterval = 10 * time.Minute
+
+func (mach *OlmMachine) sendKeyRequestCancellation(ctx context.Context, req *OutgoingKeyRequest) error {
+	cancelEvtContent := &event.Content{
+		Parsed: &event.RoomKeyRequestEventContent{
+			Action:             event.KeyRequestActionCancel,
+			RequestID:          req.RequestID,
+			RequestingDeviceID: mach.Client.DeviceID,
+		},
+	}
+	toDeviceCancel := &mautrix.ReqSendToDevice{
+		Messages: make(map[id.UserID]map[id.DeviceID]*event.Content, len(req.Targets)),
+	}
+	for user, devices := range req.Targets {
+		toDeviceCancel.Messages[user] = make(map[id.DeviceID]*event.Content, len(devices))
+		for _, device := range devices {
+			toDeviceCancel.Messages[user][device] = cancelEvtContent
+		}
+	}
+	_, err := mach.Client.SendToDevice(ctx, event.ToDeviceRoomKeyRequest, toDeviceCancel)
+	if err != nil {
+		return fmt.Errorf("failed to send cancellation: %w", err)
+	}
+	err = mach.CryptoStore.DeleteOutgoingKeyRequest(req.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to delete key request from store: %w", err)
+	}
+	return nil
+}
+
+// cancelKeyRequestsForSession cancels all outgoing key requests for the given session in the background.
+func (mach *OlmMachine) cancelKeyRequestsForSession(sessionID id.SessionID) {
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests(sessionID)
+	if err != nil {
+		mach.Log.Warn().Err(err).Str("session_id", sessionID.String()).Msg("Failed to get outgoing key requests for received session")
+		return
+	} else if len(reqs) == 0 {
+		return
+	}
+	go func() {
+		for _, req := range reqs {
+			err := mach.sendKeyRequestCancellation(context.TODO(), req)
+			if err != nil {
+				mach.Log.Warn().Err(err).
+					Str("request_id", req.RequestID).
+					Str("session_id", sessionID.String()).
+					Msg("Failed to cancel fulfilled key request")
+			} else {
+				mach.Log.Debug().
+					Str("request_id", req.RequestID).
+					Str("session_id", sessionID.String()).
+					Msg("Cancelled fulfilled key request")
+			}
+		}
+	}()
+}
+
+func (mach *OlmMachine) cancelExpiredKeyRequestsIfNeeded() {
+	mach.expiryCheckLock.Lock()
+	defer mach.expiryCheckLock.Unlock()
+	if time.Since(mach.lastKeyRequestExpiryCheck) <= keyRequestExpiryCheckInterval {
+		return
+	}
+	mach.lastKeyRequestExpiryCheck = time.Now()
+	go func() {
+		err := mach.CancelExpiredKeyRequests(context.TODO())
+		if err != nil {
+			mach.Log.Warn().Err(err).Msg("Failed to cancel expired key requests")
+		}
+	}()
+}
+
+// CancelExpiredKeyRequests sends cancellations for all outgoing key requests that are older than KeyRequestTimeout.
+//
+// This is called automatically by ProcessSyncResponse every few minutes.
+func (mach *OlmMachine) CancelExpiredKeyRequests(ctx context.Context) error {
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests("")
+	if err != nil {
+		return fmt.Errorf("failed to get outgoing key requests: %w", err)
+	}
+	for _, req := range reqs {
+		if time.Since(req.CreatedAt) < mach.KeyRequestTimeout {
+			continue
+		}
+		err = mach.sendKeyRequestCancellation(ctx, req)
+		if err != nil {
+			return fmt.Errorf("failed to cancel key request %s: %w", req.RequestID, err)
+		}
+		mach.Log.Debug().
+			Str("request_id", req.RequestID).
+			Str("session_id", req.SessionID.String()).
+			Msg("Cancelled expired key request")
+	}
+	return nil
 }
 
 func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *DecryptedOlmEvent, content *event.ForwardedRoomKeyEventContent) bool {
@@ -140,6 +251,9 @@ func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *Decrypt
 			Str("algorithm", string(content.Algorithm)).
 			Msg("Ignoring weird forwarded room key")
 		return false
+	} else if content.SenderClaimedKey == "" || content.SenderKey == "" {
+		log.Warn().Msg("Ignoring forwarded room key without sender keys")
+		return false
 	}
 
 	igsInternal, err := olm.InboundGroupSessionImport([]byte(content.SessionKey))
@@ -152,6 +266,17 @@ func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *Decrypt
 			Msg("Mismatched session ID while creating inbound group session from forward")
 		return false
 	}
+	existingIGS, _ := mach.CryptoStore.GetGroupSession(content.RoomID, content.SenderKey, content.SessionID)
+	if existingIGS != nil && existingIGS.SigningKey != content.SenderClaimedKey {
+		log.Warn().
+			Str("claimed_signing_key", content.SenderClaimedKey.String()).
+			Str("existing_signing_key", existingIGS.SigningKey.String()).
+			Msg("Ignoring forwarded room key with a different claimed signing key than the existing session")
+		return false
+	} else if existingIGS != nil && existingIGS.Internal.FirstKnownIndex() <= igsInternal.FirstKnownIndex() {
+		log.Debug().Msg("Ignoring forwarded room key that doesn't have earlier message indexes than the existing session")
+		return false
+	}
 	config := mach.StateStore.GetEncryptionEvent(content.RoomID)
 	var maxAge time.Duration
 	var maxMessages int
@@ -167,7 +292,7 @@ func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *Decrypt
 	}
 	igs := &InboundGroupSession{
 		Internal:         *igsInternal,
-		SigningKey:       evt.Keys.Ed25519,
+		SigningKey:       content.SenderClaimedKey,
 		SenderKey:        content.SenderKey,
 		RoomID:           content.RoomID,
 		ForwardingChains: append(content.ForwardingKeyChain, evt.SenderKey.String()),
@@ -177,6 +302,7 @@ func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *Decrypt
 		MaxAge:      maxAge.Milliseconds(),
 		MaxMessages: maxMessages,
 		IsScheduled: content.IsScheduled,
+		IsForwarded: true,
 	}
 	err = mach.CryptoStore.PutGroupSession(content.RoomID, content.SenderKey, content.SessionID, igs)
 	if err != nil {
@@ -184,6 +310,7 @@ func (mach *OlmMachine) importForwardedRoomKey(ctx context.Context, evt *Decrypt
 		return false
 	}
 	mach.markSessionReceived(content.SessionID)
+	mach.backupGroupSession(igs)
 	log.Debug().Msg("Received forwarded inbound group session")
 	return true
 }
@@ -232,19 +359,57 @@ func (mach *OlmMachine) defaultAllowKeyShare(ctx context.Context, device *id.Dev
 		return &KeyShareRejectBlacklisted
 	} else if trustState := mach.ResolveTrust(device); trustState >= mach.ShareKeysMinTrust {
 		log.Debug().
-			Str("min_trust", mach.SendKeysMinTrust.String()).
+			Str("min_trust", mach.ShareKeysMinTrust.String()).
 			Str("device_trust", trustState.String()).
 			Msg("Accepting key request from trusted device")
 		return nil
 	} else {
 		log.Debug().
-			Str("min_trust", mach.SendKeysMinTrust.String()).
+			Str("min_trust", mach.ShareKeysMinTrust.String()).
 			Str("device_trust", trustState.String()).
 			Msg("Rejecting key request from untrusted device")
 		return &KeyShareRejectUnverified
 	}
 }
 
+type incomingKeyRequestKey struct {
+	UserID    id.UserID
+	DeviceID  id.DeviceID
+	RequestID string
+}
+
+// handleRoomKeyRequestEvent starts handling a key request in the background, or cancels the handling of a previous
+// request if the event is a request_cancellation, so that stale requests aren't answered.
+func (mach *OlmMachine) handleRoomKeyRequestEvent(ctx context.Context, sender id.UserID, content *event.RoomKeyRequestEventContent) {
+	key := incomingKeyRequestKey{UserID: sender, DeviceID: content.RequestingDeviceID, RequestID: content.RequestID}
+	switch content.Action {
+	case event.KeyRequestActionCancel:
+		mach.incomingKeyRequestsLock.Lock()
+		cancel, ok := mach.incomingKeyRequests[key]
+		delete(mach.incomingKeyRequests, key)
+		mach.incomingKeyRequestsLock.Unlock()
+		if ok {
+			zerolog.Ctx(ctx).Debug().
+				Str("request_id", content.RequestID).
+				Str("device_id", content.RequestingDeviceID.String()).
+				Msg("Key request was cancelled before it was answered")
+			cancel()
+		}
+	case event.KeyRequestActionRequest:
+		reqCtx, cancel := context.WithCancel(ctx)
+		mach.incomingKeyRequestsLock.Lock()
+		mach.incomingKeyRequests[key] = cancel
+		mach.incomingKeyRequestsLock.Unlock()
+		go func() {
+			mach.handleRoomKeyRequest(reqCtx, sender, content)
+			mach.incomingKeyRequestsLock.Lock()
+			delete(mach.incomingKeyRequests, key)
+			mach.incomingKeyRequestsLock.Unlock()
+			cancel()
+		}()
+	}
+}
+
 func (mach *OlmMachine) handleRoomKeyRequest(ctx context.Context, sender id.UserID, content *event.RoomKeyRequestEventContent) {
 	log := zerolog.Ctx(ctx).With().
 		Str("request_id", content.RequestID).
@@ -263,7 +428,10 @@ func (mach *OlmMachine) handleRoomKeyRequest(ctx context.Context, sender id.User
 	log.Debug().Msg("Received key request")
 
 	device, err := mach.GetOrFetchDevice(ctx, sender, content.RequestingDeviceID)
-	if err != nil {
+	if ctx.Err() != nil {
+		log.Debug().Msg("Not responding to cancelled key request")
+		return
+	} else if err != nil {
 		log.Error().Err(err).Msg("Failed to fetch device that requested keys")
 		return
 	}
@@ -294,16 +462,31 @@ func (mach *OlmMachine) handleRoomKeyRequest(ctx context.Context, sender id.User
 		log = log.With().Str("unexpected_session_id", internalID.String()).Logger()
 	}
 
-	firstKnownIndex := igs.Internal.FirstKnownIndex()
-	log = log.With().Uint32("first_known_index", firstKnownIndex).Logger()
-	exportedKey, err := igs.Internal.Export(firstKnownIndex)
+	log = log.With().Uint32("first_known_index", igs.Internal.FirstKnownIndex()).Logger()
+	forwardedRoomKey, err := forwardedRoomKeyContent(igs)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to export group session to forward")
 		mach.rejectKeyRequest(ctx, KeyShareRejectInternalError, device, content.Body)
 		return
 	}
 
-	forwardedRoomKey := event.Content{
+	if ctx.Err() != nil {
+		log.Debug().Msg("Not responding to cancelled key request")
+	} else if err = mach.SendEncryptedToDevice(ctx, device, event.ToDeviceForwardedRoomKey, forwardedRoomKey); err != nil {
+		log.Error().Err(err).Msg("Failed to encrypt and send group session")
+	} else {
+		log.Debug().Msg("Successfully sent forwarded group session")
+	}
+}
+
+// forwardedRoomKeyContent exports the given inbound group session from its first known index
+// into a m.forwarded_room_key event.
+func forwardedRoomKeyContent(igs *InboundGroupSession) (event.Content, error) {
+	exportedKey, err := igs.Internal.Export(igs.Internal.FirstKnownIndex())
+	if err != nil {
+		return event.Content{}, err
+	}
+	return event.Content{
 		Parsed: &event.ForwardedRoomKeyEventContent{
 			RoomKeyEventContent: event.RoomKeyEventContent{
 				Algorithm:  id.AlgorithmMegolmV1,
@@ -311,17 +494,76 @@ func (mach *OlmMachine) handleRoomKeyRequest(ctx context.Context, sender id.User
 				SessionID:  igs.ID(),
 				SessionKey: string(exportedKey),
 			},
-			SenderKey:          content.Body.SenderKey,
+			SenderKey:          igs.SenderKey,
 			ForwardingKeyChain: igs.ForwardingChains,
 			SenderClaimedKey:   igs.SigningKey,
 		},
+	}, nil
+}
+
+var (
+	// ErrReshareNotAllowed is returned by ReshareSession if the target device isn't allowed to receive the session.
+	ErrReshareNotAllowed = errors.New("resharing group session to device not allowed")
+	// ErrReshareSessionNotFound is returned by ReshareSession if the session isn't in the crypto store.
+	ErrReshareSessionNotFound = errors.New("group session to reshare not found")
+)
+
+// ReshareSession sends a group session created by this device to a single device that didn't receive it,
+// e.g. after the device reported that it can't decrypt a message. Unlike rotating the session,
+// this doesn't affect any other devices.
+//
+// The session is forwarded the same way as key request responses, but using the same policy as ShareGroupSession:
+// the user must be in the room, and the device must not be blacklisted or below SendKeysMinTrust
+// (or unverified if ShareToUnverifiedDevices is false). Otherwise, an error wrapping ErrReshareNotAllowed is returned.
+func (mach *OlmMachine) ReshareSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID, userID id.UserID, deviceID id.DeviceID) error {
+	log := mach.machOrContextLog(ctx).With().
+		Str("action", "reshare megolm session").
+		Str("room_id", roomID.String()).
+		Str("session_id", sessionID.String()).
+		Str("target_user_id", userID.String()).
+		Str("target_device_id", deviceID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+	if userID == mach.Client.UserID && deviceID == mach.Client.DeviceID {
+		return fmt.Errorf("%w: can't reshare session to own device", ErrReshareNotAllowed)
+	}
+	inRoom := false
+	for _, sharedRoomID := range mach.StateStore.FindSharedRooms(userID) {
+		if sharedRoomID == roomID {
+			inRoom = true
+			break
+		}
+	}
+	if !inRoom {
+		return fmt.Errorf("%w: user isn't in the room", ErrReshareNotAllowed)
+	}
+	device, err := mach.GetOrFetchDevice(ctx, userID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get device: %w", err)
+	} else if device.Trust == id.TrustStateBlacklisted {
+		return fmt.Errorf("%w: device is blacklisted", ErrReshareNotAllowed)
+	} else if trustState := mach.ResolveTrust(device); trustState < mach.SendKeysMinTrust {
+		return fmt.Errorf("%w: device trust state %s is below minimum %s", ErrReshareNotAllowed, trustState, mach.SendKeysMinTrust)
+	} else if !mach.ShareToUnverifiedDevices && trustState < id.TrustStateCrossSignedVerified {
+		return fmt.Errorf("%w: device is not verified", ErrReshareNotAllowed)
 	}
 
-	if err = mach.SendEncryptedToDevice(ctx, device, event.ToDeviceForwardedRoomKey, forwardedRoomKey); err != nil {
-		log.Error().Err(err).Msg("Failed to encrypt and send group session")
-	} else {
-		log.Debug().Msg("Successfully sent forwarded group session")
+	igs, err := mach.CryptoStore.GetGroupSession(roomID, mach.account.IdentityKey(), sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get group session: %w", err)
+	} else if igs == nil {
+		return fmt.Errorf("%w: %s in %s", ErrReshareSessionNotFound, sessionID, roomID)
+	}
+	forwardedRoomKey, err := forwardedRoomKeyContent(igs)
+	if err != nil {
+		return fmt.Errorf("failed to export group session: %w", err)
+	}
+	err = mach.SendEncryptedToDevice(ctx, device, event.ToDeviceForwardedRoomKey, forwardedRoomKey)
+	if err != nil {
+		return fmt.Errorf("failed to send group session: %w", err)
 	}
+	log.Debug().Uint32("first_known_index", igs.Internal.FirstKnownIndex()).Msg("Reshared group session to device")
+	return nil
 }
 
 func (mach *OlmMachine) handleBeeperRoomKeyAck(ctx context.Context, sender id.UserID, content *event.BeeperRoomKeyAckEventContent) {
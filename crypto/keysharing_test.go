@@ -0,0 +1,365 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type sentToDevice struct {
+	eventType string
+	messages  map[id.UserID]map[id.DeviceID]json.RawMessage
+}
+
+// newMachineWithToDeviceServer creates a machine whose client sends requests to a test server
+// that records all to-device messages.
+func newMachineWithToDeviceServer(t *testing.T, userID id.UserID) (*OlmMachine, chan sentToDevice) {
+	sent := make(chan sentToDevice, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/sendToDevice/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Messages map[id.UserID]map[id.DeviceID]json.RawMessage `json:"messages"`
+		}
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&req)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.URL.Path, "/")
+		sent <- sentToDevice{eventType: parts[len(parts)-2], messages: req.Messages}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	mach := newMachine(t, userID)
+	mach.Client.HomeserverURL, _ = url.Parse(server.URL)
+	return mach, sent
+}
+
+func receiveToDevice(t *testing.T, sent chan sentToDevice) sentToDevice {
+	select {
+	case evt := <-sent:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for to-device message")
+		return sentToDevice{}
+	}
+}
+
+func TestKeyRequestCancelledWhenKeyReceived(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	outSess := NewOutboundGroupSession("!room:example.com", nil)
+	targets := map[id.UserID][]id.DeviceID{"@user1:example.com": {"otherdevice"}}
+
+	err := mach.SendRoomKeyRequest(context.TODO(), "!room:example.com", "senderkey", outSess.ID(), "req1", targets)
+	require.NoError(t, err)
+	request := receiveToDevice(t, sent)
+	assert.Equal(t, event.ToDeviceRoomKeyRequest.Type, request.eventType)
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests(outSess.ID())
+	require.NoError(t, err)
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "req1", reqs[0].RequestID)
+
+	mach.createGroupSession(context.TODO(), "senderkey", "signingkey", "!room:example.com", outSess.ID(), outSess.Internal.Key(), 0, 0, false)
+	cancellation := receiveToDevice(t, sent)
+	assert.Equal(t, event.ToDeviceRoomKeyRequest.Type, cancellation.eventType)
+	var content event.RoomKeyRequestEventContent
+	require.NoError(t, json.Unmarshal(cancellation.messages["@user1:example.com"]["otherdevice"], &content))
+	assert.EqualValues(t, event.KeyRequestActionCancel, content.Action)
+	assert.Equal(t, "req1", content.RequestID)
+
+	assert.Eventually(t, func() bool {
+		reqs, err = mach.CryptoStore.GetOutgoingKeyRequests("")
+		return err == nil && len(reqs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCancelExpiredKeyRequests(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	targets := map[id.UserID][]id.DeviceID{"@user1:example.com": {"otherdevice"}}
+	require.NoError(t, mach.CryptoStore.PutOutgoingKeyRequest(&OutgoingKeyRequest{
+		RequestID: "old",
+		SessionID: "session1",
+		Targets:   targets,
+		CreatedAt: time.Now().Add(-2 * mach.KeyRequestTimeout),
+	}))
+	require.NoError(t, mach.CryptoStore.PutOutgoingKeyRequest(&OutgoingKeyRequest{
+		RequestID: "new",
+		SessionID: "session2",
+		Targets:   targets,
+		CreatedAt: time.Now(),
+	}))
+
+	require.NoError(t, mach.CancelExpiredKeyRequests(context.TODO()))
+	cancellation := receiveToDevice(t, sent)
+	var content event.RoomKeyRequestEventContent
+	require.NoError(t, json.Unmarshal(cancellation.messages["@user1:example.com"]["otherdevice"], &content))
+	assert.Equal(t, "old", content.RequestID)
+	assert.Empty(t, sent)
+
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests("")
+	require.NoError(t, err)
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "new", reqs[0].RequestID)
+}
+
+func TestSendRoomKeyRequest_StoredBeforeSending(t *testing.T) {
+	var mach *OlmMachine
+	var storedWhenSent atomic.Bool
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs, err := mach.CryptoStore.GetOutgoingKeyRequests("session1")
+		storedWhenSent.Store(err == nil && len(reqs) == 1)
+		if fail {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "nope"}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	mach = newMachine(t, "@user1:example.com")
+	mach.Client.HomeserverURL, _ = url.Parse(server.URL)
+	targets := map[id.UserID][]id.DeviceID{"@user1:example.com": {"otherdevice"}}
+
+	err := mach.SendRoomKeyRequest(context.TODO(), "!room:example.com", "senderkey", "session1", "req1", targets)
+	assert.Error(t, err)
+	assert.True(t, storedWhenSent.Load())
+	reqs, err := mach.CryptoStore.GetOutgoingKeyRequests("")
+	require.NoError(t, err)
+	assert.Empty(t, reqs, "Unsent key request should be deleted from the store")
+
+	fail = false
+	storedWhenSent.Store(false)
+	require.NoError(t, mach.SendRoomKeyRequest(context.TODO(), "!room:example.com", "senderkey", "session1", "req2", targets))
+	assert.True(t, storedWhenSent.Load())
+	reqs, err = mach.CryptoStore.GetOutgoingKeyRequests("session1")
+	require.NoError(t, err)
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "req2", reqs[0].RequestID)
+}
+
+func TestDefaultAllowKeyShare(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	info := event.RequestedKeyInfo{RoomID: "!room:example.com", SessionID: "session1"}
+	tests := []struct {
+		name     string
+		device   *id.Device
+		expected *KeyShareRejection
+	}{
+		{"OtherUser", &id.Device{UserID: "@user2:example.com", DeviceID: "dev", Trust: id.TrustStateVerified}, &KeyShareRejectOtherUser},
+		{"Self", &id.Device{UserID: "@user1:example.com", DeviceID: mach.Client.DeviceID}, &KeyShareRejectNoResponse},
+		{"Blacklisted", &id.Device{UserID: "@user1:example.com", DeviceID: "dev", Trust: id.TrustStateBlacklisted}, &KeyShareRejectBlacklisted},
+		{"Unverified", &id.Device{UserID: "@user1:example.com", DeviceID: "dev"}, &KeyShareRejectUnverified},
+		{"Verified", &id.Device{UserID: "@user1:example.com", DeviceID: "dev", Trust: id.TrustStateVerified}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, mach.AllowKeyShare(context.TODO(), test.device, info))
+		})
+	}
+}
+
+func TestKeyRequestFromOtherUserRejected(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.CryptoStore.PutDevice("@user2:example.com", &id.Device{
+		UserID:   "@user2:example.com",
+		DeviceID: "dev",
+		Trust:    id.TrustStateVerified,
+	}))
+
+	mach.handleRoomKeyRequest(context.TODO(), "@user2:example.com", &event.RoomKeyRequestEventContent{
+		Action:             event.KeyRequestActionRequest,
+		RequestID:          "req1",
+		RequestingDeviceID: "dev",
+		Body: event.RequestedKeyInfo{
+			Algorithm: id.AlgorithmMegolmV1,
+			RoomID:    "!room:example.com",
+			SessionID: "session1",
+		},
+	})
+	for _, expectedType := range []event.Type{event.ToDeviceRoomKeyWithheld, event.ToDeviceOrgMatrixRoomKeyWithheld} {
+		rejection := receiveToDevice(t, sent)
+		assert.Equal(t, expectedType.Type, rejection.eventType)
+		var content event.RoomKeyWithheldEventContent
+		require.NoError(t, json.Unmarshal(rejection.messages["@user2:example.com"]["dev"], &content))
+		assert.Equal(t, KeyShareRejectOtherUser.Code, content.Code)
+		assert.Equal(t, id.SessionID("session1"), content.SessionID)
+	}
+}
+
+func TestKeyRequestCancellation(t *testing.T) {
+	queryStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var sentCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/keys/query" {
+			// Block fetching the requesting device until the request is cancelled
+			select {
+			case queryStarted <- struct{}{}:
+			default:
+			}
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sentCount.Add(1)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	// Cleanups run in reverse order, so this unblocks any pending handlers before the server is closed
+	t.Cleanup(func() { close(release) })
+	mach := newMachine(t, "@user1:example.com")
+	mach.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	request := &event.RoomKeyRequestEventContent{
+		Action:             event.KeyRequestActionRequest,
+		RequestID:          "req1",
+		RequestingDeviceID: "otherdevice",
+		Body: event.RequestedKeyInfo{
+			Algorithm: id.AlgorithmMegolmV1,
+			RoomID:    "!room:example.com",
+			SessionID: "session1",
+		},
+	}
+	mach.handleRoomKeyRequestEvent(context.TODO(), "@user1:example.com", request)
+	select {
+	case <-queryStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for device query")
+	}
+	mach.handleRoomKeyRequestEvent(context.TODO(), "@user1:example.com", &event.RoomKeyRequestEventContent{
+		Action:             event.KeyRequestActionCancel,
+		RequestID:          "req1",
+		RequestingDeviceID: "otherdevice",
+	})
+	assert.Eventually(t, func() bool {
+		mach.incomingKeyRequestsLock.Lock()
+		defer mach.incomingKeyRequestsLock.Unlock()
+		return len(mach.incomingKeyRequests) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, sentCount.Load())
+}
+
+func TestImportForwardedRoomKey(t *testing.T) {
+	_, sess := getExportTestSession(t)
+	exported, err := sess.Internal.Export(sess.Internal.FirstKnownIndex())
+	require.NoError(t, err)
+	content := &event.ForwardedRoomKeyEventContent{
+		RoomKeyEventContent: event.RoomKeyEventContent{
+			Algorithm:  id.AlgorithmMegolmV1,
+			RoomID:     sess.RoomID,
+			SessionID:  sess.ID(),
+			SessionKey: string(exported),
+		},
+		SenderKey:        sess.SenderKey,
+		SenderClaimedKey: sess.SigningKey,
+	}
+	forwarder := &DecryptedOlmEvent{
+		SenderKey: "forwarderidentitykey",
+		Keys:      OlmEventKeys{Ed25519: "forwardersigningkey"},
+	}
+
+	t.Run("MissingClaimedKey", func(t *testing.T) {
+		mach := newMachine(t, "@user2:example.com")
+		noClaimedKey := *content
+		noClaimedKey.SenderClaimedKey = ""
+		assert.False(t, mach.importForwardedRoomKey(context.TODO(), forwarder, &noClaimedKey))
+	})
+	t.Run("Valid", func(t *testing.T) {
+		mach := newMachine(t, "@user2:example.com")
+		require.True(t, mach.importForwardedRoomKey(context.TODO(), forwarder, content))
+		imported, err := mach.CryptoStore.GetGroupSession(sess.RoomID, sess.SenderKey, sess.ID())
+		require.NoError(t, err)
+		assert.Equal(t, sess.SigningKey, imported.SigningKey)
+		assert.Equal(t, []string{"forwarderidentitykey"}, imported.ForwardingChains)
+		assert.True(t, imported.IsForwarded)
+		// Forwarding the same session again shouldn't replace it
+		assert.False(t, mach.importForwardedRoomKey(context.TODO(), forwarder, content))
+	})
+	t.Run("MismatchingClaimedKey", func(t *testing.T) {
+		mach := newMachine(t, "@user2:example.com")
+		require.True(t, mach.importForwardedRoomKey(context.TODO(), forwarder, content))
+		wrongClaimedKey := *content
+		wrongClaimedKey.SenderClaimedKey = "wrongsigningkey"
+		assert.False(t, mach.importForwardedRoomKey(context.TODO(), forwarder, &wrongClaimedKey))
+		stored, err := mach.CryptoStore.GetGroupSession(sess.RoomID, sess.SenderKey, sess.ID())
+		require.NoError(t, err)
+		assert.Equal(t, sess.SigningKey, stored.SigningKey)
+	})
+}
+
+// decryptSentOlmEvent decrypts a to-device message sent by the test server of newMachineWithToDeviceServer.
+func decryptSentOlmEvent(t *testing.T, mach *OlmMachine, sender id.UserID, msg sentToDevice) *DecryptedOlmEvent {
+	require.Equal(t, event.ToDeviceEncrypted.Type, msg.eventType)
+	var content event.EncryptedEventContent
+	require.NoError(t, json.Unmarshal(msg.messages[mach.Client.UserID][mach.Client.DeviceID], &content))
+	decrypted, err := mach.decryptOlmEvent(context.TODO(), &event.Event{
+		Sender:  sender,
+		Type:    event.ToDeviceEncrypted,
+		Content: event.Content{Parsed: &content},
+	})
+	require.NoError(t, err)
+	return decrypted
+}
+
+func TestReshareSession(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	machineIn := newMachine(t, "@user2:example.com")
+	var otk mautrix.OneTimeKey
+	for _, otk = range machineIn.account.getOneTimeKeys("@user2:example.com", machineIn.Client.DeviceID, 0, 1) {
+		break
+	}
+	olmSession, err := mach.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk.Key)
+	require.NoError(t, err)
+	require.NoError(t, mach.CryptoStore.AddSession(machineIn.account.IdentityKey(), wrapSession(olmSession)))
+	require.NoError(t, mach.CryptoStore.PutDevices("@user2:example.com", map[id.DeviceID]*id.Device{
+		machineIn.Client.DeviceID: machineIn.OwnIdentity(),
+	}))
+
+	// mockStateStore says room1 is the only room shared with other users
+	require.NoError(t, mach.ShareGroupSession(context.TODO(), "room1", []id.UserID{"@user2:example.com"}))
+	shared := decryptSentOlmEvent(t, machineIn, mach.Client.UserID, receiveToDevice(t, sent))
+	sessionID := shared.Content.AsRoomKey().SessionID
+
+	require.NoError(t, mach.ReshareSession(context.TODO(), "room1", sessionID, "@user2:example.com", machineIn.Client.DeviceID))
+	reshared := decryptSentOlmEvent(t, machineIn, mach.Client.UserID, receiveToDevice(t, sent))
+	require.Equal(t, event.ToDeviceForwardedRoomKey, reshared.Type)
+	forwarded := reshared.Content.AsForwardedRoomKey()
+	assert.Equal(t, sessionID, forwarded.SessionID)
+	assert.Equal(t, id.RoomID("room1"), forwarded.RoomID)
+	assert.Equal(t, mach.account.IdentityKey(), forwarded.SenderKey)
+	assert.Equal(t, mach.account.SigningKey(), forwarded.SenderClaimedKey)
+
+	err = mach.ReshareSession(context.TODO(), "room1", "unknown", "@user2:example.com", machineIn.Client.DeviceID)
+	assert.ErrorIs(t, err, ErrReshareSessionNotFound)
+	err = mach.ReshareSession(context.TODO(), "room2", sessionID, "@user2:example.com", machineIn.Client.DeviceID)
+	assert.ErrorIs(t, err, ErrReshareNotAllowed)
+	require.NoError(t, mach.SetDeviceTrust(context.TODO(), "@user2:example.com", machineIn.Client.DeviceID, id.TrustStateBlacklisted))
+	err = mach.ReshareSession(context.TODO(), "room1", sessionID, "@user2:example.com", machineIn.Client.DeviceID)
+	assert.ErrorIs(t, err, ErrReshareNotAllowed)
+	assert.Empty(t, sent)
+}
@@ -33,12 +33,41 @@ type OlmMachine struct {
 
 	PlaintextMentions bool
 
-	SendKeysMinTrust  id.TrustState
+	SendKeysMinTrust id.TrustState
+	// ShareToUnverifiedDevices controls whether megolm sessions are shared with devices that haven't been verified
+	// (either directly or by cross-signing with a verified user). If false, ShareGroupSession withholds the session
+	// from unverified devices and returns an *UnverifiedDevicesError listing them, but still shares it with verified devices.
+	ShareToUnverifiedDevices bool
+	// ShareKeysMinTrust is the minimum trust level of own devices that the default AllowKeyShare function
+	// forwards keys to when they request them.
 	ShareKeysMinTrust id.TrustState
 
+	// AllowKeyShare decides whether incoming key requests are answered by forwarding the requested key.
+	// If it returns a rejection, the rejection is sent to the requesting device instead, unless it's KeyShareRejectNoResponse.
+	//
+	// The default implementation only allows sharing keys with the user's own devices whose trust level is at least
+	// ShareKeysMinTrust. It can be replaced to share keys with verified devices of other users too.
 	AllowKeyShare func(context.Context, *id.Device, event.RequestedKeyInfo) *KeyShareRejection
 
 	DefaultSASTimeout time.Duration
+	// VerificationTimeout is the maximum age of a verification transaction. Transactions that haven't finished
+	// within this time are cancelled with the m.timeout code. Setting it to zero disables the check.
+	VerificationTimeout time.Duration
+	// KeyRequestTimeout is how long outgoing key requests are kept before they're cancelled if no key is received.
+	KeyRequestTimeout time.Duration
+	// OTKTarget is the number of signed one-time keys that should be available on the server. New keys are uploaded
+	// until the count reaches this target whenever the server reports a lower count. Values above the account's
+	// maximum number of one-time keys are capped to the maximum, and values below 1 mean half of the maximum.
+	OTKTarget int
+	// KeyQueryBatchSize is the maximum number of users included in a single /keys/query request.
+	// Device lists of more users are fetched using multiple requests. Values below 1 mean no limit.
+	KeyQueryBatchSize int
+	// KeyQueryWorkers is the number of goroutines used to verify the signatures of device keys
+	// returned by /keys/query. Values below 1 mean that signatures are verified one at a time.
+	KeyQueryWorkers int
+	// ShareSecretsMinTrust is the minimum trust level of the user's own devices that secrets are shared with
+	// in response to m.secret.request events. It's also the minimum trust level of devices that secrets are accepted from.
+	ShareSecretsMinTrust id.TrustState
 	// AcceptVerificationFrom determines whether the machine will accept verification requests from this device.
 	AcceptVerificationFrom func(string, *id.Device, id.RoomID) (VerificationRequestResponse, VerificationHooks)
 
@@ -50,6 +79,15 @@ type OlmMachine struct {
 	keyWaiters     map[id.SessionID]chan struct{}
 	keyWaitersLock sync.Mutex
 
+	secretRequests     map[string]*pendingSecretRequest
+	secretRequestsLock sync.Mutex
+
+	incomingKeyRequests     map[incomingKeyRequestKey]context.CancelFunc
+	incomingKeyRequestsLock sync.Mutex
+
+	keyBackup     *keyBackupState
+	keyBackupLock sync.RWMutex
+
 	devicesToUnwedge     map[id.IdentityKey]bool
 	devicesToUnwedgeLock sync.Mutex
 	recentlyUnwedged     map[id.IdentityKey]time.Time
@@ -62,6 +100,10 @@ type OlmMachine struct {
 	otkUploadLock sync.Mutex
 	lastOTKUpload time.Time
 
+	expiryCheckLock             sync.Mutex
+	lastKeyRequestExpiryCheck   time.Time
+	lastVerificationExpiryCheck time.Time
+
 	CrossSigningKeys    *CrossSigningKeysCache
 	crossSigningPubkeys *CrossSigningPublicKeysCache
 
@@ -103,7 +145,20 @@ func NewOlmMachine(client *mautrix.Client, log *zerolog.Logger, cryptoStore Stor
 		SendKeysMinTrust:  id.TrustStateUnset,
 		ShareKeysMinTrust: id.TrustStateCrossSignedTOFU,
 
+		ShareToUnverifiedDevices: true,
+
+		ShareSecretsMinTrust: id.TrustStateCrossSignedVerified,
+
 		DefaultSASTimeout: 10 * time.Minute,
+		KeyRequestTimeout: 24 * time.Hour,
+
+		VerificationTimeout: 10 * time.Minute,
+
+		OTKTarget: 50,
+
+		KeyQueryBatchSize: 250,
+		KeyQueryWorkers:   4,
+
 		AcceptVerificationFrom: func(string, *id.Device, id.RoomID) (VerificationRequestResponse, VerificationHooks) {
 			// Reject requests by default. Users need to override this to return appropriate verification hooks.
 			return RejectRequest, nil
@@ -114,6 +169,9 @@ func NewOlmMachine(client *mautrix.Client, log *zerolog.Logger, cryptoStore Stor
 
 		keyWaiters: make(map[id.SessionID]chan struct{}),
 
+		secretRequests:      make(map[string]*pendingSecretRequest),
+		incomingKeyRequests: make(map[incomingKeyRequestKey]context.CancelFunc),
+
 		devicesToUnwedge: make(map[id.IdentityKey]bool),
 		recentlyUnwedged: make(map[id.IdentityKey]time.Time),
 	}
@@ -149,6 +207,19 @@ func (mach *OlmMachine) saveAccount() {
 	}
 }
 
+// WipeAccount deletes the Olm account and all Olm and Megolm sessions of the current account from the crypto store.
+// This should be called after logging out, so that the keys of the logged-out device don't stay in the store.
+//
+// Load must be called again before using the machine after wiping the account.
+func (mach *OlmMachine) WipeAccount() error {
+	err := mach.CryptoStore.DeleteAccount()
+	if err != nil {
+		return fmt.Errorf("failed to delete account from crypto store: %w", err)
+	}
+	mach.account = nil
+	return nil
+}
+
 // FlushStore calls the Flush method of the CryptoStore.
 func (mach *OlmMachine) FlushStore() error {
 	return mach.CryptoStore.Flush()
@@ -212,12 +283,26 @@ func (mach *OlmMachine) AddAppserviceListener(ep asEventProcessor) {
 	ep.On(event.ToDeviceVerificationKey, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationMAC, mach.HandleToDeviceEvent)
 	ep.On(event.ToDeviceVerificationCancel, mach.HandleToDeviceEvent)
+	ep.On(event.ToDeviceSecretRequest, mach.HandleToDeviceEvent)
 	ep.OnOTK(mach.HandleOTKCounts)
 	ep.OnDeviceList(mach.HandleDeviceLists)
 	mach.Log.Debug().Msg("Added listeners for encryption data coming from appservice transactions")
 }
 
+// HandleDeviceLists handles the device list changes in a /sync response or appservice transaction.
+//
+// The device lists of all tracked users in the changed and left lists are flagged as outdated. Changed users are
+// fetched immediately, while left users are only fetched again when a group session is shared with them.
 func (mach *OlmMachine) HandleDeviceLists(dl *mautrix.DeviceLists, since string) {
+	if len(dl.Changed) > 0 || len(dl.Left) > 0 {
+		outdated := make([]id.UserID, 0, len(dl.Changed)+len(dl.Left))
+		outdated = append(outdated, dl.Changed...)
+		outdated = append(outdated, dl.Left...)
+		err := mach.CryptoStore.MarkTrackedUsersOutdated(outdated)
+		if err != nil {
+			mach.Log.Warn().Err(err).Msg("Failed to mark device lists as outdated")
+		}
+	}
 	if len(dl.Changed) > 0 {
 		traceID := time.Now().Format("15:04:05.000000")
 		mach.Log.Debug().
@@ -239,14 +324,15 @@ func (mach *OlmMachine) HandleOTKCounts(otkCount *mautrix.OTKCount) {
 		return
 	}
 
-	minCount := mach.account.Internal.MaxNumberOfOneTimeKeys() / 2
-	if otkCount.SignedCurve25519 < int(minCount) {
+	target := mach.otkTarget()
+	if otkCount.SignedCurve25519 < target {
 		traceID := time.Now().Format("15:04:05.000000")
 		log := mach.Log.With().Str("trace_id", traceID).Logger()
 		ctx := log.WithContext(context.Background())
 		log.Debug().
-			Int("keys_left", otkCount.Curve25519).
-			Msg("Sync response said we have less than 50 signed curve25519 keys left, sharing new ones...")
+			Int("keys_left", otkCount.SignedCurve25519).
+			Int("target", target).
+			Msg("Sync response said we have less signed curve25519 keys left than the target, sharing new ones...")
 		err := mach.ShareKeys(ctx, otkCount.SignedCurve25519)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to share keys")
@@ -275,6 +361,8 @@ func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string
 	}
 
 	mach.HandleOTKCounts(&resp.DeviceOTKCount)
+	mach.cancelExpiredKeyRequestsIfNeeded()
+	mach.cancelExpiredVerificationsIfNeeded()
 	return true
 }
 
@@ -283,6 +371,9 @@ func (mach *OlmMachine) ProcessSyncResponse(resp *mautrix.RespSync, since string
 // Currently this is not automatically called, so you must add a listener yourself:
 //
 //	client.Syncer.(mautrix.ExtensibleSyncer).OnEventType(event.StateMember, c.crypto.HandleMemberEvent)
+//
+// Membership changes invalidate the outbound group session with InvalidateOutboundSession, which means the event
+// handler (and therefore sync processing) blocks until any in-progress encryption or group session share finishes.
 func (mach *OlmMachine) HandleMemberEvent(_ mautrix.EventSource, evt *event.Event) {
 	if !mach.StateStore.IsEncrypted(evt.RoomID) {
 		return
@@ -311,10 +402,69 @@ func (mach *OlmMachine) HandleMemberEvent(_ mautrix.EventSource, evt *event.Even
 		Str("prev_membership", string(prevContent.Membership)).
 		Str("new_membership", string(content.Membership)).
 		Msg("Got membership state change, invalidating group session in room")
-	err := mach.CryptoStore.RemoveOutboundGroupSession(evt.RoomID)
+	err := mach.InvalidateOutboundSession(context.TODO(), evt.RoomID)
+	if err != nil {
+		mach.Log.Warn().Err(err).Str("room_id", evt.RoomID.String()).Msg("Failed to invalidate outbound group session")
+	}
+}
+
+// BlacklistDevice marks the given device as blacklisted and invalidates the outbound group sessions of all
+// encrypted rooms shared with the device's owner, so that the device won't receive keys for future messages.
+func (mach *OlmMachine) BlacklistDevice(ctx context.Context, device *id.Device) error {
+	device.Trust = id.TrustStateBlacklisted
+	err := mach.CryptoStore.PutDevice(device.UserID, device)
 	if err != nil {
-		mach.Log.Warn().Str("room_id", evt.RoomID.String()).Msg("Failed to invalidate outbound group session")
+		return fmt.Errorf("failed to save device: %w", err)
 	}
+	return mach.invalidateSharedRoomSessions(ctx, device.UserID)
+}
+
+// ErrUnknownDevice is returned by SetDeviceTrust if the device isn't in the crypto store.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// SetDeviceTrust changes the trust state of a device in the crypto store.
+//
+// If the new trust state is lower than the previous one, the outbound group sessions of all encrypted rooms shared
+// with the device's owner are invalidated, so that the device won't receive keys for future messages unless it's
+// still trusted enough (see ShareToUnverifiedDevices). Blacklisted devices never receive keys.
+func (mach *OlmMachine) SetDeviceTrust(ctx context.Context, userID id.UserID, deviceID id.DeviceID, trust id.TrustState) error {
+	device, err := mach.CryptoStore.GetDevice(userID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get device: %w", err)
+	} else if device == nil {
+		return fmt.Errorf("%w %s of %s", ErrUnknownDevice, deviceID, userID)
+	}
+	prevTrust := device.Trust
+	device.Trust = trust
+	err = mach.CryptoStore.PutDevice(userID, device)
+	if err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	if trust < prevTrust {
+		return mach.invalidateSharedRoomSessions(ctx, userID)
+	}
+	return nil
+}
+
+func (mach *OlmMachine) invalidateSharedRoomSessions(ctx context.Context, userID id.UserID) error {
+	for _, roomID := range mach.StateStore.FindSharedRooms(userID) {
+		err := mach.InvalidateOutboundSession(ctx, roomID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateAllOutboundSessions removes the outbound group sessions of all rooms, so that a new session is created
+// the next time a message is sent to each room. This can be used to force rotation after a suspected key compromise.
+func (mach *OlmMachine) RotateAllOutboundSessions() error {
+	count, err := mach.CryptoStore.RemoveAllOutboundGroupSessions()
+	if err != nil {
+		return fmt.Errorf("failed to remove outbound group sessions: %w", err)
+	}
+	mach.Log.Info().Int64("room_count", count).Msg("Removed all outbound group sessions to force rotation")
+	return nil
 }
 
 // HandleToDeviceEvent handles a single to-device event. This is automatically called by ProcessSyncResponse, so you
@@ -369,6 +519,9 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 				}
 			}
 			log.Trace().Msg("Handled forwarded room key event")
+		case *event.SecretSendEventContent:
+			mach.receiveSecret(ctx, decryptedEvt, decryptedContent)
+			log.Trace().Msg("Handled secret send event")
 		case *event.DummyEventContent:
 			log.Debug().Msg("Received encrypted dummy event")
 		default:
@@ -376,7 +529,7 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 		}
 		return
 	case *event.RoomKeyRequestEventContent:
-		go mach.handleRoomKeyRequest(ctx, evt.Sender, content)
+		mach.handleRoomKeyRequestEvent(ctx, evt.Sender, content)
 	case *event.BeeperRoomKeyAckEventContent:
 		mach.handleBeeperRoomKeyAck(ctx, evt.Sender, content)
 	// verification cases
@@ -394,6 +547,8 @@ func (mach *OlmMachine) HandleToDeviceEvent(evt *event.Event) {
 		mach.handleVerificationRequest(ctx, evt.Sender, content, content.TransactionID, "")
 	case *event.RoomKeyWithheldEventContent:
 		mach.handleRoomKeyWithheld(ctx, content)
+	case *event.SecretRequestEventContent:
+		go mach.handleSecretRequest(ctx, evt.Sender, content)
 	default:
 		deviceID, _ := evt.Content.Raw["device_id"].(string)
 		log.Debug().Str("maybe_device_id", deviceID).Msg("Unhandled to-device event")
@@ -505,6 +660,7 @@ func (mach *OlmMachine) createGroupSession(ctx context.Context, senderKey id.Sen
 		return
 	}
 	mach.markSessionReceived(sessionID)
+	mach.backupGroupSession(igs)
 	log.Debug().
 		Str("session_id", sessionID.String()).
 		Str("sender_key", senderKey.String()).
@@ -522,6 +678,7 @@ func (mach *OlmMachine) markSessionReceived(id id.SessionID) {
 		delete(mach.keyWaiters, id)
 	}
 	mach.keyWaitersLock.Unlock()
+	mach.cancelKeyRequestsForSession(id)
 }
 
 // WaitForSession waits for the given Megolm session to arrive.
@@ -612,11 +769,26 @@ func (mach *OlmMachine) handleRoomKeyWithheld(ctx context.Context, content *even
 	}
 }
 
+// otkTarget returns OTKTarget validated against the maximum number of one-time keys the account can hold.
+func (mach *OlmMachine) otkTarget() int {
+	maxKeys := int(mach.account.Internal.MaxNumberOfOneTimeKeys())
+	if mach.OTKTarget <= 0 {
+		return maxKeys / 2
+	} else if mach.OTKTarget > maxKeys {
+		mach.Log.Warn().
+			Int("otk_target", mach.OTKTarget).
+			Int("max_otks", maxKeys).
+			Msg("OTK target is higher than the maximum number of one-time keys, capping to maximum")
+		return maxKeys
+	}
+	return mach.OTKTarget
+}
+
 // ShareKeys uploads necessary keys to the server.
 //
 // If the Olm account hasn't been shared, the account keys will be uploaded.
-// If currentOTKCount is less than half of the limit (100 / 2 = 50), enough one-time keys will be uploaded so exactly
-// half of the limit is filled.
+// If currentOTKCount is less than OTKTarget, enough one-time keys will be uploaded so that exactly OTKTarget keys
+// are available on the server.
 func (mach *OlmMachine) ShareKeys(ctx context.Context, currentOTKCount int) error {
 	log := mach.machOrContextLog(ctx)
 	start := time.Now()
@@ -639,7 +811,7 @@ func (mach *OlmMachine) ShareKeys(ctx context.Context, currentOTKCount int) erro
 		deviceKeys = mach.account.getInitialKeys(mach.Client.UserID, mach.Client.DeviceID)
 		log.Debug().Msg("Going to upload initial account keys")
 	}
-	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount)
+	oneTimeKeys := mach.account.getOneTimeKeys(mach.Client.UserID, mach.Client.DeviceID, currentOTKCount, mach.otkTarget())
 	if len(oneTimeKeys) == 0 && deviceKeys == nil {
 		log.Debug().Msg("No one-time keys nor device keys got when trying to share keys")
 		return nil
@@ -8,6 +8,10 @@ package crypto
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,7 +74,7 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 	machineIn := newMachine(t, "user2")
 
 	// generate OTKs for receiving machine
-	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0)
+	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0, machineIn.otkTarget())
 	var otk mautrix.OneTimeKey
 	for _, otkTmp := range otks {
 		// take first OTK
@@ -169,3 +173,108 @@ func TestOlmMachineOlmMegolmSessions(t *testing.T) {
 		t.Error("Megolm outbound session not expired after 3rd message")
 	}
 }
+
+func TestDecryptMegolmEvent_LegacyForwardingChain(t *testing.T) {
+	mach := newMachine(t, "user1")
+	outSess := mach.newOutboundGroupSession(context.TODO(), "room1")
+	outSess.Shared = true
+	require.NoError(t, mach.CryptoStore.AddOutboundGroupSession(outSess))
+	encrypted, err := mach.EncryptMegolmEvent(context.TODO(), "room1", event.EventMessage, map[string]string{"hello": "world"})
+	require.NoError(t, err)
+
+	// Sessions stored before IsForwarded existed only have the forwarding chain
+	inSess, err := mach.CryptoStore.GetGroupSession("room1", mach.OwnIdentity().IdentityKey, outSess.ID())
+	require.NoError(t, err)
+	inSess.ForwardingChains = []string{"forwarderidentitykey"}
+	inSess.IsForwarded = false
+	require.NoError(t, mach.CryptoStore.PutGroupSession("room1", inSess.SenderKey, inSess.ID(), inSess))
+
+	decrypted, err := mach.DecryptMegolmEvent(context.TODO(), &event.Event{
+		Content: event.Content{Parsed: encrypted},
+		Type:    event.EventEncrypted,
+		ID:      "event1",
+		RoomID:  "room1",
+		Sender:  "user1",
+	})
+	require.NoError(t, err)
+	assert.True(t, decrypted.Mautrix.ForwardedKeys)
+	assert.Equal(t, id.TrustStateForwarded, decrypted.Mautrix.TrustState)
+}
+
+func TestOTKTarget(t *testing.T) {
+	mach := newMachine(t, "user1")
+	maxKeys := int(mach.account.Internal.MaxNumberOfOneTimeKeys())
+	assert.Equal(t, 50, mach.otkTarget())
+	mach.OTKTarget = maxKeys + 100
+	assert.Equal(t, maxKeys, mach.otkTarget())
+	mach.OTKTarget = 0
+	assert.Equal(t, maxKeys/2, mach.otkTarget())
+
+	mach.OTKTarget = 10
+	assert.Len(t, mach.account.getOneTimeKeys("user1", "device1", 4, mach.otkTarget()), 6)
+	assert.Empty(t, mach.account.getOneTimeKeys("user1", "device1", 10, mach.otkTarget()))
+}
+
+func TestCreateOutboundSessions_FallbackKey(t *testing.T) {
+	machineIn := newMachine(t, "@user2:example.com")
+	otks := machineIn.account.getOneTimeKeys("@user2:example.com", machineIn.Client.DeviceID, 0, 1)
+	var keyID id.KeyID
+	var otk mautrix.OneTimeKey
+	for keyID, otk = range otks {
+		break
+	}
+	// Re-sign the key with the fallback flag like the server would return it for a fallback key
+	fallbackKey := mautrix.OneTimeKey{Key: otk.Key, Fallback: true}
+	signature, err := machineIn.account.Internal.SignJSON(fallbackKey)
+	require.NoError(t, err)
+	fallbackKey.Signatures = mautrix.Signatures{
+		"@user2:example.com": {id.NewKeyID(id.KeyAlgorithmEd25519, machineIn.Client.DeviceID.String()): signature},
+	}
+	fallbackKey.IsSigned = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal(t, "/_matrix/client/v3/keys/claim", r.URL.Path) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(&mautrix.RespClaimKeys{
+			OneTimeKeys: map[id.UserID]map[id.DeviceID]map[id.KeyID]mautrix.OneTimeKey{
+				"@user2:example.com": {machineIn.Client.DeviceID: {keyID: fallbackKey}},
+			},
+		}))
+	}))
+	t.Cleanup(server.Close)
+	machineOut := newMachine(t, "@user1:example.com")
+	machineOut.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	device := machineIn.OwnIdentity()
+	err = machineOut.createOutboundSessions(context.TODO(), map[id.UserID]map[id.DeviceID]*id.Device{
+		"@user2:example.com": {device.DeviceID: device},
+	})
+	require.NoError(t, err)
+	sess, err := machineOut.CryptoStore.GetLatestSession(device.IdentityKey)
+	require.NoError(t, err)
+	require.NotNil(t, sess)
+	assert.True(t, sess.UsedFallbackKey)
+}
+
+func TestBlacklistDevice(t *testing.T) {
+	mach, _ := newMachineWithToDeviceServer(t, "@user1:example.com")
+	device := &id.Device{UserID: "@user2:example.com", DeviceID: "dev", IdentityKey: "identitykey", SigningKey: "signingkey"}
+	require.NoError(t, mach.CryptoStore.PutDevice(device.UserID, device))
+	// mockStateStore says room1 is the only room shared with other users
+	for _, roomID := range []id.RoomID{"room1", "room2"} {
+		require.NoError(t, mach.ShareGroupSession(context.TODO(), roomID, nil))
+	}
+
+	require.NoError(t, mach.BlacklistDevice(context.TODO(), device))
+	stored, err := mach.CryptoStore.GetDevice(device.UserID, device.DeviceID)
+	require.NoError(t, err)
+	assert.Equal(t, id.TrustStateBlacklisted, stored.Trust)
+	session, err := mach.CryptoStore.GetOutboundGroupSession("room1")
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	session, err = mach.CryptoStore.GetOutboundGroupSession("room2")
+	require.NoError(t, err)
+	assert.NotNil(t, session)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrSecretRequestTimeout = errors.New("timed out waiting for secret")
+
+type pendingSecretRequest struct {
+	name     id.Secret
+	received chan string
+}
+
+// FetchSecretFromSSSS fetches the secret with the given name from SSSS, decrypts it using the given key
+// and stores it in the crypto store. The secret is returned as unpadded base64, like in m.secret.send events.
+func (mach *OlmMachine) FetchSecretFromSSSS(ctx context.Context, key *ssss.Key, name id.Secret) (string, error) {
+	decrypted, err := mach.SSSS.GetDecryptedAccountData(ctx, event.Type{Type: string(name), Class: event.AccountDataEventType}, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s from SSSS: %w", name, err)
+	}
+	secret := base64.RawStdEncoding.EncodeToString(decrypted)
+	err = mach.CryptoStore.PutSecret(name, secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to store secret %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+func (mach *OlmMachine) sendSecretRequest(ctx context.Context, content *event.SecretRequestEventContent) error {
+	content.RequestingDeviceID = mach.Client.DeviceID
+	toDeviceReq := &mautrix.ReqSendToDevice{
+		Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+			mach.Client.UserID: {
+				"*": {Parsed: content},
+			},
+		},
+	}
+	_, err := mach.Client.SendToDevice(ctx, event.ToDeviceSecretRequest, toDeviceReq)
+	return err
+}
+
+// RequestSecret requests the secret with the given name from all other devices of the current user and waits
+// until one of them sends it. The received secret is stored in the crypto store before returning.
+//
+// Secrets are only accepted from devices whose trust level is at least ShareSecretsMinTrust.
+// Once a secret is received (or the request times out), the request is cancelled on all other devices.
+func (mach *OlmMachine) RequestSecret(ctx context.Context, name id.Secret, timeout time.Duration) (string, error) {
+	requestID := mach.Client.TxnID()
+	req := &pendingSecretRequest{name: name, received: make(chan string, 1)}
+	mach.secretRequestsLock.Lock()
+	mach.secretRequests[requestID] = req
+	mach.secretRequestsLock.Unlock()
+	defer func() {
+		mach.secretRequestsLock.Lock()
+		delete(mach.secretRequests, requestID)
+		mach.secretRequestsLock.Unlock()
+		err := mach.sendSecretRequest(context.Background(), &event.SecretRequestEventContent{
+			Action:    event.SecretRequestActionCancel,
+			RequestID: requestID,
+		})
+		if err != nil {
+			mach.Log.Warn().Err(err).Str("request_id", requestID).Msg("Failed to cancel secret request")
+		}
+	}()
+
+	err := mach.sendSecretRequest(ctx, &event.SecretRequestEventContent{
+		Name:      name,
+		Action:    event.SecretRequestActionRequest,
+		RequestID: requestID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to send secret request: %w", err)
+	}
+
+	select {
+	case secret := <-req.received:
+		return secret, nil
+	case <-time.After(timeout):
+		return "", ErrSecretRequestTimeout
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (mach *OlmMachine) isTrustedForSecrets(ctx context.Context, device *id.Device) bool {
+	log := zerolog.Ctx(ctx)
+	if device.UserID != mach.Client.UserID {
+		log.Debug().Msg("Secrets are only shared with the user's own devices")
+		return false
+	} else if device.Trust == id.TrustStateBlacklisted {
+		log.Debug().Msg("Device is blacklisted")
+		return false
+	} else if trustState := mach.ResolveTrust(device); trustState < mach.ShareSecretsMinTrust {
+		log.Debug().
+			Str("min_trust", mach.ShareSecretsMinTrust.String()).
+			Str("device_trust", trustState.String()).
+			Msg("Device isn't trusted enough for sharing secrets")
+		return false
+	}
+	return true
+}
+
+func (mach *OlmMachine) handleSecretRequest(ctx context.Context, sender id.UserID, content *event.SecretRequestEventContent) {
+	log := zerolog.Ctx(ctx).With().
+		Str("request_id", content.RequestID).
+		Str("device_id", content.RequestingDeviceID.String()).
+		Str("secret_name", string(content.Name)).
+		Logger()
+	ctx = log.WithContext(ctx)
+	if content.Action != event.SecretRequestActionRequest {
+		// Requests are answered immediately, so there's nothing to cancel
+		return
+	} else if sender != mach.Client.UserID {
+		log.Debug().Msg("Ignoring secret request from a different user")
+		return
+	} else if content.RequestingDeviceID == mach.Client.DeviceID {
+		return
+	}
+
+	log.Debug().Msg("Received secret request")
+	device, err := mach.GetOrFetchDevice(ctx, sender, content.RequestingDeviceID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to fetch device that requested secret")
+		return
+	} else if !mach.isTrustedForSecrets(ctx, device) {
+		log.Debug().Msg("Not sharing secret with untrusted device")
+		return
+	}
+
+	secret, err := mach.CryptoStore.GetSecret(content.Name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get requested secret")
+		return
+	} else if secret == "" {
+		log.Debug().Msg("Requested secret not found")
+		return
+	}
+
+	err = mach.SendEncryptedToDevice(ctx, device, event.ToDeviceSecretSend, event.Content{
+		Parsed: &event.SecretSendEventContent{
+			RequestID: content.RequestID,
+			Secret:    secret,
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encrypt and send secret")
+	} else {
+		log.Debug().Msg("Successfully sent secret")
+	}
+}
+
+func (mach *OlmMachine) receiveSecret(ctx context.Context, evt *DecryptedOlmEvent, content *event.SecretSendEventContent) {
+	log := zerolog.Ctx(ctx).With().Str("request_id", content.RequestID).Logger()
+	ctx = log.WithContext(ctx)
+
+	mach.secretRequestsLock.Lock()
+	req, ok := mach.secretRequests[content.RequestID]
+	mach.secretRequestsLock.Unlock()
+	if !ok {
+		log.Debug().Msg("Ignoring secret for unknown request")
+		return
+	}
+	log = log.With().Str("secret_name", string(req.name)).Logger()
+	ctx = log.WithContext(ctx)
+
+	device, err := mach.GetOrFetchDevice(ctx, evt.Sender, evt.SenderDevice)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to fetch device that sent secret")
+		return
+	} else if device.IdentityKey != evt.SenderKey {
+		log.Warn().Msg("Rejecting secret as the sender key doesn't match the sender device")
+		return
+	} else if !mach.isTrustedForSecrets(ctx, device) {
+		log.Warn().Msg("Rejecting secret from untrusted device")
+		return
+	} else if content.Secret == "" {
+		log.Warn().Msg("Received empty secret")
+		return
+	}
+
+	err = mach.CryptoStore.PutSecret(req.name, content.Secret)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to store received secret")
+		return
+	}
+	select {
+	case req.received <- content.Secret:
+	default:
+	}
+	log.Debug().Msg("Received and stored secret")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func requestSecretAndReply(t *testing.T, trust id.TrustState, timeout time.Duration) (*OlmMachine, string, error) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	device := &id.Device{UserID: "@user1:example.com", DeviceID: "device2", IdentityKey: "identitykey", Trust: trust}
+	require.NoError(t, mach.CryptoStore.PutDevice(device.UserID, device))
+
+	type result struct {
+		secret string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		secret, err := mach.RequestSecret(context.TODO(), id.SecretMegolmBackupV1, timeout)
+		done <- result{secret, err}
+	}()
+
+	request := receiveToDevice(t, sent)
+	assert.Equal(t, event.ToDeviceSecretRequest.Type, request.eventType)
+	var content event.SecretRequestEventContent
+	require.NoError(t, json.Unmarshal(request.messages["@user1:example.com"]["*"], &content))
+	assert.Equal(t, event.SecretRequestActionRequest, content.Action)
+	assert.Equal(t, id.SecretMegolmBackupV1, content.Name)
+
+	mach.receiveSecret(context.TODO(), &DecryptedOlmEvent{
+		Sender:       device.UserID,
+		SenderDevice: device.DeviceID,
+		SenderKey:    device.IdentityKey,
+	}, &event.SecretSendEventContent{RequestID: content.RequestID, Secret: "backupkey"})
+
+	res := <-done
+	cancellation := receiveToDevice(t, sent)
+	require.NoError(t, json.Unmarshal(cancellation.messages["@user1:example.com"]["*"], &content))
+	assert.Equal(t, event.SecretRequestActionCancel, content.Action)
+	return mach, res.secret, res.err
+}
+
+func TestRequestSecret(t *testing.T) {
+	mach, secret, err := requestSecretAndReply(t, id.TrustStateVerified, 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "backupkey", secret)
+	stored, err := mach.CryptoStore.GetSecret(id.SecretMegolmBackupV1)
+	require.NoError(t, err)
+	assert.Equal(t, "backupkey", stored)
+}
+
+func TestRequestSecretFromUntrustedDevice(t *testing.T) {
+	mach, _, err := requestSecretAndReply(t, id.TrustStateUnset, 100*time.Millisecond)
+	assert.ErrorIs(t, err, ErrSecretRequestTimeout)
+	stored, err := mach.CryptoStore.GetSecret(id.SecretMegolmBackupV1)
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestSecretRequestFromOtherUserIgnored(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	require.NoError(t, mach.CryptoStore.PutSecret(id.SecretMegolmBackupV1, "backupkey"))
+	require.NoError(t, mach.CryptoStore.PutDevice("@user2:example.com", &id.Device{
+		UserID:   "@user2:example.com",
+		DeviceID: "dev",
+		Trust:    id.TrustStateVerified,
+	}))
+
+	mach.handleSecretRequest(context.TODO(), "@user2:example.com", &event.SecretRequestEventContent{
+		Name:               id.SecretMegolmBackupV1,
+		Action:             event.SecretRequestActionRequest,
+		RequestingDeviceID: "dev",
+		RequestID:          "req1",
+	})
+	assert.Empty(t, sent)
+}
@@ -8,6 +8,7 @@ package crypto
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"maunium.net/go/mautrix/crypto/olm"
@@ -40,7 +41,11 @@ func (o OlmSessionList) Swap(i, j int) {
 type OlmSession struct {
 	Internal olm.Session
 	ExpirationMixin
-	id id.SessionID
+	// UsedFallbackKey is true if the session was created using a fallback key (MSC2732) instead of a one-time key.
+	// Fallback keys can be claimed multiple times, so the first messages of such sessions have reduced
+	// forward secrecy until the other side replies.
+	UsedFallbackKey bool
+	id              id.SessionID
 }
 
 func (session *OlmSession) ID() id.SessionID {
@@ -109,6 +114,9 @@ type InboundGroupSession struct {
 	MaxAge      int64
 	MaxMessages int
 	IsScheduled bool
+	// IsForwarded is true if the session wasn't received directly from the sender's device,
+	// i.e. it was forwarded by another device or imported from a key export.
+	IsForwarded bool
 
 	id id.SessionID
 }
@@ -151,6 +159,53 @@ func (igs *InboundGroupSession) RatchetTo(index uint32) error {
 	return nil
 }
 
+// InboundSessionInfo contains debugging information about an inbound Megolm session, e.g. for finding out
+// why a specific event can't be decrypted. It doesn't contain any key material unless explicitly requested.
+type InboundSessionInfo struct {
+	RoomID    id.RoomID
+	SessionID id.SessionID
+	// Exists is false if the store doesn't know anything about the session.
+	Exists bool
+
+	SenderKey        id.SenderKey
+	SigningKey       id.Ed25519
+	ForwardingChains []string
+	FirstKnownIndex  uint32
+	IsForwarded      bool
+	ReceivedAt       time.Time
+
+	// WithheldCode is set if the session was withheld by the sender or redacted locally.
+	// The other session fields are empty in that case.
+	WithheldCode   event.RoomKeyWithheldCode
+	WithheldReason string
+
+	// SessionKey is the session key exported at the first known index.
+	// It's only set if key material was explicitly requested.
+	SessionKey string
+}
+
+func (igs *InboundGroupSession) info(includeKey bool) (*InboundSessionInfo, error) {
+	info := &InboundSessionInfo{
+		RoomID:           igs.RoomID,
+		SessionID:        igs.ID(),
+		Exists:           true,
+		SenderKey:        igs.SenderKey,
+		SigningKey:       igs.SigningKey,
+		ForwardingChains: igs.ForwardingChains,
+		FirstKnownIndex:  igs.Internal.FirstKnownIndex(),
+		IsForwarded:      igs.IsForwarded,
+		ReceivedAt:       igs.ReceivedAt,
+	}
+	if includeKey {
+		key, err := igs.Internal.Export(info.FirstKnownIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export session key: %w", err)
+		}
+		info.SessionKey = string(key)
+	}
+	return info, nil
+}
+
 type OGSState int
 
 const (
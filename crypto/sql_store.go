@@ -23,6 +23,7 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/crypto/ssss"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -42,12 +43,24 @@ type SQLCryptoStore struct {
 	PickleKey []byte
 	Account   *OlmAccount
 
+	// PersistFilterID makes the SyncStore implementation store the sync filter ID in the database.
+	// It's disabled by default, as a stored filter ID won't be updated if the syncer's filter changes.
+	PersistFilterID bool
+
+	// MaxOlmSessionsPerKey is the maximum number of Olm sessions stored for each sender key. When AddSession goes
+	// over the limit, the sessions that were least recently used for decrypting are deleted.
+	// Values below 1 disable the limit. Defaults to DefaultMaxOlmSessionsPerKey.
+	MaxOlmSessionsPerKey int
+
 	olmSessionCache     map[id.SenderKey]map[id.SessionID]*OlmSession
 	olmSessionCacheLock sync.Mutex
 }
 
 var _ Store = (*SQLCryptoStore)(nil)
 
+// DefaultMaxOlmSessionsPerKey is the default value for SQLCryptoStore.MaxOlmSessionsPerKey.
+const DefaultMaxOlmSessionsPerKey = 5
+
 // NewSQLCryptoStore initializes a new crypto Store using the given database, for a device's crypto material.
 // The stored material will be encrypted with the given key.
 func NewSQLCryptoStore(db *dbutil.Database, log dbutil.DatabaseLogger, accountID string, deviceID id.DeviceID, pickleKey []byte) *SQLCryptoStore {
@@ -57,6 +70,8 @@ func NewSQLCryptoStore(db *dbutil.Database, log dbutil.DatabaseLogger, accountID
 		AccountID: accountID,
 		DeviceID:  deviceID,
 
+		MaxOlmSessionsPerKey: DefaultMaxOlmSessionsPerKey,
+
 		olmSessionCache: make(map[id.SenderKey]map[id.SessionID]*OlmSession),
 	}
 }
@@ -86,10 +101,45 @@ func (store *SQLCryptoStore) GetNextBatch(ctx context.Context) (string, error) {
 	return store.SyncToken, nil
 }
 
+// PutFilterID stores the sync filter ID for the current account.
+func (store *SQLCryptoStore) PutFilterID(ctx context.Context, filterID string) error {
+	_, err := store.DB.ExecContext(ctx, `UPDATE crypto_account SET filter_id=$1 WHERE account_id=$2`, filterID, store.AccountID)
+	return err
+}
+
+// GetFilterID retrieves the sync filter ID for the current account.
+func (store *SQLCryptoStore) GetFilterID(ctx context.Context) (filterID string, err error) {
+	err = store.DB.
+		QueryRowContext(ctx, "SELECT filter_id FROM crypto_account WHERE account_id=$1", store.AccountID).
+		Scan(&filterID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
 var _ mautrix.SyncStore = (*SQLCryptoStore)(nil)
 
-func (store *SQLCryptoStore) SaveFilterID(ctx context.Context, _ id.UserID, _ string) {}
-func (store *SQLCryptoStore) LoadFilterID(ctx context.Context, _ id.UserID) string    { return "" }
+func (store *SQLCryptoStore) SaveFilterID(ctx context.Context, _ id.UserID, filterID string) {
+	if !store.PersistFilterID {
+		return
+	}
+	err := store.PutFilterID(ctx, filterID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save filter ID")
+	}
+}
+
+func (store *SQLCryptoStore) LoadFilterID(ctx context.Context, _ id.UserID) string {
+	if !store.PersistFilterID {
+		return ""
+	}
+	filterID, err := store.GetFilterID(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to load filter ID")
+	}
+	return filterID
+}
 
 func (store *SQLCryptoStore) SaveNextBatch(ctx context.Context, _ id.UserID, nextBatchToken string) {
 	err := store.PutNextBatch(ctx, nextBatchToken)
@@ -148,6 +198,51 @@ func (store *SQLCryptoStore) GetAccount() (*OlmAccount, error) {
 	return store.Account, nil
 }
 
+// GetAccounts returns all accounts in the database, including ones with a different account ID than this store.
+func (store *SQLCryptoStore) GetAccounts() ([]AccountInfo, error) {
+	rows, err := store.DB.Query("SELECT account_id, device_id, shared FROM crypto_account ORDER BY account_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts []AccountInfo
+	for rows.Next() {
+		var info AccountInfo
+		err = rows.Scan(&info.AccountID, &info.DeviceID, &info.Shared)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, info)
+	}
+	return accounts, rows.Err()
+}
+
+// DeleteAccount deletes the account row, all Olm and Megolm sessions and the device lists of the current account ID.
+// Cross-signing keys aren't tied to an account, so they're left in the store.
+func (store *SQLCryptoStore) DeleteAccount() error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range sql_store_upgrade.AccountIDTables {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE account_id=$1", table), store.AccountID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to delete rows from %s: %w", table, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit changes: %w", err)
+	}
+	store.Account = nil
+	store.SyncToken = ""
+	store.olmSessionCacheLock.Lock()
+	store.olmSessionCache = make(map[id.SenderKey]map[id.SessionID]*OlmSession)
+	store.olmSessionCacheLock.Unlock()
+	return nil
+}
+
 // HasSession returns whether there is an Olm session for the given sender key.
 func (store *SQLCryptoStore) HasSession(key id.SenderKey) bool {
 	store.olmSessionCacheLock.Lock()
@@ -167,7 +262,7 @@ func (store *SQLCryptoStore) HasSession(key id.SenderKey) bool {
 
 // GetSessions returns all the known Olm sessions for a sender key.
 func (store *SQLCryptoStore) GetSessions(key id.SenderKey) (OlmSessionList, error) {
-	rows, err := store.DB.Query("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
+	rows, err := store.DB.Query("SELECT session_id, session, created_at, last_encrypted, last_decrypted, used_fallback_key FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
 		key, store.AccountID)
 	if err != nil {
 		return nil, err
@@ -180,7 +275,7 @@ func (store *SQLCryptoStore) GetSessions(key id.SenderKey) (OlmSessionList, erro
 		sess := OlmSession{Internal: *olm.NewBlankSession()}
 		var sessionBytes []byte
 		var sessionID id.SessionID
-		err = rows.Scan(&sessionID, &sessionBytes, &sess.CreationTime, &sess.LastEncryptedTime, &sess.LastDecryptedTime)
+		err = rows.Scan(&sessionID, &sessionBytes, scanTime{&sess.CreationTime}, scanTime{&sess.LastEncryptedTime}, scanTime{&sess.LastDecryptedTime}, &sess.UsedFallbackKey)
 		if err != nil {
 			return nil, err
 		} else if existing, ok := cache[sessionID]; ok {
@@ -211,14 +306,14 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
 
-	row := store.DB.QueryRow("SELECT session_id, session, created_at, last_encrypted, last_decrypted FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC LIMIT 1",
+	row := store.DB.QueryRow("SELECT session_id, session, created_at, last_encrypted, last_decrypted, used_fallback_key FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC LIMIT 1",
 		key, store.AccountID)
 
 	sess := OlmSession{Internal: *olm.NewBlankSession()}
 	var sessionBytes []byte
 	var sessionID id.SessionID
 
-	err := row.Scan(&sessionID, &sessionBytes, &sess.CreationTime, &sess.LastEncryptedTime, &sess.LastDecryptedTime)
+	err := row.Scan(&sessionID, &sessionBytes, scanTime{&sess.CreationTime}, scanTime{&sess.LastEncryptedTime}, scanTime{&sess.LastDecryptedTime}, &sess.UsedFallbackKey)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -237,22 +332,145 @@ func (store *SQLCryptoStore) GetLatestSession(key id.SenderKey) (*OlmSession, er
 }
 
 // AddSession persists an Olm session for a sender in the database.
+//
+// If there are more than MaxOlmSessionsPerKey sessions for the sender key afterwards, the least recently used
+// sessions are deleted. The newly added session is always kept.
 func (store *SQLCryptoStore) AddSession(key id.SenderKey, session *OlmSession) error {
 	store.olmSessionCacheLock.Lock()
 	defer store.olmSessionCacheLock.Unlock()
-	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec("INSERT INTO crypto_olm_session (session_id, sender_key, session, created_at, last_encrypted, last_decrypted, account_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		session.ID(), key, sessionBytes, session.CreationTime, session.LastEncryptedTime, session.LastDecryptedTime, store.AccountID)
+	err := store.insertSession(key, session)
+	if err != nil {
+		return err
+	}
 	store.getOlmSessionCache(key)[session.ID()] = session
+	if store.MaxOlmSessionsPerKey > 0 {
+		err = store.limitSessions(key, session.ID())
+		if err != nil {
+			return fmt.Errorf("failed to delete old olm sessions: %w", err)
+		}
+	}
+	return nil
+}
+
+func (store *SQLCryptoStore) insertSession(key id.SenderKey, session *OlmSession) error {
+	sessionBytes := session.Internal.Pickle(store.PickleKey)
+	_, err := store.DB.Exec("INSERT INTO crypto_olm_session (session_id, sender_key, session, created_at, last_encrypted, last_decrypted, used_fallback_key, account_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		session.ID(), key, sessionBytes, store.timeValue(session.CreationTime), store.timeValue(session.LastEncryptedTime),
+		store.timeValue(session.LastDecryptedTime), session.UsedFallbackKey, store.AccountID)
 	return err
 }
 
+// limitSessions deletes the least recently used sessions of the given sender key
+// until there are at most MaxOlmSessionsPerKey left. The session with the given ID is never deleted.
+func (store *SQLCryptoStore) limitSessions(key id.SenderKey, keep id.SessionID) error {
+	rows, err := store.DB.Query("SELECT session_id FROM crypto_olm_session WHERE sender_key=$1 AND account_id=$2 ORDER BY last_decrypted DESC",
+		key, store.AccountID)
+	if err != nil {
+		return err
+	}
+	var toDelete []id.SessionID
+	kept := 1
+	for rows.Next() {
+		var sessionID id.SessionID
+		if err = rows.Scan(&sessionID); err != nil {
+			_ = rows.Close()
+			return err
+		} else if sessionID == keep {
+			continue
+		} else if kept < store.MaxOlmSessionsPerKey {
+			kept++
+		} else {
+			toDelete = append(toDelete, sessionID)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+	return store.deleteSessions(key, toDelete)
+}
+
+// deleteSessions deletes the given sessions from the database and the session cache.
+// The cache lock must be held when calling this.
+func (store *SQLCryptoStore) deleteSessions(key id.SenderKey, sessionIDs []id.SessionID) error {
+	cache := store.olmSessionCache[key]
+	for _, sessionID := range sessionIDs {
+		_, err := store.DB.Exec("DELETE FROM crypto_olm_session WHERE session_id=$1 AND account_id=$2", sessionID, store.AccountID)
+		if err != nil {
+			return err
+		}
+		delete(cache, sessionID)
+	}
+	return nil
+}
+
+// PruneOlmSessions deletes Olm sessions that haven't been used for encrypting or decrypting within the given duration.
+// The most recently used session of each sender key is always kept, even if it's older than that.
+//
+// Sessions that are deleted while they're being used are inserted again by UpdateSession,
+// so it's safe to call this while the OlmMachine is running. The number of deleted sessions is returned.
+func (store *SQLCryptoStore) PruneOlmSessions(olderThan time.Duration) (int, error) {
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	rows, err := store.DB.Query("SELECT session_id, sender_key, last_encrypted, last_decrypted FROM crypto_olm_session WHERE account_id=$1 ORDER BY sender_key, last_decrypted DESC",
+		store.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	toDelete := make(map[id.SenderKey][]id.SessionID)
+	var prevKey id.SenderKey
+	count := 0
+	for rows.Next() {
+		var sessionID id.SessionID
+		var senderKey id.SenderKey
+		var lastEncrypted, lastDecrypted time.Time
+		if err = rows.Scan(&sessionID, &senderKey, scanTime{&lastEncrypted}, scanTime{&lastDecrypted}); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		isLatest := senderKey != prevKey
+		prevKey = senderKey
+		if !isLatest && lastEncrypted.Before(cutoff) && lastDecrypted.Before(cutoff) {
+			toDelete[senderKey] = append(toDelete[senderKey], sessionID)
+			count++
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	} else if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for senderKey, sessionIDs := range toDelete {
+		if err = store.deleteSessions(senderKey, sessionIDs); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
 // UpdateSession replaces the Olm session for a sender in the database.
-func (store *SQLCryptoStore) UpdateSession(_ id.SenderKey, session *OlmSession) error {
+//
+// If the session was deleted in the meantime (e.g. by PruneOlmSessions), it's inserted again,
+// as the ratchet state must not be lost.
+func (store *SQLCryptoStore) UpdateSession(key id.SenderKey, session *OlmSession) error {
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
-	_, err := store.DB.Exec("UPDATE crypto_olm_session SET session=$1, last_encrypted=$2, last_decrypted=$3 WHERE session_id=$4 AND account_id=$5",
-		sessionBytes, session.LastEncryptedTime, session.LastDecryptedTime, session.ID(), store.AccountID)
-	return err
+	res, err := store.DB.Exec("UPDATE crypto_olm_session SET session=$1, last_encrypted=$2, last_decrypted=$3 WHERE session_id=$4 AND account_id=$5",
+		sessionBytes, store.timeValue(session.LastEncryptedTime), store.timeValue(session.LastDecryptedTime), session.ID(), store.AccountID)
+	if err != nil {
+		return err
+	} else if affected, err := res.RowsAffected(); err != nil || affected > 0 || key == "" {
+		return err
+	}
+	store.olmSessionCacheLock.Lock()
+	defer store.olmSessionCacheLock.Unlock()
+	err = store.insertSession(key, session)
+	if err != nil {
+		return fmt.Errorf("failed to insert deleted session again: %w", err)
+	}
+	store.getOlmSessionCache(key)[session.ID()] = session
+	return nil
 }
 
 func intishPtr[T int | int64](i T) *T {
@@ -262,11 +480,40 @@ func intishPtr[T int | int64](i T) *T {
 	return &i
 }
 
-func datePtr(t time.Time) *time.Time {
+// timeValue converts a time into the format of timestamp columns in the current dialect:
+// unix milliseconds on SQLite and timestamptz on Postgres.
+func (store *SQLCryptoStore) timeValue(t time.Time) any {
+	if store.DB.Dialect == dbutil.SQLite {
+		return t.UnixMilli()
+	}
+	return t.UTC()
+}
+
+// nullTimeValue is like timeValue, but stores zero times as NULL.
+func (store *SQLCryptoStore) nullTimeValue(t time.Time) any {
 	if t.IsZero() {
 		return nil
 	}
-	return &t
+	return store.timeValue(t)
+}
+
+// scanTime scans timestamp columns stored by timeValue. NULL values are scanned as the zero time.
+type scanTime struct {
+	*time.Time
+}
+
+func (st scanTime) Scan(src any) error {
+	switch val := src.(type) {
+	case nil:
+		*st.Time = time.Time{}
+	case int64:
+		*st.Time = time.UnixMilli(val).UTC()
+	case time.Time:
+		*st.Time = val.UTC()
+	default:
+		return fmt.Errorf("unsupported timestamp value type %T", src)
+	}
+	return nil
 }
 
 // PutGroupSession stores an inbound Megolm group session for a room, sender and session.
@@ -280,17 +527,18 @@ func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.Send
 	_, err = store.DB.Exec(`
 		INSERT INTO crypto_megolm_inbound_session (
 			session_id, sender_key, signing_key, room_id, session, forwarding_chains,
-			ratchet_safety, received_at, max_age, max_messages, is_scheduled, account_id
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ratchet_safety, received_at, max_age, max_messages, is_scheduled, is_forwarded, account_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		ON CONFLICT (session_id, account_id) DO UPDATE
 		    SET withheld_code=NULL, withheld_reason=NULL, sender_key=excluded.sender_key, signing_key=excluded.signing_key,
 		        room_id=excluded.room_id, session=excluded.session, forwarding_chains=excluded.forwarding_chains,
 		        ratchet_safety=excluded.ratchet_safety, received_at=excluded.received_at,
-		        max_age=excluded.max_age, max_messages=excluded.max_messages, is_scheduled=excluded.is_scheduled
+		        max_age=excluded.max_age, max_messages=excluded.max_messages, is_scheduled=excluded.is_scheduled,
+		        is_forwarded=excluded.is_forwarded
 	`,
 		sessionID, senderKey, session.SigningKey, roomID, sessionBytes, forwardingChains,
-		ratchetSafety, datePtr(session.ReceivedAt), intishPtr(session.MaxAge), intishPtr(session.MaxMessages),
-		session.IsScheduled, store.AccountID,
+		ratchetSafety, store.nullTimeValue(session.ReceivedAt), intishPtr(session.MaxAge), intishPtr(session.MaxMessages),
+		session.IsScheduled, session.IsForwarded, store.AccountID,
 	)
 	return err
 }
@@ -299,20 +547,24 @@ func (store *SQLCryptoStore) PutGroupSession(roomID id.RoomID, senderKey id.Send
 func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID) (*InboundGroupSession, error) {
 	var senderKeyDB, signingKey, forwardingChains, withheldCode, withheldReason sql.NullString
 	var sessionBytes, ratchetSafetyBytes []byte
-	var receivedAt sql.NullTime
+	var receivedAt time.Time
 	var maxAge, maxMessages sql.NullInt64
-	var isScheduled bool
+	var isScheduled, isForwarded bool
 	err := store.DB.QueryRow(`
-		SELECT sender_key, signing_key, session, forwarding_chains, withheld_code, withheld_reason, ratchet_safety, received_at, max_age, max_messages, is_scheduled
+		SELECT sender_key, signing_key, session, forwarding_chains, withheld_code, withheld_reason, ratchet_safety, received_at, max_age, max_messages, is_scheduled, is_forwarded
 		FROM crypto_megolm_inbound_session
 		WHERE room_id=$1 AND (sender_key=$2 OR $2 = '') AND session_id=$3 AND account_id=$4`,
 		roomID, senderKey, sessionID, store.AccountID,
-	).Scan(&senderKeyDB, &signingKey, &sessionBytes, &forwardingChains, &withheldCode, &withheldReason, &ratchetSafetyBytes, &receivedAt, &maxAge, &maxMessages, &isScheduled)
+	).Scan(&senderKeyDB, &signingKey, &sessionBytes, &forwardingChains, &withheldCode, &withheldReason, &ratchetSafetyBytes, scanTime{&receivedAt}, &maxAge, &maxMessages, &isScheduled, &isForwarded)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
-	} else if withheldCode.Valid {
+	}
+	if senderKey == "" {
+		senderKey = id.Curve25519(senderKeyDB.String)
+	}
+	if withheldCode.Valid {
 		return nil, &event.RoomKeyWithheldEventContent{
 			RoomID:    roomID,
 			Algorithm: id.AlgorithmMegolmV1,
@@ -338,9 +590,6 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 			return nil, fmt.Errorf("failed to unmarshal ratchet safety info: %w", err)
 		}
 	}
-	if senderKey == "" {
-		senderKey = id.Curve25519(senderKeyDB.String)
-	}
 	return &InboundGroupSession{
 		Internal:         *igs,
 		SigningKey:       id.Ed25519(signingKey.String),
@@ -348,13 +597,36 @@ func (store *SQLCryptoStore) GetGroupSession(roomID id.RoomID, senderKey id.Send
 		RoomID:           roomID,
 		ForwardingChains: chains,
 		RatchetSafety:    rs,
-		ReceivedAt:       receivedAt.Time,
+		ReceivedAt:       receivedAt,
 		MaxAge:           maxAge.Int64,
 		MaxMessages:      int(maxMessages.Int64),
 		IsScheduled:      isScheduled,
+		IsForwarded:      isForwarded,
 	}, nil
 }
 
+// GetInboundSessionInfo gets debugging information about an inbound Megolm session regardless of the sender key.
+// Withheld and redacted sessions are included with the withheld code and reason.
+func (store *SQLCryptoStore) GetInboundSessionInfo(roomID id.RoomID, sessionID id.SessionID, includeKey bool) (*InboundSessionInfo, error) {
+	session, err := store.GetGroupSession(roomID, "", sessionID)
+	var withheld *event.RoomKeyWithheldEventContent
+	if errors.As(err, &withheld) {
+		return &InboundSessionInfo{
+			RoomID:         roomID,
+			SessionID:      sessionID,
+			Exists:         true,
+			SenderKey:      withheld.SenderKey,
+			WithheldCode:   withheld.Code,
+			WithheldReason: withheld.Reason,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	} else if session == nil {
+		return &InboundSessionInfo{RoomID: roomID, SessionID: sessionID}, nil
+	}
+	return session.info(includeKey)
+}
+
 func (store *SQLCryptoStore) RedactGroupSession(_ id.RoomID, _ id.SenderKey, sessionID id.SessionID, reason string) error {
 	_, err := store.DB.Exec(`
 		UPDATE crypto_megolm_inbound_session
@@ -402,13 +674,17 @@ func (store *SQLCryptoStore) RedactExpiredGroupSessions() ([]id.SessionID, error
 			SET withheld_code=$1, withheld_reason=$2, session=NULL, forwarding_chains=NULL
 			WHERE account_id=$3 AND session IS NOT NULL AND is_scheduled=false
 			  AND received_at IS NOT NULL and max_age IS NOT NULL
-			  AND unixepoch(received_at) + (2 * max_age / 1000) < unixepoch(date('now'))
+			  AND received_at + 2 * max_age < $4
 			RETURNING session_id
 		`
 	default:
 		return nil, fmt.Errorf("unsupported dialect")
 	}
-	res, err := store.DB.Query(query, event.RoomKeyWithheldBeeperRedacted, "Session redacted: expired", store.AccountID)
+	args := []any{event.RoomKeyWithheldBeeperRedacted, "Session redacted: expired", store.AccountID}
+	if store.DB.Dialect == dbutil.SQLite {
+		args = append(args, time.Now().UnixMilli())
+	}
+	res, err := store.DB.Query(query, args...)
 	var sessionIDs []id.SessionID
 	for res.Next() {
 		var sessionID id.SessionID
@@ -436,7 +712,7 @@ func (store *SQLCryptoStore) RedactOutdatedGroupSessions() ([]id.SessionID, erro
 
 func (store *SQLCryptoStore) PutWithheldGroupSession(content event.RoomKeyWithheldEventContent) error {
 	_, err := store.DB.Exec("INSERT INTO crypto_megolm_inbound_session (session_id, sender_key, room_id, withheld_code, withheld_reason, received_at, account_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		content.SessionID, content.SenderKey, content.RoomID, content.Code, content.Reason, time.Now().UTC(), store.AccountID)
+		content.SessionID, content.SenderKey, content.RoomID, content.Code, content.Reason, store.timeValue(time.Now()), store.AccountID)
 	return err
 }
 
@@ -467,10 +743,10 @@ func (store *SQLCryptoStore) scanGroupSessionList(rows dbutil.Rows) (result []*I
 		var roomID id.RoomID
 		var signingKey, senderKey, forwardingChains sql.NullString
 		var sessionBytes, ratchetSafetyBytes []byte
-		var receivedAt sql.NullTime
+		var receivedAt time.Time
 		var maxAge, maxMessages sql.NullInt64
-		var isScheduled bool
-		err = rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains, &ratchetSafetyBytes, &receivedAt, &maxAge, &maxMessages, &isScheduled)
+		var isScheduled, isForwarded bool
+		err = rows.Scan(&roomID, &signingKey, &senderKey, &sessionBytes, &forwardingChains, &ratchetSafetyBytes, scanTime{&receivedAt}, &maxAge, &maxMessages, &isScheduled, &isForwarded)
 		if err != nil {
 			return
 		}
@@ -497,10 +773,11 @@ func (store *SQLCryptoStore) scanGroupSessionList(rows dbutil.Rows) (result []*I
 			RoomID:           roomID,
 			ForwardingChains: chains,
 			RatchetSafety:    rs,
-			ReceivedAt:       receivedAt.Time,
+			ReceivedAt:       receivedAt,
 			MaxAge:           maxAge.Int64,
 			MaxMessages:      int(maxMessages.Int64),
 			IsScheduled:      isScheduled,
+			IsForwarded:      isForwarded,
 		})
 	}
 	return
@@ -508,7 +785,7 @@ func (store *SQLCryptoStore) scanGroupSessionList(rows dbutil.Rows) (result []*I
 
 func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*InboundGroupSession, error) {
 	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains, ratchet_safety, received_at, max_age, max_messages, is_scheduled
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, ratchet_safety, received_at, max_age, max_messages, is_scheduled, is_forwarded
 		FROM crypto_megolm_inbound_session WHERE room_id=$1 AND account_id=$2 AND session IS NOT NULL`,
 		roomID, store.AccountID,
 	)
@@ -522,7 +799,7 @@ func (store *SQLCryptoStore) GetGroupSessionsForRoom(roomID id.RoomID) ([]*Inbou
 
 func (store *SQLCryptoStore) GetAllGroupSessions() ([]*InboundGroupSession, error) {
 	rows, err := store.DB.Query(`
-		SELECT room_id, signing_key, sender_key, session, forwarding_chains, ratchet_safety, received_at, max_age, max_messages, is_scheduled
+		SELECT room_id, signing_key, sender_key, session, forwarding_chains, ratchet_safety, received_at, max_age, max_messages, is_scheduled, is_forwarded
 		FROM crypto_megolm_inbound_session WHERE account_id=$2 AND session IS NOT NULL`,
 		store.AccountID,
 	)
@@ -539,22 +816,56 @@ func (store *SQLCryptoStore) AddOutboundGroupSession(session *OutboundGroupSessi
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
 	_, err := store.DB.Exec(`
 		INSERT INTO crypto_megolm_outbound_session
-			(room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, account_id)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			(room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, shared_devices, account_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		ON CONFLICT (account_id, room_id) DO UPDATE
 			SET session_id=excluded.session_id, session=excluded.session, shared=excluded.shared,
 				max_messages=excluded.max_messages, message_count=excluded.message_count, max_age=excluded.max_age,
-				created_at=excluded.created_at, last_used=excluded.last_used, account_id=excluded.account_id
+				created_at=excluded.created_at, last_used=excluded.last_used, shared_devices=excluded.shared_devices,
+				account_id=excluded.account_id
 	`, session.RoomID, session.ID(), sessionBytes, session.Shared, session.MaxMessages, session.MessageCount,
-		session.MaxAge.Milliseconds(), session.CreationTime, session.LastEncryptedTime, store.AccountID)
+		session.MaxAge.Milliseconds(), store.timeValue(session.CreationTime), store.timeValue(session.LastEncryptedTime), marshalOGSUsers(session.Users),
+		store.AccountID)
 	return err
 }
 
+type sharedDevice struct {
+	UserID   id.UserID   `json:"user_id"`
+	DeviceID id.DeviceID `json:"device_id"`
+	State    OGSState    `json:"state"`
+}
+
+// marshalOGSUsers converts the map of devices an outbound session was shared with into a JSON list.
+func marshalOGSUsers(users map[UserDevice]OGSState) string {
+	list := make([]sharedDevice, 0, len(users))
+	for device, state := range users {
+		list = append(list, sharedDevice{UserID: device.UserID, DeviceID: device.DeviceID, State: state})
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+func unmarshalOGSUsers(data string) (map[UserDevice]OGSState, error) {
+	users := make(map[UserDevice]OGSState)
+	if data == "" {
+		return users, nil
+	}
+	var list []sharedDevice
+	err := json.Unmarshal([]byte(data), &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range list {
+		users[UserDevice{UserID: device.UserID, DeviceID: device.DeviceID}] = device.State
+	}
+	return users, nil
+}
+
 // UpdateOutboundGroupSession replaces an outbound Megolm session with for same room and session ID.
 func (store *SQLCryptoStore) UpdateOutboundGroupSession(session *OutboundGroupSession) error {
 	sessionBytes := session.Internal.Pickle(store.PickleKey)
 	_, err := store.DB.Exec("UPDATE crypto_megolm_outbound_session SET session=$1, message_count=$2, last_used=$3 WHERE room_id=$4 AND session_id=$5 AND account_id=$6",
-		sessionBytes, session.MessageCount, session.LastEncryptedTime, session.RoomID, session.ID(), store.AccountID)
+		sessionBytes, session.MessageCount, store.timeValue(session.LastEncryptedTime), session.RoomID, session.ID(), store.AccountID)
 	return err
 }
 
@@ -563,16 +874,21 @@ func (store *SQLCryptoStore) GetOutboundGroupSession(roomID id.RoomID) (*Outboun
 	var ogs OutboundGroupSession
 	var sessionBytes []byte
 	var maxAgeMS int64
+	var sharedDevices string
 	err := store.DB.QueryRow(`
-		SELECT session, shared, max_messages, message_count, max_age, created_at, last_used
+		SELECT session, shared, max_messages, message_count, max_age, created_at, last_used, shared_devices
 		FROM crypto_megolm_outbound_session WHERE room_id=$1 AND account_id=$2`,
 		roomID, store.AccountID,
-	).Scan(&sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &maxAgeMS, &ogs.CreationTime, &ogs.LastEncryptedTime)
+	).Scan(&sessionBytes, &ogs.Shared, &ogs.MaxMessages, &ogs.MessageCount, &maxAgeMS, scanTime{&ogs.CreationTime}, scanTime{&ogs.LastEncryptedTime}, &sharedDevices)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
+	ogs.Users, err = unmarshalOGSUsers(sharedDevices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse shared device list: %w", err)
+	}
 	intOGS := olm.NewBlankOutboundGroupSession()
 	err = intOGS.Unpickle(sessionBytes, store.PickleKey)
 	if err != nil {
@@ -591,8 +907,104 @@ func (store *SQLCryptoStore) RemoveOutboundGroupSession(roomID id.RoomID) error
 	return err
 }
 
+// RemoveAllOutboundGroupSessions removes the outbound Megolm sessions of all rooms for the current account.
+func (store *SQLCryptoStore) RemoveAllOutboundGroupSessions() (int64, error) {
+	res, err := store.DB.Exec("DELETE FROM crypto_megolm_outbound_session WHERE account_id=$1", store.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PutOutgoingKeyRequest stores an outgoing key request for the current account.
+func (store *SQLCryptoStore) PutOutgoingKeyRequest(req *OutgoingKeyRequest) error {
+	targets, err := json.Marshal(req.Targets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key request targets: %w", err)
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO crypto_outgoing_key_request (request_id, room_id, sender_key, session_id, targets, created_at, account_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (account_id, request_id) DO UPDATE SET targets=excluded.targets
+	`, req.RequestID, req.RoomID, req.SenderKey, req.SessionID, targets, store.timeValue(req.CreatedAt), store.AccountID)
+	return err
+}
+
+// GetOutgoingKeyRequests returns the outgoing key requests for the given session ID, or all requests if the session ID is empty.
+func (store *SQLCryptoStore) GetOutgoingKeyRequests(sessionID id.SessionID) ([]*OutgoingKeyRequest, error) {
+	rows, err := store.DB.Query(`
+		SELECT request_id, room_id, sender_key, session_id, targets, created_at FROM crypto_outgoing_key_request
+		WHERE account_id=$1 AND (session_id=$2 OR $2='')
+	`, store.AccountID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reqs []*OutgoingKeyRequest
+	for rows.Next() {
+		var req OutgoingKeyRequest
+		var targets []byte
+		err = rows.Scan(&req.RequestID, &req.RoomID, &req.SenderKey, &req.SessionID, &targets, scanTime{&req.CreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(targets, &req.Targets)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal key request targets: %w", err)
+		}
+		reqs = append(reqs, &req)
+	}
+	return reqs, rows.Err()
+}
+
+// DeleteOutgoingKeyRequest deletes the outgoing key request with the given request ID.
+func (store *SQLCryptoStore) DeleteOutgoingKeyRequest(requestID string) error {
+	_, err := store.DB.Exec("DELETE FROM crypto_outgoing_key_request WHERE request_id=$1 AND account_id=$2", requestID, store.AccountID)
+	return err
+}
+
+// PutSecret stores the given secret, encrypted with the pickle key.
+func (store *SQLCryptoStore) PutSecret(name id.Secret, value string) error {
+	encrypted, err := json.Marshal((&ssss.Key{Key: store.PickleKey}).Encrypt(string(name), []byte(value)))
+	if err != nil {
+		return fmt.Errorf("failed to marshal encrypted secret: %w", err)
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO crypto_secrets (name, secret, account_id) VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, name) DO UPDATE SET secret=excluded.secret
+	`, name, encrypted, store.AccountID)
+	return err
+}
+
+// GetSecret returns the secret with the given name, or an empty string if it's not stored.
+func (store *SQLCryptoStore) GetSecret(name id.Secret) (string, error) {
+	var encryptedBytes []byte
+	err := store.DB.QueryRow("SELECT secret FROM crypto_secrets WHERE name=$1 AND account_id=$2", name, store.AccountID).Scan(&encryptedBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var encrypted ssss.EncryptedKeyData
+	if err = json.Unmarshal(encryptedBytes, &encrypted); err != nil {
+		return "", fmt.Errorf("failed to unmarshal encrypted secret: %w", err)
+	}
+	decrypted, err := (&ssss.Key{Key: store.PickleKey}).Decrypt(string(name), encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(decrypted), nil
+}
+
+// DeleteSecret deletes the secret with the given name.
+func (store *SQLCryptoStore) DeleteSecret(name id.Secret) error {
+	_, err := store.DB.Exec("DELETE FROM crypto_secrets WHERE name=$1 AND account_id=$2", name, store.AccountID)
+	return err
+}
+
 // ValidateMessageIndex returns whether the given event information match the ones stored in the database
 // for the given sender key, session ID and index. If the index hasn't been stored, this will store it.
+// If the stored values don't match, the returned error is a *DuplicateMessageIndexError.
 func (store *SQLCryptoStore) ValidateMessageIndex(ctx context.Context, senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
 	const validateQuery = `
 	INSERT INTO crypto_message_index (sender_key, session_id, "index", event_id, timestamp)
@@ -613,7 +1025,11 @@ func (store *SQLCryptoStore) ValidateMessageIndex(ctx context.Context, senderKey
 			Int64("expected_timestamp", expectedTimestamp).
 			Int64("actual_timestamp", timestamp).
 			Msg("Failed to validate that message index wasn't duplicated")
-		return false, nil
+		return false, &DuplicateMessageIndexError{
+			MessageIndex:      index,
+			OriginalEventID:   expectedEventID,
+			OriginalTimestamp: expectedTimestamp,
+		}
 	}
 	return true, nil
 }
@@ -621,14 +1037,14 @@ func (store *SQLCryptoStore) ValidateMessageIndex(ctx context.Context, senderKey
 // GetDevices returns a map of device IDs to device identities, including the identity and signing keys, for a given user ID.
 func (store *SQLCryptoStore) GetDevices(userID id.UserID) (map[id.DeviceID]*id.Device, error) {
 	var ignore id.UserID
-	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE user_id=$1", userID).Scan(&ignore)
+	err := store.DB.QueryRow("SELECT user_id FROM crypto_tracked_user WHERE account_id=$1 AND user_id=$2", store.AccountID, userID).Scan(&ignore)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	rows, err := store.DB.Query("SELECT device_id, identity_key, signing_key, trust, deleted, name FROM crypto_device WHERE user_id=$1 AND deleted=false", userID)
+	rows, err := store.DB.Query("SELECT device_id, identity_key, signing_key, trust, deleted, name FROM crypto_device WHERE account_id=$1 AND user_id=$2 AND deleted=false", store.AccountID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -650,8 +1066,8 @@ func (store *SQLCryptoStore) GetDevice(userID id.UserID, deviceID id.DeviceID) (
 	var identity id.Device
 	err := store.DB.QueryRow(`
 		SELECT identity_key, signing_key, trust, deleted, name
-		FROM crypto_device WHERE user_id=$1 AND device_id=$2`,
-		userID, deviceID,
+		FROM crypto_device WHERE account_id=$1 AND user_id=$2 AND device_id=$3`,
+		store.AccountID, userID, deviceID,
 	).Scan(&identity.IdentityKey, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -669,8 +1085,8 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 	var identity id.Device
 	err := store.DB.QueryRow(`
 		SELECT device_id, signing_key, trust, deleted, name
-		FROM crypto_device WHERE user_id=$1 AND identity_key=$2`,
-		userID, identityKey,
+		FROM crypto_device WHERE account_id=$1 AND user_id=$2 AND identity_key=$3`,
+		store.AccountID, userID, identityKey,
 	).Scan(&identity.DeviceID, &identity.SigningKey, &identity.Trust, &identity.Deleted, &identity.Name)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -684,18 +1100,18 @@ func (store *SQLCryptoStore) FindDeviceByKey(userID id.UserID, identityKey id.Id
 }
 
 const deviceInsertQuery = `
-INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
-ON CONFLICT (user_id, device_id) DO UPDATE
+INSERT INTO crypto_device (account_id, user_id, device_id, identity_key, signing_key, trust, deleted, name)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (account_id, user_id, device_id) DO UPDATE
     SET identity_key=excluded.identity_key, deleted=excluded.deleted, trust=excluded.trust, name=excluded.name
 `
 
-var deviceMassInsertTemplate = strings.ReplaceAll(deviceInsertQuery, "($1, $2, $3, $4, $5, $6, $7)", "%s")
+var deviceMassInsertTemplate = strings.ReplaceAll(deviceInsertQuery, "($1, $2, $3, $4, $5, $6, $7, $8)", "%s")
 
 // PutDevice stores a single device for a user, replacing it if it exists already.
 func (store *SQLCryptoStore) PutDevice(userID id.UserID, device *id.Device) error {
 	_, err := store.DB.Exec(deviceInsertQuery,
-		userID, device.DeviceID, device.IdentityKey, device.SigningKey, device.Trust, device.Deleted, device.Name)
+		store.AccountID, userID, device.DeviceID, device.IdentityKey, device.SigningKey, device.Trust, device.Deleted, device.Name)
 	return err
 }
 
@@ -706,12 +1122,15 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO crypto_tracked_user (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID)
+	_, err = tx.Exec(`
+		INSERT INTO crypto_tracked_user (account_id, user_id, devices_outdated) VALUES ($1, $2, false)
+		ON CONFLICT (account_id, user_id) DO UPDATE SET devices_outdated=false
+	`, store.AccountID, userID)
 	if err != nil {
 		return fmt.Errorf("failed to add user to tracked users list: %w", err)
 	}
 
-	_, err = tx.Exec("UPDATE crypto_device SET deleted=true WHERE user_id=$1", userID)
+	_, err = tx.Exec("UPDATE crypto_device SET deleted=true WHERE account_id=$1 AND user_id=$2", store.AccountID, userID)
 	if err != nil {
 		_ = tx.Rollback()
 		return fmt.Errorf("failed to delete old devices: %w", err)
@@ -728,7 +1147,7 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 	for deviceID := range devices {
 		deviceIDs = append(deviceIDs, deviceID)
 	}
-	const valueStringFormat = "($1, $%d, $%d, $%d, $%d, $%d, $%d)"
+	const valueStringFormat = "($1, $2, $%d, $%d, $%d, $%d, $%d, $%d)"
 	for batchDeviceIdx := 0; batchDeviceIdx < len(deviceIDs); batchDeviceIdx += deviceBatchLen {
 		var batchDevices []id.DeviceID
 		if batchDeviceIdx+deviceBatchLen < len(deviceIDs) {
@@ -736,10 +1155,11 @@ func (store *SQLCryptoStore) PutDevices(userID id.UserID, devices map[id.DeviceI
 		} else {
 			batchDevices = deviceIDs[batchDeviceIdx:]
 		}
-		values := make([]interface{}, 1, len(devices)*6+1)
-		values[0] = userID
+		values := make([]interface{}, 2, len(devices)*6+2)
+		values[0] = store.AccountID
+		values[1] = userID
 		valueStrings := make([]string, 0, len(devices))
-		i := 2
+		i := 3
 		for _, deviceID := range batchDevices {
 			identity := devices[deviceID]
 			values = append(values, deviceID, identity.IdentityKey, identity.SigningKey, identity.Trust, identity.Deleted, identity.Name)
@@ -765,15 +1185,16 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID,
 	var rows dbutil.Rows
 	var err error
 	if store.DB.Dialect == dbutil.Postgres && PostgresArrayWrapper != nil {
-		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id = ANY($1)", PostgresArrayWrapper(users))
+		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE account_id=$1 AND user_id = ANY($2)", store.AccountID, PostgresArrayWrapper(users))
 	} else {
 		queryString := make([]string, len(users))
-		params := make([]interface{}, len(users))
+		params := make([]interface{}, len(users)+1)
+		params[0] = store.AccountID
 		for i, user := range users {
-			queryString[i] = fmt.Sprintf("$%d", i+1)
-			params[i] = user
+			queryString[i] = fmt.Sprintf("$%d", i+2)
+			params[i+1] = user
 		}
-		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE user_id IN ("+strings.Join(queryString, ",")+")", params...)
+		rows, err = store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE account_id=$1 AND user_id IN ("+strings.Join(queryString, ",")+")", params...)
 	}
 	if err != nil {
 		return users, err
@@ -790,6 +1211,80 @@ func (store *SQLCryptoStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID,
 	return users[:ptr], nil
 }
 
+// MarkTrackedUsersOutdated flags the device lists of the given tracked users as outdated.
+func (store *SQLCryptoStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	if len(users) == 0 {
+		return nil
+	}
+	var err error
+	if store.DB.Dialect == dbutil.Postgres && PostgresArrayWrapper != nil {
+		_, err = store.DB.Exec("UPDATE crypto_tracked_user SET devices_outdated=true WHERE account_id=$1 AND user_id = ANY($2)", store.AccountID, PostgresArrayWrapper(users))
+	} else {
+		queryString := make([]string, len(users))
+		params := make([]interface{}, len(users)+1)
+		params[0] = store.AccountID
+		for i, user := range users {
+			queryString[i] = fmt.Sprintf("$%d", i+2)
+			params[i+1] = user
+		}
+		_, err = store.DB.Exec("UPDATE crypto_tracked_user SET devices_outdated=true WHERE account_id=$1 AND user_id IN ("+strings.Join(queryString, ",")+")", params...)
+	}
+	return err
+}
+
+// GetOutdatedTrackedUsers returns all tracked users whose device lists have been flagged as outdated.
+func (store *SQLCryptoStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	rows, err := store.DB.Query("SELECT user_id FROM crypto_tracked_user WHERE account_id=$1 AND devices_outdated=true", store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	var users []id.UserID
+	for rows.Next() {
+		var userID id.UserID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+// Stats returns the number of rows in each crypto table of the current account,
+// along with the total size of the pickled Olm and Megolm sessions.
+func (store *SQLCryptoStore) Stats() (*StoreStats, error) {
+	var stats StoreStats
+	err := store.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(session)), 0) FROM crypto_olm_session WHERE account_id=$1", store.AccountID).
+		Scan(&stats.OlmSessions, &stats.OlmSessionBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count olm sessions: %w", err)
+	}
+	err = store.DB.QueryRow(`
+		SELECT COUNT(session), COUNT(*) - COUNT(session), COALESCE(SUM(LENGTH(session)), 0)
+		FROM crypto_megolm_inbound_session WHERE account_id=$1
+	`, store.AccountID).Scan(&stats.InboundGroupSessions, &stats.WithheldGroupSessions, &stats.InboundGroupSessionBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count inbound group sessions: %w", err)
+	}
+	counts := []struct {
+		name  string
+		query string
+		args  []any
+		dest  *int
+	}{
+		{"outbound group sessions", "SELECT COUNT(*) FROM crypto_megolm_outbound_session WHERE account_id=$1", []any{store.AccountID}, &stats.OutboundGroupSessions},
+		{"devices", "SELECT COUNT(*) FROM crypto_device WHERE account_id=$1 AND deleted=false", []any{store.AccountID}, &stats.Devices},
+		{"tracked users", "SELECT COUNT(*) FROM crypto_tracked_user WHERE account_id=$1", []any{store.AccountID}, &stats.TrackedUsers},
+		{"message indices", "SELECT COUNT(*) FROM crypto_message_index", nil, &stats.MessageIndices},
+	}
+	for _, count := range counts {
+		if err = store.DB.QueryRow(count.query, count.args...).Scan(count.dest); err != nil {
+			return nil, fmt.Errorf("failed to count %s: %w", count.name, err)
+		}
+	}
+	return &stats, nil
+}
+
 // PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 func (store *SQLCryptoStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	_, err := store.DB.Exec(`
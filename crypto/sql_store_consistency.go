@@ -0,0 +1,170 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/id"
+)
+
+// OlmSessionFinding identifies an Olm session found by CheckConsistency.
+type OlmSessionFinding struct {
+	AccountID string
+	SessionID id.SessionID
+	SenderKey id.SenderKey
+}
+
+// MegolmSessionFinding identifies an inbound or outbound Megolm session found by CheckConsistency.
+type MegolmSessionFinding struct {
+	AccountID string
+	RoomID    id.RoomID
+	SessionID id.SessionID
+}
+
+// OrphanedRowsFinding is the number of rows in a table that belong to an account ID that doesn't exist.
+type OrphanedRowsFinding struct {
+	Table     string
+	AccountID string
+	Count     int
+}
+
+// ConsistencyReport contains the findings of SQLCryptoStore.CheckConsistency.
+type ConsistencyReport struct {
+	// OlmSessionsWithUnknownDevice are Olm sessions whose sender key doesn't match any known device.
+	OlmSessionsWithUnknownDevice []OlmSessionFinding
+	// EmptyInboundGroupSessions are inbound Megolm sessions that have no session data, but haven't been withheld or redacted.
+	EmptyInboundGroupSessions []MegolmSessionFinding
+	// ExpiredSharedOutboundSessions are outbound Megolm sessions that are past their max age, but are still marked as shared.
+	ExpiredSharedOutboundSessions []MegolmSessionFinding
+	// OrphanedRows are rows in account-specific tables whose account ID isn't in the crypto_account table.
+	OrphanedRows []OrphanedRowsFinding
+}
+
+// IsEmpty returns true if the report doesn't contain any findings.
+func (report *ConsistencyReport) IsEmpty() bool {
+	return len(report.OlmSessionsWithUnknownDevice) == 0 &&
+		len(report.EmptyInboundGroupSessions) == 0 &&
+		len(report.ExpiredSharedOutboundSessions) == 0 &&
+		len(report.OrphanedRows) == 0
+}
+
+// CheckConsistency checks the whole database for inconsistent data, including the data of other account IDs.
+//
+// The check is read-only: it doesn't fix anything, it only returns the findings.
+func (store *SQLCryptoStore) CheckConsistency() (*ConsistencyReport, error) {
+	var report ConsistencyReport
+	if err := store.checkOlmSessionDevices(&report); err != nil {
+		return nil, fmt.Errorf("failed to check olm sessions: %w", err)
+	} else if err = store.checkEmptyInboundGroupSessions(&report); err != nil {
+		return nil, fmt.Errorf("failed to check inbound group sessions: %w", err)
+	} else if err = store.checkExpiredOutboundGroupSessions(&report); err != nil {
+		return nil, fmt.Errorf("failed to check outbound group sessions: %w", err)
+	} else if err = store.checkOrphanedRows(&report); err != nil {
+		return nil, fmt.Errorf("failed to check orphaned rows: %w", err)
+	}
+	return &report, nil
+}
+
+func (store *SQLCryptoStore) checkOlmSessionDevices(report *ConsistencyReport) error {
+	rows, err := store.DB.Query(`
+		SELECT account_id, session_id, sender_key FROM crypto_olm_session
+		WHERE sender_key NOT IN (SELECT identity_key FROM crypto_device WHERE crypto_device.account_id=crypto_olm_session.account_id)
+		ORDER BY account_id, session_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var finding OlmSessionFinding
+		if err = rows.Scan(&finding.AccountID, &finding.SessionID, &finding.SenderKey); err != nil {
+			return err
+		}
+		report.OlmSessionsWithUnknownDevice = append(report.OlmSessionsWithUnknownDevice, finding)
+	}
+	return rows.Err()
+}
+
+func (store *SQLCryptoStore) checkEmptyInboundGroupSessions(report *ConsistencyReport) error {
+	rows, err := store.DB.Query(`
+		SELECT account_id, room_id, session_id FROM crypto_megolm_inbound_session
+		WHERE (session IS NULL OR length(session)=0) AND withheld_code IS NULL
+		ORDER BY account_id, room_id, session_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var finding MegolmSessionFinding
+		if err = rows.Scan(&finding.AccountID, &finding.RoomID, &finding.SessionID); err != nil {
+			return err
+		}
+		report.EmptyInboundGroupSessions = append(report.EmptyInboundGroupSessions, finding)
+	}
+	return rows.Err()
+}
+
+func (store *SQLCryptoStore) checkExpiredOutboundGroupSessions(report *ConsistencyReport) error {
+	rows, err := store.DB.Query(`
+		SELECT account_id, room_id, session_id, max_age, created_at FROM crypto_megolm_outbound_session
+		WHERE shared=true
+		ORDER BY account_id, room_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var finding MegolmSessionFinding
+		var maxAgeMS int64
+		var createdAt time.Time
+		if err = rows.Scan(&finding.AccountID, &finding.RoomID, &finding.SessionID, &maxAgeMS, scanTime{&createdAt}); err != nil {
+			return err
+		}
+		if maxAgeMS > 0 && time.Since(createdAt) > time.Duration(maxAgeMS)*time.Millisecond {
+			report.ExpiredSharedOutboundSessions = append(report.ExpiredSharedOutboundSessions, finding)
+		}
+	}
+	return rows.Err()
+}
+
+func (store *SQLCryptoStore) checkOrphanedRows(report *ConsistencyReport) error {
+	for _, table := range sql_store_upgrade.AccountIDTables {
+		if table == "crypto_account" {
+			continue
+		}
+		err := store.checkOrphanedRowsInTable(report, table)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (store *SQLCryptoStore) checkOrphanedRowsInTable(report *ConsistencyReport, table string) error {
+	rows, err := store.DB.Query(fmt.Sprintf(`
+		SELECT account_id, COUNT(*) FROM %s
+		WHERE account_id NOT IN (SELECT account_id FROM crypto_account)
+		GROUP BY account_id ORDER BY account_id
+	`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		finding := OrphanedRowsFinding{Table: table}
+		if err = rows.Scan(&finding.AccountID, &finding.Count); err != nil {
+			return err
+		}
+		report.OrphanedRows = append(report.OrphanedRows, finding)
+	}
+	return rows.Err()
+}
@@ -1,9 +1,10 @@
--- v0 -> v10: Latest revision
+-- v0 -> v20 (compatible with v19+): Latest revision
 CREATE TABLE IF NOT EXISTS crypto_account (
 	account_id TEXT    PRIMARY KEY,
 	device_id  TEXT    NOT NULL,
 	shared     BOOLEAN NOT NULL,
 	sync_token TEXT    NOT NULL,
+	filter_id  TEXT    NOT NULL DEFAULT '',
 	account    bytea   NOT NULL
 );
 
@@ -17,10 +18,14 @@ CREATE TABLE IF NOT EXISTS crypto_message_index (
 );
 
 CREATE TABLE IF NOT EXISTS crypto_tracked_user (
-	user_id TEXT PRIMARY KEY
+	account_id       TEXT,
+	user_id          TEXT,
+	devices_outdated BOOLEAN NOT NULL DEFAULT false,
+	PRIMARY KEY (account_id, user_id)
 );
 
 CREATE TABLE IF NOT EXISTS crypto_device (
+	account_id   TEXT,
 	user_id      TEXT,
 	device_id    TEXT,
 	identity_key CHAR(43) NOT NULL,
@@ -28,19 +33,26 @@ CREATE TABLE IF NOT EXISTS crypto_device (
 	trust        SMALLINT NOT NULL,
 	deleted      BOOLEAN  NOT NULL,
 	name         TEXT     NOT NULL,
-	PRIMARY KEY (user_id, device_id)
+	PRIMARY KEY (account_id, user_id, device_id)
 );
 
 CREATE TABLE IF NOT EXISTS crypto_olm_session (
-	account_id     TEXT,
-	session_id     CHAR(43),
-	sender_key     CHAR(43)  NOT NULL,
-	session        bytea     NOT NULL,
-	created_at     timestamp NOT NULL,
-	last_decrypted timestamp NOT NULL,
-	last_encrypted timestamp NOT NULL,
+	account_id        TEXT,
+	session_id        CHAR(43),
+	sender_key        CHAR(43)  NOT NULL,
+	session           bytea     NOT NULL,
+	-- only: postgres for next 3 lines
+	created_at        timestamptz NOT NULL,
+	last_decrypted    timestamptz NOT NULL,
+	last_encrypted    timestamptz NOT NULL,
+	-- only: sqlite for next 3 lines
+	created_at        BIGINT    NOT NULL,
+	last_decrypted    BIGINT    NOT NULL,
+	last_encrypted    BIGINT    NOT NULL,
+	used_fallback_key BOOLEAN   NOT NULL DEFAULT false,
 	PRIMARY KEY (account_id, session_id)
 );
+CREATE INDEX IF NOT EXISTS crypto_olm_session_sender_key_idx ON crypto_olm_session (account_id, sender_key, last_decrypted);
 
 CREATE TABLE IF NOT EXISTS crypto_megolm_inbound_session (
 	account_id        TEXT,
@@ -53,27 +65,50 @@ CREATE TABLE IF NOT EXISTS crypto_megolm_inbound_session (
 	withheld_code     TEXT,
 	withheld_reason   TEXT,
 	ratchet_safety    jsonb,
-	received_at       timestamp,
+	-- only: postgres
+	received_at       timestamptz,
+	-- only: sqlite
+	received_at       BIGINT,
 	max_age           BIGINT,
 	max_messages      INTEGER,
 	is_scheduled      BOOLEAN NOT NULL DEFAULT false,
+	is_forwarded      BOOLEAN NOT NULL DEFAULT false,
 	PRIMARY KEY (account_id, session_id)
 );
 
 CREATE TABLE IF NOT EXISTS crypto_megolm_outbound_session (
-	account_id    TEXT,
-	room_id       TEXT,
-	session_id    CHAR(43)  NOT NULL UNIQUE,
-	session       bytea     NOT NULL,
-	shared        BOOLEAN   NOT NULL,
-	max_messages  INTEGER   NOT NULL,
-	message_count INTEGER   NOT NULL,
-	max_age       BIGINT    NOT NULL,
-	created_at    timestamp NOT NULL,
-	last_used     timestamp NOT NULL,
+	account_id     TEXT,
+	room_id        TEXT,
+	session_id     CHAR(43)  NOT NULL UNIQUE,
+	session        bytea     NOT NULL,
+	shared         BOOLEAN   NOT NULL,
+	max_messages   INTEGER   NOT NULL,
+	message_count  INTEGER   NOT NULL,
+	max_age        BIGINT    NOT NULL,
+	-- only: postgres for next 2 lines
+	created_at     timestamptz NOT NULL,
+	last_used      timestamptz NOT NULL,
+	-- only: sqlite for next 2 lines
+	created_at     BIGINT    NOT NULL,
+	last_used      BIGINT    NOT NULL,
+	shared_devices TEXT      NOT NULL DEFAULT '',
 	PRIMARY KEY (account_id, room_id)
 );
 
+CREATE TABLE IF NOT EXISTS crypto_outgoing_key_request (
+	account_id TEXT,
+	request_id TEXT,
+	room_id    TEXT      NOT NULL,
+	sender_key CHAR(43)  NOT NULL,
+	session_id CHAR(43)  NOT NULL,
+	targets    jsonb     NOT NULL,
+	-- only: postgres
+	created_at timestamptz NOT NULL,
+	-- only: sqlite
+	created_at BIGINT    NOT NULL,
+	PRIMARY KEY (account_id, request_id)
+);
+
 CREATE TABLE IF NOT EXISTS crypto_cross_signing_keys (
 	user_id TEXT,
 	usage   TEXT,
@@ -92,3 +127,10 @@ CREATE TABLE IF NOT EXISTS crypto_cross_signing_signatures (
 	signature      CHAR(88) NOT NULL,
 	PRIMARY KEY (signed_user_id, signed_key, signer_user_id, signer_key)
 );
+
+CREATE TABLE IF NOT EXISTS crypto_secrets (
+	account_id TEXT,
+	name       TEXT,
+	secret     bytea NOT NULL,
+	PRIMARY KEY (account_id, name)
+);
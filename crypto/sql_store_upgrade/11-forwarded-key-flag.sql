@@ -0,0 +1,4 @@
+-- v11: Add explicit flag for megolm sessions that weren't received directly from the sender
+ALTER TABLE crypto_megolm_inbound_session ADD COLUMN is_forwarded BOOLEAN NOT NULL DEFAULT false;
+UPDATE crypto_megolm_inbound_session SET is_forwarded=true
+	WHERE forwarding_chains IS NOT NULL AND forwarding_chains<>'' AND forwarding_chains<>sender_key;
@@ -0,0 +1,11 @@
+-- v12: Add table for tracking outgoing key requests
+CREATE TABLE crypto_outgoing_key_request (
+	account_id TEXT,
+	request_id TEXT,
+	room_id    TEXT      NOT NULL,
+	sender_key CHAR(43)  NOT NULL,
+	session_id CHAR(43)  NOT NULL,
+	targets    jsonb     NOT NULL,
+	created_at timestamp NOT NULL,
+	PRIMARY KEY (account_id, request_id)
+);
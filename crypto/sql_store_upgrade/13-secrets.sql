@@ -0,0 +1,7 @@
+-- v13: Add table for secrets received from SSSS or other devices
+CREATE TABLE crypto_secrets (
+	account_id TEXT,
+	name       TEXT,
+	secret     bytea NOT NULL,
+	PRIMARY KEY (account_id, name)
+);
@@ -0,0 +1,2 @@
+-- v14: Add column for storing the sync filter ID
+ALTER TABLE crypto_account ADD COLUMN filter_id TEXT NOT NULL DEFAULT '';
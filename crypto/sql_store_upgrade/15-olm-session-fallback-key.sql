@@ -0,0 +1,2 @@
+-- v15: Add flag for olm sessions created using a fallback key
+ALTER TABLE crypto_olm_session ADD COLUMN used_fallback_key BOOLEAN NOT NULL DEFAULT false;
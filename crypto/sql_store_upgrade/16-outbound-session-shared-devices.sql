@@ -0,0 +1,2 @@
+-- v16: Store the devices outbound megolm sessions have been shared with
+ALTER TABLE crypto_megolm_outbound_session ADD COLUMN shared_devices TEXT NOT NULL DEFAULT '';
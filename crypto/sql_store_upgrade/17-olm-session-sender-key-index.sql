@@ -0,0 +1,2 @@
+-- v17 (compatible with v16+): Add index for finding the latest Olm sessions of a sender key
+CREATE INDEX crypto_olm_session_sender_key_idx ON crypto_olm_session (account_id, sender_key, last_decrypted);
@@ -0,0 +1,33 @@
+-- v18: Scope tracked users and device lists to accounts
+CREATE TABLE crypto_tracked_user_new (
+	account_id TEXT,
+	user_id    TEXT,
+	PRIMARY KEY (account_id, user_id)
+);
+-- Existing rows were shared by all accounts, so copy them to every account
+INSERT INTO crypto_tracked_user_new (account_id, user_id)
+	SELECT crypto_account.account_id, crypto_tracked_user.user_id FROM crypto_tracked_user, crypto_account;
+INSERT INTO crypto_tracked_user_new (account_id, user_id)
+	SELECT '', user_id FROM crypto_tracked_user WHERE NOT EXISTS (SELECT 1 FROM crypto_account);
+DROP TABLE crypto_tracked_user;
+ALTER TABLE crypto_tracked_user_new RENAME TO crypto_tracked_user;
+
+CREATE TABLE crypto_device_new (
+	account_id   TEXT,
+	user_id      TEXT,
+	device_id    TEXT,
+	identity_key CHAR(43) NOT NULL,
+	signing_key  CHAR(43) NOT NULL,
+	trust        SMALLINT NOT NULL,
+	deleted      BOOLEAN  NOT NULL,
+	name         TEXT     NOT NULL,
+	PRIMARY KEY (account_id, user_id, device_id)
+);
+INSERT INTO crypto_device_new (account_id, user_id, device_id, identity_key, signing_key, trust, deleted, name)
+	SELECT crypto_account.account_id, d.user_id, d.device_id, d.identity_key, d.signing_key, d.trust, d.deleted, d.name
+	FROM crypto_device d, crypto_account;
+INSERT INTO crypto_device_new (account_id, user_id, device_id, identity_key, signing_key, trust, deleted, name)
+	SELECT '', user_id, device_id, identity_key, signing_key, trust, deleted, name
+	FROM crypto_device WHERE NOT EXISTS (SELECT 1 FROM crypto_account);
+DROP TABLE crypto_device;
+ALTER TABLE crypto_device_new RENAME TO crypto_device;
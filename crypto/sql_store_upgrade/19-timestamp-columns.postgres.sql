@@ -0,0 +1,13 @@
+-- v19: Store timestamps as timestamptz on Postgres and unix milliseconds on SQLite
+-- The old timestamp columns were read as UTC, so interpret the existing values the same way
+ALTER TABLE crypto_olm_session
+	ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+	ALTER COLUMN last_decrypted TYPE timestamptz USING last_decrypted AT TIME ZONE 'UTC',
+	ALTER COLUMN last_encrypted TYPE timestamptz USING last_encrypted AT TIME ZONE 'UTC';
+ALTER TABLE crypto_megolm_inbound_session
+	ALTER COLUMN received_at TYPE timestamptz USING received_at AT TIME ZONE 'UTC';
+ALTER TABLE crypto_megolm_outbound_session
+	ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+	ALTER COLUMN last_used TYPE timestamptz USING last_used AT TIME ZONE 'UTC';
+ALTER TABLE crypto_outgoing_key_request
+	ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
@@ -0,0 +1,96 @@
+-- v19: Store timestamps as timestamptz on Postgres and unix milliseconds on SQLite
+-- SQLite can't change column types, so the tables are recreated. The old values are strings written by the
+-- driver (e.g. 2006-01-02 15:04:05.999999999-07:00), which julianday() converts to UTC including the offset.
+CREATE TABLE crypto_olm_session_new (
+	account_id        TEXT,
+	session_id        CHAR(43),
+	sender_key        CHAR(43) NOT NULL,
+	session           bytea    NOT NULL,
+	created_at        BIGINT   NOT NULL,
+	last_decrypted    BIGINT   NOT NULL,
+	last_encrypted    BIGINT   NOT NULL,
+	used_fallback_key BOOLEAN  NOT NULL DEFAULT false,
+	PRIMARY KEY (account_id, session_id)
+);
+INSERT INTO crypto_olm_session_new (account_id, session_id, sender_key, session, created_at, last_decrypted, last_encrypted, used_fallback_key)
+SELECT account_id, session_id, sender_key, session,
+	CASE WHEN typeof(created_at)='integer' THEN created_at ELSE CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER) END,
+	CASE WHEN typeof(last_decrypted)='integer' THEN last_decrypted ELSE CAST(ROUND((julianday(last_decrypted) - 2440587.5) * 86400000) AS INTEGER) END,
+	CASE WHEN typeof(last_encrypted)='integer' THEN last_encrypted ELSE CAST(ROUND((julianday(last_encrypted) - 2440587.5) * 86400000) AS INTEGER) END,
+	used_fallback_key
+FROM crypto_olm_session;
+DROP TABLE crypto_olm_session;
+ALTER TABLE crypto_olm_session_new RENAME TO crypto_olm_session;
+CREATE INDEX crypto_olm_session_sender_key_idx ON crypto_olm_session (account_id, sender_key, last_decrypted);
+
+CREATE TABLE crypto_megolm_inbound_session_new (
+	account_id        TEXT,
+	session_id        CHAR(43),
+	sender_key        CHAR(43) NOT NULL,
+	signing_key       CHAR(43),
+	room_id           TEXT     NOT NULL,
+	session           bytea,
+	forwarding_chains bytea,
+	withheld_code     TEXT,
+	withheld_reason   TEXT,
+	ratchet_safety    jsonb,
+	received_at       BIGINT,
+	max_age           BIGINT,
+	max_messages      INTEGER,
+	is_scheduled      BOOLEAN NOT NULL DEFAULT false,
+	is_forwarded      BOOLEAN NOT NULL DEFAULT false,
+	PRIMARY KEY (account_id, session_id)
+);
+INSERT INTO crypto_megolm_inbound_session_new (
+	account_id, session_id, sender_key, signing_key, room_id, session, forwarding_chains, withheld_code,
+	withheld_reason, ratchet_safety, received_at, max_age, max_messages, is_scheduled, is_forwarded
+)
+SELECT account_id, session_id, sender_key, signing_key, room_id, session, forwarding_chains, withheld_code,
+	withheld_reason, ratchet_safety,
+	CASE WHEN typeof(received_at)='integer' THEN received_at ELSE CAST(ROUND((julianday(received_at) - 2440587.5) * 86400000) AS INTEGER) END,
+	max_age, max_messages, is_scheduled, is_forwarded
+FROM crypto_megolm_inbound_session;
+DROP TABLE crypto_megolm_inbound_session;
+ALTER TABLE crypto_megolm_inbound_session_new RENAME TO crypto_megolm_inbound_session;
+
+CREATE TABLE crypto_megolm_outbound_session_new (
+	account_id     TEXT,
+	room_id        TEXT,
+	session_id     CHAR(43) NOT NULL UNIQUE,
+	session        bytea    NOT NULL,
+	shared         BOOLEAN  NOT NULL,
+	max_messages   INTEGER  NOT NULL,
+	message_count  INTEGER  NOT NULL,
+	max_age        BIGINT   NOT NULL,
+	created_at     BIGINT   NOT NULL,
+	last_used      BIGINT   NOT NULL,
+	shared_devices TEXT     NOT NULL DEFAULT '',
+	PRIMARY KEY (account_id, room_id)
+);
+INSERT INTO crypto_megolm_outbound_session_new (
+	account_id, room_id, session_id, session, shared, max_messages, message_count, max_age, created_at, last_used, shared_devices
+)
+SELECT account_id, room_id, session_id, session, shared, max_messages, message_count, max_age,
+	CASE WHEN typeof(created_at)='integer' THEN created_at ELSE CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER) END,
+	CASE WHEN typeof(last_used)='integer' THEN last_used ELSE CAST(ROUND((julianday(last_used) - 2440587.5) * 86400000) AS INTEGER) END,
+	shared_devices
+FROM crypto_megolm_outbound_session;
+DROP TABLE crypto_megolm_outbound_session;
+ALTER TABLE crypto_megolm_outbound_session_new RENAME TO crypto_megolm_outbound_session;
+
+CREATE TABLE crypto_outgoing_key_request_new (
+	account_id TEXT,
+	request_id TEXT,
+	room_id    TEXT     NOT NULL,
+	sender_key CHAR(43) NOT NULL,
+	session_id CHAR(43) NOT NULL,
+	targets    jsonb    NOT NULL,
+	created_at BIGINT   NOT NULL,
+	PRIMARY KEY (account_id, request_id)
+);
+INSERT INTO crypto_outgoing_key_request_new (account_id, request_id, room_id, sender_key, session_id, targets, created_at)
+SELECT account_id, request_id, room_id, sender_key, session_id, targets,
+	CASE WHEN typeof(created_at)='integer' THEN created_at ELSE CAST(ROUND((julianday(created_at) - 2440587.5) * 86400000) AS INTEGER) END
+FROM crypto_outgoing_key_request;
+DROP TABLE crypto_outgoing_key_request;
+ALTER TABLE crypto_outgoing_key_request_new RENAME TO crypto_outgoing_key_request;
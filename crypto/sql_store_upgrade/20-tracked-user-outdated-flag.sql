@@ -0,0 +1,2 @@
+-- v20 (compatible with v19+): Add outdated flag for tracked users' device lists
+ALTER TABLE crypto_tracked_user ADD COLUMN devices_outdated BOOLEAN NOT NULL DEFAULT false;
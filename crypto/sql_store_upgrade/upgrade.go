@@ -7,8 +7,11 @@
 package sql_store_upgrade
 
 import (
+	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
+	"reflect"
 
 	"go.mau.fi/util/dbutil"
 )
@@ -18,11 +21,170 @@ var Table dbutil.UpgradeTable
 const VersionTableName = "crypto_version"
 
 //go:embed *.sql
-var fs embed.FS
+var upgrades embed.FS
 
 func init() {
 	Table.Register(-1, 3, 0, "Unsupported version", false, func(tx dbutil.Execable, database *dbutil.Database) error {
 		return fmt.Errorf("upgrading from versions 1 and 2 of the crypto store is no longer supported in mautrix-go v0.12+")
 	})
-	Table.RegisterFS(fs)
+	Table.RegisterFS(upgrades)
+}
+
+// AccountIDTables contains the names of all tables in the crypto store that have an account_id column.
+var AccountIDTables = []string{"crypto_account", "crypto_olm_session", "crypto_megolm_inbound_session", "crypto_megolm_outbound_session", "crypto_outgoing_key_request", "crypto_secrets", "crypto_tracked_user", "crypto_device"}
+
+// AssignAccountID changes the account ID of all rows with the given old account ID to a new value in one transaction.
+//
+// This is meant for stores created before account IDs were introduced, where all rows have an empty account ID,
+// so oldAccountID is usually an empty string. The update fails if the new account ID is already in use.
+func AssignAccountID(db *sql.DB, dialect dbutil.Dialect, oldAccountID, newAccountID string) error {
+	if dialect != dbutil.Postgres && dialect != dbutil.SQLite {
+		return fmt.Errorf("unsupported database dialect %q", dialect.String())
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range AccountIDTables {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET account_id=$1 WHERE account_id=$2", table), newAccountID, oldAccountID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to update account ID in %s: %w", table, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit changes: %w", err)
+	}
+	return nil
+}
+
+// ErrUnsupportedSchemaVersion is returned (wrapped in an UnsupportedSchemaVersionError) when the crypto store
+// was upgraded by a newer version of mautrix-go and can't be used by this version.
+var ErrUnsupportedSchemaVersion = errors.New("unsupported crypto store schema version")
+
+// UnsupportedSchemaVersionError contains the versions of a crypto store schema that this version of mautrix-go
+// can't use. It matches both ErrUnsupportedSchemaVersion and dbutil.ErrUnsupportedDatabaseVersion with errors.Is.
+type UnsupportedSchemaVersionError struct {
+	// Version is the schema version the database is on.
+	Version int
+	// CompatVersion is the oldest schema version whose code can still use the database.
+	CompatVersion int
+	// LatestVersion is the newest schema version known to this version of mautrix-go.
+	LatestVersion int
+}
+
+func (err *UnsupportedSchemaVersionError) Error() string {
+	return fmt.Sprintf("%s: currently on v%d (compatible down to v%d), latest known: v%d", ErrUnsupportedSchemaVersion, err.Version, err.CompatVersion, err.LatestVersion)
+}
+
+func (err *UnsupportedSchemaVersionError) Unwrap() []error {
+	return []error{ErrUnsupportedSchemaVersion, dbutil.ErrUnsupportedDatabaseVersion}
+}
+
+// GetVersion returns the current schema version of the crypto store in the given database,
+// as well as the compat version, i.e. the oldest schema version whose code can still use the database.
+//
+// Both are zero if the crypto store hasn't been created yet. Databases upgraded before the compat version was
+// recorded report the schema version as the compat version.
+func GetVersion(db *dbutil.Database) (version, compat int, err error) {
+	if exists, err := db.TableExists(nil, VersionTableName); err != nil {
+		return 0, 0, fmt.Errorf("failed to check if version table exists: %w", err)
+	} else if !exists {
+		return 0, 0, nil
+	}
+	compatExists, err := db.ColumnExists(nil, VersionTableName, "compat")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to check if version table has compat column: %w", err)
+	}
+	var compatNull sql.NullInt32
+	if compatExists {
+		err = db.QueryRow(fmt.Sprintf("SELECT version, compat FROM %s LIMIT 1", VersionTableName)).Scan(&version, &compatNull)
+	} else {
+		err = db.QueryRow(fmt.Sprintf("SELECT version FROM %s LIMIT 1", VersionTableName)).Scan(&version)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to get current version: %w", err)
+	}
+	if compatNull.Valid && compatNull.Int32 != 0 {
+		compat = int(compatNull.Int32)
+	} else {
+		compat = version
+	}
+	return
+}
+
+// Upgrade upgrades the crypto store in the given database to the latest schema version.
+//
+// If the crypto store was upgraded by a newer version of mautrix-go to a schema this version can't use,
+// the dbutil.ErrUnsupportedDatabaseVersion error from db.Upgrade() is returned as an UnsupportedSchemaVersionError.
+// Databases on a newer schema version are allowed if all the unknown upgrades are marked as compatible
+// with the latest known version, which is the case for purely additive upgrades like new indexes.
+func Upgrade(db *dbutil.Database) error {
+	err := db.Upgrade()
+	if errors.Is(err, dbutil.ErrUnsupportedDatabaseVersion) {
+		version, compat, versionErr := GetVersion(db)
+		if versionErr != nil {
+			return fmt.Errorf("%w (failed to get version for error: %v)", err, versionErr)
+		}
+		return &UnsupportedSchemaVersionError{Version: version, CompatVersion: compat, LatestVersion: len(Table)}
+	}
+	return err
+}
+
+// PlannedUpgrade is a single schema upgrade returned by DryRun.
+type PlannedUpgrade struct {
+	From    int
+	To      int
+	Message string
+	// CompatVersion is the oldest schema version whose code can still use the database after this upgrade.
+	// It's the same as To unless the upgrade is marked as backwards-compatible.
+	CompatVersion int
+}
+
+// plannedUpgrade reads the upgrade registered at the given index of Table. dbutil doesn't export the parsed
+// upgrade headers, so they're read with reflection instead of parsing the upgrade files a second time.
+func plannedUpgrade(index int) (upgrade PlannedUpgrade, ok bool, err error) {
+	item := reflect.ValueOf(Table).Index(index)
+	fn, to, compat, message := item.FieldByName("fn"), item.FieldByName("upgradesTo"), item.FieldByName("compatVersion"), item.FieldByName("message")
+	if !fn.IsValid() || !to.IsValid() || !compat.IsValid() || !message.IsValid() {
+		return upgrade, false, fmt.Errorf("unsupported dbutil upgrade table format")
+	} else if fn.IsNil() {
+		return upgrade, false, nil
+	}
+	return PlannedUpgrade{From: index, To: int(to.Int()), Message: message.String(), CompatVersion: int(compat.Int())}, true, nil
+}
+
+// DryRun returns the upgrades that db.Upgrade() would apply to the crypto store in the given database,
+// without changing anything. The returned list is empty if the database is already up to date.
+//
+// To see the upgrades as they're applied, set the Log field of the database to a logger, e.g. dbutil.ZeroLogger.
+func DryRun(db *dbutil.Database) ([]PlannedUpgrade, error) {
+	version, compat, err := GetVersion(db)
+	if err != nil {
+		return nil, err
+	} else if version > 0 && version < 3 {
+		return nil, fmt.Errorf("upgrading from versions 1 and 2 of the crypto store is no longer supported in mautrix-go v0.12+")
+	} else if compat > len(Table) {
+		// This is the same check db.Upgrade() does before making any changes
+		return nil, &UnsupportedSchemaVersionError{Version: version, CompatVersion: compat, LatestVersion: len(Table)}
+	}
+	var planned []PlannedUpgrade
+	from := version
+	for version < len(Table) {
+		upgrade, ok, err := plannedUpgrade(version)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			version++
+			continue
+		}
+		upgrade.From = from
+		planned = append(planned, upgrade)
+		version = upgrade.To
+		from = version
+	}
+	return planned, nil
 }
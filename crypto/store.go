@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -32,6 +33,12 @@ type Store interface {
 	PutAccount(*OlmAccount) error
 	// GetAccount returns the OlmAccount in the store that was previously inserted with PutAccount.
 	GetAccount() (*OlmAccount, error)
+	// DeleteAccount deletes the OlmAccount along with all Olm and Megolm sessions that belong to it.
+	// Stores that can hold multiple accounts must only delete the data of the current account.
+	DeleteAccount() error
+	// GetAccounts returns basic info about all accounts in the store. Stores that only hold a single account
+	// should return that account if it exists.
+	GetAccounts() ([]AccountInfo, error)
 
 	// AddSession inserts an Olm session into the store.
 	AddSession(id.SenderKey, *OlmSession) error
@@ -43,6 +50,7 @@ type Store interface {
 	// It's usually safe to return the most recently added session if sorting by session ID is too difficult.
 	GetLatestSession(id.SenderKey) (*OlmSession, error)
 	// UpdateSession updates a session that has previously been inserted with AddSession.
+	// The ratchet state changes on every use, so the update must be persisted immediately.
 	UpdateSession(id.SenderKey, *OlmSession) error
 
 	// PutGroupSession inserts an inbound Megolm session into the store. If an earlier withhold event has been inserted
@@ -65,6 +73,10 @@ type Store interface {
 	PutWithheldGroupSession(event.RoomKeyWithheldEventContent) error
 	// GetWithheldGroupSession gets the event content that was previously inserted with PutWithheldGroupSession.
 	GetWithheldGroupSession(id.RoomID, id.SenderKey, id.SessionID) (*event.RoomKeyWithheldEventContent, error)
+	// GetInboundSessionInfo gets debugging information about an inbound Megolm session regardless of the sender key.
+	// If the store doesn't know about the session, this should return an InboundSessionInfo with Exists set to false.
+	// The session key should only be included if the bool parameter is true.
+	GetInboundSessionInfo(id.RoomID, id.SessionID, bool) (*InboundSessionInfo, error)
 
 	// GetGroupSessionsForRoom gets all the inbound Megolm sessions for a specific room. This is used for creating key
 	// export files. Unlike GetGroupSession, this should not return any errors about withheld keys.
@@ -84,6 +96,24 @@ type Store interface {
 	GetOutboundGroupSession(id.RoomID) (*OutboundGroupSession, error)
 	// RemoveOutboundGroupSession removes the stored outbound Megolm session for the given room ID.
 	RemoveOutboundGroupSession(id.RoomID) error
+	// RemoveAllOutboundGroupSessions removes the stored outbound Megolm sessions of all rooms.
+	// It returns the number of sessions removed.
+	RemoveAllOutboundGroupSessions() (int64, error)
+
+	// PutOutgoingKeyRequest stores an outgoing key request, so that it can be cancelled when the key arrives.
+	PutOutgoingKeyRequest(*OutgoingKeyRequest) error
+	// GetOutgoingKeyRequests returns the stored outgoing key requests for the given session ID.
+	// If the session ID is empty, all stored requests are returned.
+	GetOutgoingKeyRequests(id.SessionID) ([]*OutgoingKeyRequest, error)
+	// DeleteOutgoingKeyRequest deletes the outgoing key request with the given request ID.
+	DeleteOutgoingKeyRequest(requestID string) error
+
+	// PutSecret stores a secret received from SSSS or from another device.
+	PutSecret(name id.Secret, value string) error
+	// GetSecret returns the secret with the given name. An empty string is returned if the secret isn't stored.
+	GetSecret(name id.Secret) (string, error)
+	// DeleteSecret deletes the secret with the given name.
+	DeleteSecret(name id.Secret) error
 
 	// ValidateMessageIndex validates that the given message details aren't from a replay attack.
 	//
@@ -93,6 +123,7 @@ type Store interface {
 	// * If the map key doesn't exist, the given values should be stored and this should return true.
 	// * If the map key exists and the stored values match the given values, this should return true.
 	// * If the map key exists, but the stored values do not match the given values, this should return false.
+	//   Implementations may also return a *DuplicateMessageIndexError with the stored values as the error.
 	ValidateMessageIndex(ctx context.Context, senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error)
 
 	// GetDevices returns a map from device ID to id.Device struct containing all devices of a given user.
@@ -108,6 +139,11 @@ type Store interface {
 	// FilterTrackedUsers returns a filtered version of the given list that only includes user IDs whose device lists
 	// have been stored with PutDevices. A user is considered tracked even if the PutDevices list was empty.
 	FilterTrackedUsers([]id.UserID) ([]id.UserID, error)
+	// MarkTrackedUsersOutdated flags the stored device lists of the given users as outdated, so that they're fetched
+	// again before they're used. Users whose device lists aren't tracked are ignored. PutDevices clears the flag.
+	MarkTrackedUsersOutdated([]id.UserID) error
+	// GetOutdatedTrackedUsers returns all tracked users whose device lists have been flagged as outdated.
+	GetOutdatedTrackedUsers() ([]id.UserID, error)
 
 	// PutCrossSigningKey stores a cross-signing key of some user along with its usage.
 	PutCrossSigningKey(id.UserID, id.CrossSigningUsage, id.Ed25519) error
@@ -119,6 +155,45 @@ type Store interface {
 	IsKeySignedBy(userID id.UserID, key id.Ed25519, signedByUser id.UserID, signedByKey id.Ed25519) (bool, error)
 	// DropSignaturesByKey deletes the signatures made by the given user and key from the store. It returns the number of signatures deleted.
 	DropSignaturesByKey(id.UserID, id.Ed25519) (int64, error)
+
+	// Stats returns the number of items in the store, e.g. for tracking the growth of the store over time.
+	Stats() (*StoreStats, error)
+}
+
+// StoreStats contains the number of items in a crypto store, as returned by Store.Stats.
+//
+// The byte sizes are approximate sizes of the pickled sessions. They're zero for stores that can't compute them cheaply.
+type StoreStats struct {
+	OlmSessions           int
+	InboundGroupSessions  int
+	OutboundGroupSessions int
+	// WithheldGroupSessions is the number of inbound group sessions that were withheld or redacted.
+	WithheldGroupSessions int
+	Devices               int
+	TrackedUsers          int
+	// MessageIndices is the number of stored megolm message indices. The SQL store shares the same table
+	// between all accounts, so this includes the indices of every account in the database.
+	MessageIndices int
+
+	OlmSessionBytes          int64
+	InboundGroupSessionBytes int64
+}
+
+// AccountInfo contains basic information about an account in a crypto store.
+type AccountInfo struct {
+	AccountID string
+	DeviceID  id.DeviceID
+	Shared    bool
+}
+
+// OutgoingKeyRequest is a key request sent by this device that hasn't been cancelled yet.
+type OutgoingKeyRequest struct {
+	RequestID string
+	RoomID    id.RoomID
+	SenderKey id.SenderKey
+	SessionID id.SessionID
+	Targets   map[id.UserID][]id.DeviceID
+	CreatedAt time.Time
 }
 
 type messageIndexKey struct {
@@ -134,6 +209,9 @@ type messageIndexValue struct {
 
 // MemoryStore is a simple in-memory Store implementation. It can optionally have a callback function for saving data,
 // but the actual storage must be implemented manually.
+//
+// It can be passed to NewOlmMachine instead of SQLCryptoStore, e.g. for testing code that uses OlmMachine
+// without a database.
 type MemoryStore struct {
 	lock sync.RWMutex
 
@@ -146,8 +224,11 @@ type MemoryStore struct {
 	OutGroupSessions      map[id.RoomID]*OutboundGroupSession
 	MessageIndices        map[messageIndexKey]messageIndexValue
 	Devices               map[id.UserID]map[id.DeviceID]*id.Device
+	OutdatedUsers         map[id.UserID]struct{}
 	CrossSigningKeys      map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
+	OutgoingKeyRequests   map[string]*OutgoingKeyRequest
+	Secrets               map[id.Secret]string
 }
 
 var _ Store = (*MemoryStore)(nil)
@@ -165,6 +246,9 @@ func NewMemoryStore(saveCallback func() error) *MemoryStore {
 		OutGroupSessions:      make(map[id.RoomID]*OutboundGroupSession),
 		MessageIndices:        make(map[messageIndexKey]messageIndexValue),
 		Devices:               make(map[id.UserID]map[id.DeviceID]*id.Device),
+		OutdatedUsers:         make(map[id.UserID]struct{}),
+		OutgoingKeyRequests:   make(map[string]*OutgoingKeyRequest),
+		Secrets:               make(map[id.Secret]string),
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
 	}
@@ -189,6 +273,32 @@ func (gs *MemoryStore) PutAccount(account *OlmAccount) error {
 	return err
 }
 
+// GetAccounts returns the account in the store, if there is one. The memory store doesn't know
+// the account or device ID, so those fields are always empty.
+func (gs *MemoryStore) GetAccounts() ([]AccountInfo, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	if gs.Account == nil {
+		return nil, nil
+	}
+	return []AccountInfo{{Shared: gs.Account.Shared}}, nil
+}
+
+func (gs *MemoryStore) DeleteAccount() error {
+	gs.lock.Lock()
+	gs.Account = nil
+	gs.Sessions = make(map[id.SenderKey]OlmSessionList)
+	gs.GroupSessions = make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*InboundGroupSession)
+	gs.WithheldGroupSessions = make(map[id.RoomID]map[id.SenderKey]map[id.SessionID]*event.RoomKeyWithheldEventContent)
+	gs.OutGroupSessions = make(map[id.RoomID]*OutboundGroupSession)
+	gs.MessageIndices = make(map[messageIndexKey]messageIndexValue)
+	gs.OutgoingKeyRequests = make(map[string]*OutgoingKeyRequest)
+	gs.Secrets = make(map[id.Secret]string)
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *MemoryStore) GetSessions(senderKey id.SenderKey) (OlmSessionList, error) {
 	gs.lock.Lock()
 	sessions, ok := gs.Sessions[senderKey]
@@ -323,6 +433,29 @@ func (gs *MemoryStore) RedactOutdatedGroupSessions() ([]id.SessionID, error) {
 	return nil, fmt.Errorf("not implemented")
 }
 
+func (gs *MemoryStore) GetInboundSessionInfo(roomID id.RoomID, sessionID id.SessionID, includeKey bool) (*InboundSessionInfo, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	for _, sessions := range gs.GroupSessions[roomID] {
+		if session, ok := sessions[sessionID]; ok {
+			return session.info(includeKey)
+		}
+	}
+	for senderKey, sessions := range gs.WithheldGroupSessions[roomID] {
+		if withheld, ok := sessions[sessionID]; ok {
+			return &InboundSessionInfo{
+				RoomID:         roomID,
+				SessionID:      sessionID,
+				Exists:         true,
+				SenderKey:      senderKey,
+				WithheldCode:   withheld.Code,
+				WithheldReason: withheld.Reason,
+			}, nil
+		}
+	}
+	return &InboundSessionInfo{RoomID: roomID, SessionID: sessionID}, nil
+}
+
 func (gs *MemoryStore) getWithheldGroupSessions(roomID id.RoomID, senderKey id.SenderKey) map[id.SessionID]*event.RoomKeyWithheldEventContent {
 	room, ok := gs.WithheldGroupSessions[roomID]
 	if !ok {
@@ -420,6 +553,64 @@ func (gs *MemoryStore) RemoveOutboundGroupSession(roomID id.RoomID) error {
 	return nil
 }
 
+func (gs *MemoryStore) RemoveAllOutboundGroupSessions() (int64, error) {
+	gs.lock.Lock()
+	count := int64(len(gs.OutGroupSessions))
+	gs.OutGroupSessions = make(map[id.RoomID]*OutboundGroupSession)
+	gs.lock.Unlock()
+	return count, nil
+}
+
+func (gs *MemoryStore) PutOutgoingKeyRequest(req *OutgoingKeyRequest) error {
+	gs.lock.Lock()
+	gs.OutgoingKeyRequests[req.RequestID] = req
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *MemoryStore) GetOutgoingKeyRequests(sessionID id.SessionID) ([]*OutgoingKeyRequest, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	var reqs []*OutgoingKeyRequest
+	for _, req := range gs.OutgoingKeyRequests {
+		if sessionID == "" || req.SessionID == sessionID {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+func (gs *MemoryStore) DeleteOutgoingKeyRequest(requestID string) error {
+	gs.lock.Lock()
+	delete(gs.OutgoingKeyRequests, requestID)
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *MemoryStore) PutSecret(name id.Secret, value string) error {
+	gs.lock.Lock()
+	gs.Secrets[name] = value
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *MemoryStore) GetSecret(name id.Secret) (string, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	return gs.Secrets[name], nil
+}
+
+func (gs *MemoryStore) DeleteSecret(name id.Secret) error {
+	gs.lock.Lock()
+	delete(gs.Secrets, name)
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
 func (gs *MemoryStore) ValidateMessageIndex(_ context.Context, senderKey id.SenderKey, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
 	gs.lock.Lock()
 	defer gs.lock.Unlock()
@@ -438,7 +629,11 @@ func (gs *MemoryStore) ValidateMessageIndex(_ context.Context, senderKey id.Send
 		return true, nil
 	}
 	if val.EventID != eventID || val.Timestamp != timestamp {
-		return false, nil
+		return false, &DuplicateMessageIndexError{
+			MessageIndex:      index,
+			OriginalEventID:   val.EventID,
+			OriginalTimestamp: val.Timestamp,
+		}
 	}
 	return true, nil
 }
@@ -498,6 +693,7 @@ func (gs *MemoryStore) PutDevice(userID id.UserID, device *id.Device) error {
 func (gs *MemoryStore) PutDevices(userID id.UserID, devices map[id.DeviceID]*id.Device) error {
 	gs.lock.Lock()
 	gs.Devices[userID] = devices
+	delete(gs.OutdatedUsers, userID)
 	err := gs.save()
 	gs.lock.Unlock()
 	return err
@@ -517,6 +713,58 @@ func (gs *MemoryStore) FilterTrackedUsers(users []id.UserID) ([]id.UserID, error
 	return users[:ptr], nil
 }
 
+func (gs *MemoryStore) MarkTrackedUsersOutdated(users []id.UserID) error {
+	gs.lock.Lock()
+	if gs.OutdatedUsers == nil {
+		gs.OutdatedUsers = make(map[id.UserID]struct{})
+	}
+	for _, userID := range users {
+		if _, ok := gs.Devices[userID]; ok {
+			gs.OutdatedUsers[userID] = struct{}{}
+		}
+	}
+	err := gs.save()
+	gs.lock.Unlock()
+	return err
+}
+
+func (gs *MemoryStore) GetOutdatedTrackedUsers() ([]id.UserID, error) {
+	gs.lock.RLock()
+	users := make([]id.UserID, 0, len(gs.OutdatedUsers))
+	for userID := range gs.OutdatedUsers {
+		users = append(users, userID)
+	}
+	gs.lock.RUnlock()
+	return users, nil
+}
+
+func (gs *MemoryStore) Stats() (*StoreStats, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	stats := &StoreStats{
+		OutboundGroupSessions: len(gs.OutGroupSessions),
+		TrackedUsers:          len(gs.Devices),
+		MessageIndices:        len(gs.MessageIndices),
+	}
+	for _, sessions := range gs.Sessions {
+		stats.OlmSessions += len(sessions)
+	}
+	for _, senders := range gs.GroupSessions {
+		for _, sessions := range senders {
+			stats.InboundGroupSessions += len(sessions)
+		}
+	}
+	for _, senders := range gs.WithheldGroupSessions {
+		for _, sessions := range senders {
+			stats.WithheldGroupSessions += len(sessions)
+		}
+	}
+	for _, devices := range gs.Devices {
+		stats.Devices += len(devices)
+	}
+	return stats, nil
+}
+
 func (gs *MemoryStore) PutCrossSigningKey(userID id.UserID, usage id.CrossSigningUsage, key id.Ed25519) error {
 	gs.lock.RLock()
 	userKeys, ok := gs.CrossSigningKeys[userID]
@@ -9,13 +9,20 @@ package crypto
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"go.mau.fi/util/dbutil"
 
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/sql_store_upgrade"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -60,6 +67,22 @@ func TestPutNextBatch(t *testing.T) {
 	}
 }
 
+func TestSyncStoreFilterID(t *testing.T) {
+	stores := getCryptoStores(t)
+	store := stores["sql"].(*SQLCryptoStore)
+	store.PutAccount(NewOlmAccount())
+	store.SaveFilterID(context.Background(), "", "filter1")
+	if filterID := store.LoadFilterID(context.Background(), ""); filterID != "" {
+		t.Errorf("Expected no filter ID when persisting is disabled, got %v", filterID)
+	}
+
+	store.PersistFilterID = true
+	store.SaveFilterID(context.Background(), "", "filter2")
+	if filterID := store.LoadFilterID(context.Background(), ""); filterID != "filter2" {
+		t.Errorf("Expected filter2, got %v", filterID)
+	}
+}
+
 func TestPutAccount(t *testing.T) {
 	stores := getCryptoStores(t)
 	for storeName, store := range stores {
@@ -80,6 +103,136 @@ func TestPutAccount(t *testing.T) {
 	}
 }
 
+func TestGetAccounts(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	otherStore := NewSQLCryptoStore(store.DB, nil, "otheraccid", id.DeviceID("otherdev"), []byte("test"))
+	store.PutAccount(NewOlmAccount())
+	otherAcc := NewOlmAccount()
+	otherAcc.Shared = true
+	otherStore.PutAccount(otherAcc)
+
+	accounts, err := store.GetAccounts()
+	if err != nil {
+		t.Fatalf("Error getting accounts: %v", err)
+	}
+	expected := []AccountInfo{
+		{AccountID: "accid", DeviceID: "dev", Shared: false},
+		{AccountID: "otheraccid", DeviceID: "otherdev", Shared: true},
+	}
+	if len(accounts) != len(expected) {
+		t.Fatalf("Expected %d accounts, got %d", len(expected), len(accounts))
+	}
+	for i, acc := range accounts {
+		if acc != expected[i] {
+			t.Errorf("Expected account %d to be %+v, got %+v", i, expected[i], acc)
+		}
+	}
+}
+
+func TestAssignAccountID(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	legacyStore := NewSQLCryptoStore(store.DB, nil, "", id.DeviceID("dev"), []byte("test"))
+	acc := NewOlmAccount()
+	legacyStore.PutAccount(acc)
+	olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal Olm session: %v", err)
+	}
+	err = legacyStore.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal})
+	if err != nil {
+		t.Fatalf("Error storing Olm session: %v", err)
+	}
+
+	err = sql_store_upgrade.AssignAccountID(store.DB.RawDB, store.DB.Dialect, "", "newaccid")
+	if err != nil {
+		t.Fatalf("Error assigning account ID: %v", err)
+	}
+
+	newStore := NewSQLCryptoStore(store.DB, nil, "newaccid", id.DeviceID("dev"), []byte("test"))
+	retrieved, err := newStore.GetAccount()
+	if err != nil {
+		t.Fatalf("Error retrieving account: %v", err)
+	} else if retrieved == nil || retrieved.IdentityKey() != acc.IdentityKey() {
+		t.Error("Account wasn't moved to the new account ID")
+	}
+	if !newStore.HasSession(olmSessID) {
+		t.Error("Olm session wasn't moved to the new account ID")
+	}
+	accounts, err := store.GetAccounts()
+	if err != nil {
+		t.Fatalf("Error getting accounts: %v", err)
+	} else if len(accounts) != 1 || accounts[0].AccountID != "newaccid" {
+		t.Errorf("Expected only newaccid to be in the store, got %+v", accounts)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	store.PutAccount(NewOlmAccount())
+	report, err := store.CheckConsistency()
+	if err != nil {
+		t.Fatalf("Error checking consistency: %v", err)
+	} else if !report.IsEmpty() {
+		t.Errorf("Expected empty report for empty store, got %+v", report)
+	}
+
+	olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+	if err != nil {
+		t.Fatalf("Error creating internal Olm session: %v", err)
+	}
+	err = store.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal})
+	if err != nil {
+		t.Fatalf("Error storing Olm session: %v", err)
+	}
+	outbound := NewOutboundGroupSession("room1", nil)
+	outbound.Shared = true
+	outbound.MaxAge = time.Hour
+	outbound.CreationTime = time.Now().Add(-2 * time.Hour)
+	err = store.AddOutboundGroupSession(outbound)
+	if err != nil {
+		t.Fatalf("Error inserting outbound session: %v", err)
+	}
+	_, err = store.DB.Exec("INSERT INTO crypto_megolm_inbound_session (account_id, session_id, sender_key, room_id) VALUES ($1, $2, $3, $4)",
+		store.AccountID, "emptysession", olmSessID, "room2")
+	if err != nil {
+		t.Fatalf("Error inserting empty inbound session: %v", err)
+	}
+	err = store.PutWithheldGroupSession(event.RoomKeyWithheldEventContent{
+		RoomID:    "room2",
+		SenderKey: olmSessID,
+		SessionID: "withheldsession",
+		Code:      event.RoomKeyWithheldUnauthorized,
+	})
+	if err != nil {
+		t.Fatalf("Error inserting withheld session: %v", err)
+	}
+	orphanStore := NewSQLCryptoStore(store.DB, nil, "orphanaccid", id.DeviceID("dev"), []byte("test"))
+	err = orphanStore.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal})
+	if err != nil {
+		t.Fatalf("Error storing orphaned Olm session: %v", err)
+	}
+
+	report, err = store.CheckConsistency()
+	if err != nil {
+		t.Fatalf("Error checking consistency: %v", err)
+	}
+	if len(report.OlmSessionsWithUnknownDevice) != 2 {
+		t.Errorf("Expected 2 olm sessions with unknown devices, got %+v", report.OlmSessionsWithUnknownDevice)
+	}
+	expectedEmpty := []MegolmSessionFinding{{AccountID: store.AccountID, RoomID: "room2", SessionID: "emptysession"}}
+	if len(report.EmptyInboundGroupSessions) != 1 || report.EmptyInboundGroupSessions[0] != expectedEmpty[0] {
+		t.Errorf("Expected empty inbound sessions %+v, got %+v", expectedEmpty, report.EmptyInboundGroupSessions)
+	}
+	expectedExpired := MegolmSessionFinding{AccountID: store.AccountID, RoomID: "room1", SessionID: outbound.ID()}
+	if len(report.ExpiredSharedOutboundSessions) != 1 || report.ExpiredSharedOutboundSessions[0] != expectedExpired {
+		t.Errorf("Expected expired outbound sessions [%+v], got %+v", expectedExpired, report.ExpiredSharedOutboundSessions)
+	}
+	expectedOrphan := OrphanedRowsFinding{Table: "crypto_olm_session", AccountID: "orphanaccid", Count: 1}
+	if len(report.OrphanedRows) != 1 || report.OrphanedRows[0] != expectedOrphan {
+		t.Errorf("Expected orphaned rows [%+v], got %+v", expectedOrphan, report.OrphanedRows)
+	}
+}
+
 func TestValidateMessageIndex(t *testing.T) {
 	stores := getCryptoStores(t)
 	for storeName, store := range stores {
@@ -91,11 +244,18 @@ func TestValidateMessageIndex(t *testing.T) {
 			if ok, _ := store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), "sess1", "event1", 0, 1001); ok {
 				t.Error("First message validated successfully after changing timestamp")
 			}
-			if ok, _ := store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), "sess1", "event2", 0, 1000); ok {
+			ok, err := store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), "sess1", "event2", 0, 1000)
+			if ok {
 				t.Error("First message validated successfully after changing event ID")
 			}
-			if ok, _ := store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), "sess1", "event1", 0, 1000); !ok {
-				t.Error("First message not validated successfully for a second time")
+			var dupErr *DuplicateMessageIndexError
+			if !errors.As(err, &dupErr) {
+				t.Errorf("Expected DuplicateMessageIndexError, got %v", err)
+			} else if dupErr.OriginalEventID != "event1" || dupErr.OriginalTimestamp != 1000 {
+				t.Errorf("Expected original event1 at 1000, got %s at %d", dupErr.OriginalEventID, dupErr.OriginalTimestamp)
+			}
+			if ok, err := store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), "sess1", "event1", 0, 1000); !ok || err != nil {
+				t.Error("First message not validated successfully for a second time:", err)
 			}
 		})
 	}
@@ -114,8 +274,9 @@ func TestStoreOlmSession(t *testing.T) {
 			}
 
 			olmSess := OlmSession{
-				id:       olmSessID,
-				Internal: *olmInternal,
+				id:              olmSessID,
+				Internal:        *olmInternal,
+				UsedFallbackKey: true,
 			}
 			err = store.AddSession(olmSessID, &olmSess)
 			if err != nil {
@@ -125,6 +286,10 @@ func TestStoreOlmSession(t *testing.T) {
 				t.Error("Not found Olm session after inserting it")
 			}
 
+			if sqlStore, ok := store.(*SQLCryptoStore); ok {
+				// Make sure the session is read from the database rather than the cache
+				sqlStore.olmSessionCache = make(map[id.SenderKey]map[id.SessionID]*OlmSession)
+			}
 			retrieved, err := store.GetLatestSession(olmSessID)
 			if err != nil {
 				t.Errorf("Failed retrieving Olm session: %v", err)
@@ -136,10 +301,208 @@ func TestStoreOlmSession(t *testing.T) {
 			if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != olmPickled {
 				t.Error("Pickled Olm session does not match original")
 			}
+			if !retrieved.UsedFallbackKey {
+				t.Error("Fallback key flag was not stored")
+			}
 		})
 	}
 }
 
+func TestUpgradeDryRun(t *testing.T) {
+	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	store := NewSQLCryptoStore(db, nil, "accid", id.DeviceID("dev"), []byte("test"))
+	latest := len(sql_store_upgrade.Table)
+	planned, err := sql_store_upgrade.DryRun(store.DB)
+	if err != nil {
+		t.Fatalf("Error planning upgrades: %v", err)
+	} else if len(planned) != 1 || planned[0].From != 0 || planned[0].To != latest {
+		t.Errorf("Expected a single upgrade from v0 to v%d, got %+v", latest, planned)
+	}
+	if exists, _ := store.DB.TableExists(nil, "crypto_account"); exists {
+		t.Error("Dry run created tables")
+	}
+
+	if err = store.DB.Upgrade(); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	if planned, err = sql_store_upgrade.DryRun(store.DB); err != nil {
+		t.Fatalf("Error planning upgrades: %v", err)
+	} else if len(planned) != 0 {
+		t.Errorf("Expected no upgrades for up-to-date database, got %+v", planned)
+	}
+
+	if _, err = store.DB.Exec("UPDATE crypto_version SET version=$1", latest-2); err != nil {
+		t.Fatalf("Error changing version: %v", err)
+	}
+	if planned, err = sql_store_upgrade.DryRun(store.DB); err != nil {
+		t.Fatalf("Error planning upgrades: %v", err)
+	} else if len(planned) != 2 || planned[0].From != latest-2 || planned[1].To != latest || planned[1].Message == "" {
+		t.Errorf("Expected upgrades from v%d to v%d, got %+v", latest-2, latest, planned)
+	}
+}
+
+func TestUpgradeSchemaCompatibility(t *testing.T) {
+	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	store := NewSQLCryptoStore(db, nil, "accid", id.DeviceID("dev"), []byte("test"))
+	latest := len(sql_store_upgrade.Table)
+	// The latest upgrade (v20) only adds a column, so the schema is still compatible with v19
+	latestCompat := latest - 1
+	if err = sql_store_upgrade.Upgrade(store.DB); err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	if version, compat, err := sql_store_upgrade.GetVersion(store.DB); err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	} else if version != latest || compat != latestCompat {
+		t.Errorf("Expected v%d compatible with v%d, got v%d compatible with v%d", latest, latestCompat, version, compat)
+	}
+
+	// New binary, old database: a compat version that was never recorded is treated as the schema version.
+	if _, err = store.DB.Exec("UPDATE crypto_version SET version=16, compat=NULL"); err != nil {
+		t.Fatalf("Error changing version: %v", err)
+	}
+	if planned, err := sql_store_upgrade.DryRun(store.DB); err != nil {
+		t.Fatalf("Error planning upgrades: %v", err)
+	} else if len(planned) != latest-16 || planned[0].CompatVersion != 16 || planned[1].CompatVersion != 18 {
+		t.Errorf("Expected v17 upgrade compatible with v16 followed by incompatible upgrades, got %+v", planned)
+	}
+	if _, err = store.DB.Exec("ALTER TABLE crypto_tracked_user DROP COLUMN devices_outdated"); err != nil {
+		t.Fatalf("Error dropping column: %v", err)
+	}
+	if _, err = store.DB.Exec("UPDATE crypto_version SET version=17, compat=NULL"); err != nil {
+		t.Fatalf("Error changing version: %v", err)
+	}
+	if version, compat, err := sql_store_upgrade.GetVersion(store.DB); err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	} else if version != 17 || compat != 17 {
+		t.Errorf("Expected v17 compatible with v17, got v%d compatible with v%d", version, compat)
+	}
+	if err = sql_store_upgrade.Upgrade(store.DB); err != nil {
+		t.Fatalf("Error upgrading old database: %v", err)
+	}
+	if version, compat, err := sql_store_upgrade.GetVersion(store.DB); err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	} else if version != latest || compat != latestCompat {
+		t.Errorf("Expected v%d compatible with v%d after upgrade, got v%d compatible with v%d", latest, latestCompat, version, compat)
+	}
+
+	// Old binary, new database with an incompatible upgrade.
+	if _, err = store.DB.Exec("UPDATE crypto_version SET version=$1, compat=$1", latest+1); err != nil {
+		t.Fatalf("Error changing version: %v", err)
+	}
+	err = sql_store_upgrade.Upgrade(store.DB)
+	var schemaErr *sql_store_upgrade.UnsupportedSchemaVersionError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Expected UnsupportedSchemaVersionError, got %v", err)
+	} else if schemaErr.Version != latest+1 || schemaErr.CompatVersion != latest+1 || schemaErr.LatestVersion != latest {
+		t.Errorf("Unexpected versions in error: %+v", schemaErr)
+	} else if !errors.Is(err, sql_store_upgrade.ErrUnsupportedSchemaVersion) || !errors.Is(err, dbutil.ErrUnsupportedDatabaseVersion) {
+		t.Errorf("Expected error to match unsupported schema version errors, got %v", err)
+	}
+	if _, err = sql_store_upgrade.DryRun(store.DB); !errors.As(err, &schemaErr) {
+		t.Errorf("Expected dry run to return UnsupportedSchemaVersionError, got %v", err)
+	}
+
+	// Old binary, new database with an additive upgrade.
+	if _, err = store.DB.Exec("UPDATE crypto_version SET version=$1, compat=$2", latest+1, latest); err != nil {
+		t.Fatalf("Error changing version: %v", err)
+	}
+	if err = sql_store_upgrade.Upgrade(store.DB); err != nil {
+		t.Errorf("Expected compatible newer database to be accepted, got %v", err)
+	}
+	if planned, err := sql_store_upgrade.DryRun(store.DB); err != nil {
+		t.Errorf("Error planning upgrades: %v", err)
+	} else if len(planned) != 0 {
+		t.Errorf("Expected no upgrades for compatible newer database, got %+v", planned)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			store.PutAccount(NewOlmAccount())
+			olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal Olm session: %v", err)
+			}
+			err = store.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal})
+			if err != nil {
+				t.Fatalf("Error storing Olm session: %v", err)
+			}
+
+			err = store.DeleteAccount()
+			if err != nil {
+				t.Fatalf("Error deleting account: %v", err)
+			}
+			if acc, err := store.GetAccount(); err != nil {
+				t.Errorf("Error retrieving account: %v", err)
+			} else if acc != nil {
+				t.Error("Got account after deleting it")
+			}
+			if store.HasSession(olmSessID) {
+				t.Error("Found Olm session after deleting account")
+			}
+		})
+	}
+}
+
+func TestDeleteAccountOnlyDeletesCurrentAccount(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	otherStore := NewSQLCryptoStore(store.DB, nil, "otheraccid", id.DeviceID("otherdev"), []byte("test"))
+	otherAcc := NewOlmAccount()
+	for _, s := range []*SQLCryptoStore{store, otherStore} {
+		if s == store {
+			s.PutAccount(NewOlmAccount())
+		} else {
+			s.PutAccount(otherAcc)
+		}
+		olmInternal, err := olm.SessionFromPickled([]byte(olmPickled), []byte("test"))
+		if err != nil {
+			t.Fatalf("Error creating internal Olm session: %v", err)
+		}
+		err = s.AddSession(olmSessID, &OlmSession{id: olmSessID, Internal: *olmInternal})
+		if err != nil {
+			t.Fatalf("Error storing Olm session: %v", err)
+		}
+	}
+
+	err := store.DeleteAccount()
+	if err != nil {
+		t.Fatalf("Error deleting account: %v", err)
+	}
+	if store.HasSession(olmSessID) {
+		t.Error("Found Olm session of deleted account")
+	}
+
+	// Use a fresh store instance to make sure the data is read from the database instead of the caches
+	otherStore = NewSQLCryptoStore(store.DB, nil, "otheraccid", id.DeviceID("otherdev"), []byte("test"))
+	retrieved, err := otherStore.GetAccount()
+	if err != nil {
+		t.Fatalf("Error retrieving other account: %v", err)
+	} else if retrieved == nil {
+		t.Fatal("Other account was deleted")
+	} else if retrieved.IdentityKey() != otherAcc.IdentityKey() {
+		t.Errorf("Expected other account identity key %v, got %v", otherAcc.IdentityKey(), retrieved.IdentityKey())
+	}
+	if !otherStore.HasSession(olmSessID) {
+		t.Error("Olm session of other account was deleted")
+	}
+}
+
 func TestStoreMegolmSession(t *testing.T) {
 	stores := getCryptoStores(t)
 	for storeName, store := range stores {
@@ -156,6 +519,8 @@ func TestStoreMegolmSession(t *testing.T) {
 				SigningKey: acc.SigningKey(),
 				SenderKey:  acc.IdentityKey(),
 				RoomID:     "room1",
+
+				IsForwarded: true,
 			}
 
 			err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
@@ -171,6 +536,85 @@ func TestStoreMegolmSession(t *testing.T) {
 			if pickled := string(retrieved.Internal.Pickle([]byte("test"))); pickled != groupSession {
 				t.Error("Pickled inbound group session does not match original")
 			}
+			if !retrieved.IsForwarded {
+				t.Error("Inbound group session lost forwarded flag")
+			}
+		})
+	}
+}
+
+func TestStoreInboundSessionInfo(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			acc := NewOlmAccount()
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{
+				Internal:         *internal,
+				SigningKey:       acc.SigningKey(),
+				SenderKey:        acc.IdentityKey(),
+				RoomID:           "room1",
+				ForwardingChains: []string{"forwarder"},
+			}
+
+			info, err := store.GetInboundSessionInfo("room1", igs.ID(), false)
+			if err != nil {
+				t.Errorf("Error getting info of missing session: %v", err)
+			} else if info.Exists {
+				t.Error("Missing session marked as existing")
+			}
+
+			err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs)
+			if err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			info, err = store.GetInboundSessionInfo("room1", igs.ID(), false)
+			if err != nil {
+				t.Fatalf("Error getting session info: %v", err)
+			}
+			if !info.Exists {
+				t.Error("Stored session not marked as existing")
+			}
+			if info.SenderKey != acc.IdentityKey() || info.SigningKey != acc.SigningKey() {
+				t.Error("Session info keys don't match")
+			}
+			if info.FirstKnownIndex != internal.FirstKnownIndex() {
+				t.Errorf("Expected first known index %d, got %d", internal.FirstKnownIndex(), info.FirstKnownIndex)
+			}
+			if len(info.ForwardingChains) != 1 || info.ForwardingChains[0] != "forwarder" {
+				t.Errorf("Unexpected forwarding chains %v", info.ForwardingChains)
+			}
+			if info.SessionKey != "" {
+				t.Error("Session key included without requesting it")
+			}
+
+			info, err = store.GetInboundSessionInfo("room1", igs.ID(), true)
+			if err != nil {
+				t.Errorf("Error getting session info with key: %v", err)
+			} else if info.SessionKey == "" {
+				t.Error("Session key not included after requesting it")
+			}
+
+			err = store.PutWithheldGroupSession(event.RoomKeyWithheldEventContent{
+				RoomID:    "room1",
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: "withheld",
+				SenderKey: acc.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnverified,
+				Reason:    "not verified",
+			})
+			if err != nil {
+				t.Fatalf("Error storing withheld session: %v", err)
+			}
+			info, err = store.GetInboundSessionInfo("room1", "withheld", false)
+			if err != nil {
+				t.Errorf("Error getting withheld session info: %v", err)
+			} else if !info.Exists || info.WithheldCode != event.RoomKeyWithheldUnverified || info.SenderKey != acc.IdentityKey() {
+				t.Errorf("Unexpected withheld session info %+v", info)
+			}
 		})
 	}
 }
@@ -217,6 +661,80 @@ func TestStoreOutboundMegolmSession(t *testing.T) {
 	}
 }
 
+func TestRemoveAllOutboundGroupSessions(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			for _, roomID := range []id.RoomID{"room1", "room2"} {
+				err := store.AddOutboundGroupSession(NewOutboundGroupSession(roomID, nil))
+				if err != nil {
+					t.Fatalf("Error inserting outbound session: %v", err)
+				}
+			}
+
+			count, err := store.RemoveAllOutboundGroupSessions()
+			if err != nil {
+				t.Fatalf("Error removing outbound sessions: %v", err)
+			} else if count != 2 {
+				t.Errorf("Expected 2 sessions to be removed, got %d", count)
+			}
+			for _, roomID := range []id.RoomID{"room1", "room2"} {
+				if sess, err := store.GetOutboundGroupSession(roomID); err != nil {
+					t.Errorf("Error retrieving outbound session: %v", err)
+				} else if sess != nil {
+					t.Errorf("Got outbound session for %s after removing all sessions", roomID)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreOutgoingKeyRequests(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			req := &OutgoingKeyRequest{
+				RequestID: "req1",
+				RoomID:    "room1",
+				SenderKey: olmSessID,
+				SessionID: "session1",
+				Targets:   map[id.UserID][]id.DeviceID{"user1": {"dev1", "dev2"}},
+				CreatedAt: time.Now().UTC().Truncate(time.Second),
+			}
+			err := store.PutOutgoingKeyRequest(req)
+			if err != nil {
+				t.Fatalf("Error storing key request: %v", err)
+			}
+
+			reqs, err := store.GetOutgoingKeyRequests("session2")
+			if err != nil {
+				t.Errorf("Error retrieving key requests: %v", err)
+			} else if len(reqs) != 0 {
+				t.Errorf("Got key requests for wrong session: %+v", reqs)
+			}
+			reqs, err = store.GetOutgoingKeyRequests("session1")
+			if err != nil {
+				t.Fatalf("Error retrieving key requests: %v", err)
+			} else if len(reqs) != 1 {
+				t.Fatalf("Expected 1 key request, got %d", len(reqs))
+			} else if reqs[0].RequestID != req.RequestID || len(reqs[0].Targets["user1"]) != 2 || !reqs[0].CreatedAt.Equal(req.CreatedAt) {
+				t.Errorf("Expected key request %+v, got %+v", req, reqs[0])
+			}
+
+			err = store.DeleteOutgoingKeyRequest(req.RequestID)
+			if err != nil {
+				t.Fatalf("Error deleting key request: %v", err)
+			}
+			reqs, err = store.GetOutgoingKeyRequests("")
+			if err != nil {
+				t.Errorf("Error retrieving key requests: %v", err)
+			} else if len(reqs) != 0 {
+				t.Errorf("Got key requests after deleting: %+v", reqs)
+			}
+		})
+	}
+}
+
 func TestStoreDevices(t *testing.T) {
 	stores := getCryptoStores(t)
 	for storeName, store := range stores {
@@ -259,3 +777,475 @@ func TestStoreDevices(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreOutdatedTrackedUsers(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			for _, userID := range []id.UserID{"user1", "user2"} {
+				if err := store.PutDevices(userID, map[id.DeviceID]*id.Device{}); err != nil {
+					t.Fatalf("Error storing devices: %v", err)
+				}
+			}
+			if err := store.MarkTrackedUsersOutdated([]id.UserID{"user1", "user3"}); err != nil {
+				t.Fatalf("Error marking users outdated: %v", err)
+			}
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil {
+				t.Errorf("Error getting outdated users: %v", err)
+			} else if len(outdated) != 1 || outdated[0] != "user1" {
+				t.Errorf("Expected only 'user1' to be outdated, got %v", outdated)
+			}
+			if err := store.PutDevices("user1", map[id.DeviceID]*id.Device{}); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			if outdated, err := store.GetOutdatedTrackedUsers(); err != nil {
+				t.Errorf("Error getting outdated users: %v", err)
+			} else if len(outdated) != 0 {
+				t.Errorf("Expected no outdated users after storing devices, got %v", outdated)
+			}
+		})
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			acc := NewOlmAccount()
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{
+				Internal:   *internal,
+				SigningKey: acc.SigningKey(),
+				SenderKey:  acc.IdentityKey(),
+				RoomID:     "room1",
+			}
+			if err = store.PutGroupSession("room1", acc.IdentityKey(), igs.ID(), igs); err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			err = store.PutWithheldGroupSession(event.RoomKeyWithheldEventContent{
+				RoomID:    "room1",
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: "withheld",
+				SenderKey: acc.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnavailable,
+			})
+			if err != nil {
+				t.Fatalf("Error storing withheld group session: %v", err)
+			}
+			if err = store.PutDevices("user1", map[id.DeviceID]*id.Device{
+				"dev1": {UserID: "user1", DeviceID: "dev1", IdentityKey: acc.IdentityKey(), SigningKey: acc.SigningKey()},
+				"dev2": {UserID: "user1", DeviceID: "dev2", IdentityKey: acc.IdentityKey(), SigningKey: acc.SigningKey()},
+			}); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			if err = store.PutDevices("user2", map[id.DeviceID]*id.Device{}); err != nil {
+				t.Fatalf("Error storing devices: %v", err)
+			}
+			if _, err = store.ValidateMessageIndex(context.TODO(), acc.IdentityKey(), igs.ID(), "$event", 0, 1000); err != nil {
+				t.Fatalf("Error validating message index: %v", err)
+			}
+
+			stats, err := store.Stats()
+			if err != nil {
+				t.Fatalf("Error getting store stats: %v", err)
+			}
+			if stats.InboundGroupSessions != 1 || stats.WithheldGroupSessions != 1 {
+				t.Errorf("Expected 1 inbound and 1 withheld group session, got %d and %d", stats.InboundGroupSessions, stats.WithheldGroupSessions)
+			}
+			if stats.Devices != 2 || stats.TrackedUsers != 2 {
+				t.Errorf("Expected 2 devices and 2 tracked users, got %d and %d", stats.Devices, stats.TrackedUsers)
+			}
+			if stats.MessageIndices != 1 {
+				t.Errorf("Expected 1 message index, got %d", stats.MessageIndices)
+			}
+			if stats.OlmSessions != 0 || stats.OutboundGroupSessions != 0 {
+				t.Errorf("Expected no olm or outbound group sessions, got %d and %d", stats.OlmSessions, stats.OutboundGroupSessions)
+			}
+			if storeName == "sql" && stats.InboundGroupSessionBytes == 0 {
+				t.Error("Expected inbound group session size to be counted")
+			}
+		})
+	}
+}
+
+func TestSQLStoreDevicesPerAccount(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	otherStore := NewSQLCryptoStore(store.DB, nil, "otheraccid", id.DeviceID("otherdev"), []byte("test"))
+	acc := NewOlmAccount()
+	device := &id.Device{
+		UserID:      "user1",
+		DeviceID:    "dev1",
+		IdentityKey: acc.IdentityKey(),
+		SigningKey:  acc.SigningKey(),
+		Trust:       id.TrustStateVerified,
+	}
+	if err := store.PutDevices("user1", map[id.DeviceID]*id.Device{"dev1": device}); err != nil {
+		t.Fatalf("Error storing devices: %v", err)
+	}
+
+	if filtered, err := otherStore.FilterTrackedUsers([]id.UserID{"user1"}); err != nil {
+		t.Errorf("Error filtering tracked users: %v", err)
+	} else if len(filtered) != 0 {
+		t.Errorf("Expected user1 not to be tracked by other account, got %v", filtered)
+	}
+	if devs, err := otherStore.GetDevices("user1"); err != nil {
+		t.Errorf("Error getting devices: %v", err)
+	} else if devs != nil {
+		t.Errorf("Expected no devices for other account, got %v", devs)
+	}
+
+	otherDevice := *device
+	otherDevice.Trust = id.TrustStateBlacklisted
+	if err := otherStore.PutDevices("user1", map[id.DeviceID]*id.Device{"dev1": &otherDevice}); err != nil {
+		t.Fatalf("Error storing devices for other account: %v", err)
+	}
+	if err := otherStore.PutDevice("user1", &id.Device{UserID: "user1", DeviceID: "dev2", IdentityKey: "key2", SigningKey: "key2"}); err != nil {
+		t.Fatalf("Error storing device for other account: %v", err)
+	}
+	if dev, err := store.GetDevice("user1", "dev1"); err != nil {
+		t.Errorf("Error getting device: %v", err)
+	} else if dev == nil || dev.Trust != id.TrustStateVerified {
+		t.Errorf("Expected device trust to stay verified, got %+v", dev)
+	}
+	if dev, err := store.FindDeviceByKey("user1", acc.IdentityKey()); err != nil {
+		t.Errorf("Error finding device: %v", err)
+	} else if dev == nil || dev.Trust != id.TrustStateVerified {
+		t.Errorf("Expected device trust to stay verified, got %+v", dev)
+	}
+	if devs, err := store.GetDevices("user1"); err != nil {
+		t.Errorf("Error getting devices: %v", err)
+	} else if len(devs) != 1 {
+		t.Errorf("Expected only one device for first account, got %v", devs)
+	}
+	if dev, err := otherStore.GetDevice("user1", "dev1"); err != nil {
+		t.Errorf("Error getting device: %v", err)
+	} else if dev == nil || dev.Trust != id.TrustStateBlacklisted {
+		t.Errorf("Expected device to be blacklisted for other account, got %+v", dev)
+	}
+}
+
+func TestSQLStoreDeviceAccountMigration(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	store.PutAccount(NewOlmAccount())
+	otherStore := NewSQLCryptoStore(store.DB, nil, "otheraccid", id.DeviceID("otherdev"), []byte("test"))
+	otherStore.PutAccount(NewOlmAccount())
+
+	// Recreate the v17 versions of the tables with some data and re-run the upgrade
+	for _, query := range []string{
+		"DROP TABLE crypto_tracked_user",
+		"DROP TABLE crypto_device",
+		"CREATE TABLE crypto_tracked_user (user_id TEXT PRIMARY KEY)",
+		`CREATE TABLE crypto_device (
+			user_id TEXT, device_id TEXT, identity_key CHAR(43) NOT NULL, signing_key CHAR(43) NOT NULL,
+			trust SMALLINT NOT NULL, deleted BOOLEAN NOT NULL, name TEXT NOT NULL, PRIMARY KEY (user_id, device_id)
+		)`,
+		"INSERT INTO crypto_tracked_user (user_id) VALUES ('user1')",
+		"INSERT INTO crypto_device (user_id, device_id, identity_key, signing_key, trust, deleted, name) VALUES ('user1', 'dev1', 'key', 'key', 300, false, 'Device')",
+		"UPDATE crypto_version SET version=17",
+	} {
+		if _, err := store.DB.Exec(query); err != nil {
+			t.Fatalf("Error preparing old schema: %v", err)
+		}
+	}
+	if err := store.DB.Upgrade(); err != nil {
+		t.Fatalf("Error upgrading: %v", err)
+	}
+
+	for _, s := range []*SQLCryptoStore{store, otherStore} {
+		if filtered, err := s.FilterTrackedUsers([]id.UserID{"user1"}); err != nil {
+			t.Errorf("Error filtering tracked users: %v", err)
+		} else if len(filtered) != 1 {
+			t.Errorf("Expected user1 to be tracked by %s after upgrade, got %v", s.AccountID, filtered)
+		}
+		if dev, err := s.GetDevice("user1", "dev1"); err != nil {
+			t.Errorf("Error getting device: %v", err)
+		} else if dev == nil || dev.Trust != id.TrustStateVerified || dev.Name != "Device" {
+			t.Errorf("Expected device to be preserved for %s after upgrade, got %+v", s.AccountID, dev)
+		}
+	}
+}
+
+func TestStoreSecrets(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			secret, err := store.GetSecret(id.SecretMegolmBackupV1)
+			if err != nil {
+				t.Errorf("Error retrieving missing secret: %v", err)
+			} else if secret != "" {
+				t.Errorf("Got secret before storing it: %s", secret)
+			}
+
+			err = store.PutSecret(id.SecretMegolmBackupV1, "supersecret")
+			if err != nil {
+				t.Fatalf("Error storing secret: %v", err)
+			}
+			secret, err = store.GetSecret(id.SecretMegolmBackupV1)
+			if err != nil {
+				t.Errorf("Error retrieving secret: %v", err)
+			} else if secret != "supersecret" {
+				t.Errorf("Expected secret supersecret, got %s", secret)
+			}
+
+			if sqlStore, ok := store.(*SQLCryptoStore); ok {
+				var raw string
+				err = sqlStore.DB.QueryRow("SELECT secret FROM crypto_secrets WHERE name=$1", id.SecretMegolmBackupV1).Scan(&raw)
+				if err != nil {
+					t.Errorf("Error retrieving raw secret: %v", err)
+				} else if strings.Contains(raw, "supersecret") {
+					t.Errorf("Secret was stored in plaintext: %s", raw)
+				}
+			}
+
+			err = store.DeleteSecret(id.SecretMegolmBackupV1)
+			if err != nil {
+				t.Fatalf("Error deleting secret: %v", err)
+			}
+			secret, err = store.GetSecret(id.SecretMegolmBackupV1)
+			if err != nil {
+				t.Errorf("Error retrieving deleted secret: %v", err)
+			} else if secret != "" {
+				t.Errorf("Got secret after deleting it: %s", secret)
+			}
+		})
+	}
+}
+
+func newTestOlmSession(t *testing.T, lastUsed time.Time) *OlmSession {
+	acc, otherAcc := NewOlmAccount(), NewOlmAccount()
+	var otk id.Curve25519
+	for _, key := range otherAcc.getOneTimeKeys("@user:example.com", "dev", 0, 1) {
+		otk = key.Key
+	}
+	session, err := acc.Internal.NewOutboundSession(otherAcc.IdentityKey(), otk)
+	if err != nil {
+		t.Fatalf("Error creating Olm session: %v", err)
+	}
+	wrapped := wrapSession(session)
+	wrapped.CreationTime = lastUsed
+	wrapped.LastEncryptedTime = lastUsed
+	wrapped.LastDecryptedTime = lastUsed
+	return wrapped
+}
+
+func TestSQLStoreOlmSessionLimit(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	store.MaxOlmSessionsPerKey = 3
+	var sessions []*OlmSession
+	for i := 0; i < 5; i++ {
+		sessions = append(sessions, newTestOlmSession(t, time.Now().Add(time.Duration(i-10)*time.Hour)))
+	}
+	// The newest session is added first, so it should be kept regardless of the last used timestamp
+	sessions[0], sessions[4] = sessions[4], sessions[0]
+	for _, sess := range sessions {
+		if err := store.AddSession(olmSessID, sess); err != nil {
+			t.Fatalf("Error storing Olm session: %v", err)
+		}
+	}
+	sessionIDs := func() map[id.SessionID]bool {
+		var count int
+		err := store.DB.QueryRow("SELECT COUNT(*) FROM crypto_olm_session WHERE sender_key=$1", olmSessID).Scan(&count)
+		if err != nil {
+			t.Fatalf("Error counting Olm sessions: %v", err)
+		}
+		list, err := store.GetSessions(olmSessID)
+		if err != nil {
+			t.Fatalf("Error getting Olm sessions: %v", err)
+		} else if len(list) != count {
+			t.Errorf("Expected %d sessions from GetSessions, got %d", count, len(list))
+		}
+		ids := make(map[id.SessionID]bool)
+		for _, sess := range list {
+			ids[sess.ID()] = true
+		}
+		return ids
+	}
+	ids := sessionIDs()
+	if len(ids) != 3 {
+		t.Fatalf("Expected 3 sessions to be kept, got %d", len(ids))
+	}
+	// The last added session and the two most recently used earlier ones should be kept
+	for _, i := range []int{4, 3, 0} {
+		if !ids[sessions[i].ID()] {
+			t.Errorf("Expected session %d to be kept", i)
+		}
+	}
+	if len(store.olmSessionCache[olmSessID]) != 3 {
+		t.Errorf("Expected deleted sessions to be removed from the cache, got %d cached", len(store.olmSessionCache[olmSessID]))
+	}
+
+	store.MaxOlmSessionsPerKey = 0
+	if err := store.AddSession(olmSessID, newTestOlmSession(t, time.Now())); err != nil {
+		t.Fatalf("Error storing Olm session: %v", err)
+	} else if len(sessionIDs()) != 4 {
+		t.Error("Sessions were deleted even though the limit was disabled")
+	}
+}
+
+func TestSQLStorePruneOlmSessions(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	store.MaxOlmSessionsPerKey = 0
+	oldLatest := newTestOlmSession(t, time.Now().Add(-48*time.Hour))
+	oldest := newTestOlmSession(t, time.Now().Add(-72*time.Hour))
+	recent := newTestOlmSession(t, time.Now())
+	stale := newTestOlmSession(t, time.Now().Add(-48*time.Hour))
+	for key, sessions := range map[id.SenderKey][]*OlmSession{"key1": {oldLatest, oldest}, "key2": {recent, stale}} {
+		for _, sess := range sessions {
+			if err := store.AddSession(key, sess); err != nil {
+				t.Fatalf("Error storing Olm session: %v", err)
+			}
+		}
+	}
+
+	count, err := store.PruneOlmSessions(24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Error pruning Olm sessions: %v", err)
+	} else if count != 2 {
+		t.Errorf("Expected 2 sessions to be pruned, got %d", count)
+	}
+	if latest, err := store.GetLatestSession("key1"); err != nil || latest == nil || latest.ID() != oldLatest.ID() {
+		t.Errorf("Expected the latest session of key1 to be kept, got %v (err: %v)", latest, err)
+	}
+	if list, err := store.GetSessions("key2"); err != nil || len(list) != 1 || list[0].ID() != recent.ID() {
+		t.Errorf("Expected only the recent session of key2 to be kept, got %v (err: %v)", list, err)
+	}
+
+	// A session that was pruned while it was in use is inserted again when it's updated
+	if err = store.UpdateSession("key2", stale); err != nil {
+		t.Fatalf("Error updating pruned session: %v", err)
+	} else if list, err := store.GetSessions("key2"); err != nil || len(list) != 2 {
+		t.Errorf("Expected pruned session to be inserted again, got %v (err: %v)", list, err)
+	}
+}
+
+// getSQLTestStores returns an SQLite store and, if MAUTRIX_TEST_POSTGRES is set to a connection string, a Postgres store.
+func getSQLTestStores(t *testing.T) map[string]*SQLCryptoStore {
+	stores := map[string]*SQLCryptoStore{
+		"sqlite": getCryptoStores(t)["sql"].(*SQLCryptoStore),
+	}
+	if uri := os.Getenv("MAUTRIX_TEST_POSTGRES"); uri != "" {
+		db, err := dbutil.NewWithDialect(uri, "postgres")
+		if err != nil {
+			t.Fatalf("Error opening postgres db: %v", err)
+		}
+		accountID := "test-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		store := NewSQLCryptoStore(db, nil, accountID, id.DeviceID("dev"), []byte("test"))
+		if err = store.DB.Upgrade(); err != nil {
+			t.Fatalf("Error creating tables: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = store.DeleteAccount()
+			_ = db.RawDB.Close()
+		})
+		stores["postgres"] = store
+	}
+	return stores
+}
+
+func TestSQLStoreTimestampRoundTrip(t *testing.T) {
+	plus3 := time.FixedZone("UTC+3", 3*60*60)
+	// Later in real time, but earlier in wall clock time
+	newer := time.Date(2023, 6, 1, 10, 0, 0, 123000000, time.UTC)
+	older := time.Date(2023, 6, 1, 12, 0, 0, 0, plus3)
+	for name, store := range getSQLTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			olderSess, newerSess := newTestOlmSession(t, older), newTestOlmSession(t, newer)
+			for _, sess := range []*OlmSession{newerSess, olderSess} {
+				if err := store.AddSession("senderkey", sess); err != nil {
+					t.Fatalf("Error storing Olm session: %v", err)
+				}
+			}
+			// Use a fresh store instance to make sure the data is read from the database instead of the caches
+			freshStore := NewSQLCryptoStore(store.DB, nil, store.AccountID, id.DeviceID("dev"), []byte("test"))
+			latest, err := freshStore.GetLatestSession("senderkey")
+			if err != nil {
+				t.Fatalf("Error getting latest session: %v", err)
+			} else if latest == nil || latest.ID() != newerSess.ID() {
+				t.Errorf("Expected latest session to be %s, got %+v", newerSess.ID(), latest)
+			} else if !latest.LastDecryptedTime.Equal(newer) || !latest.CreationTime.Equal(newer) {
+				t.Errorf("Expected timestamps to be %v, got %v/%v", newer, latest.CreationTime, latest.LastDecryptedTime)
+			}
+
+			req := &OutgoingKeyRequest{RequestID: "req1", RoomID: "!room:example.com", SenderKey: "senderkey", SessionID: "session", CreatedAt: older}
+			if err = store.PutOutgoingKeyRequest(req); err != nil {
+				t.Fatalf("Error storing key request: %v", err)
+			}
+			if reqs, err := store.GetOutgoingKeyRequests("session"); err != nil {
+				t.Errorf("Error getting key requests: %v", err)
+			} else if len(reqs) != 1 || !reqs[0].CreatedAt.Equal(older) {
+				t.Errorf("Expected key request created at %v, got %+v", older, reqs)
+			}
+
+			internal, err := olm.InboundGroupSessionFromPickled([]byte(groupSession), []byte("test"))
+			if err != nil {
+				t.Fatalf("Error creating internal inbound group session: %v", err)
+			}
+			igs := &InboundGroupSession{
+				Internal:   *internal,
+				SenderKey:  "senderkey",
+				RoomID:     "!room:example.com",
+				ReceivedAt: time.Now().Add(-2 * time.Hour),
+				MaxAge:     (30 * time.Minute).Milliseconds(),
+			}
+			if err = store.PutGroupSession(igs.RoomID, igs.SenderKey, igs.ID(), igs); err != nil {
+				t.Fatalf("Error storing inbound group session: %v", err)
+			}
+			if redacted, err := store.RedactExpiredGroupSessions(); err != nil {
+				t.Errorf("Error redacting expired sessions: %v", err)
+			} else if len(redacted) != 1 || redacted[0] != igs.ID() {
+				t.Errorf("Expected expired session %s to be redacted, got %v", igs.ID(), redacted)
+			}
+		})
+	}
+}
+
+func TestSQLStoreTimestampMigration(t *testing.T) {
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	// Recreate the v18 version of the Olm session table with timestamps written by the SQLite driver and re-run the upgrade
+	for _, query := range []string{
+		"DROP TABLE crypto_olm_session",
+		`CREATE TABLE crypto_olm_session (
+			account_id TEXT, session_id CHAR(43), sender_key CHAR(43) NOT NULL, session bytea NOT NULL,
+			created_at timestamp NOT NULL, last_decrypted timestamp NOT NULL, last_encrypted timestamp NOT NULL,
+			used_fallback_key BOOLEAN NOT NULL DEFAULT false, PRIMARY KEY (account_id, session_id)
+		)`,
+		"ALTER TABLE crypto_tracked_user DROP COLUMN devices_outdated",
+		"UPDATE crypto_version SET version=18",
+	} {
+		if _, err := store.DB.Exec(query); err != nil {
+			t.Fatalf("Error preparing old schema: %v", err)
+		}
+	}
+	const insertOldSession = `
+		INSERT INTO crypto_olm_session (account_id, session_id, sender_key, session, created_at, last_decrypted, last_encrypted)
+		VALUES ('accid', $1, 'senderkey', $2, $3, $3, $3)
+	`
+	// The older session sorts first as a string, but is actually earlier
+	for sessionID, timestamp := range map[string]string{
+		"older": "2023-06-01 12:00:00+03:00",
+		"newer": "2023-06-01 10:00:00.5+00:00",
+	} {
+		if _, err := store.DB.Exec(insertOldSession, sessionID, []byte(olmPickled), timestamp); err != nil {
+			t.Fatalf("Error inserting old session: %v", err)
+		}
+	}
+	if err := store.DB.Upgrade(); err != nil {
+		t.Fatalf("Error upgrading: %v", err)
+	}
+	latest, err := store.GetLatestSession("senderkey")
+	expected := time.Date(2023, 6, 1, 10, 0, 0, 500000000, time.UTC)
+	if err != nil {
+		t.Fatalf("Error getting latest session: %v", err)
+	} else if latest == nil || !latest.LastDecryptedTime.Equal(expected) {
+		t.Errorf("Expected latest session to be last used at %v, got %+v", expected, latest)
+	}
+	sessions, err := store.GetSessions("senderkey")
+	if err != nil {
+		t.Fatalf("Error getting sessions: %v", err)
+	} else if len(sessions) != 2 || !sessions[1].LastDecryptedTime.Equal(time.Date(2023, 6, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected two sessions with the older one converted to UTC, got %+v", sessions)
+	}
+}
@@ -114,6 +114,7 @@ type verificationState struct {
 	hooks               VerificationHooks
 	extendTimeout       context.CancelFunc
 	inRoomID            id.RoomID
+	createdAt           time.Time
 	lock                sync.Mutex
 }
 
@@ -210,6 +211,7 @@ func (mach *OlmMachine) actuallyStartVerification(ctx context.Context, userID id
 			keyReceived:         false,
 			sasMatched:          make(chan bool, 1),
 			hooks:               hooks,
+			createdAt:           time.Now(),
 			chosenSASMethod:     sasMethods[0],
 			inRoomID:            inRoomID,
 		}
@@ -286,6 +288,51 @@ func (mach *OlmMachine) timeoutAfter(ctx context.Context, verState *verification
 	}()
 }
 
+const verificationExpiryCheckInterval = 1 * time.Minute
+
+func (mach *OlmMachine) cancelExpiredVerificationsIfNeeded() {
+	mach.expiryCheckLock.Lock()
+	defer mach.expiryCheckLock.Unlock()
+	if time.Since(mach.lastVerificationExpiryCheck) <= verificationExpiryCheckInterval {
+		return
+	}
+	mach.lastVerificationExpiryCheck = time.Now()
+	go mach.CancelExpiredVerifications(context.TODO())
+}
+
+// CancelExpiredVerifications cancels all verification transactions that were started more than VerificationTimeout ago,
+// regardless of whether messages are still being exchanged. It returns the number of transactions that were cancelled.
+//
+// This is called automatically by ProcessSyncResponse, so it only needs to be called manually if the sync loop isn't used.
+func (mach *OlmMachine) CancelExpiredVerifications(ctx context.Context) int {
+	if mach.VerificationTimeout <= 0 {
+		return 0
+	}
+	cancelled := 0
+	mach.keyVerificationTransactionState.Range(func(key, value any) bool {
+		verState := value.(*verificationState)
+		if time.Since(verState.createdAt) < mach.VerificationTimeout {
+			return true
+		}
+		verState.lock.Lock()
+		defer verState.lock.Unlock()
+		if _, ok := mach.keyVerificationTransactionState.LoadAndDelete(key); !ok {
+			// The transaction was finished or cancelled while waiting for the lock
+			return true
+		}
+		transactionID := strings.TrimPrefix(key.(string), verState.otherDevice.UserID.String()+":")
+		err := mach.callbackAndCancelSASVerification(ctx, verState, transactionID, "Timed out", event.VerificationCancelByTimeout)
+		if err != nil {
+			mach.Log.Warn().Err(err).Str("transaction_id", transactionID).Msg("Failed to send cancellation for expired verification transaction")
+		} else {
+			mach.Log.Debug().Str("transaction_id", transactionID).Msg("Cancelled expired verification transaction")
+		}
+		cancelled++
+		return true
+	})
+	return cancelled
+}
+
 // handleVerificationAccept handles an incoming m.key.verification.accept message.
 // It continues the SAS verification process by sending the SAS key message to the other device.
 func (mach *OlmMachine) handleVerificationAccept(ctx context.Context, userID id.UserID, content *event.VerificationAcceptEventContent, transactionID string) {
@@ -442,6 +489,12 @@ func (mach *OlmMachine) sasCompared(ctx context.Context, didMatch bool, transact
 		}
 	} else {
 		verState.sasMatched <- false
+		// If the MAC was already received, the MAC handler will cancel the verification once it reads the result.
+		// Otherwise, cancel it right away instead of waiting for a MAC that might never come.
+		if _, ok := mach.keyVerificationTransactionState.LoadAndDelete(verState.otherDevice.UserID.String() + ":" + transactionID); ok {
+			mach.Log.Warn().Msgf("SAS do not match! Canceling transaction %v", transactionID)
+			_ = mach.callbackAndCancelSASVerification(ctx, verState, transactionID, "SAS do not match", event.VerificationCancelSASMismatch)
+		}
 	}
 }
 
@@ -627,6 +680,7 @@ func (mach *OlmMachine) NewSASVerificationWith(ctx context.Context, device *id.D
 		keyReceived:         false,
 		sasMatched:          make(chan bool, 1),
 		hooks:               hooks,
+		createdAt:           time.Now(),
 	}
 	verState.lock.Lock()
 	defer verState.lock.Unlock()
@@ -735,6 +789,9 @@ func (mach *OlmMachine) SendSASVerificationAccept(ctx context.Context, fromUser
 
 func (mach *OlmMachine) callbackAndCancelSASVerification(ctx context.Context, verState *verificationState, transactionID, reason string, code event.VerificationCancelCode) error {
 	go verState.hooks.OnCancel(true, reason, code)
+	if verState.inRoomID != "" {
+		return mach.SendInRoomSASVerificationCancel(ctx, verState.inRoomID, verState.otherDevice.UserID, transactionID, reason, code)
+	}
 	return mach.SendSASVerificationCancel(ctx, verState.otherDevice.UserID, verState.otherDevice.DeviceID, transactionID, reason, code)
 }
 
@@ -281,6 +281,7 @@ func (mach *OlmMachine) newInRoomSASVerificationWithInner(ctx context.Context, i
 		sasMatched:          make(chan bool, 1),
 		hooks:               hooks,
 		inRoomID:            inRoomID,
+		createdAt:           time.Now(),
 	}
 	verState.lock.Lock()
 	defer verState.lock.Unlock()
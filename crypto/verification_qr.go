@@ -0,0 +1,242 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidQRCodeHeader      = errors.New("invalid QR code: missing MATRIX header")
+	ErrUnsupportedQRCodeVersion = errors.New("unsupported QR code version")
+	ErrInvalidQRCodeMode        = errors.New("invalid QR code mode")
+	ErrQRCodeTooShort           = errors.New("invalid QR code: data too short")
+	ErrQRCodeSecretTooShort     = errors.New("invalid QR code: shared secret too short")
+	ErrQRCodeKeyMismatch        = errors.New("keys in QR code don't match known keys")
+	ErrMissingCrossSigningKeys  = errors.New("cross-signing public keys not found")
+)
+
+// QRCodeMode is the mode byte of a QR code used for verification.
+type QRCodeMode byte
+
+const (
+	// QRCodeModeCrossSigning is used for verifying other users.
+	// The first key is the displaying user's master key and the second key is what they think the scanning user's master key is.
+	QRCodeModeCrossSigning QRCodeMode = 0x00
+	// QRCodeModeSelfVerifyingMasterKeyTrusted is used when verifying own devices if the displaying device trusts the master key.
+	// The first key is the master key and the second key is what the displaying device thinks the scanning device's key is.
+	QRCodeModeSelfVerifyingMasterKeyTrusted QRCodeMode = 0x01
+	// QRCodeModeSelfVerifyingMasterKeyUntrusted is used when verifying own devices if the displaying device doesn't trust the master key.
+	// The first key is the displaying device's key and the second key is what it thinks the master key is.
+	QRCodeModeSelfVerifyingMasterKeyUntrusted QRCodeMode = 0x02
+)
+
+const qrCodeHeader = "MATRIX"
+const qrCodeVersion = 0x02
+const qrCodeSharedSecretLength = 16
+
+// qrCodeMinSharedSecretLength is the minimum length of the shared secret required by the spec.
+const qrCodeMinSharedSecretLength = 8
+
+// QRCode contains the data in a QR code used for verification as specified in
+// https://spec.matrix.org/v1.8/client-server-api/#qr-code-format
+type QRCode struct {
+	Mode          QRCodeMode
+	TransactionID string
+	FirstKey      id.Ed25519
+	SecondKey     id.Ed25519
+	SharedSecret  []byte
+}
+
+// Bytes encodes the QR code data into the binary format that should be rendered as a QR code.
+func (qr *QRCode) Bytes() ([]byte, error) {
+	firstKey, err := base64.RawStdEncoding.DecodeString(qr.FirstKey.String())
+	if err != nil || len(firstKey) != 32 {
+		return nil, fmt.Errorf("invalid first key %q", qr.FirstKey)
+	}
+	secondKey, err := base64.RawStdEncoding.DecodeString(qr.SecondKey.String())
+	if err != nil || len(secondKey) != 32 {
+		return nil, fmt.Errorf("invalid second key %q", qr.SecondKey)
+	}
+	if len(qr.SharedSecret) < qrCodeMinSharedSecretLength {
+		return nil, ErrQRCodeSecretTooShort
+	}
+	var buf bytes.Buffer
+	buf.WriteString(qrCodeHeader)
+	buf.WriteByte(qrCodeVersion)
+	buf.WriteByte(byte(qr.Mode))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(qr.TransactionID)))
+	buf.WriteString(qr.TransactionID)
+	buf.Write(firstKey)
+	buf.Write(secondKey)
+	buf.Write(qr.SharedSecret)
+	return buf.Bytes(), nil
+}
+
+// ParseQRCode parses the binary data of a scanned verification QR code.
+func ParseQRCode(data []byte) (*QRCode, error) {
+	if !bytes.HasPrefix(data, []byte(qrCodeHeader)) {
+		return nil, ErrInvalidQRCodeHeader
+	}
+	data = data[len(qrCodeHeader):]
+	if len(data) < 4 {
+		return nil, ErrQRCodeTooShort
+	} else if data[0] != qrCodeVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedQRCodeVersion, data[0])
+	}
+	qr := &QRCode{Mode: QRCodeMode(data[1])}
+	if qr.Mode > QRCodeModeSelfVerifyingMasterKeyUntrusted {
+		return nil, fmt.Errorf("%w %d", ErrInvalidQRCodeMode, data[1])
+	}
+	txnIDLength := int(binary.BigEndian.Uint16(data[2:4]))
+	data = data[4:]
+	if len(data) < txnIDLength+32+32 {
+		return nil, ErrQRCodeTooShort
+	}
+	qr.TransactionID = string(data[:txnIDLength])
+	data = data[txnIDLength:]
+	qr.FirstKey = id.Ed25519(base64.RawStdEncoding.EncodeToString(data[:32]))
+	qr.SecondKey = id.Ed25519(base64.RawStdEncoding.EncodeToString(data[32:64]))
+	qr.SharedSecret = data[64:]
+	if len(qr.SharedSecret) < qrCodeMinSharedSecretLength {
+		return nil, ErrQRCodeSecretTooShort
+	}
+	return qr, nil
+}
+
+func (mach *OlmMachine) getMasterKey(ctx context.Context, userID id.UserID) (id.Ed25519, error) {
+	var keys *CrossSigningPublicKeysCache
+	var err error
+	if userID == mach.Client.UserID {
+		keys = mach.GetOwnCrossSigningPublicKeys(ctx)
+	} else {
+		keys, err = mach.GetCrossSigningPublicKeys(ctx, userID)
+	}
+	if err != nil {
+		return "", err
+	} else if keys == nil || keys.MasterKey == "" {
+		return "", ErrMissingCrossSigningKeys
+	}
+	return keys.MasterKey, nil
+}
+
+// NewQRCode generates a QR code that this device can display for verification with the given device.
+//
+// The mode is chosen automatically: other users are verified with their master key, while own devices are
+// verified in one of the self-verification modes depending on whether the cross-signing private keys are cached.
+func (mach *OlmMachine) NewQRCode(ctx context.Context, otherDevice *id.Device, transactionID string) (*QRCode, error) {
+	ownMasterKey, err := mach.getMasterKey(ctx, mach.Client.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get own master key: %w", err)
+	}
+	qr := &QRCode{
+		TransactionID: transactionID,
+		SharedSecret:  make([]byte, qrCodeSharedSecretLength),
+	}
+	if _, err = rand.Read(qr.SharedSecret); err != nil {
+		return nil, fmt.Errorf("failed to generate shared secret: %w", err)
+	}
+	if otherDevice.UserID != mach.Client.UserID {
+		qr.Mode = QRCodeModeCrossSigning
+		qr.FirstKey = ownMasterKey
+		qr.SecondKey, err = mach.getMasterKey(ctx, otherDevice.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get master key of %s: %w", otherDevice.UserID, err)
+		}
+	} else if mach.CrossSigningKeys != nil {
+		qr.Mode = QRCodeModeSelfVerifyingMasterKeyTrusted
+		qr.FirstKey = ownMasterKey
+		qr.SecondKey = otherDevice.SigningKey
+	} else {
+		qr.Mode = QRCodeModeSelfVerifyingMasterKeyUntrusted
+		qr.FirstKey = mach.account.SigningKey()
+		qr.SecondKey = ownMasterKey
+	}
+	return qr, nil
+}
+
+// VerifyScannedQRCode checks that the keys in a QR code scanned from the given device match the keys in the store,
+// then cross-signs the device (or its owner) if the cross-signing keys are cached. The device itself is only marked
+// as verified in QRCodeModeSelfVerifyingMasterKeyUntrusted, as the other modes don't contain the device key.
+//
+// After a successful verification, the caller should send a m.reciprocate.v1 verification start event
+// containing the shared secret from the QR code to the other device.
+func (mach *OlmMachine) VerifyScannedQRCode(ctx context.Context, qr *QRCode, otherDevice *id.Device) error {
+	log := mach.machOrContextLog(ctx).With().
+		Str("user_id", otherDevice.UserID.String()).
+		Str("device_id", otherDevice.DeviceID.String()).
+		Str("transaction_id", qr.TransactionID).
+		Logger()
+	ownMasterKey, err := mach.getMasterKey(ctx, mach.Client.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get own master key: %w", err)
+	}
+	var theirMasterKey id.Ed25519
+	switch qr.Mode {
+	case QRCodeModeCrossSigning:
+		if otherDevice.UserID == mach.Client.UserID {
+			return fmt.Errorf("%w: cross-signing mode used for own device", ErrInvalidQRCodeMode)
+		}
+		theirMasterKey, err = mach.getMasterKey(ctx, otherDevice.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get master key of %s: %w", otherDevice.UserID, err)
+		} else if qr.FirstKey != theirMasterKey || qr.SecondKey != ownMasterKey {
+			return ErrQRCodeKeyMismatch
+		}
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		if otherDevice.UserID != mach.Client.UserID {
+			return fmt.Errorf("%w: self-verification mode used for other user", ErrInvalidQRCodeMode)
+		} else if qr.FirstKey != ownMasterKey || qr.SecondKey != mach.account.SigningKey() {
+			return ErrQRCodeKeyMismatch
+		}
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		if otherDevice.UserID != mach.Client.UserID {
+			return fmt.Errorf("%w: self-verification mode used for other user", ErrInvalidQRCodeMode)
+		} else if qr.FirstKey != otherDevice.SigningKey || qr.SecondKey != ownMasterKey {
+			return ErrQRCodeKeyMismatch
+		}
+	default:
+		return fmt.Errorf("%w %d", ErrInvalidQRCodeMode, qr.Mode)
+	}
+
+	// Only the self-verifying mode with an untrusted master key contains the key of the other device,
+	// the other modes only verify master keys, so they rely on cross-signing for trust.
+	if qr.Mode == QRCodeModeSelfVerifyingMasterKeyUntrusted {
+		otherDevice.Trust = id.TrustStateVerified
+		err = mach.CryptoStore.PutDevice(otherDevice.UserID, otherDevice)
+		if err != nil {
+			return fmt.Errorf("failed to store device trust: %w", err)
+		}
+		log.Debug().Msg("Marked device as verified after QR code verification")
+	}
+
+	if mach.CrossSigningKeys == nil {
+		log.Debug().Msg("Cross-signing keys not cached, not cross-signing after QR code verification")
+		return nil
+	}
+	switch qr.Mode {
+	case QRCodeModeCrossSigning:
+		err = mach.SignUser(ctx, otherDevice.UserID, theirMasterKey)
+	case QRCodeModeSelfVerifyingMasterKeyTrusted:
+		err = mach.SignOwnMasterKey(ctx)
+	case QRCodeModeSelfVerifyingMasterKeyUntrusted:
+		err = mach.SignOwnDevice(ctx, otherDevice)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign after QR code verification: %w", err)
+	}
+	log.Debug().Msg("Cross-signed after QR code verification")
+	return nil
+}
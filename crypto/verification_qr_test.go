@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestQRCodeBytesRoundtrip(t *testing.T) {
+	qr := &QRCode{
+		Mode:          QRCodeModeSelfVerifyingMasterKeyTrusted,
+		TransactionID: "txnid",
+		FirstKey:      NewOlmAccount().SigningKey(),
+		SecondKey:     NewOlmAccount().SigningKey(),
+		SharedSecret:  []byte("0123456789abcdef"),
+	}
+	data, err := qr.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("MATRIX\x02\x01\x00\x05txnid"), data[:15])
+	assert.Len(t, data, 15+32+32+16)
+
+	parsed, err := ParseQRCode(data)
+	require.NoError(t, err)
+	assert.Equal(t, qr, parsed)
+}
+
+func TestParseInvalidQRCode(t *testing.T) {
+	_, err := ParseQRCode([]byte("NOTMATRIX"))
+	assert.ErrorIs(t, err, ErrInvalidQRCodeHeader)
+	_, err = ParseQRCode([]byte("MATRIX\x01\x00\x00\x00"))
+	assert.ErrorIs(t, err, ErrUnsupportedQRCodeVersion)
+	_, err = ParseQRCode([]byte("MATRIX\x02\x03\x00\x00"))
+	assert.ErrorIs(t, err, ErrInvalidQRCodeMode)
+	_, err = ParseQRCode([]byte("MATRIX\x02\x00\x00\x05txnid"))
+	assert.ErrorIs(t, err, ErrQRCodeTooShort)
+
+	qr := &QRCode{
+		FirstKey:     NewOlmAccount().SigningKey(),
+		SecondKey:    NewOlmAccount().SigningKey(),
+		SharedSecret: []byte("1234567"),
+	}
+	_, err = qr.Bytes()
+	assert.ErrorIs(t, err, ErrQRCodeSecretTooShort)
+	qr.SharedSecret = []byte("12345678")
+	data, err := qr.Bytes()
+	require.NoError(t, err)
+	_, err = ParseQRCode(data[:len(data)-1])
+	assert.ErrorIs(t, err, ErrQRCodeSecretTooShort)
+	_, err = ParseQRCode(data)
+	assert.NoError(t, err)
+}
+
+func TestVerifyScannedQRCode(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	ownMasterKey := NewOlmAccount().SigningKey()
+	otherMasterKey := NewOlmAccount().SigningKey()
+	require.NoError(t, mach.CryptoStore.PutCrossSigningKey("@user1:example.com", id.XSUsageMaster, ownMasterKey))
+	require.NoError(t, mach.CryptoStore.PutCrossSigningKey("@user2:example.com", id.XSUsageMaster, otherMasterKey))
+	ownDevice := &id.Device{UserID: "@user1:example.com", DeviceID: "OTHERDEVICE", SigningKey: NewOlmAccount().SigningKey()}
+	otherUserDevice := &id.Device{UserID: "@user2:example.com", DeviceID: "DEVICE", SigningKey: NewOlmAccount().SigningKey()}
+
+	t.Run("KeyMismatch", func(t *testing.T) {
+		err := mach.VerifyScannedQRCode(context.TODO(), &QRCode{
+			Mode:      QRCodeModeSelfVerifyingMasterKeyUntrusted,
+			FirstKey:  ownDevice.SigningKey,
+			SecondKey: otherMasterKey,
+		}, ownDevice)
+		assert.ErrorIs(t, err, ErrQRCodeKeyMismatch)
+		assert.Equal(t, id.TrustStateUnset, ownDevice.Trust)
+	})
+	t.Run("WrongModeForUser", func(t *testing.T) {
+		err := mach.VerifyScannedQRCode(context.TODO(), &QRCode{
+			Mode:      QRCodeModeCrossSigning,
+			FirstKey:  ownMasterKey,
+			SecondKey: ownMasterKey,
+		}, ownDevice)
+		assert.ErrorIs(t, err, ErrInvalidQRCodeMode)
+	})
+	t.Run("SelfVerification", func(t *testing.T) {
+		err := mach.VerifyScannedQRCode(context.TODO(), &QRCode{
+			Mode:      QRCodeModeSelfVerifyingMasterKeyUntrusted,
+			FirstKey:  ownDevice.SigningKey,
+			SecondKey: ownMasterKey,
+		}, ownDevice)
+		require.NoError(t, err)
+		stored, err := mach.CryptoStore.GetDevice(ownDevice.UserID, ownDevice.DeviceID)
+		require.NoError(t, err)
+		assert.Equal(t, id.TrustStateVerified, stored.Trust)
+	})
+	t.Run("OtherUser", func(t *testing.T) {
+		err := mach.VerifyScannedQRCode(context.TODO(), &QRCode{
+			Mode:      QRCodeModeCrossSigning,
+			FirstKey:  otherMasterKey,
+			SecondKey: ownMasterKey,
+		}, otherUserDevice)
+		require.NoError(t, err)
+		// The QR code doesn't contain the device key, so only cross-signing can make the device trusted
+		stored, err := mach.CryptoStore.GetDevice(otherUserDevice.UserID, otherUserDevice.DeviceID)
+		require.NoError(t, err)
+		assert.Nil(t, stored)
+		assert.Equal(t, id.TrustStateUnset, otherUserDevice.Trust)
+	})
+}
+
+func TestNewQRCode(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	ownMasterKey := NewOlmAccount().SigningKey()
+	require.NoError(t, mach.CryptoStore.PutCrossSigningKey("@user1:example.com", id.XSUsageMaster, ownMasterKey))
+	ownDevice := &id.Device{UserID: "@user1:example.com", DeviceID: "OTHERDEVICE", SigningKey: NewOlmAccount().SigningKey()}
+
+	qr, err := mach.NewQRCode(context.TODO(), ownDevice, "txnid")
+	require.NoError(t, err)
+	assert.Equal(t, QRCodeModeSelfVerifyingMasterKeyUntrusted, qr.Mode)
+	assert.Equal(t, mach.account.SigningKey(), qr.FirstKey)
+	assert.Equal(t, ownMasterKey, qr.SecondKey)
+	assert.Len(t, qr.SharedSecret, qrCodeSharedSecretLength)
+}
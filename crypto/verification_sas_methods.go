@@ -7,7 +7,11 @@
 package crypto
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
 
 	"maunium.net/go/mautrix/crypto/olm"
 	"maunium.net/go/mautrix/event"
@@ -33,6 +37,42 @@ type VerificationMethod interface {
 
 const sasInfoFormat = "MATRIX_KEY_VERIFICATION_SAS|%s|%s|%s|%s|%s|%s|%s"
 
+// SASInfo returns the info string used for deriving the SAS bytes from the shared secret.
+// The keys are the unpadded base64 encoded ephemeral public keys of the devices.
+func SASInfo(initUserID id.UserID, initDeviceID id.DeviceID, initKey string,
+	acceptUserID id.UserID, acceptDeviceID id.DeviceID, acceptKey string, transactionID string) string {
+	return fmt.Sprintf(sasInfoFormat,
+		initUserID, initDeviceID, initKey,
+		acceptUserID, acceptDeviceID, acceptKey,
+		transactionID)
+}
+
+func generateSASBytes(sharedSecret []byte, info string, length int) ([]byte, error) {
+	output := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, nil, []byte(info)), output)
+	return output, err
+}
+
+// SASDecimal computes the decimal SAS from the shared secret of the key agreement and the info string
+// (see SASInfo). This can be used by callers that handle the verification transport themselves.
+func SASDecimal(sharedSecret []byte, info string) (DecimalSASData, error) {
+	sasBytes, err := generateSASBytes(sharedSecret, info, 5)
+	if err != nil {
+		return DecimalSASData{}, err
+	}
+	return decimalFromSASBytes(sasBytes), nil
+}
+
+// SASEmoji computes the emoji SAS from the shared secret of the key agreement and the info string
+// (see SASInfo). This can be used by callers that handle the verification transport themselves.
+func SASEmoji(sharedSecret []byte, info string) (EmojiSASData, error) {
+	sasBytes, err := generateSASBytes(sharedSecret, info, 6)
+	if err != nil {
+		return EmojiSASData{}, err
+	}
+	return emojisFromSASBytes(sasBytes), nil
+}
+
 // VerificationMethodDecimal describes the decimal SAS method.
 type VerificationMethodDecimal struct{}
 
@@ -49,23 +89,20 @@ func (VerificationMethodDecimal) GetVerificationSAS(initUserID id.UserID, initDe
 	acceptUserID id.UserID, acceptDeviceID id.DeviceID, acceptKey string,
 	transactionID string, sas *olm.SAS) (SASData, error) {
 
-	sasInfo := fmt.Sprintf(sasInfoFormat,
-		initUserID, initDeviceID, initKey,
-		acceptUserID, acceptDeviceID, acceptKey,
-		transactionID)
-
+	sasInfo := SASInfo(initUserID, initDeviceID, initKey, acceptUserID, acceptDeviceID, acceptKey, transactionID)
 	sasBytes, err := sas.GenerateBytes([]byte(sasInfo), 5)
 	if err != nil {
 		return DecimalSASData{0, 0, 0}, err
 	}
+	return decimalFromSASBytes(sasBytes), nil
+}
 
-	numbers := DecimalSASData{
+func decimalFromSASBytes(sasBytes []byte) DecimalSASData {
+	return DecimalSASData{
 		(uint(sasBytes[0])<<5 | uint(sasBytes[1])>>3) + 1000,
 		(uint(sasBytes[1]&0x7)<<10 | uint(sasBytes[2])<<2 | uint(sasBytes[3]>>6)) + 1000,
 		(uint(sasBytes[3]&0x3F)<<7 | uint(sasBytes[4])>>1) + 1000,
 	}
-
-	return numbers, nil
 }
 
 // Type returns the decimal SAS method type.
@@ -170,18 +207,15 @@ func (VerificationMethodEmoji) GetVerificationSAS(initUserID id.UserID, initDevi
 	acceptUserID id.UserID, acceptDeviceID id.DeviceID, acceptKey string,
 	transactionID string, sas *olm.SAS) (SASData, error) {
 
-	sasInfo := fmt.Sprintf(sasInfoFormat,
-		initUserID, initDeviceID, initKey,
-		acceptUserID, acceptDeviceID, acceptKey,
-		transactionID)
-
-	var emojis EmojiSASData
+	sasInfo := SASInfo(initUserID, initDeviceID, initKey, acceptUserID, acceptDeviceID, acceptKey, transactionID)
 	sasBytes, err := sas.GenerateBytes([]byte(sasInfo), 6)
-
 	if err != nil {
-		return emojis, err
+		return EmojiSASData{}, err
 	}
+	return emojisFromSASBytes(sasBytes), nil
+}
 
+func emojisFromSASBytes(sasBytes []byte) (emojis EmojiSASData) {
 	sasNum := uint64(sasBytes[0])<<40 | uint64(sasBytes[1])<<32 | uint64(sasBytes[2])<<24 |
 		uint64(sasBytes[3])<<16 | uint64(sasBytes[4])<<8 | uint64(sasBytes[5])
 
@@ -191,8 +225,7 @@ func (VerificationMethodEmoji) GetVerificationSAS(initUserID id.UserID, initDevi
 		emoji := allEmojis[emojiIdx]
 		emojis[i] = emoji
 	}
-
-	return emojis, nil
+	return
 }
 
 // Type returns the emoji SAS method type.
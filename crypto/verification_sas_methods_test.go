@@ -0,0 +1,69 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/crypto/goolm/sas"
+)
+
+func newSASPair(t *testing.T) (*sas.SAS, *sas.SAS) {
+	alice, err := sas.New()
+	require.NoError(t, err)
+	bob, err := sas.New()
+	require.NoError(t, err)
+	require.NoError(t, alice.SetTheirKey(bob.GetPubkey()))
+	require.NoError(t, bob.SetTheirKey(alice.GetPubkey()))
+	return alice, bob
+}
+
+func TestSASEmoji(t *testing.T) {
+	alice, bob := newSASPair(t)
+	info := SASInfo("@alice:example.com", "ALICE", string(alice.GetPubkey()), "@bob:example.com", "BOB", string(bob.GetPubkey()), "txn")
+
+	aliceEmojis, err := SASEmoji(alice.Secret, info)
+	require.NoError(t, err)
+	bobEmojis, err := SASEmoji(bob.Secret, info)
+	require.NoError(t, err)
+	assert.Equal(t, aliceEmojis, bobEmojis)
+
+	sasBytes, err := alice.GenerateBytes([]byte(info), 6)
+	require.NoError(t, err)
+	assert.Equal(t, emojisFromSASBytes(sasBytes), aliceEmojis)
+}
+
+func TestSASDecimal(t *testing.T) {
+	alice, bob := newSASPair(t)
+	info := SASInfo("@alice:example.com", "ALICE", string(alice.GetPubkey()), "@bob:example.com", "BOB", string(bob.GetPubkey()), "txn")
+
+	aliceNumbers, err := SASDecimal(alice.Secret, info)
+	require.NoError(t, err)
+	bobNumbers, err := SASDecimal(bob.Secret, info)
+	require.NoError(t, err)
+	assert.Equal(t, aliceNumbers, bobNumbers)
+	for _, number := range aliceNumbers {
+		assert.GreaterOrEqual(t, number, uint(1000))
+		assert.LessOrEqual(t, number, uint(9191))
+	}
+
+	sasBytes, err := alice.GenerateBytes([]byte(info), 5)
+	require.NoError(t, err)
+	assert.Equal(t, decimalFromSASBytes(sasBytes), aliceNumbers)
+}
+
+func TestSASDecimalKnownValue(t *testing.T) {
+	assert.Equal(t, DecimalSASData{1000, 1000, 1000}, decimalFromSASBytes([]byte{0, 0, 0, 0, 0}))
+	assert.Equal(t, DecimalSASData{9191, 9191, 9191}, decimalFromSASBytes([]byte{0xff, 0xff, 0xff, 0xff, 0xff}))
+	emojis := emojisFromSASBytes([]byte{0, 0, 0, 0, 0, 0})
+	for _, emoji := range emojis {
+		assert.Equal(t, allEmojis[0], emoji)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type cancelRecordingHooks struct {
+	cancelled chan event.VerificationCancelCode
+}
+
+func (hooks *cancelRecordingHooks) VerifySASMatch(*id.Device, SASData) bool {
+	return false
+}
+
+func (hooks *cancelRecordingHooks) VerificationMethods() []VerificationMethod {
+	return []VerificationMethod{VerificationMethodDecimal{}}
+}
+
+func (hooks *cancelRecordingHooks) OnCancel(_ bool, _ string, code event.VerificationCancelCode) {
+	hooks.cancelled <- code
+}
+
+func (hooks *cancelRecordingHooks) OnSuccess() {}
+
+func TestCancelExpiredVerifications(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	hooks := &cancelRecordingHooks{cancelled: make(chan event.VerificationCancelCode, 2)}
+	device := &id.Device{UserID: "@user2:example.com", DeviceID: "dev"}
+	mach.keyVerificationTransactionState.Store("@user2:example.com:old", &verificationState{
+		otherDevice: device,
+		hooks:       hooks,
+		createdAt:   time.Now().Add(-2 * mach.VerificationTimeout),
+	})
+	mach.keyVerificationTransactionState.Store("@user2:example.com:new", &verificationState{
+		otherDevice: device,
+		hooks:       hooks,
+		createdAt:   time.Now(),
+	})
+
+	assert.Equal(t, 1, mach.CancelExpiredVerifications(context.TODO()))
+	cancellation := receiveToDevice(t, sent)
+	assert.Equal(t, event.ToDeviceVerificationCancel.Type, cancellation.eventType)
+	var content event.VerificationCancelEventContent
+	require.NoError(t, json.Unmarshal(cancellation.messages["@user2:example.com"]["dev"], &content))
+	assert.Equal(t, "old", content.TransactionID)
+	assert.Equal(t, event.VerificationCancelByTimeout, content.Code)
+	assert.Equal(t, event.VerificationCancelByTimeout, <-hooks.cancelled)
+	assert.Empty(t, sent)
+
+	_, ok := mach.keyVerificationTransactionState.Load("@user2:example.com:old")
+	assert.False(t, ok)
+	_, ok = mach.keyVerificationTransactionState.Load("@user2:example.com:new")
+	assert.True(t, ok)
+}
+
+func TestCancelExpiredVerificationsDisabled(t *testing.T) {
+	mach := newMachine(t, "@user1:example.com")
+	mach.VerificationTimeout = 0
+	mach.keyVerificationTransactionState.Store("@user2:example.com:old", &verificationState{
+		otherDevice: &id.Device{UserID: "@user2:example.com", DeviceID: "dev"},
+		createdAt:   time.Now().Add(-24 * time.Hour),
+	})
+	assert.Equal(t, 0, mach.CancelExpiredVerifications(context.TODO()))
+	_, ok := mach.keyVerificationTransactionState.Load("@user2:example.com:old")
+	assert.True(t, ok)
+}
+
+func TestSASMismatchCancelsImmediately(t *testing.T) {
+	mach, sent := newMachineWithToDeviceServer(t, "@user1:example.com")
+	hooks := &cancelRecordingHooks{cancelled: make(chan event.VerificationCancelCode, 2)}
+	verState := &verificationState{
+		otherDevice:   &id.Device{UserID: "@user2:example.com", DeviceID: "dev"},
+		hooks:         hooks,
+		sasMatched:    make(chan bool, 1),
+		extendTimeout: func() {},
+	}
+	mach.keyVerificationTransactionState.Store("@user2:example.com:txn", verState)
+
+	mach.sasCompared(context.TODO(), false, "txn", verState)
+	cancellation := receiveToDevice(t, sent)
+	assert.Equal(t, event.ToDeviceVerificationCancel.Type, cancellation.eventType)
+	var content event.VerificationCancelEventContent
+	require.NoError(t, json.Unmarshal(cancellation.messages["@user2:example.com"]["dev"], &content))
+	assert.Equal(t, "txn", content.TransactionID)
+	assert.Equal(t, event.VerificationCancelSASMismatch, content.Code)
+	assert.Equal(t, event.VerificationCancelSASMismatch, <-hooks.cancelled)
+	_, ok := mach.keyVerificationTransactionState.Load("@user2:example.com:txn")
+	assert.False(t, ok)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// SentTransactionCacheSize is the number of recent transaction IDs that clients remember for echo detection.
+var SentTransactionCacheSize = 256
+
+// sentTransactionCache is a bounded set of transaction IDs used by this client.
+// When the cache is full, the oldest transaction IDs are forgotten first.
+type sentTransactionCache struct {
+	ring []string
+	ptr  int
+	set  map[string]struct{}
+	lock sync.Mutex
+}
+
+func (stc *sentTransactionCache) add(txnID string) {
+	stc.lock.Lock()
+	defer stc.lock.Unlock()
+	if stc.set == nil {
+		stc.ring = make([]string, SentTransactionCacheSize)
+		stc.set = make(map[string]struct{}, SentTransactionCacheSize)
+	}
+	if len(stc.ring) == 0 {
+		return
+	} else if _, exists := stc.set[txnID]; exists {
+		return
+	}
+	if old := stc.ring[stc.ptr]; old != "" {
+		delete(stc.set, old)
+	}
+	stc.ring[stc.ptr] = txnID
+	stc.set[txnID] = struct{}{}
+	stc.ptr = (stc.ptr + 1) % len(stc.ring)
+}
+
+func (stc *sentTransactionCache) has(txnID string) bool {
+	stc.lock.Lock()
+	_, exists := stc.set[txnID]
+	stc.lock.Unlock()
+	return exists
+}
+
+// IsOwnEcho checks if the given event was sent by this client, based on the transaction ID in the unsigned data.
+//
+// Only transactions sent through SendMessageEvent or RedactEvent are remembered,
+// and only the last SentTransactionCacheSize transaction IDs are kept.
+func (cli *Client) IsOwnEcho(evt *event.Event) bool {
+	return evt.Unsigned.TransactionID != "" && cli.sentTxnIDs.has(evt.Unsigned.TransactionID)
+}
+
+func (cli *Client) markOwnEchoes(resp *RespSync) {
+	mark := func(events []*event.Event) {
+		for _, evt := range events {
+			if cli.IsOwnEcho(evt) {
+				evt.Mautrix.IsOwnEcho = true
+			}
+		}
+	}
+	for _, roomData := range resp.Rooms.Join {
+		mark(roomData.Timeline.Events)
+	}
+	for _, roomData := range resp.Rooms.Leave {
+		mark(roomData.Timeline.Events)
+	}
+}
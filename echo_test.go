@@ -0,0 +1,44 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestClient_IsOwnEcho(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintln(w, `{"event_id": "$event"}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+
+	for i := 0; i < mautrix.SentTransactionCacheSize+1; i++ {
+		_, err = cli.SendMessageEvent(context.Background(), "!room:example.com", event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "hello",
+		}, mautrix.ReqSendEvent{TransactionID: fmt.Sprintf("txn%d", i)})
+		require.NoError(t, err)
+	}
+	evt := &event.Event{Unsigned: event.Unsigned{TransactionID: "txn1"}}
+	assert.True(t, cli.IsOwnEcho(evt))
+	evt.Unsigned.TransactionID = "txn0"
+	assert.False(t, cli.IsOwnEcho(evt), "oldest transaction ID should've been evicted")
+	evt.Unsigned.TransactionID = "unknown"
+	assert.False(t, cli.IsOwnEcho(evt))
+}
@@ -145,6 +145,15 @@ func (e RespError) Error() string {
 	return e.ErrCode + ": " + e.Err
 }
 
+// IsSoftLogout returns true if the error is M_UNKNOWN_TOKEN with soft_logout set to true,
+// which means that the client can re-authenticate without losing the device and its crypto state.
+//
+// See https://spec.matrix.org/v1.8/client-server-api/#soft-logout
+func (e RespError) IsSoftLogout() bool {
+	softLogout, _ := e.ExtraData["soft_logout"].(bool)
+	return e.ErrCode == MUnknownToken.ErrCode && softLogout
+}
+
 func (e RespError) Is(err error) bool {
 	e2, ok := err.(RespError)
 	if !ok {
@@ -78,6 +78,9 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceVerificationCancel:  reflect.TypeOf(VerificationCancelEventContent{}),
 	ToDeviceVerificationRequest: reflect.TypeOf(VerificationRequestEventContent{}),
 
+	ToDeviceSecretRequest: reflect.TypeOf(SecretRequestEventContent{}),
+	ToDeviceSecretSend:    reflect.TypeOf(SecretSendEventContent{}),
+
 	ToDeviceOrgMatrixRoomKeyWithheld: reflect.TypeOf(RoomKeyWithheldEventContent{}),
 
 	ToDeviceBeeperRoomKeyAck: reflect.TypeOf(BeeperRoomKeyAckEventContent{}),
@@ -450,6 +453,20 @@ func (content *Content) AsRoomKeyWithheld() *RoomKeyWithheldEventContent {
 	}
 	return casted
 }
+func (content *Content) AsSecretRequest() *SecretRequestEventContent {
+	casted, ok := content.Parsed.(*SecretRequestEventContent)
+	if !ok {
+		return &SecretRequestEventContent{}
+	}
+	return casted
+}
+func (content *Content) AsSecretSend() *SecretSendEventContent {
+	casted, ok := content.Parsed.(*SecretSendEventContent)
+	if !ok {
+		return &SecretSendEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsCallInvite() *CallInviteEventContent {
 	casted, ok := content.Parsed.(*CallInviteEventContent)
 	if !ok {
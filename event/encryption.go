@@ -176,4 +176,27 @@ func (withheld *RoomKeyWithheldEventContent) Is(other error) bool {
 	return withheld.Code == "" || otherWithheld.Code == "" || withheld.Code == otherWithheld.Code
 }
 
+type SecretRequestAction string
+
+const (
+	SecretRequestActionRequest SecretRequestAction = "request"
+	SecretRequestActionCancel  SecretRequestAction = "request_cancellation"
+)
+
+// SecretRequestEventContent represents the content of a m.secret.request to_device event.
+// https://spec.matrix.org/v1.8/client-server-api/#msecretrequest
+type SecretRequestEventContent struct {
+	Name               id.Secret           `json:"name,omitempty"`
+	Action             SecretRequestAction `json:"action"`
+	RequestingDeviceID id.DeviceID         `json:"requesting_device_id"`
+	RequestID          string              `json:"request_id"`
+}
+
+// SecretSendEventContent represents the content of a m.secret.send to_device event.
+// https://spec.matrix.org/v1.8/client-server-api/#msecretsend
+type SecretSendEventContent struct {
+	RequestID string `json:"request_id"`
+	Secret    string `json:"secret"`
+}
+
 type DummyEventContent struct{}
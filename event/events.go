@@ -50,6 +50,9 @@ type eventForMarshaling struct {
 }
 
 // UnmarshalJSON unmarshals the event, including moving prev_content from the top level to inside unsigned.
+//
+// If the event is already redacted (i.e. unsigned contains redacted_because), any content keys
+// that the redaction algorithm doesn't preserve are removed.
 func (evt *Event) UnmarshalJSON(data []byte) error {
 	var efm eventForMarshaling
 	err := json.Unmarshal(data, &efm)
@@ -67,6 +70,9 @@ func (evt *Event) UnmarshalJSON(data []byte) error {
 	if efm.Unsigned != nil {
 		evt.Unsigned = *efm.Unsigned
 	}
+	if evt.Unsigned.RedactedBecause != nil {
+		evt.Content.stripRedacted(evt.Type)
+	}
 	if efm.PrevContent != nil && evt.Unsigned.PrevContent == nil {
 		evt.Unsigned.PrevContent = efm.PrevContent
 	}
@@ -116,6 +122,12 @@ type MautrixInfo struct {
 	DecryptionDuration time.Duration
 
 	CheckpointSent bool
+	// IsOwnEcho is set by the client syncer if the event was sent by the same client,
+	// i.e. the unsigned transaction ID matches one that was used for sending recently.
+	IsOwnEcho bool
+	// DecryptionError is set by the client if the event was fetched with DecryptHistory enabled,
+	// but couldn't be decrypted, e.g. because the megolm session isn't known.
+	DecryptionError error
 }
 
 func (evt *Event) GetStateKey() string {
@@ -149,3 +161,19 @@ func (us *Unsigned) IsEmpty() bool {
 	return us.PrevContent == nil && us.PrevSender == "" && us.ReplacesState == "" && us.Age == 0 &&
 		us.TransactionID == "" && us.RedactedBecause == nil && us.InviteRoomState == nil && us.Relations == nil
 }
+
+// AgeDuration returns the age of the event as a time.Duration.
+//
+// The age is the time elapsed between the event being sent and the homeserver returning it,
+// so it's only meaningful relative to when the event was received.
+func (us *Unsigned) AgeDuration() time.Duration {
+	return time.Duration(us.Age) * time.Millisecond
+}
+
+// IsOwnTransaction returns true if the event has the given transaction ID in the unsigned data.
+//
+// The homeserver only includes transaction_id for the client that sent the event,
+// so this can be used to detect echoes of events sent by this client.
+func (us *Unsigned) IsOwnTransaction(txnID string) bool {
+	return txnID != "" && us.TransactionID == txnID
+}
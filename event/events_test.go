@@ -0,0 +1,124 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const stateEventWithUnsigned = `{
+	"sender": "@tulir:maunium.net",
+	"type": "m.room.topic",
+	"state_key": "",
+	"origin_server_ts": 1587252684192,
+	"event_id": "$foo",
+	"room_id": "!bar",
+	"content": {"topic": "new topic"},
+	"unsigned": {
+		"age": 1234,
+		"transaction_id": "mautrix-go_1_2",
+		"replaces_state": "$old",
+		"prev_content": {"topic": "old topic"},
+		"redacted_because": {
+			"sender": "@tulir:maunium.net",
+			"type": "m.room.redaction",
+			"event_id": "$redaction",
+			"room_id": "!bar",
+			"content": {"reason": "spam"}
+		}
+	}
+}`
+
+func TestEvent_UnmarshalUnsigned(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(stateEventWithUnsigned), &evt)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1234), evt.Unsigned.Age)
+	assert.Equal(t, 1234*time.Millisecond, evt.Unsigned.AgeDuration())
+	assert.Equal(t, "mautrix-go_1_2", evt.Unsigned.TransactionID)
+	assert.True(t, evt.Unsigned.IsOwnTransaction("mautrix-go_1_2"))
+	assert.False(t, evt.Unsigned.IsOwnTransaction(""))
+	assert.Equal(t, id.EventID("$old"), evt.Unsigned.ReplacesState)
+	require.NotNil(t, evt.Unsigned.PrevContent)
+	assert.Equal(t, "old topic", evt.Unsigned.PrevContent.Raw["topic"])
+	require.NotNil(t, evt.Unsigned.RedactedBecause)
+	assert.Equal(t, id.EventID("$redaction"), evt.Unsigned.RedactedBecause.ID)
+}
+
+func TestEvent_UnmarshalLegacyPrevContent(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(`{
+		"type": "m.room.topic",
+		"state_key": "",
+		"content": {"topic": "new topic"},
+		"prev_content": {"topic": "old topic"},
+		"replaces_state": "$old"
+	}`), &evt)
+	require.NoError(t, err)
+	require.NotNil(t, evt.Unsigned.PrevContent)
+	assert.Equal(t, "old topic", evt.Unsigned.PrevContent.Raw["topic"])
+	assert.Equal(t, id.EventID("$old"), evt.Unsigned.ReplacesState)
+}
+
+func TestEvent_UnmarshalRedacted(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(`{
+		"sender": "@tulir:maunium.net",
+		"type": "m.room.message",
+		"event_id": "$foo",
+		"room_id": "!bar",
+		"content": {"msgtype": "m.text", "body": "leaked"},
+		"unsigned": {
+			"redacted_because": {
+				"sender": "@tulir:maunium.net",
+				"type": "m.room.redaction",
+				"event_id": "$redaction",
+				"room_id": "!bar",
+				"redacts": "$foo",
+				"content": {"reason": "spam"}
+			}
+		}
+	}`), &evt)
+	require.NoError(t, err)
+	assert.True(t, evt.IsRedacted())
+	require.NotNil(t, evt.RedactedBecause())
+	assert.Equal(t, id.EventID("$redaction"), evt.RedactedBecause().ID)
+	assert.Empty(t, evt.Content.Raw)
+	assert.JSONEq(t, `{}`, string(evt.Content.VeryRaw))
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	assert.Empty(t, evt.Content.AsMessage().Body)
+
+	var member *event.Event
+	err = json.Unmarshal([]byte(`{
+		"type": "m.room.member",
+		"state_key": "@tulir:maunium.net",
+		"content": {
+			"membership": "join",
+			"displayname": "leaked",
+			"third_party_invite": {"display_name": "leaked", "signed": {"token": "abc"}}
+		},
+		"unsigned": {"redacted_because": {"type": "m.room.redaction", "content": {}}}
+	}`), &member)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"membership": "join", "third_party_invite": {"signed": {"token": "abc"}}}`, string(member.Content.VeryRaw))
+
+	var topic *event.Event
+	err = json.Unmarshal([]byte(`{"type": "m.room.topic", "state_key": "", "content": {"topic": "visible"}}`), &topic)
+	require.NoError(t, err)
+	assert.False(t, topic.IsRedacted())
+	assert.Nil(t, topic.RedactedBecause())
+	assert.Equal(t, "visible", topic.Content.Raw["topic"])
+}
@@ -43,6 +43,22 @@ type MemberEventContent struct {
 	Reason           string              `json:"reason,omitempty"`
 }
 
+// GetDisplayName returns the display name in the member event, or the given user ID if the display name isn't set.
+func (content *MemberEventContent) GetDisplayName(userID id.UserID) string {
+	if content == nil || content.Displayname == "" {
+		return userID.String()
+	}
+	return content.Displayname
+}
+
+// GetAvatarURL returns the parsed avatar URL in the member event. Invalid and empty URLs are returned as an empty ContentURI.
+func (content *MemberEventContent) GetAvatarURL() id.ContentURI {
+	if content == nil {
+		return id.ContentURI{}
+	}
+	return content.AvatarURL.ParseOrIgnore()
+}
+
 type ThirdPartyInvite struct {
 	DisplayName string `json:"display_name"`
 	Signed      struct {
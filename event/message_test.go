@@ -87,6 +87,33 @@ func TestMessageEventContent__ParseEdit(t *testing.T) {
 	assert.Equal(t, "<strong>Hello</strong>, World!", content.NewContent.FormattedBody)
 }
 
+const replaceRelationContent = `{
+	"msgtype": "m.text",
+	"body": "* hello @user",
+	"m.mentions": {},
+	"m.new_content": {
+		"msgtype": "m.text",
+		"body": "hello @user",
+		"m.mentions": {"user_ids": ["@user:example.com"]}
+	},
+	"m.relates_to": {
+		"rel_type": "m.replace",
+		"event_id": "$original"
+	}
+}`
+
+func TestMessageEventContent__ParseReplaceRelation(t *testing.T) {
+	content := event.Content{VeryRaw: []byte(replaceRelationContent)}
+	require.NoError(t, content.ParseRaw(event.EventMessage))
+	msg := content.AsMessage()
+	assert.Equal(t, id.EventID("$original"), msg.RelatesTo.GetReplaceID())
+	require.NotNil(t, msg.NewContent)
+	assert.Equal(t, "hello @user", msg.NewContent.Body)
+	assert.Nil(t, msg.NewContent.RelatesTo)
+	require.NotNil(t, msg.NewContent.Mentions)
+	assert.Equal(t, []id.UserID{"@user:example.com"}, msg.NewContent.Mentions.UserIDs)
+}
+
 const imageMessageEvent = `{
 	"sender": "@tulir:maunium.net",
 	"type": "m.room.message",
@@ -0,0 +1,51 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mau.fi/util/variationselector"
+)
+
+// MaxReactionKeyLength is the maximum length of a reaction key in characters (unicode code points)
+// accepted by NormalizeReactionKey.
+var MaxReactionKeyLength = 128
+
+var (
+	ErrEmptyReactionKey        = errors.New("reaction key is empty")
+	ErrReactionKeyTooLong      = errors.New("reaction key is too long")
+	ErrReactionKeyControlChars = errors.New("reaction key contains control characters")
+)
+
+// NormalizeReactionKey trims whitespace from the given reaction key, validates its length and content,
+// and fully qualifies emoji variation selectors, so the same emoji always produces the same key.
+//
+// Keys that are empty after trimming, longer than MaxReactionKeyLength or contain control characters
+// are rejected with an error.
+func NormalizeReactionKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		return "", ErrEmptyReactionKey
+	} else if !utf8.ValidString(key) {
+		return "", fmt.Errorf("reaction key is not valid UTF-8")
+	}
+	for _, char := range key {
+		if unicode.IsControl(char) {
+			return "", ErrReactionKeyControlChars
+		}
+	}
+	key = variationselector.FullyQualify(key)
+	if utf8.RuneCountInString(key) > MaxReactionKeyLength {
+		return "", fmt.Errorf("%w (%d > %d)", ErrReactionKeyTooLong, utf8.RuneCountInString(key), MaxReactionKeyLength)
+	}
+	return key, nil
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestNormalizeReactionKey(t *testing.T) {
+	key, err := event.NormalizeReactionKey(" 👍 ")
+	assert.NoError(t, err)
+	assert.Equal(t, "👍", key)
+
+	key, err = event.NormalizeReactionKey("❤")
+	assert.NoError(t, err)
+	assert.Equal(t, "❤️", key)
+
+	_, err = event.NormalizeReactionKey("  ")
+	assert.ErrorIs(t, err, event.ErrEmptyReactionKey)
+	_, err = event.NormalizeReactionKey("a\x00b")
+	assert.ErrorIs(t, err, event.ErrReactionKeyControlChars)
+	_, err = event.NormalizeReactionKey(strings.Repeat("a", event.MaxReactionKeyLength+1))
+	assert.ErrorIs(t, err, event.ErrReactionKeyTooLong)
+}
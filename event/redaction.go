@@ -0,0 +1,95 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"encoding/json"
+)
+
+// preservedRedactionKeys contains the content keys that the redaction algorithm keeps for each event type.
+//
+// The room version of an event isn't known when parsing it, so this is the union of the keys kept by all room versions.
+// A nil value means that the whole content is kept (m.room.create in room v11+). Map values are the nested keys to keep.
+var preservedRedactionKeys = map[string]map[string]map[string]struct{}{
+	StateMember.Type: {
+		"membership":                       nil,
+		"join_authorised_via_users_server": nil,
+		"third_party_invite":               {"signed": {}},
+	},
+	StateCreate.Type: nil,
+	StateJoinRules.Type: {
+		"join_rule": nil,
+		"allow":     nil,
+	},
+	StatePowerLevels.Type: {
+		"ban":            nil,
+		"events":         nil,
+		"events_default": nil,
+		"invite":         nil,
+		"kick":           nil,
+		"redact":         nil,
+		"state_default":  nil,
+		"users":          nil,
+		"users_default":  nil,
+	},
+	StateHistoryVisibility.Type: {
+		"history_visibility": nil,
+	},
+	StateAliases.Type: {
+		"aliases": nil,
+	},
+	EventRedaction.Type: {
+		"redacts": nil,
+	},
+}
+
+// IsRedacted returns true if the event was already redacted when it was received,
+// i.e. if the unsigned data contains the redaction event.
+func (evt *Event) IsRedacted() bool {
+	return evt.Unsigned.RedactedBecause != nil
+}
+
+// RedactedBecause returns the redaction event that redacted this event, or nil if the event isn't redacted.
+func (evt *Event) RedactedBecause() *Event {
+	return evt.Unsigned.RedactedBecause
+}
+
+// stripRedacted removes all content keys that the redaction algorithm wouldn't have kept for the given event type.
+//
+// Homeservers already strip the content of redacted events, so this is only a safety net against content
+// that shouldn't be there, e.g. from buggy or malicious servers.
+func (content *Content) stripRedacted(evtType Type) {
+	keep, ok := preservedRedactionKeys[evtType.Type]
+	if ok && keep == nil {
+		return
+	}
+	stripped := make(map[string]interface{})
+	var changed bool
+	for key, nestedKeep := range keep {
+		value, ok := content.Raw[key]
+		if !ok {
+			continue
+		}
+		if nested, isMap := value.(map[string]interface{}); isMap && nestedKeep != nil {
+			strippedNested := make(map[string]interface{})
+			for nestedKey := range nestedKeep {
+				if nestedValue, ok := nested[nestedKey]; ok {
+					strippedNested[nestedKey] = nestedValue
+				}
+			}
+			changed = changed || len(strippedNested) != len(nested)
+			value = strippedNested
+		}
+		stripped[key] = value
+	}
+	if !changed && len(stripped) == len(content.Raw) {
+		return
+	}
+	content.Raw = stripped
+	content.Parsed = nil
+	content.VeryRaw, _ = json.Marshal(stripped)
+}
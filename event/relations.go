@@ -8,6 +8,7 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
 
 	"maunium.net/go/mautrix/id"
 )
@@ -198,12 +199,28 @@ func (ec *EventIDChunk) Serialize(typ RelationType) RelationChunk {
 	return ec.RelationChunk
 }
 
+// ThreadSummary is the server-side aggregation of a thread, bundled inside the m.thread key of unsigned.m.relations.
+//
+// https://spec.matrix.org/v1.8/client-server-api/#server-side-aggregation-of-mthread-relationships
+type ThreadSummary struct {
+	LatestEvent             *Event `json:"latest_event,omitempty"`
+	Count                   int    `json:"count"`
+	CurrentUserParticipated bool   `json:"current_user_participated"`
+}
+
 type Relations struct {
 	Raw map[RelationType]RelationChunk `json:"-"`
 
 	Annotations AnnotationChunk `json:"m.annotation,omitempty"`
 	References  EventIDChunk    `json:"m.reference,omitempty"`
 	Replaces    EventIDChunk    `json:"m.replace,omitempty"`
+
+	// Replacement is the most recent edit of the event, if the server bundled it in the m.replace key.
+	//
+	// https://spec.matrix.org/v1.8/client-server-api/#server-side-aggregation-of-mreplace-relationships
+	Replacement *Event `json:"-"`
+	// Thread is the thread summary, if the event is a thread root.
+	Thread *ThreadSummary `json:"-"`
 }
 
 type serializableRelations Relations
@@ -212,7 +229,56 @@ func (relations *Relations) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &relations.Raw); err != nil {
 		return err
 	}
-	return json.Unmarshal(data, (*serializableRelations)(relations))
+	if err := json.Unmarshal(data, (*serializableRelations)(relations)); err != nil {
+		return err
+	}
+	var bundled struct {
+		Replace json.RawMessage `json:"m.replace,omitempty"`
+		Thread  *ThreadSummary  `json:"m.thread,omitempty"`
+	}
+	if err := json.Unmarshal(data, &bundled); err != nil {
+		return err
+	}
+	relations.Thread = bundled.Thread
+	// Old versions of the spec used a chunk for m.replace, newer ones bundle the whole event.
+	if len(bundled.Replace) > 0 && relations.Replaces.Chunk == nil {
+		if err := json.Unmarshal(bundled.Replace, &relations.Replacement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAnnotationCount returns the number of annotations (reactions) with the given key.
+func (relations *Relations) GetAnnotationCount(key string) int {
+	if relations == nil {
+		return 0
+	}
+	return relations.Annotations.Map[key]
+}
+
+// GetReplacementContent returns the m.new_content of the bundled replacement event, or nil if there isn't one.
+func (relations *Relations) GetReplacementContent() *MessageEventContent {
+	if relations == nil || relations.Replacement == nil {
+		return nil
+	}
+	err := relations.Replacement.Content.ParseRaw(relations.Replacement.Type)
+	if err != nil && !errors.Is(err, ErrContentAlreadyParsed) {
+		return nil
+	}
+	content, ok := relations.Replacement.Content.Parsed.(*MessageEventContent)
+	if !ok {
+		return nil
+	}
+	return content.NewContent
+}
+
+// GetThreadCount returns the number of events in the thread, or zero if the event isn't a thread root.
+func (relations *Relations) GetThreadCount() int {
+	if relations == nil || relations.Thread == nil {
+		return 0
+	}
+	return relations.Thread.Count
 }
 
 func (relations *Relations) MarshalJSON() ([]byte, error) {
@@ -222,13 +288,22 @@ func (relations *Relations) MarshalJSON() ([]byte, error) {
 	relations.Raw[RelAnnotation] = relations.Annotations.Serialize()
 	relations.Raw[RelReference] = relations.References.Serialize(RelReference)
 	relations.Raw[RelReplace] = relations.Replaces.Serialize(RelReplace)
+	output := make(map[RelationType]any, len(relations.Raw))
 	for key, item := range relations.Raw {
 		if !item.Limited {
 			item.Count = len(item.Chunk)
 		}
-		if item.Count == 0 {
+		if item.Count != 0 {
+			output[key] = item
+		} else {
 			delete(relations.Raw, key)
 		}
 	}
-	return json.Marshal(relations.Raw)
+	if relations.Replacement != nil {
+		output[RelReplace] = relations.Replacement
+	}
+	if relations.Thread != nil {
+		output[RelThread] = relations.Thread
+	}
+	return json.Marshal(output)
 }
@@ -0,0 +1,92 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const eventWithBundledRelations = `{
+	"sender": "@tulir:maunium.net",
+	"type": "m.room.message",
+	"origin_server_ts": 1587252684192,
+	"event_id": "$root",
+	"room_id": "!bar",
+	"content": {"msgtype": "m.text", "body": "hello"},
+	"unsigned": {
+		"m.relations": {
+			"m.annotation": {"chunk": [{"type": "m.reaction", "key": "👍", "count": 3}]},
+			"m.replace": {
+				"sender": "@tulir:maunium.net",
+				"type": "m.room.message",
+				"event_id": "$edit",
+				"room_id": "!bar",
+				"content": {
+					"msgtype": "m.text",
+					"body": "* hello there",
+					"m.new_content": {"msgtype": "m.text", "body": "hello there"},
+					"m.relates_to": {"rel_type": "m.replace", "event_id": "$root"}
+				}
+			},
+			"m.thread": {
+				"latest_event": {
+					"sender": "@tulir:maunium.net",
+					"type": "m.room.message",
+					"event_id": "$latest",
+					"room_id": "!bar",
+					"content": {"msgtype": "m.text", "body": "latest"}
+				},
+				"count": 7,
+				"current_user_participated": true
+			}
+		}
+	}
+}`
+
+func TestRelations_UnmarshalBundled(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(eventWithBundledRelations), &evt)
+	require.NoError(t, err)
+	rel := evt.Unsigned.Relations
+	require.NotNil(t, rel)
+
+	assert.Equal(t, 3, rel.GetAnnotationCount("👍"))
+	assert.Equal(t, 0, rel.GetAnnotationCount("👎"))
+
+	require.NotNil(t, rel.Replacement)
+	assert.Equal(t, id.EventID("$edit"), rel.Replacement.ID)
+	newContent := rel.GetReplacementContent()
+	require.NotNil(t, newContent)
+	assert.Equal(t, "hello there", newContent.Body)
+
+	require.NotNil(t, rel.Thread)
+	assert.Equal(t, 7, rel.GetThreadCount())
+	assert.True(t, rel.Thread.CurrentUserParticipated)
+	require.NotNil(t, rel.Thread.LatestEvent)
+	assert.Equal(t, id.EventID("$latest"), rel.Thread.LatestEvent.ID)
+}
+
+func TestRelations_MarshalBundled(t *testing.T) {
+	var evt *event.Event
+	err := json.Unmarshal([]byte(eventWithBundledRelations), &evt)
+	require.NoError(t, err)
+	data, err := json.Marshal(evt.Unsigned.Relations)
+	require.NoError(t, err)
+	var roundtrip event.Relations
+	err = json.Unmarshal(data, &roundtrip)
+	require.NoError(t, err)
+	assert.Equal(t, 7, roundtrip.GetThreadCount())
+	require.NotNil(t, roundtrip.Replacement)
+	assert.Equal(t, id.EventID("$edit"), roundtrip.Replacement.ID)
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"unicode/utf16"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// UserColorIndex deterministically hashes the given user ID into a number between 0 and n-1.
+//
+// The hash is the same one Element uses for choosing user name colors (a Java-style string hash over
+// UTF-16 code units), so with n=8 the result matches the color index used by Element and most other clients.
+func UserColorIndex(userID id.UserID, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	var hash int32
+	for _, char := range utf16.Encode([]rune(userID)) {
+		hash = (hash << 5) - hash + int32(char)
+	}
+	abs := int64(hash)
+	if abs < 0 {
+		abs = -abs
+	}
+	return int(abs % int64(n))
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+)
+
+func TestUserColorIndex(t *testing.T) {
+	assert.Equal(t, 3, format.UserColorIndex("@alice:example.com", 8))
+	assert.Equal(t, 0, format.UserColorIndex("@bob:example.com", 8))
+	assert.Equal(t, 5, format.UserColorIndex("@tulir:maunium.net", 8))
+	assert.Equal(t, 2, format.UserColorIndex("@🐈:example.com", 8))
+	assert.Equal(t, 0, format.UserColorIndex("@alice:example.com", 0))
+}
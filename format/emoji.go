@@ -0,0 +1,250 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"strings"
+)
+
+// EmojiShortcodes is the map of shortcodes (without colons) to unicode emojis used by ExpandEmojiShortcodes.
+// The names follow the GitHub/Slack conventions. Callers can add more entries to the map at startup.
+var EmojiShortcodes = map[string]string{
+	"+1":                           "👍",
+	"-1":                           "👎",
+	"100":                          "💯",
+	"angry":                        "😠",
+	"astonished":                   "😲",
+	"baby":                         "👶",
+	"balloon":                      "🎈",
+	"bear":                         "🐻",
+	"beer":                         "🍺",
+	"beers":                        "🍻",
+	"bell":                         "🔔",
+	"bird":                         "🐦",
+	"blush":                        "😊",
+	"bomb":                         "💣",
+	"book":                         "📖",
+	"boom":                         "💥",
+	"broken_heart":                 "💔",
+	"bug":                          "🐛",
+	"bulb":                         "💡",
+	"cake":                         "🍰",
+	"calendar":                     "📆",
+	"camera":                       "📷",
+	"cat":                          "🐱",
+	"check":                        "✔️",
+	"checkered_flag":               "🏁",
+	"clap":                         "👏",
+	"coffee":                       "☕",
+	"cold_sweat":                   "😰",
+	"confused":                     "😕",
+	"cookie":                       "🍪",
+	"cool":                         "🆒",
+	"cow":                          "🐮",
+	"crossed_fingers":              "🤞",
+	"cry":                          "😢",
+	"crying_cat_face":              "😿",
+	"dancer":                       "💃",
+	"disappointed":                 "😞",
+	"dizzy":                        "💫",
+	"dog":                          "🐶",
+	"eyes":                         "👀",
+	"expressionless":               "😑",
+	"facepalm":                     "🤦",
+	"fearful":                      "😨",
+	"fire":                         "🔥",
+	"fish":                         "🐟",
+	"flushed":                      "😳",
+	"fox_face":                     "🦊",
+	"frowning":                     "😦",
+	"ghost":                        "👻",
+	"gift":                         "🎁",
+	"grin":                         "😁",
+	"grinning":                     "😀",
+	"grimacing":                    "😬",
+	"hammer":                       "🔨",
+	"hand":                         "✋",
+	"heart":                        "❤️",
+	"heart_eyes":                   "😍",
+	"hearts":                       "♥️",
+	"heavy_check_mark":             "✔️",
+	"heavy_plus_sign":              "➕",
+	"hourglass":                    "⌛",
+	"hugs":                         "🤗",
+	"hushed":                       "😯",
+	"innocent":                     "😇",
+	"joy":                          "😂",
+	"key":                          "🔑",
+	"kiss":                         "💋",
+	"kissing":                      "😗",
+	"kissing_heart":                "😘",
+	"laughing":                     "😆",
+	"link":                         "🔗",
+	"lock":                         "🔒",
+	"mag":                          "🔍",
+	"mask":                         "😷",
+	"memo":                         "📝",
+	"moneybag":                     "💰",
+	"monkey":                       "🐒",
+	"moon":                         "🌔",
+	"muscle":                       "💪",
+	"neutral_face":                 "😐",
+	"no_entry":                     "⛔",
+	"no_mouth":                     "😶",
+	"ok":                           "🆗",
+	"ok_hand":                      "👌",
+	"open_mouth":                   "😮",
+	"package":                      "📦",
+	"partying_face":                "🥳",
+	"penguin":                      "🐧",
+	"pensive":                      "😔",
+	"persevere":                    "😣",
+	"pig":                          "🐷",
+	"pizza":                        "🍕",
+	"point_down":                   "👇",
+	"point_left":                   "👈",
+	"point_right":                  "👉",
+	"point_up":                     "☝️",
+	"pray":                         "🙏",
+	"question":                     "❓",
+	"rabbit":                       "🐰",
+	"rage":                         "😡",
+	"rainbow":                      "🌈",
+	"raised_hands":                 "🙌",
+	"relaxed":                      "☺️",
+	"relieved":                     "😌",
+	"robot":                        "🤖",
+	"rocket":                       "🚀",
+	"rofl":                         "🤣",
+	"rose":                         "🌹",
+	"scream":                       "😱",
+	"see_no_evil":                  "🙈",
+	"shrug":                        "🤷",
+	"skull":                        "💀",
+	"sleeping":                     "😴",
+	"sleepy":                       "😪",
+	"slightly_frowning_face":       "🙁",
+	"slightly_smiling_face":        "🙂",
+	"smile":                        "😄",
+	"smiley":                       "😃",
+	"smirk":                        "😏",
+	"snake":                        "🐍",
+	"sob":                          "😭",
+	"sparkles":                     "✨",
+	"star":                         "⭐",
+	"star_struck":                  "🤩",
+	"stuck_out_tongue":             "😛",
+	"stuck_out_tongue_winking_eye": "😜",
+	"sun_with_face":                "🌞",
+	"sunglasses":                   "😎",
+	"sunny":                        "☀️",
+	"sweat":                        "😓",
+	"sweat_smile":                  "😅",
+	"tada":                         "🎉",
+	"thinking":                     "🤔",
+	"thumbsdown":                   "👎",
+	"thumbsup":                     "👍",
+	"tired_face":                   "😫",
+	"triumph":                      "😤",
+	"trophy":                       "🏆",
+	"unamused":                     "😒",
+	"upside_down_face":             "🙃",
+	"v":                            "✌️",
+	"warning":                      "⚠️",
+	"wave":                         "👋",
+	"weary":                        "😩",
+	"white_check_mark":             "✅",
+	"wink":                         "😉",
+	"worried":                      "😟",
+	"x":                            "❌",
+	"yawning_face":                 "🥱",
+	"yum":                          "😋",
+	"zany_face":                    "🤪",
+	"zap":                          "⚡",
+	"zipper_mouth_face":            "🤐",
+	"zzz":                          "💤",
+}
+
+var emojiShortcodeRegex = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+func expandEmojiShortcodesInText(text string) string {
+	return emojiShortcodeRegex.ReplaceAllStringFunc(text, func(shortcode string) string {
+		if emoji, ok := EmojiShortcodes[shortcode[1:len(shortcode)-1]]; ok {
+			return emoji
+		}
+		return shortcode
+	})
+}
+
+// expandEmojiShortcodesInLine expands shortcodes in a single line, skipping inline code spans.
+func expandEmojiShortcodesInLine(line string) string {
+	var output strings.Builder
+	for len(line) > 0 {
+		start := strings.IndexByte(line, '`')
+		if start < 0 {
+			output.WriteString(expandEmojiShortcodesInText(line))
+			break
+		}
+		output.WriteString(expandEmojiShortcodesInText(line[:start]))
+		line = line[start:]
+		fence := line[:len(line)-len(strings.TrimLeft(line, "`"))]
+		end := strings.Index(line[len(fence):], fence)
+		if end < 0 {
+			// Unclosed code span, the backticks are literal
+			output.WriteString(fence)
+			line = line[len(fence):]
+			continue
+		}
+		codeSpanEnd := len(fence) + end + len(fence)
+		output.WriteString(line[:codeSpanEnd])
+		line = line[codeSpanEnd:]
+	}
+	return output.String()
+}
+
+// isIndentedCodeLine returns true if the line is indented enough to be part of an indented code block.
+func isIndentedCodeLine(line string) bool {
+	return strings.HasPrefix(line, "    ") || strings.HasPrefix(strings.TrimLeft(line, " "), "\t")
+}
+
+// ExpandEmojiShortcodes replaces emoji shortcodes like :smile: in the given markdown text with unicode emojis
+// using the EmojiShortcodes map. Unknown shortcodes are left untouched, and shortcodes inside code spans,
+// fenced code blocks or indented code blocks aren't expanded.
+//
+// Indented code blocks can't interrupt paragraphs, so indented lines are only treated as code after a blank line.
+func ExpandEmojiShortcodes(text string) string {
+	lines := strings.Split(text, "\n")
+	var codeFence string
+	var inIndentedCode bool
+	afterBlank := true
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if codeFence != "" {
+			if strings.HasPrefix(trimmed, codeFence) && strings.TrimSpace(strings.TrimLeft(trimmed, codeFence[:1])) == "" {
+				codeFence = ""
+				afterBlank = true
+			}
+			continue
+		} else if strings.TrimSpace(line) == "" {
+			afterBlank = true
+			continue
+		} else if isIndentedCodeLine(line) && (inIndentedCode || afterBlank) {
+			inIndentedCode = true
+			afterBlank = false
+			continue
+		}
+		inIndentedCode = false
+		afterBlank = false
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			codeFence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+			continue
+		}
+		lines[i] = expandEmojiShortcodesInLine(line)
+	}
+	return strings.Join(lines, "\n")
+}
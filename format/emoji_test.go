@@ -0,0 +1,39 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+)
+
+func TestExpandEmojiShortcodes(t *testing.T) {
+	assert.Equal(t, "hello 😄 👍", format.ExpandEmojiShortcodes("hello :smile: :+1:"))
+	assert.Equal(t, "unknown :not_an_emoji: stays", format.ExpandEmojiShortcodes("unknown :not_an_emoji: stays"))
+	assert.Equal(t, "😄 `:smile:` 😄", format.ExpandEmojiShortcodes(":smile: `:smile:` :smile:"))
+	assert.Equal(t, "😄 `` :smile: `` `", format.ExpandEmojiShortcodes(":smile: `` :smile: `` `"))
+	assert.Equal(t, "😄\n```\n:smile:\n```\n😄", format.ExpandEmojiShortcodes(":smile:\n```\n:smile:\n```\n:smile:"))
+	assert.Equal(t, "~~~~go\n:smile:\n~~~\n:smile:", format.ExpandEmojiShortcodes("~~~~go\n:smile:\n~~~\n:smile:"))
+	assert.Equal(t, "10:30:45", format.ExpandEmojiShortcodes("10:30:45"))
+	assert.Equal(t, "😄\n\n    :smile:\n\n\t:smile:\n😄", format.ExpandEmojiShortcodes(":smile:\n\n    :smile:\n\n\t:smile:\n:smile:"))
+	assert.Equal(t, "    :smile:", format.ExpandEmojiShortcodes("    :smile:"))
+	// Indented lines can't start a code block in the middle of a paragraph
+	assert.Equal(t, "😄\n    😄", format.ExpandEmojiShortcodes(":smile:\n    :smile:"))
+}
+
+func TestRenderMarkdown_EmojiShortcodes(t *testing.T) {
+	format.ExpandEmojiShortcodesInMarkdown = true
+	defer func() {
+		format.ExpandEmojiShortcodesInMarkdown = false
+	}()
+	assert.Equal(t, "hello 😄", format.RenderMarkdown("hello :smile:", true, false).Body)
+	assert.Equal(t, "hello :smile:", format.RenderMarkdown("hello :smile:", false, false).Body)
+	assert.Equal(t, "hello :smile:", format.RenderMarkdown("hello :smile:", false, true).Body)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// CustomEmojiHeight is the height used for custom emoji images rendered with RenderCustomEmoji.
+const CustomEmojiHeight = 32
+
+// CustomEmoji is a custom emoji found in a HTML message body.
+type CustomEmoji struct {
+	// Shortcode is the name of the emoji, including the surrounding colons.
+	Shortcode string
+	URI       id.ContentURI
+}
+
+func wrapShortcode(shortcode string) string {
+	if !strings.HasPrefix(shortcode, ":") {
+		shortcode = ":" + shortcode
+	}
+	if !strings.HasSuffix(shortcode, ":") || len(shortcode) == 1 {
+		shortcode += ":"
+	}
+	return shortcode
+}
+
+// RenderCustomEmoji renders an inline image for a custom emoji with the data-mx-emoticon attribute,
+// which is what clients like Element use for custom emoji (MSC2545).
+//
+// The shortcode may be given with or without the surrounding colons.
+func RenderCustomEmoji(uri id.ContentURI, shortcode string) string {
+	shortcode = html.EscapeString(wrapShortcode(shortcode))
+	return fmt.Sprintf(
+		`<img data-mx-emoticon src="%s" alt="%s" title="%s" height="%d">`,
+		html.EscapeString(uri.String()), shortcode, shortcode, CustomEmojiHeight,
+	)
+}
+
+func isCustomEmojiNode(node *html.Node) bool {
+	if node.Type != html.ElementNode || node.Data != "img" {
+		return false
+	}
+	for _, attr := range node.Attr {
+		if attr.Key == "data-mx-emoticon" {
+			return true
+		}
+	}
+	return false
+}
+
+func getCustomEmoji(node *html.Node) (emoji CustomEmoji, ok bool) {
+	var alt, title string
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "src":
+			emoji.URI, _ = id.ParseContentURI(attr.Val)
+		case "alt":
+			alt = attr.Val
+		case "title":
+			title = attr.Val
+		}
+	}
+	if alt == "" {
+		alt = title
+	}
+	if emoji.URI.IsEmpty() || alt == "" {
+		return
+	}
+	emoji.Shortcode = wrapShortcode(alt)
+	return emoji, true
+}
+
+// ParseCustomEmojis finds all custom emoji images (img tags with the data-mx-emoticon attribute) in the given HTML.
+// Images without a valid mxc:// URI or shortcode are ignored.
+func ParseCustomEmojis(htmlData string) (emojis []CustomEmoji) {
+	node, err := html.Parse(strings.NewReader(htmlData))
+	if err != nil {
+		return nil
+	}
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if isCustomEmojiNode(node) {
+			if emoji, ok := getCustomEmoji(node); ok {
+				emojis = append(emojis, emoji)
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return
+}
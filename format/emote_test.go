@@ -0,0 +1,33 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCustomEmoji_RoundTrip(t *testing.T) {
+	uri := id.MustParseContentURI("mxc://example.com/blobcat")
+	rendered := format.RenderCustomEmoji(uri, "blobcat")
+	assert.Equal(t, `<img data-mx-emoticon src="mxc://example.com/blobcat" alt=":blobcat:" title=":blobcat:" height="32">`, rendered)
+
+	htmlBody := "hello " + rendered
+	assert.Equal(t, []format.CustomEmoji{{Shortcode: ":blobcat:", URI: uri}}, format.ParseCustomEmojis(htmlBody))
+	assert.Equal(t, "hello :blobcat:", format.HTMLToText(htmlBody))
+	sanitized := format.SanitizeHTML(htmlBody, format.SanitizeOptions{})
+	assert.Equal(t, []format.CustomEmoji{{Shortcode: ":blobcat:", URI: uri}}, format.ParseCustomEmojis(sanitized))
+}
+
+func TestParseCustomEmojis_Invalid(t *testing.T) {
+	assert.Empty(t, format.ParseCustomEmojis(`<img data-mx-emoticon src="https://example.com/cat.png" alt=":cat:">`))
+	assert.Empty(t, format.ParseCustomEmojis(`<img src="mxc://example.com/cat" alt=":cat:">`))
+}
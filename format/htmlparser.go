@@ -62,6 +62,7 @@ type LinkConverter func(text, href string, ctx Context) string
 type ColorConverter func(text, fg, bg string, ctx Context) string
 type CodeBlockConverter func(code, language string, ctx Context) string
 type PillConverter func(displayname, mxid, eventID string, ctx Context) string
+type CustomEmojiConverter func(emoji CustomEmoji, ctx Context) string
 
 func DefaultPillConverter(displayname, mxid, eventID string, _ Context) string {
 	switch {
@@ -99,6 +100,8 @@ type HTMLParser struct {
 	MonospaceBlockConverter CodeBlockConverter
 	MonospaceConverter      TextConverter
 	TextConverter           TextConverter
+	// CustomEmojiConverter is called for custom emoji images. By default, the shortcode is used as the text.
+	CustomEmojiConverter CustomEmojiConverter
 }
 
 // TaggedString is a string that also contains a HTML tag.
@@ -290,6 +293,19 @@ func (parser *HTMLParser) linkToString(node *html.Node, ctx Context) string {
 	return fmt.Sprintf("%s (%s)", str, href)
 }
 
+func (parser *HTMLParser) imgToString(node *html.Node, ctx Context) string {
+	if !isCustomEmojiNode(node) {
+		return ""
+	}
+	emoji, ok := getCustomEmoji(node)
+	if !ok {
+		return parser.getAttribute(node, "alt")
+	} else if parser.CustomEmojiConverter != nil {
+		return parser.CustomEmojiConverter(emoji, ctx)
+	}
+	return emoji.Shortcode
+}
+
 func (parser *HTMLParser) tagToString(node *html.Node, ctx Context) string {
 	ctx = ctx.WithTag(node.Data)
 	switch node.Data {
@@ -311,12 +327,16 @@ func (parser *HTMLParser) tagToString(node *html.Node, ctx Context) string {
 		return parser.nodeToTagAwareString(node.FirstChild, ctx)
 	case "hr":
 		return parser.HorizontalLine
+	case "img":
+		return parser.imgToString(node, ctx)
 	case "pre":
 		var preStr, language string
 		if node.FirstChild != nil && node.FirstChild.Type == html.ElementNode && node.FirstChild.Data == "code" {
-			class := parser.getAttribute(node.FirstChild, "class")
-			if strings.HasPrefix(class, "language-") {
-				language = class[len("language-"):]
+			for _, class := range strings.Fields(parser.getAttribute(node.FirstChild, "class")) {
+				if strings.HasPrefix(class, "language-") {
+					language = class[len("language-"):]
+					break
+				}
 			}
 			preStr = parser.nodeToString(node.FirstChild.FirstChild, ctx.WithWhitespace())
 		} else {
@@ -8,6 +8,7 @@ package format
 
 import (
 	"fmt"
+	stdhtml "html"
 	"strings"
 
 	"github.com/yuin/goldmark"
@@ -24,6 +25,10 @@ const paragraphEnd = "</p>"
 var Extensions = goldmark.WithExtensions(extension.Strikethrough, extension.Table, mdext.Spoiler)
 var HTMLOptions = goldmark.WithRendererOptions(html.WithHardWraps(), html.WithUnsafe())
 
+// ExpandEmojiShortcodesInMarkdown controls whether RenderMarkdown should replace emoji shortcodes like :smile:
+// with unicode emojis using ExpandEmojiShortcodes before rendering. Text is never changed when markdown is disabled.
+var ExpandEmojiShortcodesInMarkdown = false
+
 var withHTML = goldmark.New(Extensions, HTMLOptions)
 var noHTML = goldmark.New(Extensions, HTMLOptions, goldmark.WithExtensions(mdext.EscapeHTML))
 
@@ -49,9 +54,17 @@ func RenderMarkdownCustom(text string, renderer goldmark.Markdown) event.Message
 	return HTMLToContent(htmlBody)
 }
 
+// IsFormattingNeeded checks whether the given HTML contains any formatting compared to the plaintext version.
+// HTML that only differs from the text by escaping (e.g. &amp; instead of &) doesn't need formatting.
+func IsFormattingNeeded(html, text string) bool {
+	return html != text && stdhtml.UnescapeString(html) != text
+}
+
+// HTMLToContent converts the given HTML into message event content, generating the plaintext body with HTMLToMarkdown.
+// The formatted body is omitted if the HTML doesn't contain any formatting (see IsFormattingNeeded).
 func HTMLToContent(html string) event.MessageEventContent {
 	text := HTMLToMarkdown(html)
-	if html != text {
+	if IsFormattingNeeded(html, text) {
 		return event.MessageEventContent{
 			FormattedBody: html,
 			Format:        event.FormatHTML,
@@ -65,10 +78,27 @@ func HTMLToContent(html string) event.MessageEventContent {
 	}
 }
 
+// EnsurePlaintextBody regenerates the plaintext body of the given content from the formatted body with HTMLToText
+// if the plaintext body is missing or stale. The body is considered stale if it's identical to the HTML
+// formatted body, which usually means the sender copied the HTML into both fields.
+//
+// Content without a HTML formatted body is not modified.
+func EnsurePlaintextBody(content *event.MessageEventContent) {
+	if content == nil || content.Format != event.FormatHTML || len(content.FormattedBody) == 0 {
+		return
+	}
+	if len(strings.TrimSpace(content.Body)) == 0 || content.Body == content.FormattedBody {
+		content.Body = HTMLToText(content.FormattedBody)
+	}
+}
+
 func RenderMarkdown(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
 	var htmlBody string
 
 	if allowMarkdown {
+		if ExpandEmojiShortcodesInMarkdown {
+			text = ExpandEmojiShortcodes(text)
+		}
 		rndr := withHTML
 		if !allowHTML {
 			rndr = noHTML
@@ -84,3 +114,15 @@ func RenderMarkdown(text string, allowMarkdown, allowHTML bool) event.MessageEve
 		}
 	}
 }
+
+// RenderMarkdownSanitized renders the given text like RenderMarkdown, but also passes the resulting HTML through
+// SanitizeHTML with the given options. This can be used to restrict the allowed tags, e.g. to forbid images or headings.
+//
+// The plaintext body is generated from the sanitized HTML, so it's always a valid fallback for the formatted body.
+func RenderMarkdownSanitized(text string, allowMarkdown, allowHTML bool, opts SanitizeOptions) event.MessageEventContent {
+	content := RenderMarkdown(text, allowMarkdown, allowHTML)
+	if content.Format != event.FormatHTML {
+		return content
+	}
+	return HTMLToContent(SanitizeHTML(content.FormattedBody, opts))
+}
@@ -32,11 +32,16 @@ func TestRenderMarkdown_PlainText(t *testing.T) {
 
 func TestRenderMarkdown_EscapeHTML(t *testing.T) {
 	content := format.RenderMarkdown("<b>hello world</b>", true, false)
+	assert.Equal(t, event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "<b>hello world</b>",
+	}, content)
+	content = format.RenderMarkdown("<b>hello</b> **world**", true, false)
 	assert.Equal(t, event.MessageEventContent{
 		MsgType:       event.MsgText,
-		Body:          "<b>hello world</b>",
+		Body:          "<b>hello</b> **world**",
 		Format:        event.FormatHTML,
-		FormattedBody: "&lt;b&gt;hello world&lt;/b&gt;",
+		FormattedBody: "&lt;b&gt;hello&lt;/b&gt; <strong>world</strong>",
 	}, content)
 }
 
@@ -141,3 +146,40 @@ func TestRenderMarkdown_DiscordUnderline(t *testing.T) {
 		assert.Equal(t, html, strings.ReplaceAll(rendered, "\n", ""))
 	}
 }
+
+func TestRenderMarkdown_CodeBlockLanguageRoundTrip(t *testing.T) {
+	markdown := "```go\nfmt.Println(\"hello\")\n```"
+	content := format.RenderMarkdown(markdown, true, false)
+	assert.Equal(t, "<pre><code class=\"language-go\">fmt.Println(&quot;hello&quot;)\n</code></pre>", content.FormattedBody)
+	assert.Equal(t, markdown, content.Body)
+	assert.Equal(t, markdown, format.HTMLToMarkdown(content.FormattedBody))
+}
+
+func TestHTMLToMarkdown_CodeBlockMultipleClasses(t *testing.T) {
+	assert.Equal(t, "```go\nx := 1\n```", format.HTMLToMarkdown(`<pre><code class="hljs language-go">x := 1</code></pre>`))
+}
+
+func TestEnsurePlaintextBody(t *testing.T) {
+	content := &event.MessageEventContent{Format: event.FormatHTML, FormattedBody: "<b>hello</b> <i>world</i>"}
+	format.EnsurePlaintextBody(content)
+	assert.Equal(t, "**hello** _world_", content.Body)
+
+	content = &event.MessageEventContent{Format: event.FormatHTML, FormattedBody: "<b>hello</b>", Body: "<b>hello</b>"}
+	format.EnsurePlaintextBody(content)
+	assert.Equal(t, "**hello**", content.Body)
+
+	content = &event.MessageEventContent{Format: event.FormatHTML, FormattedBody: "<b>hello</b>", Body: "hello"}
+	format.EnsurePlaintextBody(content)
+	assert.Equal(t, "hello", content.Body)
+
+	content = &event.MessageEventContent{Body: "plain"}
+	format.EnsurePlaintextBody(content)
+	assert.Equal(t, "plain", content.Body)
+}
+
+func TestRenderMarkdown_NoFormattingNeeded(t *testing.T) {
+	content := format.RenderMarkdown(`"hello" & <world>`, true, false)
+	assert.Equal(t, event.MessageEventContent{MsgType: event.MsgText, Body: `"hello" & <world>`}, content)
+	assert.True(t, format.IsFormattingNeeded("<b>hi</b>", "**hi**"))
+	assert.False(t, format.IsFormattingNeeded("a &amp; b", "a & b"))
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MatrixLink is a matrix.to or matrix: URI found in the plaintext body of a message.
+type MatrixLink struct {
+	// Start and End are the byte offsets of the link in the body.
+	Start int
+	End   int
+	// URL is the link as it appears in the body.
+	URL string
+	// Target is the parsed link, which contains the user, room or event that the link points at, as well as via servers.
+	Target *id.MatrixURI
+}
+
+var matrixLinkRegex = regexp.MustCompile(`(?:https://matrix\.to/#/|matrix:)[^\s<>"]+`)
+
+// FindMatrixLinks finds all matrix.to URLs and matrix: URIs in the plaintext body of the given message.
+// Links that can't be parsed are ignored, and trailing punctuation is not considered to be a part of the link.
+func FindMatrixLinks(content *event.MessageEventContent) (links []MatrixLink) {
+	for _, match := range matrixLinkRegex.FindAllStringIndex(content.Body, -1) {
+		start, end := match[0], match[1]
+		end = start + len(strings.TrimRight(content.Body[start:end], ".,:;!?)]'"))
+		uri, err := id.ParseMatrixURIOrMatrixToURL(content.Body[start:end])
+		if err != nil || uri == nil {
+			continue
+		}
+		links = append(links, MatrixLink{
+			Start:  start,
+			End:    end,
+			URL:    content.Body[start:end],
+			Target: uri,
+		})
+	}
+	return
+}
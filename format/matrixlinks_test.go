@@ -0,0 +1,38 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFindMatrixLinks(t *testing.T) {
+	content := &event.MessageEventContent{
+		Body: "see https://matrix.to/#/!room:example.com/$event?via=example.com, ask matrix:u/alice:example.com. " +
+			"or join https://matrix.to/#/#room:example.com but not https://matrix.to/#/invalid",
+	}
+	links := format.FindMatrixLinks(content)
+	require.Len(t, links, 3)
+
+	assert.Equal(t, "https://matrix.to/#/!room:example.com/$event?via=example.com", links[0].URL)
+	assert.Equal(t, links[0].URL, content.Body[links[0].Start:links[0].End])
+	assert.Equal(t, id.RoomID("!room:example.com"), links[0].Target.RoomID())
+	assert.Equal(t, id.EventID("$event"), links[0].Target.EventID())
+	assert.Equal(t, []string{"example.com"}, links[0].Target.Via)
+
+	assert.Equal(t, "matrix:u/alice:example.com", links[1].URL)
+	assert.Equal(t, id.UserID("@alice:example.com"), links[1].Target.UserID())
+
+	assert.Equal(t, id.RoomAlias("#room:example.com"), links[2].Target.RoomAlias())
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"maunium.net/go/mautrix/event"
+)
+
+// NormalizeReactionKey is an alias for event.NormalizeReactionKey.
+func NormalizeReactionKey(key string) (string, error) {
+	return event.NormalizeReactionKey(key)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// DefaultMaxDepth is the default maximum tag nesting depth for SanitizeHTML, as recommended by the spec.
+const DefaultMaxDepth = 100
+
+// SanitizeOptions contains options for SanitizeHTML.
+type SanitizeOptions struct {
+	// MaxDepth is the maximum nesting depth of tags. Tags nested deeper than this are removed,
+	// but their text content is kept. Defaults to DefaultMaxDepth if zero.
+	MaxDepth int
+	// AllowedTags maps allowed tag names to the attributes allowed on them.
+	// Tags that aren't in the map are unwrapped. Defaults to DefaultAllowedTags if nil.
+	//
+	// Attribute values are still validated, so e.g. allowing the src attribute won't allow non-mxc images.
+	AllowedTags map[string][]string
+}
+
+// DefaultAllowedTags contains the tags and attributes allowed in Matrix HTML.
+// See https://spec.matrix.org/v1.8/client-server-api/#mroommessage-msgtypes
+var DefaultAllowedTags = map[string][]string{
+	"font":       {"data-mx-bg-color", "data-mx-color", "color"},
+	"del":        nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"blockquote": nil,
+	"p":          nil,
+	"a":          {"name", "target", "href"},
+	"ul":         nil,
+	"ol":         {"start"},
+	"sup":        nil,
+	"sub":        nil,
+	"li":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"strong":     nil,
+	"em":         nil,
+	"strike":     nil,
+	"code":       {"class"},
+	"hr":         nil,
+	"br":         nil,
+	"div":        nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"caption":    nil,
+	"pre":        nil,
+	"span":       {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"img":        {"width", "height", "alt", "title", "src", "data-mx-emoticon"},
+	"details":    nil,
+	"summary":    nil,
+	"mx-reply":   nil,
+}
+
+// AllowedTagsWithout returns a copy of DefaultAllowedTags without the given tags.
+func AllowedTagsWithout(tags ...string) map[string][]string {
+	allowed := make(map[string][]string, len(DefaultAllowedTags))
+	for tag, attrs := range DefaultAllowedTags {
+		allowed[tag] = attrs
+	}
+	for _, tag := range tags {
+		delete(allowed, tag)
+	}
+	return allowed
+}
+
+// droppedContentTags are tags whose content is removed entirely instead of just unwrapping the tag.
+var droppedContentTags = map[string]struct{}{
+	"script":   {},
+	"style":    {},
+	"head":     {},
+	"iframe":   {},
+	"object":   {},
+	"noscript": {},
+	"template": {},
+	"textarea": {},
+}
+
+var allowedLinkSchemes = []string{"https://", "http://", "ftp://", "mailto:", "magnet:", "matrix:"}
+
+var hexColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func isAllowedAttributeValue(tag, key, val string) bool {
+	switch key {
+	case "data-mx-color", "data-mx-bg-color", "color":
+		return hexColorRegex.MatchString(val)
+	case "href":
+		lowerVal := strings.ToLower(val)
+		for _, scheme := range allowedLinkSchemes {
+			if strings.HasPrefix(lowerVal, scheme) {
+				return true
+			}
+		}
+		return false
+	case "src":
+		return tag == "img" && strings.HasPrefix(val, "mxc://")
+	case "class":
+		return tag == "code" && strings.HasPrefix(val, "language-") && !strings.ContainsAny(val, " \t\n")
+	case "target":
+		return val == "_blank"
+	default:
+		return true
+	}
+}
+
+type sanitizer struct {
+	SanitizeOptions
+	output strings.Builder
+}
+
+func (s *sanitizer) filterAttributes(node *html.Node, allowed []string) []html.Attribute {
+	var attrs []html.Attribute
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+		for _, allowedKey := range allowed {
+			if attr.Key == allowedKey && isAllowedAttributeValue(node.Data, attr.Key, attr.Val) {
+				attrs = append(attrs, attr)
+				break
+			}
+		}
+	}
+	return attrs
+}
+
+func (s *sanitizer) children(node *html.Node, depth int) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		s.node(child, depth)
+	}
+}
+
+func (s *sanitizer) node(node *html.Node, depth int) {
+	switch node.Type {
+	case html.TextNode:
+		s.output.WriteString(html.EscapeString(node.Data))
+	case html.ElementNode:
+		if _, dropContent := droppedContentTags[node.Data]; dropContent {
+			return
+		}
+		allowedAttrs, allowed := s.AllowedTags[node.Data]
+		if !allowed || depth >= s.MaxDepth || (node.Data == "img" && len(s.filterAttributes(node, []string{"src"})) == 0) {
+			s.children(node, depth)
+			return
+		}
+		s.output.WriteByte('<')
+		s.output.WriteString(node.Data)
+		for _, attr := range s.filterAttributes(node, allowedAttrs) {
+			s.output.WriteByte(' ')
+			s.output.WriteString(attr.Key)
+			s.output.WriteString(`="`)
+			s.output.WriteString(html.EscapeString(attr.Val))
+			s.output.WriteByte('"')
+		}
+		s.output.WriteByte('>')
+		if node.DataAtom == atom.Br || node.DataAtom == atom.Hr || node.DataAtom == atom.Img {
+			return
+		}
+		s.children(node, depth+1)
+		s.output.WriteString("</")
+		s.output.WriteString(node.Data)
+		s.output.WriteByte('>')
+	case html.DocumentNode:
+		s.children(node, depth)
+	}
+}
+
+// SanitizeHTML removes all tags and attributes that aren't allowed in Matrix HTML from the given string.
+//
+// Disallowed tags are unwrapped (i.e. their content is kept), except for tags like script and style,
+// which are removed along with their content. Color attributes must be in the #RRGGBB format,
+// links must use a safe scheme and images must point at mxc:// URIs.
+func SanitizeHTML(htmlData string, opts SanitizeOptions) string {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	if opts.AllowedTags == nil {
+		opts.AllowedTags = DefaultAllowedTags
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(htmlData), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return html.EscapeString(htmlData)
+	}
+	s := &sanitizer{SanitizeOptions: opts}
+	for _, node := range nodes {
+		s.node(node, 0)
+	}
+	return s.output.String()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+	}{
+		{"Allowed", `<b>bold</b> <a href="https://example.com">link</a>`, `<b>bold</b> <a href="https://example.com">link</a>`},
+		{"UnknownTag", `<marquee>hello</marquee>`, `hello`},
+		{"Script", `hi<script>alert(1)</script><style>body{}</style>`, `hi`},
+		{"EventHandler", `<b onclick="alert(1)">bold</b>`, `<b>bold</b>`},
+		{"JavascriptLink", `<a href="javascript:alert(1)">link</a>`, `<a>link</a>`},
+		{"Color", `<span data-mx-color="#ff0000" data-mx-bg-color="red">text</span>`, `<span data-mx-color="#ff0000">text</span>`},
+		{"Spoiler", `<span data-mx-spoiler="reason">text</span>`, `<span data-mx-spoiler="reason">text</span>`},
+		{"MXCImage", `<img src="mxc://example.com/abc" alt="cat">`, `<img src="mxc://example.com/abc" alt="cat">`},
+		{"HTTPImage", `<img src="https://example.com/cat.png" alt="cat">`, ``},
+		{"CodeLanguage", `<pre><code class="language-go">x &lt; y</code></pre>`, `<pre><code class="language-go">x &lt; y</code></pre>`},
+		{"CodeClass", `<code class="evil">x</code>`, `<code>x</code>`},
+		{"Escaping", `<p>"quoted" &amp; <b title="x">b</b></p>`, `<p>&#34;quoted&#34; &amp; <b>b</b></p>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.out, format.SanitizeHTML(test.in, format.SanitizeOptions{}))
+		})
+	}
+}
+
+func TestSanitizeHTML_MaxDepth(t *testing.T) {
+	in := strings.Repeat("<b>", 5) + "deep" + strings.Repeat("</b>", 5)
+	assert.Equal(t, "<b><b><b>deep</b></b></b>", format.SanitizeHTML(in, format.SanitizeOptions{MaxDepth: 3}))
+}
+
+func TestSanitizeHTML_AllowedTags(t *testing.T) {
+	opts := format.SanitizeOptions{AllowedTags: format.AllowedTagsWithout("img", "h1")}
+	assert.Equal(t, "title <b>bold</b>", format.SanitizeHTML(`<h1>title</h1> <b>bold</b><img src="mxc://example.com/abc">`, opts))
+	_, hasImg := format.DefaultAllowedTags["img"]
+	assert.True(t, hasImg, "AllowedTagsWithout shouldn't modify the default map")
+}
+
+func TestRenderMarkdownSanitized(t *testing.T) {
+	opts := format.SanitizeOptions{AllowedTags: format.AllowedTagsWithout("h1", "img")}
+	content := format.RenderMarkdownSanitized("# Title\n\n**bold** ![cat](mxc://example.com/abc)", true, false, opts)
+	assert.Equal(t, event.FormatHTML, content.Format)
+	assert.Equal(t, "Title\n<p><strong>bold</strong> </p>", content.FormattedBody)
+	assert.Equal(t, "Title\n**bold**", content.Body)
+
+	content = format.RenderMarkdownSanitized("# Title", true, false, opts)
+	assert.Equal(t, event.MessageEventContent{MsgType: event.MsgText, Body: "Title"}, content)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// unsplittableMarkdownRegex matches markdown links, inline code and emphasis, which shouldn't be split at spaces.
+var unsplittableMarkdownRegex = regexp.MustCompile("\\[[^\\]]*\\]\\([^)]*\\)|`[^`]+`|\\*\\*[^*]+\\*\\*|__[^_]+__|_[^_\\s][^_]*_|~~[^~]+~~|\\|\\|[^|]+\\|\\|")
+
+func runeLen(str string) int {
+	return utf8.RuneCountInString(str)
+}
+
+// hardSplit splits the string into parts of at most maxLen runes without caring about boundaries.
+func hardSplit(str string, maxLen int) (parts []string) {
+	for runeLen(str) > maxLen {
+		end := 0
+		for i := 0; i < maxLen; i++ {
+			_, size := utf8.DecodeRuneInString(str[end:])
+			end += size
+		}
+		parts = append(parts, str[:end])
+		str = str[end:]
+	}
+	return append(parts, str)
+}
+
+// splitLine splits a single line into parts of at most maxLen runes at spaces, without splitting links or
+// inline formatting. Words, links and formatting that are longer than maxLen by themselves are split anyway.
+func splitLine(line string, maxLen int) (parts []string) {
+	spans := unsplittableMarkdownRegex.FindAllStringIndex(line, -1)
+	isInSpan := func(index int) bool {
+		for _, span := range spans {
+			if index > span[0] && index < span[1] {
+				return true
+			}
+		}
+		return false
+	}
+	var words []string
+	wordStart := 0
+	for i, char := range line {
+		if char == ' ' && !isInSpan(i) {
+			words = append(words, line[wordStart:i])
+			wordStart = i + 1
+		}
+	}
+	words = append(words, line[wordStart:])
+
+	var current strings.Builder
+	for _, word := range words {
+		if current.Len() > 0 && runeLen(current.String())+1+runeLen(word) <= maxLen {
+			current.WriteByte(' ')
+			current.WriteString(word)
+			continue
+		}
+		if current.Len() > 0 {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+		if runeLen(word) > maxLen {
+			wordParts := hardSplit(word, maxLen)
+			parts = append(parts, wordParts[:len(wordParts)-1]...)
+			word = wordParts[len(wordParts)-1]
+		}
+		current.WriteString(word)
+	}
+	return append(parts, current.String())
+}
+
+// splitCodeBlock splits the lines of a fenced code block into multiple fenced code blocks of at most maxLen runes.
+func splitCodeBlock(openFence, closeFence string, lines []string, maxLen int) (parts []string) {
+	overhead := runeLen(openFence) + 1 + 1 + runeLen(closeFence)
+	available := maxLen - overhead
+	if available <= 0 {
+		// The fences alone don't fit, fall back to splitting the block as plain text
+		return splitLines(append(append([]string{openFence}, lines...), closeFence), maxLen)
+	}
+	for _, group := range splitLines(lines, available) {
+		parts = append(parts, openFence+"\n"+group+"\n"+closeFence)
+	}
+	return
+}
+
+// splitLines combines the given lines into parts of at most maxLen runes, splitting lines that are too long.
+func splitLines(lines []string, maxLen int) (parts []string) {
+	var current strings.Builder
+	currentLen := 0
+	started := false
+	for _, line := range lines {
+		lineParts := []string{line}
+		if runeLen(line) > maxLen {
+			lineParts = splitLine(line, maxLen)
+		}
+		for _, part := range lineParts {
+			partLen := runeLen(part)
+			if started && currentLen+1+partLen > maxLen {
+				parts = append(parts, current.String())
+				current.Reset()
+				currentLen = 0
+			} else if started {
+				current.WriteByte('\n')
+				currentLen++
+			}
+			current.WriteString(part)
+			currentLen += partLen
+			started = true
+		}
+	}
+	return append(parts, current.String())
+}
+
+// splitMarkdown splits the given markdown text into units that can be freely joined with newlines:
+// normal lines and entire fenced code blocks (which are split into multiple blocks if they're too long).
+func splitMarkdown(text string, maxLen int) (units []string) {
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimLeft(lines[i], " ")
+		if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+			units = append(units, lines[i])
+			continue
+		}
+		fence := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			closing := strings.TrimLeft(lines[j], " ")
+			if strings.HasPrefix(closing, fence) && strings.TrimSpace(strings.TrimLeft(closing, fence[:1])) == "" {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			// Unclosed code block, treat the rest of the message as code
+			end = len(lines)
+			lines = append(lines, fence)
+		}
+		block := strings.Join(lines[i:end+1], "\n")
+		if runeLen(block) <= maxLen {
+			units = append(units, block)
+		} else {
+			units = append(units, splitCodeBlock(lines[i], lines[end], lines[i+1:end], maxLen)...)
+		}
+		i = end
+	}
+	return
+}
+
+func joinUnits(units []string, maxLen int) (chunks []string) {
+	var current strings.Builder
+	currentLen := 0
+	for _, unit := range units {
+		unitLen := runeLen(unit)
+		if currentLen > 0 && currentLen+1+unitLen > maxLen {
+			chunks = append(chunks, strings.TrimSpace(current.String()))
+			current.Reset()
+			currentLen = 0
+		}
+		if unitLen > maxLen {
+			// Code blocks are already split in splitMarkdown, so this only happens with plain lines
+			parts := splitLine(unit, maxLen)
+			chunks = append(chunks, parts[:len(parts)-1]...)
+			unit = parts[len(parts)-1]
+			unitLen = runeLen(unit)
+		}
+		if currentLen > 0 {
+			current.WriteByte('\n')
+			currentLen++
+		}
+		current.WriteString(unit)
+		currentLen += unitLen
+	}
+	if last := strings.TrimSpace(current.String()); len(last) > 0 {
+		chunks = append(chunks, last)
+	}
+	return
+}
+
+// SplitMessage splits the given message content into multiple messages whose plaintext bodies are at most
+// maxLen characters (unicode code points) long.
+//
+// The body is split at line boundaries if possible, then at word boundaries, and only in the middle of words
+// if a single word is too long. Links and inline formatting are only split if they don't fit in a chunk by themselves.
+// Fenced code blocks are split at line boundaries when possible, with the fences repeated in each chunk.
+// Chunks are never longer than maxLen. If the content has a HTML formatted body, a new formatted
+// body is rendered for each chunk from the markdown in the plaintext body.
+//
+// All other fields, including relations, are copied to every chunk. If the body already fits, the content is
+// returned as-is.
+func SplitMessage(content *event.MessageEventContent, maxLen int) []*event.MessageEventContent {
+	if maxLen <= 0 || runeLen(content.Body) <= maxLen {
+		return []*event.MessageEventContent{content}
+	}
+	var chunks []string
+	for _, chunk := range joinUnits(splitMarkdown(content.Body, maxLen), maxLen) {
+		// This is just a safeguard, the chunks should already fit
+		chunks = append(chunks, hardSplit(chunk, maxLen)...)
+	}
+	output := make([]*event.MessageEventContent, len(chunks))
+	for i, chunk := range chunks {
+		chunkContent := *content
+		if content.Format == event.FormatHTML {
+			rendered := RenderMarkdown(chunk, true, false)
+			chunkContent.Format = rendered.Format
+			chunkContent.FormattedBody = rendered.FormattedBody
+		}
+		chunkContent.Body = chunk
+		output[i] = &chunkContent
+	}
+	return output
+}
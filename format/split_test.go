@@ -0,0 +1,86 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+func splitBodies(content *event.MessageEventContent, maxLen int) []string {
+	var bodies []string
+	for _, part := range format.SplitMessage(content, maxLen) {
+		bodies = append(bodies, part.Body)
+	}
+	return bodies
+}
+
+func TestSplitMessage_Short(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+	parts := format.SplitMessage(content, 10)
+	require.Len(t, parts, 1)
+	assert.Same(t, content, parts[0])
+}
+
+func TestSplitMessage_Lines(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "first line\nsecond line\nthird line"}
+	assert.Equal(t, []string{"first line\nsecond line", "third line"}, splitBodies(content, 22))
+}
+
+func TestSplitMessage_Words(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "one two three four five"}
+	assert.Equal(t, []string{"one two", "three four", "five"}, splitBodies(content, 10))
+	content.Body = "a [link with spaces](https://example.com) b"
+	assert.Equal(t, []string{"a", "[link with spaces](https://example.com)", "b"}, splitBodies(content, 40))
+	content.Body = "see https://example.com/path ok"
+	assert.Equal(t, []string{"see", "https://example.com/path", "ok"}, splitBodies(content, 24))
+	content.Body = "see https://example.com/very/long/path ok"
+	assert.Equal(t, []string{"see", "https://e", "xample.co", "m/very/lo", "ng/path", "ok"}, splitBodies(content, 9))
+	content.Body = strings.Repeat("x", 25)
+	assert.Equal(t, []string{strings.Repeat("x", 10), strings.Repeat("x", 10), strings.Repeat("x", 5)}, splitBodies(content, 10))
+}
+
+func TestSplitMessage_CodeBlock(t *testing.T) {
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "intro\n```go\nline1\nline2\nline3\n```"}
+	assert.Equal(t, []string{"intro", "```go\nline1\nline2\n```", "```go\nline3\n```"}, splitBodies(content, 22))
+}
+
+func TestSplitMessage_NeverExceedsMaxLen(t *testing.T) {
+	bodies := []string{
+		"[" + strings.Repeat("link ", 10) + "](https://example.com/" + strings.Repeat("a", 30) + ")",
+		"**" + strings.Repeat("b", 30) + "**",
+		"```" + strings.Repeat("c", 30) + "\n" + strings.Repeat("d", 30) + "\n```",
+		"`" + strings.Repeat("e ", 20) + "`",
+		strings.Repeat("ü", 50),
+	}
+	for _, body := range bodies {
+		parts := splitBodies(&event.MessageEventContent{MsgType: event.MsgText, Body: body}, 8)
+		assert.Greater(t, len(parts), 1)
+		for _, part := range parts {
+			assert.LessOrEqual(t, utf8.RuneCountInString(part), 8, "chunk %q of %q is too long", part, body)
+		}
+	}
+}
+
+func TestSplitMessage_HTML(t *testing.T) {
+	content := format.RenderMarkdown("**bold words** and _italic words_", true, false)
+	parts := format.SplitMessage(&content, 15)
+	require.Len(t, parts, 3)
+	assert.Equal(t, "**bold words**", parts[0].Body)
+	assert.Equal(t, "<strong>bold words</strong>", parts[0].FormattedBody)
+	assert.Equal(t, "and", parts[1].Body)
+	assert.Empty(t, parts[1].FormattedBody)
+	assert.Equal(t, "_italic words_", parts[2].Body)
+	assert.Equal(t, "<em>italic words</em>", parts[2].FormattedBody)
+}
@@ -55,7 +55,7 @@ func ParseContentURI(uri string) (parsed ContentURI, err error) {
 		return
 	} else if !strings.HasPrefix(uri, "mxc://") {
 		err = InvalidContentURI
-	} else if index := strings.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := strings.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = uri[6 : 6+index]
@@ -71,7 +71,7 @@ func ParseContentURIBytes(uri []byte) (parsed ContentURI, err error) {
 		return
 	} else if !bytes.HasPrefix(uri, mxcBytes) {
 		err = InvalidContentURI
-	} else if index := bytes.IndexRune(uri[6:], '/'); index == -1 || index == len(uri)-7 {
+	} else if index := bytes.IndexRune(uri[6:], '/'); index <= 0 || index == len(uri)-7 {
 		err = InvalidContentURI
 	} else {
 		parsed.Homeserver = string(uri[6 : 6+index])
@@ -0,0 +1,41 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package id_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestParseContentURI(t *testing.T) {
+	parsed, err := id.ParseContentURI("mxc://maunium.net/abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, id.ContentURI{Homeserver: "maunium.net", FileID: "abcdef"}, parsed)
+	assert.Equal(t, "mxc://maunium.net/abcdef", parsed.String())
+
+	parsedBytes, err := id.ParseContentURIBytes([]byte("mxc://maunium.net/abcdef"))
+	assert.NoError(t, err)
+	assert.Equal(t, parsed, parsedBytes)
+}
+
+func TestParseContentURI_Empty(t *testing.T) {
+	parsed, err := id.ParseContentURI("")
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsEmpty())
+}
+
+func TestParseContentURI_Invalid(t *testing.T) {
+	for _, uri := range []string{"https://maunium.net/abcdef", "mxc://maunium.net", "mxc://maunium.net/", "mxc:///abcdef"} {
+		_, err := id.ParseContentURI(uri)
+		assert.ErrorIs(t, err, id.InvalidContentURI, uri)
+		_, err = id.ParseContentURIBytes([]byte(uri))
+		assert.ErrorIs(t, err, id.InvalidContentURI, uri)
+	}
+}
@@ -44,6 +44,16 @@ const (
 	XSUsageUserSigning CrossSigningUsage = "user_signing"
 )
 
+// Secret is the name of a secret that can be stored in SSSS or shared between devices using m.secret.send.
+type Secret string
+
+const (
+	SecretXSMaster       Secret = "m.cross_signing.master"
+	SecretXSSelfSigning  Secret = "m.cross_signing.self_signing"
+	SecretXSUserSigning  Secret = "m.cross_signing.user_signing"
+	SecretMegolmBackupV1 Secret = "m.megolm_backup.v1"
+)
+
 // A SessionID is an arbitrary string that identifies an Olm or Megolm session.
 type SessionID string
 
@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestClient_JoinedMembers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.com/joined_members":
+			_, _ = fmt.Fprintln(w, `{"joined": {"@alice:example.com": {"display_name": "Alice", "avatar_url": "mxc://example.com/alice"}}}`)
+		case "/_matrix/client/v3/joined_rooms":
+			_, _ = fmt.Fprintln(w, `{"joined_rooms": ["!room:example.com"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+
+	members, err := cli.JoinedMembers(context.Background(), "!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, map[id.UserID]mautrix.JoinedMember{
+		"@alice:example.com": {DisplayName: "Alice", AvatarURL: "mxc://example.com/alice"},
+	}, members.Joined)
+	assert.Equal(t, event.MembershipJoin, cli.StateStore.GetMember("!room:example.com", "@alice:example.com").Membership)
+
+	rooms, err := cli.JoinedRooms(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []id.RoomID{"!room:example.com"}, rooms.JoinedRooms)
+}
+
+func TestClient_Members_Filter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/members", r.URL.Path)
+		assert.Equal(t, "s123", r.URL.Query().Get("at"))
+		assert.Equal(t, "ban", r.URL.Query().Get("membership"))
+		assert.False(t, r.URL.Query().Has("not_membership"))
+		_, _ = fmt.Fprintln(w, `{"chunk": [{
+			"type": "m.room.member",
+			"state_key": "@spammer:example.com",
+			"sender": "@admin:example.com",
+			"event_id": "$ban",
+			"room_id": "!room:example.com",
+			"content": {"membership": "ban"}
+		}]}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+
+	resp, err := cli.Members(context.Background(), "!room:example.com", mautrix.ReqMembers{At: "s123", Membership: event.MembershipBan})
+	require.NoError(t, err)
+	require.Len(t, resp.Chunk, 1)
+	assert.Equal(t, "@spammer:example.com", *resp.Chunk[0].StateKey)
+	assert.Equal(t, event.MembershipBan, resp.Chunk[0].Content.AsMember().Membership)
+	// Historical and filtered member lists must not be stored as the current state
+	_, ok := cli.StateStore.TryGetMember("!room:example.com", "@spammer:example.com")
+	assert.False(t, ok)
+}
+
+func TestClient_Members_UpdatesStateStore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.RawQuery)
+		_, _ = fmt.Fprintln(w, `{"chunk": [{
+			"type": "m.room.member",
+			"state_key": "@alice:example.com",
+			"sender": "@alice:example.com",
+			"event_id": "$join",
+			"room_id": "!room:example.com",
+			"content": {"membership": "join", "displayname": "Alice"}
+		}]}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+
+	_, err = cli.Members(context.Background(), "!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", cli.StateStore.GetMemberDisplayName("!room:example.com", "@alice:example.com"))
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// PowerLevelCheck is the result of checking whether the current user can perform an action in a room.
+type PowerLevelCheck struct {
+	// Allowed is true if the user's power level is high enough to perform the action.
+	Allowed bool
+	// Required is the power level required to perform the action.
+	Required int
+	// Actual is the user's current power level in the room.
+	Actual int
+}
+
+func newPowerLevelCheck(required, actual int) PowerLevelCheck {
+	return PowerLevelCheck{
+		Allowed:  actual >= required,
+		Required: required,
+		Actual:   actual,
+	}
+}
+
+// cachedPowerLevels returns the power levels of the given room from the state store,
+// falling back to fetching them from the server if they're not cached.
+func (cli *Client) cachedPowerLevels(ctx context.Context, roomID id.RoomID) (*event.PowerLevelsEventContent, error) {
+	if cli.StateStore != nil {
+		if pl := cli.StateStore.GetPowerLevels(roomID); pl != nil {
+			return pl, nil
+		}
+	}
+	var pl event.PowerLevelsEventContent
+	err := cli.StateEvent(ctx, roomID, event.StatePowerLevels, "", &pl)
+	if errors.Is(err, MNotFound) {
+		// Rooms without a power level event use the defaults for everything
+		return &pl, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get power levels: %w", err)
+	}
+	return &pl, nil
+}
+
+// CanSendEvent checks whether the current user has a high enough power level to send the given event type in the room.
+// The event type class is used to decide whether the state default or events default applies.
+//
+// Power levels are read from the state store if possible, and fetched from the server otherwise.
+func (cli *Client) CanSendEvent(ctx context.Context, roomID id.RoomID, eventType event.Type) (PowerLevelCheck, error) {
+	pl, err := cli.cachedPowerLevels(ctx, roomID)
+	if err != nil {
+		return PowerLevelCheck{}, err
+	}
+	return newPowerLevelCheck(pl.GetEventLevel(eventType), pl.GetUserLevel(cli.UserID)), nil
+}
+
+// CanSendMessage checks whether the current user can send m.room.message events in the room.
+func (cli *Client) CanSendMessage(ctx context.Context, roomID id.RoomID) (PowerLevelCheck, error) {
+	return cli.CanSendEvent(ctx, roomID, event.EventMessage)
+}
+
+// CanRedact checks whether the current user can redact an event sent by targetSender in the room.
+//
+// Redacting own events only requires the power level for sending m.room.redaction events,
+// while redacting events of other users also requires the redact level.
+func (cli *Client) CanRedact(ctx context.Context, roomID id.RoomID, targetSender id.UserID) (PowerLevelCheck, error) {
+	pl, err := cli.cachedPowerLevels(ctx, roomID)
+	if err != nil {
+		return PowerLevelCheck{}, err
+	}
+	required := pl.GetEventLevel(event.EventRedaction)
+	if targetSender != cli.UserID && pl.Redact() > required {
+		required = pl.Redact()
+	}
+	return newPowerLevelCheck(required, pl.GetUserLevel(cli.UserID)), nil
+}
+
+// CanInvite checks whether the current user can invite users to the room.
+func (cli *Client) CanInvite(ctx context.Context, roomID id.RoomID) (PowerLevelCheck, error) {
+	pl, err := cli.cachedPowerLevels(ctx, roomID)
+	if err != nil {
+		return PowerLevelCheck{}, err
+	}
+	return newPowerLevelCheck(pl.Invite(), pl.GetUserLevel(cli.UserID)), nil
+}
+
+// CanKick checks whether the current user can kick the given user from the room.
+//
+// In addition to the kick level, the current user's power level must be strictly higher than the target's.
+func (cli *Client) CanKick(ctx context.Context, roomID id.RoomID, target id.UserID) (PowerLevelCheck, error) {
+	return cli.canModerate(ctx, roomID, target, (*event.PowerLevelsEventContent).Kick)
+}
+
+// CanBan checks whether the current user can ban the given user from the room.
+//
+// In addition to the ban level, the current user's power level must be strictly higher than the target's.
+func (cli *Client) CanBan(ctx context.Context, roomID id.RoomID, target id.UserID) (PowerLevelCheck, error) {
+	return cli.canModerate(ctx, roomID, target, (*event.PowerLevelsEventContent).Ban)
+}
+
+func (cli *Client) canModerate(ctx context.Context, roomID id.RoomID, target id.UserID, getLevel func(*event.PowerLevelsEventContent) int) (PowerLevelCheck, error) {
+	pl, err := cli.cachedPowerLevels(ctx, roomID)
+	if err != nil {
+		return PowerLevelCheck{}, err
+	}
+	check := newPowerLevelCheck(getLevel(pl), pl.GetUserLevel(cli.UserID))
+	if check.Allowed && target != cli.UserID && pl.GetUserLevel(target) >= check.Actual {
+		check.Allowed = false
+	}
+	return check, nil
+}
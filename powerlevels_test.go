@@ -0,0 +1,64 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const plTestRoom = id.RoomID("!room:example.com")
+
+func newPowerLevelTestClient(t *testing.T) *mautrix.Client {
+	cli, err := mautrix.NewClient("https://example.com", "@bot:example.com", "")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	cli.StateStore.SetPowerLevels(plTestRoom, &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{
+			"@bot:example.com":   50,
+			"@admin:example.com": 100,
+		},
+	})
+	return cli
+}
+
+func TestClient_CanSendMessage(t *testing.T) {
+	check, err := newPowerLevelTestClient(t).CanSendMessage(context.Background(), plTestRoom)
+	require.NoError(t, err)
+	assert.Equal(t, mautrix.PowerLevelCheck{Allowed: true, Required: 0, Actual: 50}, check)
+}
+
+func TestClient_CanRedact(t *testing.T) {
+	cli := newPowerLevelTestClient(t)
+	check, err := cli.CanRedact(context.Background(), plTestRoom, cli.UserID)
+	require.NoError(t, err)
+	assert.True(t, check.Allowed)
+	assert.Equal(t, 0, check.Required)
+	check, err = cli.CanRedact(context.Background(), plTestRoom, "@user:example.com")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed)
+	assert.Equal(t, 50, check.Required)
+}
+
+func TestClient_CanKick(t *testing.T) {
+	cli := newPowerLevelTestClient(t)
+	check, err := cli.CanKick(context.Background(), plTestRoom, "@user:example.com")
+	require.NoError(t, err)
+	assert.True(t, check.Allowed)
+	check, err = cli.CanKick(context.Background(), plTestRoom, "@admin:example.com")
+	require.NoError(t, err)
+	assert.False(t, check.Allowed)
+	assert.Equal(t, 50, check.Required)
+	assert.Equal(t, 50, check.Actual)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type readMarkerKey struct {
+	roomID  id.RoomID
+	receipt bool
+}
+
+type pendingReadMarker struct {
+	send  func(ctx context.Context) error
+	timer *time.Timer
+}
+
+// readMarkerDebouncer holds the read marker updates that are waiting for Client.ReadMarkerDebounce to pass.
+type readMarkerDebouncer struct {
+	pending map[readMarkerKey]*pendingReadMarker
+	lock    sync.Mutex
+}
+
+func (cli *Client) debounceReadMarker(key readMarkerKey, send func(ctx context.Context) error) {
+	rmd := &cli.readMarkers
+	rmd.lock.Lock()
+	defer rmd.lock.Unlock()
+	if rmd.pending == nil {
+		rmd.pending = make(map[readMarkerKey]*pendingReadMarker)
+	}
+	if existing, ok := rmd.pending[key]; ok {
+		// Keep the original timer so that constant updates can't postpone the request forever
+		existing.send = send
+		return
+	}
+	pending := &pendingReadMarker{send: send}
+	pending.timer = time.AfterFunc(cli.ReadMarkerDebounce, func() {
+		rmd.lock.Lock()
+		if rmd.pending[key] != pending {
+			rmd.lock.Unlock()
+			return
+		}
+		delete(rmd.pending, key)
+		rmd.lock.Unlock()
+		err := pending.send(context.Background())
+		if err != nil {
+			cli.Log.Err(err).Str("room_id", key.roomID.String()).Msg("Failed to send debounced read marker")
+		}
+	})
+	rmd.pending[key] = pending
+}
+
+// FlushReadMarkers immediately sends all read marker updates that are being held back by ReadMarkerDebounce.
+//
+// This should be called before shutting down to make sure the final read positions are sent.
+// Client.Close calls this automatically.
+func (cli *Client) FlushReadMarkers(ctx context.Context) error {
+	rmd := &cli.readMarkers
+	rmd.lock.Lock()
+	pending := rmd.pending
+	rmd.pending = nil
+	rmd.lock.Unlock()
+	var errs []error
+	for _, marker := range pending {
+		marker.timer.Stop()
+		if err := marker.send(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
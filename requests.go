@@ -127,6 +127,7 @@ type ReqRedact struct {
 	Extra  map[string]interface{}
 }
 
+// ReqMembers contains the query parameters for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3roomsroomidmembers
 type ReqMembers struct {
 	At            string           `json:"at"`
 	Membership    event.Membership `json:"membership,omitempty"`
@@ -318,6 +319,20 @@ type ReqDeleteDevice struct {
 	Auth interface{} `json:"auth,omitempty"`
 }
 
+// ReqChangePassword is the JSON request for https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3accountpassword
+type ReqChangePassword struct {
+	Auth          interface{} `json:"auth,omitempty"`
+	NewPassword   string      `json:"new_password"`
+	LogoutDevices bool        `json:"logout_devices"`
+}
+
+// ReqDeactivateAccount is the JSON request for https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3accountdeactivate
+type ReqDeactivateAccount struct {
+	Auth     interface{} `json:"auth,omitempty"`
+	Erase    bool        `json:"erase,omitempty"`
+	IDServer string      `json:"id_server,omitempty"`
+}
+
 // ReqDeleteDevices is the JSON request for https://spec.matrix.org/v1.2/client-server-api/#post_matrixclientv3delete_devices
 type ReqDeleteDevices struct {
 	Devices []id.DeviceID `json:"devices"`
@@ -341,6 +356,9 @@ type ReqBatchSend struct {
 	BeeperNewMessages bool      `json:"-"`
 	BeeperMarkReadBy  id.UserID `json:"-"`
 
+	// EnsureIncreasingTimestamps makes BatchSend call EnsureIncreasingTimestamps on the events before sending them.
+	EnsureIncreasingTimestamps bool `json:"-"`
+
 	StateEventsAtStart []*event.Event `json:"state_events_at_start"`
 	Events             []*event.Event `json:"events"`
 }
@@ -353,6 +371,9 @@ type ReqBeeperBatchSend struct {
 	SendNotification    bool           `json:"send_notification"`
 	MarkReadBy          id.UserID      `json:"mark_read_by,omitempty"`
 	Events              []*event.Event `json:"events"`
+
+	// EnsureIncreasingTimestamps makes BeeperBatchSend call EnsureIncreasingTimestamps on the events before sending them.
+	EnsureIncreasingTimestamps bool `json:"-"`
 }
 
 type ReqSetReadMarkers struct {
@@ -407,6 +428,52 @@ func (req *ReqHierarchy) Query() map[string]string {
 	return query
 }
 
+// ReqGetRelations contains the parameters for https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+//
+// As it's a GET method, there is no JSON body, so this is only path and query parameters.
+type ReqGetRelations struct {
+	// Only return events with this relation type. Required if EventType is set.
+	RelationType event.RelationType
+	// Only return events of this type. Ignored if RelationType is not set.
+	EventType event.Type
+
+	Dir   Direction
+	From  string
+	To    string
+	Limit int
+}
+
+// PathSuffix returns the optional path components after the event ID.
+func (req *ReqGetRelations) PathSuffix() ClientURLPath {
+	if req == nil || req.RelationType == "" {
+		return ClientURLPath{}
+	}
+	if req.EventType.Type != "" {
+		return ClientURLPath{req.RelationType, req.EventType.Type}
+	}
+	return ClientURLPath{req.RelationType}
+}
+
+func (req *ReqGetRelations) Query() map[string]string {
+	query := map[string]string{}
+	if req == nil {
+		return query
+	}
+	if req.Dir != 0 {
+		query["dir"] = string(req.Dir)
+	}
+	if req.From != "" {
+		query["from"] = req.From
+	}
+	if req.To != "" {
+		query["to"] = req.To
+	}
+	if req.Limit > 0 {
+		query["limit"] = strconv.Itoa(req.Limit)
+	}
+	return query
+}
+
 type ReqAppservicePing struct {
 	TxnID string `json:"transaction_id,omitempty"`
 }
@@ -436,6 +503,12 @@ type ReqRoomKeysVersionCreate struct {
 	AuthData  json.RawMessage `json:"auth_data"`
 }
 
+type ReqRoomKeysVersionUpdate struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Version   string          `json:"version,omitempty"`
+}
+
 type ReqRoomKeysUpdate struct {
 	Rooms map[id.RoomID]ReqRoomKeysRoomUpdate `json:"rooms"`
 }
@@ -143,6 +143,11 @@ type RespUserInteractive struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// RespDeactivateAccount is the JSON response for https://spec.matrix.org/v1.8/client-server-api/#post_matrixclientv3accountdeactivate
+type RespDeactivateAccount struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 type UIAFlow struct {
 	Stages []AuthType `json:"stages,omitempty"`
 }
@@ -558,6 +563,13 @@ type RespHierarchy struct {
 	Rooms     []ChildRoomsChunk `json:"rooms"`
 }
 
+// RespGetRelations is the JSON response for https://spec.matrix.org/v1.8/client-server-api/#get_matrixclientv1roomsroomidrelationseventid
+type RespGetRelations struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+	PrevBatch string         `json:"prev_batch,omitempty"`
+}
+
 type ChildRoomsChunk struct {
 	AvatarURL        id.ContentURI           `json:"avatar_url,omitempty"`
 	CanonicalAlias   id.RoomAlias            `json:"canonical_alias,omitempty"`
@@ -0,0 +1,65 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// roomSendQueue orders the event sends to each room when Client.SequentialRoomSends is enabled.
+//
+// The queue of a room is a chain of channels: each send waits for the channel of the previous send to be closed
+// and closes its own channel when it's done, so sends happen in the order they were started.
+type roomSendQueue struct {
+	tails map[id.RoomID]chan struct{}
+	lock  sync.Mutex
+}
+
+// waitRoomSendTurn waits until all previously started sends to the given room have finished.
+// The returned function must be called after the send is done to let the next send proceed.
+//
+// If the context is cancelled while waiting, the error is returned and the place in the queue is released
+// once the previous sends are done.
+func (cli *Client) waitRoomSendTurn(ctx context.Context, roomID id.RoomID) (done func(), err error) {
+	if !cli.SequentialRoomSends {
+		return func() {}, nil
+	}
+	rsq := &cli.roomSendQueue
+	rsq.lock.Lock()
+	if rsq.tails == nil {
+		rsq.tails = make(map[id.RoomID]chan struct{})
+	}
+	prev := rsq.tails[roomID]
+	own := make(chan struct{})
+	rsq.tails[roomID] = own
+	rsq.lock.Unlock()
+
+	release := func() {
+		rsq.lock.Lock()
+		if rsq.tails[roomID] == own {
+			delete(rsq.tails, roomID)
+		}
+		rsq.lock.Unlock()
+		close(own)
+	}
+	if prev == nil {
+		return release, nil
+	}
+	select {
+	case <-prev:
+		return release, nil
+	case <-ctx.Done():
+		go func() {
+			<-prev
+			release()
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 	"go.mau.fi/util/dbutil"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -133,6 +134,25 @@ func (store *SQLStateStore) TryGetMember(roomID id.RoomID, userID id.UserID) (*e
 	return &member, err == nil
 }
 
+func (store *SQLStateStore) GetMemberDisplayName(roomID id.RoomID, userID id.UserID) string {
+	var displayname string
+	var isAmbiguous bool
+	err := store.
+		QueryRow(`
+			SELECT displayname, EXISTS(
+				SELECT 1 FROM mx_user_profile other
+				WHERE other.room_id=$1 AND other.user_id<>$2 AND other.displayname=mx_user_profile.displayname
+				  AND other.membership IN ('join', 'invite')
+			)
+			FROM mx_user_profile WHERE room_id=$1 AND user_id=$2
+		`, roomID, userID).
+		Scan(&displayname, &isAmbiguous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warn("Failed to scan display name of %s in %s: %v", userID, roomID, err)
+	}
+	return mautrix.DisambiguateDisplayName(userID, displayname, isAmbiguous)
+}
+
 func (store *SQLStateStore) FindSharedRooms(userID id.UserID) (rooms []id.RoomID) {
 	query := `
 		SELECT room_id FROM mx_user_profile
@@ -261,6 +281,64 @@ func (store *SQLStateStore) IsEncrypted(roomID id.RoomID) bool {
 	return cfg != nil && cfg.Algorithm == id.AlgorithmMegolmV1
 }
 
+func (store *SQLStateStore) SetRoomName(roomID id.RoomID, name string) {
+	_, err := store.Exec(`
+		INSERT INTO mx_room_state (room_id, name) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET name=excluded.name
+	`, roomID, name)
+	if err != nil {
+		store.Log.Warn("Failed to store name of %s: %v", roomID, err)
+	}
+}
+
+func (store *SQLStateStore) GetRoomName(roomID id.RoomID) string {
+	var name sql.NullString
+	err := store.
+		QueryRow("SELECT name FROM mx_room_state WHERE room_id=$1", roomID).
+		Scan(&name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		store.Log.Warn("Failed to scan name of %s: %v", roomID, err)
+	}
+	return name.String
+}
+
+func (store *SQLStateStore) SetCanonicalAlias(roomID id.RoomID, content *event.CanonicalAliasEventContent) {
+	contentBytes, err := json.Marshal(content)
+	if err != nil {
+		store.Log.Warn("Failed to marshal canonical alias of %s: %v", roomID, err)
+		return
+	}
+	_, err = store.Exec(`
+		INSERT INTO mx_room_state (room_id, canonical_alias) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET canonical_alias=excluded.canonical_alias
+	`, roomID, contentBytes)
+	if err != nil {
+		store.Log.Warn("Failed to store canonical alias of %s: %v", roomID, err)
+	}
+}
+
+func (store *SQLStateStore) GetCanonicalAlias(roomID id.RoomID) *event.CanonicalAliasEventContent {
+	var data []byte
+	err := store.
+		QueryRow("SELECT canonical_alias FROM mx_room_state WHERE room_id=$1", roomID).
+		Scan(&data)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			store.Log.Warn("Failed to scan canonical alias of %s: %v", roomID, err)
+		}
+		return nil
+	} else if data == nil {
+		return nil
+	}
+	content := &event.CanonicalAliasEventContent{}
+	err = json.Unmarshal(data, content)
+	if err != nil {
+		store.Log.Warn("Failed to parse canonical alias of %s: %v", roomID, err)
+		return nil
+	}
+	return content
+}
+
 func (store *SQLStateStore) SetPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) {
 	levelsBytes, err := json.Marshal(levels)
 	if err != nil {
@@ -1,4 +1,4 @@
--- v0 -> v5: Latest revision
+-- v0 -> v6: Latest revision
 
 CREATE TABLE mx_registrations (
 	user_id TEXT PRIMARY KEY
@@ -17,7 +17,9 @@ CREATE TABLE mx_user_profile (
 );
 
 CREATE TABLE mx_room_state (
-	room_id      TEXT PRIMARY KEY,
-	power_levels jsonb,
-	encryption   jsonb
+	room_id         TEXT PRIMARY KEY,
+	power_levels    jsonb,
+	encryption      jsonb,
+	name            TEXT,
+	canonical_alias jsonb
 );
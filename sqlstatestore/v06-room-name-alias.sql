@@ -0,0 +1,3 @@
+-- v6: Store room name and canonical alias
+ALTER TABLE mx_room_state ADD COLUMN name TEXT;
+ALTER TABLE mx_room_state ADD COLUMN canonical_alias jsonb;
@@ -0,0 +1,45 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestClient_StateEvent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.com/state/m.room.topic/":
+			_, _ = fmt.Fprintln(w, `{"topic": "hello world"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = fmt.Fprintln(w, `{"errcode": "M_NOT_FOUND", "error": "Event not found"}`)
+		}
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@bot:example.com", "token")
+	require.NoError(t, err)
+
+	var topic event.TopicEventContent
+	err = cli.StateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &topic)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", topic.Topic)
+
+	var name event.RoomNameEventContent
+	err = cli.StateEvent(context.Background(), "!room:example.com", event.StateRoomName, "", &name)
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
@@ -7,6 +7,9 @@
 package mautrix
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"maunium.net/go/mautrix/event"
@@ -20,6 +23,7 @@ type StateStore interface {
 	IsMembership(roomID id.RoomID, userID id.UserID, allowedMemberships ...event.Membership) bool
 	GetMember(roomID id.RoomID, userID id.UserID) *event.MemberEventContent
 	TryGetMember(roomID id.RoomID, userID id.UserID) (*event.MemberEventContent, bool)
+	GetMemberDisplayName(roomID id.RoomID, userID id.UserID) string
 	SetMembership(roomID id.RoomID, userID id.UserID, membership event.Membership)
 	SetMember(roomID id.RoomID, userID id.UserID, member *event.MemberEventContent)
 	ClearCachedMembers(roomID id.RoomID, memberships ...event.Membership)
@@ -30,9 +34,74 @@ type StateStore interface {
 	SetEncryptionEvent(roomID id.RoomID, content *event.EncryptionEventContent)
 	IsEncrypted(roomID id.RoomID) bool
 
+	SetRoomName(roomID id.RoomID, name string)
+	GetRoomName(roomID id.RoomID) string
+	SetCanonicalAlias(roomID id.RoomID, content *event.CanonicalAliasEventContent)
+	GetCanonicalAlias(roomID id.RoomID) *event.CanonicalAliasEventContent
+
 	GetRoomJoinedOrInvitedMembers(roomID id.RoomID) ([]id.UserID, error)
 }
 
+// DisambiguateDisplayName calculates the display name to show for a room member as specified in
+// https://spec.matrix.org/v1.8/client-server-api/#calculating-the-display-name-for-a-user
+//
+// If the user doesn't have a display name, the user ID is used. If another joined or invited member
+// has the same display name, the user ID is appended in parentheses.
+func DisambiguateDisplayName(userID id.UserID, displayname string, isAmbiguous bool) string {
+	if displayname == "" {
+		return userID.String()
+	} else if isAmbiguous {
+		return fmt.Sprintf("%s (%s)", displayname, userID)
+	}
+	return displayname
+}
+
+const maxRoomDisplayNameHeroes = 5
+
+// ComputeRoomDisplayName calculates the display name of a room as specified in
+// https://spec.matrix.org/v1.8/client-server-api/#calculating-the-display-name-for-a-room
+//
+// The name is computed from the current data in the state store, so it reflects changes to the room name,
+// canonical alias and members as soon as they've been passed to UpdateStateStore.
+// Heroes are picked from the joined and invited members other than the given user, sorted by user ID.
+func ComputeRoomDisplayName(store StateStore, roomID id.RoomID, ownUserID id.UserID) string {
+	if name := store.GetRoomName(roomID); name != "" {
+		return name
+	} else if alias := store.GetCanonicalAlias(roomID); alias != nil && alias.Alias != "" {
+		return alias.Alias.String()
+	}
+	members, _ := store.GetRoomJoinedOrInvitedMembers(roomID)
+	heroes := make([]id.UserID, 0, len(members))
+	for _, userID := range members {
+		if userID != ownUserID {
+			heroes = append(heroes, userID)
+		}
+	}
+	if len(heroes) == 0 {
+		return "Empty Room"
+	}
+	sort.Slice(heroes, func(i, j int) bool {
+		return heroes[i] < heroes[j]
+	})
+	otherCount := 0
+	if len(heroes) > maxRoomDisplayNameHeroes {
+		otherCount = len(heroes) - maxRoomDisplayNameHeroes
+		heroes = heroes[:maxRoomDisplayNameHeroes]
+	}
+	names := make([]string, len(heroes))
+	for i, userID := range heroes {
+		names[i] = store.GetMemberDisplayName(roomID, userID)
+	}
+	switch {
+	case otherCount > 0:
+		return fmt.Sprintf("%s and %d others", strings.Join(names, ", "), otherCount)
+	case len(names) == 1:
+		return names[0]
+	default:
+		return fmt.Sprintf("%s and %s", strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+	}
+}
+
 func UpdateStateStore(store StateStore, evt *event.Event) {
 	if store == nil || evt == nil || evt.StateKey == nil {
 		return
@@ -48,6 +117,10 @@ func UpdateStateStore(store StateStore, evt *event.Event) {
 		store.SetPowerLevels(evt.RoomID, content)
 	case *event.EncryptionEventContent:
 		store.SetEncryptionEvent(evt.RoomID, content)
+	case *event.RoomNameEventContent:
+		store.SetRoomName(evt.RoomID, content.Name)
+	case *event.CanonicalAliasEventContent:
+		store.SetCanonicalAlias(evt.RoomID, content)
 	}
 }
 
@@ -65,11 +138,15 @@ type MemoryStateStore struct {
 	Members       map[id.RoomID]map[id.UserID]*event.MemberEventContent `json:"memberships"`
 	PowerLevels   map[id.RoomID]*event.PowerLevelsEventContent          `json:"power_levels"`
 	Encryption    map[id.RoomID]*event.EncryptionEventContent           `json:"encryption"`
+	RoomNames     map[id.RoomID]string                                  `json:"room_names"`
+	Aliases       map[id.RoomID]*event.CanonicalAliasEventContent       `json:"canonical_aliases"`
 
 	registrationsLock sync.RWMutex
 	membersLock       sync.RWMutex
 	powerLevelsLock   sync.RWMutex
 	encryptionLock    sync.RWMutex
+	roomNamesLock     sync.RWMutex
+	aliasesLock       sync.RWMutex
 }
 
 func NewMemoryStateStore() StateStore {
@@ -78,6 +155,8 @@ func NewMemoryStateStore() StateStore {
 		Members:       make(map[id.RoomID]map[id.UserID]*event.MemberEventContent),
 		PowerLevels:   make(map[id.RoomID]*event.PowerLevelsEventContent),
 		Encryption:    make(map[id.RoomID]*event.EncryptionEventContent),
+		RoomNames:     make(map[id.RoomID]string),
+		Aliases:       make(map[id.RoomID]*event.CanonicalAliasEventContent),
 	}
 }
 
@@ -139,6 +218,22 @@ func (store *MemoryStateStore) TryGetMember(roomID id.RoomID, userID id.UserID)
 	return
 }
 
+func (store *MemoryStateStore) GetMemberDisplayName(roomID id.RoomID, userID id.UserID) string {
+	store.membersLock.RLock()
+	defer store.membersLock.RUnlock()
+	members := store.Members[roomID]
+	member, ok := members[userID]
+	if !ok || member.Displayname == "" {
+		return userID.String()
+	}
+	for otherUserID, otherMember := range members {
+		if otherUserID != userID && otherMember.Membership.IsInviteOrJoin() && otherMember.Displayname == member.Displayname {
+			return DisambiguateDisplayName(userID, member.Displayname, true)
+		}
+	}
+	return member.Displayname
+}
+
 func (store *MemoryStateStore) IsInRoom(roomID id.RoomID, userID id.UserID) bool {
 	return store.IsMembership(roomID, userID, "join")
 }
@@ -249,3 +344,27 @@ func (store *MemoryStateStore) IsEncrypted(roomID id.RoomID) bool {
 	cfg := store.GetEncryptionEvent(roomID)
 	return cfg != nil && cfg.Algorithm == id.AlgorithmMegolmV1
 }
+
+func (store *MemoryStateStore) SetRoomName(roomID id.RoomID, name string) {
+	store.roomNamesLock.Lock()
+	store.RoomNames[roomID] = name
+	store.roomNamesLock.Unlock()
+}
+
+func (store *MemoryStateStore) GetRoomName(roomID id.RoomID) string {
+	store.roomNamesLock.RLock()
+	defer store.roomNamesLock.RUnlock()
+	return store.RoomNames[roomID]
+}
+
+func (store *MemoryStateStore) SetCanonicalAlias(roomID id.RoomID, content *event.CanonicalAliasEventContent) {
+	store.aliasesLock.Lock()
+	store.Aliases[roomID] = content
+	store.aliasesLock.Unlock()
+}
+
+func (store *MemoryStateStore) GetCanonicalAlias(roomID id.RoomID) *event.CanonicalAliasEventContent {
+	store.aliasesLock.RLock()
+	defer store.aliasesLock.RUnlock()
+	return store.Aliases[roomID]
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMemoryStateStore_GetMemberDisplayName(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	store := mautrix.NewMemoryStateStore()
+	store.SetMember(roomID, "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Alice"})
+	store.SetMember(roomID, "@bob:example.com", &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Bob"})
+	store.SetMember(roomID, "@bob:example.org", &event.MemberEventContent{Membership: event.MembershipInvite, Displayname: "Bob"})
+	store.SetMember(roomID, "@alice:example.org", &event.MemberEventContent{Membership: event.MembershipLeave, Displayname: "Alice"})
+	store.SetMember(roomID, "@nameless:example.com", &event.MemberEventContent{Membership: event.MembershipJoin})
+
+	assert.Equal(t, "Alice", store.GetMemberDisplayName(roomID, "@alice:example.com"))
+	assert.Equal(t, "Bob (@bob:example.com)", store.GetMemberDisplayName(roomID, "@bob:example.com"))
+	assert.Equal(t, "Bob (@bob:example.org)", store.GetMemberDisplayName(roomID, "@bob:example.org"))
+	assert.Equal(t, "@nameless:example.com", store.GetMemberDisplayName(roomID, "@nameless:example.com"))
+	assert.Equal(t, "@unknown:example.com", store.GetMemberDisplayName(roomID, "@unknown:example.com"))
+}
+
+func TestComputeRoomDisplayName(t *testing.T) {
+	const roomID = id.RoomID("!room:example.com")
+	const ownUserID = id.UserID("@me:example.com")
+	store := mautrix.NewMemoryStateStore()
+	stateEvt := func(evtType event.Type, stateKey string, content any) *event.Event {
+		return &event.Event{RoomID: roomID, Type: evtType, StateKey: &stateKey, Content: event.Content{Parsed: content}}
+	}
+	assert.Equal(t, "Empty Room", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+
+	mautrix.UpdateStateStore(store, stateEvt(event.StateMember, ownUserID.String(), &event.MemberEventContent{Membership: event.MembershipJoin}))
+	mautrix.UpdateStateStore(store, stateEvt(event.StateMember, "@alice:example.com", &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Alice"}))
+	assert.Equal(t, "Alice", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+	mautrix.UpdateStateStore(store, stateEvt(event.StateMember, "@bob:example.com", &event.MemberEventContent{Membership: event.MembershipInvite, Displayname: "Bob"}))
+	assert.Equal(t, "Alice and Bob", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+	for _, user := range []string{"carol", "dave", "eve", "frank"} {
+		mautrix.UpdateStateStore(store, stateEvt(event.StateMember, "@"+user+":example.com", &event.MemberEventContent{Membership: event.MembershipJoin}))
+	}
+	assert.Equal(t, "Alice, Bob, @carol:example.com, @dave:example.com, @eve:example.com and 1 others", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+
+	mautrix.UpdateStateStore(store, stateEvt(event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{
+		Alias:      "#old:example.com",
+		AltAliases: []id.RoomAlias{"#alt:example.com"},
+	}))
+	assert.Equal(t, "#old:example.com", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+	assert.Equal(t, []id.RoomAlias{"#alt:example.com"}, store.GetCanonicalAlias(roomID).AltAliases)
+	mautrix.UpdateStateStore(store, stateEvt(event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{Alias: "#new:example.com"}))
+	assert.Equal(t, "#new:example.com", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+
+	mautrix.UpdateStateStore(store, stateEvt(event.StateRoomName, "", &event.RoomNameEventContent{Name: "Meow"}))
+	assert.Equal(t, "Meow", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+	mautrix.UpdateStateStore(store, stateEvt(event.StateRoomName, "", &event.RoomNameEventContent{}))
+	mautrix.UpdateStateStore(store, stateEvt(event.StateCanonicalAlias, "", &event.CanonicalAliasEventContent{}))
+	assert.Equal(t, "Alice, Bob, @carol:example.com, @dave:example.com, @eve:example.com and 1 others", mautrix.ComputeRoomDisplayName(store, roomID, ownUserID))
+}
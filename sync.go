@@ -9,6 +9,9 @@ package mautrix
 import (
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
 	"runtime/debug"
 	"time"
 
@@ -121,6 +124,57 @@ type DefaultSyncer struct {
 	ParseErrorHandler func(evt *event.Event, err error) bool
 	// FilterJSON is used when the client starts syncing and doesn't get an existing filter ID from SyncStore's LoadFilterID.
 	FilterJSON *Filter
+	// FailedSyncBackoff is used to calculate the wait time after syncs that failed due to network or server errors.
+	// It's reset after a successful sync.
+	FailedSyncBackoff ExponentialBackoff
+}
+
+// DefaultBackoffMin is the wait time after the first failure for ExponentialBackoffs that don't set Min.
+const DefaultBackoffMin = 1 * time.Second
+
+// DefaultBackoffMax is the maximum wait time for ExponentialBackoffs that don't set Max.
+const DefaultBackoffMax = 2 * time.Minute
+
+// ExponentialBackoff calculates wait times that double after each consecutive failure.
+// The zero value is usable, it starts at DefaultBackoffMin and is capped at DefaultBackoffMax.
+type ExponentialBackoff struct {
+	// Min is the wait time after the first failure. If zero, DefaultBackoffMin is used.
+	Min time.Duration
+	// Max is the maximum wait time. If zero or negative, DefaultBackoffMax is used.
+	Max time.Duration
+	// Jitter is the maximum fraction of the wait time that is randomly added or subtracted, e.g. 0.2 for ±20%.
+	// Values above 1 are treated as 1, so the wait time is never negative.
+	Jitter float64
+
+	failures int
+}
+
+// Next returns the time to wait after a failure and increments the failure counter.
+func (eb *ExponentialBackoff) Next() time.Duration {
+	wait := eb.Min
+	if wait <= 0 {
+		wait = DefaultBackoffMin
+	}
+	maxWait := eb.Max
+	if maxWait <= 0 {
+		maxWait = DefaultBackoffMax
+	}
+	for i := 0; i < eb.failures && wait < maxWait && wait < math.MaxInt64/2; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	eb.failures++
+	if jitter := math.Min(eb.Jitter, 1); jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * jitter * float64(wait))
+	}
+	return wait
+}
+
+// Reset resets the failure counter, so that the next wait time will be Min again.
+func (eb *ExponentialBackoff) Reset() {
+	eb.failures = 0
 }
 
 var _ Syncer = (*DefaultSyncer)(nil)
@@ -133,6 +187,11 @@ func NewDefaultSyncer() *DefaultSyncer {
 		syncListeners:     []SyncHandler{},
 		globalListeners:   []EventHandler{},
 		ParseEventContent: true,
+		FailedSyncBackoff: ExponentialBackoff{
+			Min:    2 * time.Second,
+			Max:    2 * time.Minute,
+			Jitter: 0.2,
+		},
 		ParseErrorHandler: func(evt *event.Event, err error) bool {
 			// By default, drop known events that can't be parsed, but let unknown events through
 			return errors.Is(err, event.ErrUnsupportedContentType) ||
@@ -150,6 +209,7 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 			err = fmt.Errorf("ProcessResponse panicked! since=%s panic=%s\n%s", since, r, debug.Stack())
 		}
 	}()
+	s.FailedSyncBackoff.Reset()
 
 	for _, listener := range s.syncListeners {
 		if !listener(res, since) {
@@ -241,12 +301,17 @@ func (s *DefaultSyncer) OnEvent(callback EventHandler) {
 	s.globalListeners = append(s.globalListeners, callback)
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+// OnFailedSync returns a fatal error for M_UNKNOWN_TOKEN errors. Network and server errors are retried using
+// FailedSyncBackoff and other HTTP errors are retried after 10 seconds.
 func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
 	if errors.Is(err, MUnknownToken) {
 		return 0, err
 	}
-	return 10 * time.Second, nil
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil && httpErr.Response.StatusCode < 500 && httpErr.Response.StatusCode != http.StatusTooManyRequests {
+		return 10 * time.Second, nil
+	}
+	return s.FailedSyncBackoff.Next(), nil
 }
 
 var defaultFilter = Filter{
@@ -0,0 +1,82 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := mautrix.ExponentialBackoff{Min: 1 * time.Second, Max: 10 * time.Second}
+	for _, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		assert.Equal(t, expected*time.Second, backoff.Next())
+	}
+	backoff.Reset()
+	assert.Equal(t, 1*time.Second, backoff.Next())
+}
+
+func TestExponentialBackoff_ZeroValue(t *testing.T) {
+	var backoff mautrix.ExponentialBackoff
+	for _, expected := range []time.Duration{1, 2, 4, 8, 16, 32, 64} {
+		assert.Equal(t, expected*mautrix.DefaultBackoffMin, backoff.Next())
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, mautrix.DefaultBackoffMax, backoff.Next())
+	}
+}
+
+func TestExponentialBackoff_Jitter(t *testing.T) {
+	backoff := mautrix.ExponentialBackoff{Min: 10 * time.Second, Max: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		wait := backoff.Next()
+		assert.GreaterOrEqual(t, wait, 5*time.Second)
+		assert.LessOrEqual(t, wait, 15*time.Second)
+	}
+
+	backoff = mautrix.ExponentialBackoff{Min: 10 * time.Second, Max: 10 * time.Second, Jitter: 3}
+	for i := 0; i < 100; i++ {
+		wait := backoff.Next()
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, 20*time.Second)
+	}
+}
+
+func TestDefaultSyncer_OnFailedSync(t *testing.T) {
+	syncer := mautrix.NewDefaultSyncer()
+	syncer.FailedSyncBackoff = mautrix.ExponentialBackoff{Min: 1 * time.Second, Max: 1 * time.Minute}
+	networkErr := mautrix.HTTPError{Message: "request error", WrappedError: errors.New("connection refused")}
+	for _, expected := range []time.Duration{1, 2, 4} {
+		wait, err := syncer.OnFailedSync(nil, networkErr)
+		assert.NoError(t, err)
+		assert.Equal(t, expected*time.Second, wait)
+	}
+
+	wait, err := syncer.OnFailedSync(nil, mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusBadGateway}})
+	assert.NoError(t, err)
+	assert.Equal(t, 8*time.Second, wait)
+
+	wait, err = syncer.OnFailedSync(nil, mautrix.HTTPError{Response: &http.Response{StatusCode: http.StatusBadRequest}})
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, wait)
+
+	_, err = syncer.OnFailedSync(nil, mautrix.HTTPError{
+		Response:  &http.Response{StatusCode: http.StatusUnauthorized},
+		RespError: &mautrix.RespError{ErrCode: mautrix.MUnknownToken.ErrCode},
+	})
+	assert.ErrorIs(t, err, mautrix.MUnknownToken)
+
+	assert.NoError(t, syncer.ProcessResponse(&mautrix.RespSync{}, "since"))
+	wait, _ = syncer.OnFailedSync(nil, networkErr)
+	assert.Equal(t, 1*time.Second, wait)
+}
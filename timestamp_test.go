@@ -0,0 +1,43 @@
+// Copyright (c) 2023 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestClient_SendMessageEvent_Timestamp(t *testing.T) {
+	var gotTS string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTS = r.URL.Query().Get("ts")
+		_, _ = fmt.Fprintln(w, `{"event_id": "$event"}`)
+	}))
+	defer ts.Close()
+	cli, err := mautrix.NewClient(ts.URL, "@ghost:example.com", "as_token")
+	require.NoError(t, err)
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+
+	_, err = cli.SendMessageEvent(context.Background(), "!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{Timestamp: 1234})
+	assert.ErrorIs(t, err, mautrix.ErrTimestampRequiresAppService)
+	_, err = cli.SendMassagedStateEvent(context.Background(), "!room:example.com", event.StateTopic, "", &event.TopicEventContent{}, 1234)
+	assert.ErrorIs(t, err, mautrix.ErrTimestampRequiresAppService)
+
+	cli.SetAppServiceUserID = true
+	_, err = cli.SendMessageEvent(context.Background(), "!room:example.com", event.EventMessage, content, mautrix.ReqSendEvent{Timestamp: 1234})
+	require.NoError(t, err)
+	assert.Equal(t, "1234", gotTS)
+}
@@ -63,3 +63,13 @@ func TestClient_BuildURL_MissingSchemeWithPath(t *testing.T) {
 	built := cli.BuildClientURL("v3", "foo/bar%2F🐈 1", "hello", "world")
 	assert.Equal(t, "https://example.com/base/_matrix/client/v3/foo%2Fbar%252F%F0%9F%90%88%201/hello/world", built)
 }
+
+func TestClient_BuildURL_AppServiceDeviceID(t *testing.T) {
+	cli, err := mautrix.NewClient("https://example.com", "@ghost:example.com", "")
+	assert.NoError(t, err)
+	cli.SetAppServiceUserID = true
+	cli.DeviceID = "DEVICE"
+	assert.Equal(t, "https://example.com/_matrix/client/v3/sync?user_id=%40ghost%3Aexample.com", cli.BuildClientURL("v3", "sync"))
+	cli.SetAppServiceDeviceID = true
+	assert.Equal(t, "https://example.com/_matrix/client/v3/sync?org.matrix.msc3202.device_id=DEVICE&user_id=%40ghost%3Aexample.com", cli.BuildClientURL("v3", "sync"))
+}